@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 到期检查和过期处理任务的默认间隔
+const (
+	defaultExpiryCheckInterval    = 6 * time.Hour  // 每6小时检查一次即将到期的订阅
+	defaultExpiredProcessInterval = 12 * time.Hour // 每12小时处理一次过期的订阅
+)
+
 // TaskScheduler 定时任务调度器
 type TaskScheduler struct {
 	service         *SubscriptionService
@@ -13,15 +22,27 @@ type TaskScheduler struct {
 	wg              sync.WaitGroup
 	checkInterval   time.Duration // 检查即将到期订阅的时间间隔
 	processInterval time.Duration // 处理已过期订阅的时间间隔
+	retryInterval   time.Duration // 重试失败通知的时间间隔
+	dunningInterval time.Duration // 检查待重试续订扣款的时间间隔
+	paused          atomic.Bool   // 暂停时任务照常触发但跳过执行
 }
 
 // NewTaskScheduler 创建新的任务调度器
-func NewTaskScheduler(service *SubscriptionService) *TaskScheduler {
+// checkInterval 和 processInterval 不大于0时使用默认间隔
+func NewTaskScheduler(service *SubscriptionService, checkInterval, processInterval time.Duration) *TaskScheduler {
+	if checkInterval <= 0 {
+		checkInterval = defaultExpiryCheckInterval
+	}
+	if processInterval <= 0 {
+		processInterval = defaultExpiredProcessInterval
+	}
 	return &TaskScheduler{
 		service:         service,
 		stopChan:        make(chan struct{}),
-		checkInterval:   6 * time.Hour,  // 每6小时检查一次即将到期的订阅
-		processInterval: 12 * time.Hour, // 每12小时处理一次过期的订阅
+		checkInterval:   checkInterval,
+		processInterval: processInterval,
+		retryInterval:   30 * time.Minute, // 每30分钟重试一次失败的通知
+		dunningInterval: time.Hour,        // 每小时检查一次到期需重试的续订扣款
 	}
 }
 
@@ -37,11 +58,19 @@ func (ts *TaskScheduler) Start() {
 	ts.wg.Add(1)
 	go ts.runProcessExpiredTask()
 
+	// 启动重试失败通知的任务
+	ts.wg.Add(1)
+	go ts.runRetryNotificationsTask()
+
+	// 启动重试续订扣款的任务
+	ts.wg.Add(1)
+	go ts.runDunningTask()
+
 	log.Println("所有定时任务已启动")
 }
 
-// Stop 停止所有定时任务
-func (ts *TaskScheduler) Stop() {
+// Stop 停止所有定时任务，等待正在执行的任务结束，ctx 结束时不再等待并返回错误
+func (ts *TaskScheduler) Stop(ctx context.Context) error {
 	log.Println("正在停止定时任务调度器...")
 	close(ts.stopChan)
 
@@ -52,15 +81,34 @@ func (ts *TaskScheduler) Stop() {
 		close(done)
 	}()
 
-	// 设置超时，避免永久等待
+	// 由调用方的时限控制等待时间，避免永久等待
 	select {
 	case <-done:
 		log.Println("所有定时任务已正常停止")
-	case <-time.After(10 * time.Second):
+		return nil
+	case <-ctx.Done():
 		log.Println("部分定时任务可能未能正常停止，已超时")
+		return fmt.Errorf("等待定时任务停止超时: %w", ctx.Err())
 	}
 }
 
+// Pause 暂停后台任务，定时器继续运行但每次触发都跳过处理
+func (ts *TaskScheduler) Pause() {
+	ts.paused.Store(true)
+	log.Println("定时任务调度器已暂停")
+}
+
+// Resume 恢复后台任务，从下一次触发开始正常处理
+func (ts *TaskScheduler) Resume() {
+	ts.paused.Store(false)
+	log.Println("定时任务调度器已恢复")
+}
+
+// Paused 返回调度器是否处于暂停状态
+func (ts *TaskScheduler) Paused() bool {
+	return ts.paused.Load()
+}
+
 // runCheckExpiringTask 运行检查即将到期订阅的定时任务
 func (ts *TaskScheduler) runCheckExpiringTask() {
 	defer ts.wg.Done()
@@ -109,8 +157,53 @@ func (ts *TaskScheduler) runProcessExpiredTask() {
 	}
 }
 
+// runRetryNotificationsTask 运行重试失败通知的定时任务
+func (ts *TaskScheduler) runRetryNotificationsTask() {
+	defer ts.wg.Done()
+
+	log.Printf("重试失败通知任务已启动，间隔: %v", ts.retryInterval)
+
+	ticker := time.NewTicker(ts.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ts.retryFailedNotifications()
+		case <-ts.stopChan:
+			log.Println("重试失败通知任务收到停止信号，正在退出...")
+			return
+		}
+	}
+}
+
+// runDunningTask 运行重试续订扣款的定时任务
+func (ts *TaskScheduler) runDunningTask() {
+	defer ts.wg.Done()
+
+	log.Printf("重试续订扣款任务已启动，间隔: %v", ts.dunningInterval)
+
+	ticker := time.NewTicker(ts.dunningInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ts.retryPastDueCharges()
+		case <-ts.stopChan:
+			log.Println("重试续订扣款任务收到停止信号，正在退出...")
+			return
+		}
+	}
+}
+
 // checkExpiringSubscriptions 执行检查即将到期订阅的逻辑
 func (ts *TaskScheduler) checkExpiringSubscriptions() {
+	if ts.Paused() {
+		log.Println("调度器已暂停，跳过检查即将到期订阅任务")
+		return
+	}
+
 	log.Println("开始执行检查即将到期订阅任务...")
 	start := time.Now()
 
@@ -124,11 +217,21 @@ func (ts *TaskScheduler) checkExpiringSubscriptions() {
 	}()
 
 	// 执行业务逻辑
-	ts.service.CheckExpiringSubscriptions()
+	summary, err := ts.service.CheckExpiringSubscriptions()
+	if err != nil {
+		log.Printf("检查即将到期订阅任务失败: %v", err)
+		return
+	}
+	logBatchSummary("检查即将到期订阅任务", summary)
 }
 
 // processExpiredSubscriptions 执行处理已过期订阅的逻辑
 func (ts *TaskScheduler) processExpiredSubscriptions() {
+	if ts.Paused() {
+		log.Println("调度器已暂停，跳过处理已过期订阅任务")
+		return
+	}
+
 	log.Println("开始执行处理已过期订阅任务...")
 	start := time.Now()
 
@@ -142,5 +245,65 @@ func (ts *TaskScheduler) processExpiredSubscriptions() {
 	}()
 
 	// 执行业务逻辑
-	ts.service.ProcessExpiredSubscriptions()
+	summary, err := ts.service.ProcessExpiredSubscriptions()
+	if err != nil {
+		log.Printf("处理已过期订阅任务失败: %v", err)
+		return
+	}
+	logBatchSummary("处理已过期订阅任务", summary)
+}
+
+// retryFailedNotifications 执行重试失败通知的逻辑
+func (ts *TaskScheduler) retryFailedNotifications() {
+	if ts.Paused() {
+		log.Println("调度器已暂停，跳过重试失败通知任务")
+		return
+	}
+
+	log.Println("开始执行重试失败通知任务...")
+	start := time.Now()
+
+	// 捕获可能的panic
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("重试失败通知任务发生panic: %v", r)
+		}
+
+		log.Printf("重试失败通知任务完成，耗时: %v", time.Since(start))
+	}()
+
+	// 执行业务逻辑，同时发送因每日上限推迟到期的通知
+	ts.service.RetryFailedNotifications()
+	ts.service.SendDeferredNotifications()
+}
+
+// retryPastDueCharges 执行重试续订扣款的逻辑
+func (ts *TaskScheduler) retryPastDueCharges() {
+	if ts.Paused() {
+		log.Println("调度器已暂停，跳过重试续订扣款任务")
+		return
+	}
+
+	log.Println("开始执行重试续订扣款任务...")
+	start := time.Now()
+
+	// 捕获可能的panic
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("重试续订扣款任务发生panic: %v", r)
+		}
+
+		log.Printf("重试续订扣款任务完成，耗时: %v", time.Since(start))
+	}()
+
+	// 执行业务逻辑
+	ts.service.ProcessPastDueSubscriptions()
+}
+
+// logBatchSummary 记录批处理任务的结果，有失败的订阅时输出警告
+func logBatchSummary(task string, summary BatchSummary) {
+	log.Printf("%s结果: 处理 %d 个，通知 %d 个，失败 %d 个", task, summary.Processed, summary.Notified, summary.Failed)
+	if summary.Failed > 0 {
+		log.Printf("警告: %s有 %d 个订阅处理失败", task, summary.Failed)
+	}
 }
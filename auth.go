@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken 令牌缺失、格式错误、签名不匹配或已过期
+var ErrInvalidToken = errors.New("认证令牌无效")
+
+// 令牌头部固定为 HS256
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// AuthClaims 令牌中携带的身份信息
+type AuthClaims struct {
+	Subject   string `json:"sub"`             // 用户ID
+	Admin     bool   `json:"admin,omitempty"` // 是否为管理员
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// UserID 返回令牌对应的用户ID
+func (c *AuthClaims) UserID() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+// JWTAuth 基于 HS256 签名令牌的认证
+type JWTAuth struct {
+	secret []byte
+	clock  Clock
+}
+
+// NewJWTAuth 创建认证实例，secret 用于签发和校验令牌
+func NewJWTAuth(secret string) *JWTAuth {
+	return &JWTAuth{secret: []byte(secret), clock: realClock{}}
+}
+
+// IssueToken 为用户签发有效期为 ttl 的令牌，admin 为 true 时可访问管理接口
+func (a *JWTAuth) IssueToken(userID int64, admin bool, ttl time.Duration) (string, error) {
+	now := a.clock.Now()
+	payload, err := json.Marshal(AuthClaims{
+		Subject:   strconv.FormatInt(userID, 10),
+		Admin:     admin,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("编码令牌失败: %w", err)
+	}
+
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + a.sign(signingInput), nil
+}
+
+// ParseToken 校验令牌签名和有效期，返回其中的身份信息
+func (a *JWTAuth) ParseToken(token string) (*AuthClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, fmt.Errorf("%w: 格式错误", ErrInvalidToken)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: 签名格式错误", ErrInvalidToken)
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(a.sign(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, expected) {
+		return nil, fmt.Errorf("%w: 签名不匹配", ErrInvalidToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: 内容格式错误", ErrInvalidToken)
+	}
+	var claims AuthClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: 内容格式错误", ErrInvalidToken)
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, fmt.Errorf("%w: 用户ID无效", ErrInvalidToken)
+	}
+	if a.clock.Now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("%w: 已过期", ErrInvalidToken)
+	}
+
+	return &claims, nil
+}
+
+// sign 计算签名并以 base64url 编码
+func (a *JWTAuth) sign(signingInput string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate 从 Authorization: Bearer 请求头解析令牌，失败时写入401响应
+func (a *JWTAuth) authenticate(w http.ResponseWriter, r *http.Request) (*AuthClaims, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "缺少认证令牌", http.StatusUnauthorized)
+		log.Printf("请求缺少认证令牌: %s %s", r.Method, r.URL.Path)
+		return nil, false
+	}
+
+	claims, err := a.ParseToken(strings.TrimSpace(token))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		log.Printf("认证令牌校验失败: %v", err)
+		return nil, false
+	}
+	return claims, true
+}
+
+// RequireUser 要求请求携带有效令牌，且查询参数或JSON请求体中的 user_id 与令牌中的用户一致
+// 管理员令牌可以访问任意用户的数据；publicMethods 中的请求方法不做认证，例如注册用户的 POST
+func (a *JWTAuth) RequireUser(next http.HandlerFunc, publicMethods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range publicMethods {
+			if r.Method == method {
+				next(w, r)
+				return
+			}
+		}
+
+		claims, ok := a.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		if !claims.Admin {
+			requested, err := requestedUserIDs(w, r)
+			if err != nil {
+				http.Error(w, "无效的请求数据", http.StatusBadRequest)
+				log.Printf("读取请求体失败: %v", err)
+				return
+			}
+			authenticated, _ := claims.UserID()
+			for _, userID := range requested {
+				if userID != authenticated {
+					http.Error(w, "无权访问其他用户的数据", http.StatusForbidden)
+					log.Printf("用户 %d 请求访问用户 %d 的数据，已拒绝", authenticated, userID)
+					return
+				}
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// RequireAdmin 要求请求携带有效的管理员令牌
+func (a *JWTAuth) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := a.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !claims.Admin {
+			http.Error(w, "需要管理员权限", http.StatusForbidden)
+			log.Printf("用户 %s 请求管理接口 %s，已拒绝", claims.Subject, r.URL.Path)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// 认证时读取的请求体大小上限
+const maxAuthBodyBytes = 1 << 20
+
+// errTrailingJSON 请求体在第一个JSON值之后还有其他内容
+var errTrailingJSON = errors.New("请求体只能包含一个JSON对象")
+
+// requestedUserIDs 返回请求中指定的 user_id：查询参数和JSON请求体中的字段
+// 读取后恢复请求体，处理器仍可正常解析；请求体不是单个有效的JSON对象时返回错误，不跳过检查
+func requestedUserIDs(w http.ResponseWriter, r *http.Request) ([]int64, error) {
+	var ids []int64
+	if userID, err := strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64); err == nil {
+		ids = append(ids, userID)
+	}
+
+	if r.Method == http.MethodGet || r.Body == nil {
+		return ids, nil
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAuthBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ids, nil
+	}
+
+	// 与处理器一样只解析第一个JSON值，因此请求体必须恰好是一个JSON对象，
+	// 否则处理器读到的 user_id 可能没有经过这里的检查
+	var payload struct {
+		UserID *int64 `json:"user_id"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		return nil, errTrailingJSON
+	}
+	if payload.UserID != nil {
+		ids = append(ids, *payload.UserID)
+	}
+	return ids, nil
+}
@@ -2,24 +2,43 @@ package main
 
 import (
 	"log"
+	"maps"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
+// 缓存统计数据的默认刷新间隔
+const defaultCacheUpdateInterval = 5 * time.Minute
+
 // SubscriptionCache 缓存服务，用于提高查询性能
 type SubscriptionCache struct {
 	cache          Cache
 	db             *DatabaseService
 	updateInterval time.Duration
 	stopChan       chan struct{}
+	loadStats      func() (SystemStats, error) // 统计数据加载函数，默认从数据库查询
+	refreshGroup   singleflight.Group          // 合并并发的刷新，同一轮刷新只执行一次统计查询
+	reloadMu       sync.Mutex                  // 保证各轮刷新依次执行
+	refreshRound   atomic.Uint64               // 已开始查询的最新一轮刷新的轮次
 }
 
 // NewSubscriptionCache 创建缓存服务实例
-func NewSubscriptionCache(db *DatabaseService) *SubscriptionCache {
+// updateInterval 为定期刷新的间隔，不大于0时使用默认间隔
+func NewSubscriptionCache(db *DatabaseService, updateInterval time.Duration) *SubscriptionCache {
+	if updateInterval <= 0 {
+		updateInterval = defaultCacheUpdateInterval
+	}
 	cache := &SubscriptionCache{
 		db:             db,
-		updateInterval: 5 * time.Minute,
+		updateInterval: updateInterval,
 		stopChan:       make(chan struct{}),
 	}
+	cache.loadStats = cache.queryStats
 
 	// 初始化缓存
 	if err := cache.refreshCache(); err != nil {
@@ -33,70 +52,177 @@ func NewSubscriptionCache(db *DatabaseService) *SubscriptionCache {
 }
 
 // refreshCache 刷新缓存数据，更新系统统计指标
+// 定期刷新与业务操作触发的刷新可能同时发生，并发的调用合并为一轮查询
 func (sc *SubscriptionCache) refreshCache() error {
-	// 获取用户总数
-	userCount, err := sc.db.GetTotalUserCount()
-	if err != nil {
-		log.Printf("刷新缓存获取用户数失败: %v", err)
-		return err
-	}
+	result := <-sc.startRefresh()
+	return result.Err
+}
 
-	// 获取支付总额
-	totalAmount, err := sc.db.GetTotalPaymentAmount()
-	if err != nil {
-		log.Printf("刷新缓存获取付款总额失败: %v", err)
-		return err
-	}
+// startRefresh 加入下一轮尚未开始查询的刷新，返回该轮刷新结果的通道
+// 已经开始查询的一轮可能读不到调用方刚完成的写入，因此不加入这一轮，而是等它结束后共享下一轮的结果
+func (sc *SubscriptionCache) startRefresh() <-chan singleflight.Result {
+	round := sc.refreshRound.Load() + 1
+	return sc.refreshGroup.DoChan(strconv.FormatUint(round, 10), func() (interface{}, error) {
+		sc.reloadMu.Lock()
+		defer sc.reloadMu.Unlock()
 
-	// 获取活跃订阅数
-	activeSubCount, err := sc.db.GetActiveSubscriptionsCount()
-	if err != nil {
-		log.Printf("刷新缓存获取活跃订阅数失败: %v", err)
-		return err
-	}
+		// 各轮依次执行，轮次只会增大：晚到的调用可能以较旧的轮次重新发起一轮，这一轮同样在调用之后开始查询
+		if sc.refreshRound.Load() < round {
+			sc.refreshRound.Store(round)
+		}
+		return nil, sc.reload()
+	})
+}
 
-	// 获取本月新增订阅数
-	newSubCount, err := sc.db.GetNewSubscriptionsMonth()
+// reload 查询统计数据并替换缓存快照
+func (sc *SubscriptionCache) reload() error {
+	// 先在锁外计算出完整的统计快照
+	stats, err := sc.loadStats()
 	if err != nil {
-		log.Printf("刷新缓存获取本月新增订阅数失败: %v", err)
 		return err
 	}
+	stats.LastUpdated = time.Now()
 
-	// 获取本月新增付费金额
-	newPaymentAmount, err := sc.db.GetNewPaymentAmountMonth()
-	if err != nil {
-		log.Printf("刷新缓存获取本月新增付费金额失败: %v", err)
-		return err
-	}
+	// 整体替换快照，读取方不会看到新旧数据混合的结果
+	sc.cache.mutex.Lock()
+	sc.cache.stats = stats
+	sc.cache.mutex.Unlock()
 
-	// 获取本月续订数
-	renewalCount, err := sc.db.GetRenewalsMonth()
-	if err != nil {
-		log.Printf("刷新缓存获取本月续订数失败: %v", err)
-		return err
+	// 同步更新监控指标
+	publishStatsMetrics(stats)
+
+	return nil
+}
+
+// statsDelta 单个业务操作对统计指标的增量，金额为负数时表示扣减（例如退款）
+type statsDelta struct {
+	users            int
+	activeByPlan     map[string]int // 各套餐活跃订阅数的变化，合计即为活跃订阅数的变化
+	paymentAmount    float64        // 成功支付总额的变化
+	newSubscriptions int
+	newPaymentAmount float64
+	renewals         int
+	renewalAmount    float64
+	failedPayments   int
+}
+
+// apply 将业务操作的增量累加到缓存的统计快照上，避免每次操作都重新查询全部统计
+// 在写锁内完成累加，并发的操作不会丢失增量，读取方也不会看到只累加了一部分的快照
+// 累加结果由 periodicUpdate 的全量刷新定期校准
+func (sc *SubscriptionCache) apply(delta statsDelta) {
+	now := time.Now()
+
+	sc.cache.mutex.Lock()
+	stats := sc.cache.stats
+
+	// 跨月后月度指标从零开始累计
+	if !monthStartUTC(now).Equal(monthStartUTC(stats.LastUpdated)) {
+		stats.NewSubscriptionsMonth, stats.NewPaymentAmountMonth = 0, 0
+		stats.RenewalsMonth, stats.RenewalAmountMonth = 0, 0
 	}
 
-	// 获取本月续订金额
-	renewalAmount, err := sc.db.GetRenewalAmountMonth()
-	if err != nil {
-		log.Printf("刷新缓存获取本月续订金额失败: %v", err)
-		return err
+	// 复制 map 后再修改，已发布的快照保持不变
+	byPlan := maps.Clone(stats.ActiveByPlan)
+	if byPlan == nil {
+		byPlan = make(map[string]int)
 	}
+	for plan, change := range delta.activeByPlan {
+		byPlan[plan] += change
+		stats.ActiveSubscriptions += change
+	}
+	stats.ActiveByPlan = byPlan
 
-	// 更新缓存
-	sc.cache.mutex.Lock()
-	defer sc.cache.mutex.Unlock()
+	stats.TotalUsers += delta.users
+	stats.TotalPaymentAmount += delta.paymentAmount
+	stats.NewSubscriptionsMonth += delta.newSubscriptions
+	stats.NewPaymentAmountMonth += delta.newPaymentAmount
+	stats.RenewalsMonth += delta.renewals
+	stats.RenewalAmountMonth += delta.renewalAmount
+	stats.FailedPayments += delta.failedPayments
+	stats.LastUpdated = now
 
-	sc.cache.totalUsers = userCount
-	sc.cache.totalPaymentAmount = totalAmount
-	sc.cache.activeSubscriptions = activeSubCount
-	sc.cache.newSubscriptionsMonth = newSubCount
-	sc.cache.newPaymentAmountMonth = newPaymentAmount
-	sc.cache.renewalsMonth = renewalCount
-	sc.cache.renewalAmountMonth = renewalAmount
-	sc.cache.lastUpdated = time.Now()
+	sc.cache.stats = stats
 
-	return nil
+	// 在锁内更新监控指标，保证指标与快照的先后顺序一致
+	publishStatsMetrics(stats)
+	sc.cache.mutex.Unlock()
+}
+
+// queryStats 从数据库查询各项统计指标
+// 各项查询互不依赖，并发执行以减少刷新耗时；任一查询失败时返回第一个错误
+func (sc *SubscriptionCache) queryStats() (SystemStats, error) {
+	var stats SystemStats
+	var g errgroup.Group
+
+	// 每个查询只写入自己的字段，全部完成后再读取 stats
+	g.Go(func() (err error) {
+		// 获取用户总数
+		if stats.TotalUsers, err = sc.db.GetTotalUserCount(); err != nil {
+			log.Printf("刷新缓存获取用户数失败: %v", err)
+		}
+		return err
+	})
+	g.Go(func() (err error) {
+		// 获取支付总额
+		if stats.TotalPaymentAmount, err = sc.db.GetTotalPaymentAmount(); err != nil {
+			log.Printf("刷新缓存获取付款总额失败: %v", err)
+		}
+		return err
+	})
+	g.Go(func() (err error) {
+		// 获取活跃订阅数
+		if stats.ActiveSubscriptions, err = sc.db.GetActiveSubscriptionsCount(); err != nil {
+			log.Printf("刷新缓存获取活跃订阅数失败: %v", err)
+		}
+		return err
+	})
+	g.Go(func() (err error) {
+		// 获取各套餐的活跃订阅数
+		if stats.ActiveByPlan, err = sc.db.GetActiveSubscriptionsByPlan(); err != nil {
+			log.Printf("刷新缓存获取套餐活跃订阅数失败: %v", err)
+		}
+		return err
+	})
+	g.Go(func() (err error) {
+		// 获取本月新增订阅数
+		if stats.NewSubscriptionsMonth, err = sc.db.GetNewSubscriptionsMonth(); err != nil {
+			log.Printf("刷新缓存获取本月新增订阅数失败: %v", err)
+		}
+		return err
+	})
+	g.Go(func() (err error) {
+		// 获取本月新增付费金额
+		if stats.NewPaymentAmountMonth, err = sc.db.GetNewPaymentAmountMonth(); err != nil {
+			log.Printf("刷新缓存获取本月新增付费金额失败: %v", err)
+		}
+		return err
+	})
+	g.Go(func() (err error) {
+		// 获取本月续订数
+		if stats.RenewalsMonth, err = sc.db.GetRenewalsMonth(); err != nil {
+			log.Printf("刷新缓存获取本月续订数失败: %v", err)
+		}
+		return err
+	})
+	g.Go(func() (err error) {
+		// 获取本月续订金额
+		if stats.RenewalAmountMonth, err = sc.db.GetRenewalAmountMonth(); err != nil {
+			log.Printf("刷新缓存获取本月续订金额失败: %v", err)
+		}
+		return err
+	})
+	g.Go(func() (err error) {
+		// 获取支付失败记录数
+		if stats.FailedPayments, err = sc.db.GetFailedPaymentsCount(); err != nil {
+			log.Printf("刷新缓存获取支付失败记录数失败: %v", err)
+		}
+		return err
+	})
+
+	if err := g.Wait(); err != nil {
+		return stats, err
+	}
+	return stats, nil
 }
 
 // periodicUpdate 定期更新缓存
@@ -122,18 +248,12 @@ func (sc *SubscriptionCache) Stop() {
 }
 
 // GetStats 获取系统统计数据
+// 返回快照的副本，调用方修改其中的 map 不会影响缓存
 func (sc *SubscriptionCache) GetStats() SystemStats {
 	sc.cache.mutex.RLock()
 	defer sc.cache.mutex.RUnlock()
 
-	return SystemStats{
-		TotalUsers:            sc.cache.totalUsers,
-		TotalPaymentAmount:    sc.cache.totalPaymentAmount,
-		ActiveSubscriptions:   sc.cache.activeSubscriptions,
-		NewSubscriptionsMonth: sc.cache.newSubscriptionsMonth,
-		NewPaymentAmountMonth: sc.cache.newPaymentAmountMonth,
-		RenewalsMonth:         sc.cache.renewalsMonth,
-		RenewalAmountMonth:    sc.cache.renewalAmountMonth,
-		LastUpdated:           sc.cache.lastUpdated,
-	}
+	stats := sc.cache.stats
+	stats.ActiveByPlan = maps.Clone(stats.ActiveByPlan)
+	return stats
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzip 文件开头的魔数
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// openInput 返回读取 r 内容的 reader，forceGzip 为 true 或输入以 gzip 魔数开头时解压后再读取
+// 只预读魔数长度的字节判断格式，适用于标准输入等不能回退的输入
+func openInput(r io.Reader, forceGzip bool) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	if !forceGzip {
+		head, err := buffered.Peek(len(gzipMagic))
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("读取输入失败: %w", err)
+		}
+		if !bytes.Equal(head, gzipMagic) {
+			return io.NopCloser(buffered), nil
+		}
+	}
+
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("解析gzip输入失败: %w", err)
+	}
+	return gz, nil
+}
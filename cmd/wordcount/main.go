@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// 统计文本中的单词频率并输出出现最多的单词，未指定文件时从标准输入读取，gzip 压缩的输入自动解压
+//
+//	go run ./cmd/wordcount -file text_data.txt -top 30
+//	cat text_data.txt.gz | go run ./cmd/wordcount
+func main() {
+	path := flag.String("file", "", "要统计的文本文件路径，为空时从标准输入读取")
+	top := flag.Int("top", 30, "输出出现次数最多的前N个单词")
+	forceGzip := flag.Bool("gzip", false, "按gzip格式解压输入，不设置时根据文件开头的魔数判断")
+	lower := flag.Bool("lower", false, "统计前将单词转为小写，大小写不同的同一单词合并计数")
+	stopwordsPath := flag.String("stopwords", "", "停用词表文件路径，其中的单词不参与统计")
+	flag.Parse()
+
+	if *top <= 0 {
+		fmt.Fprintf(os.Stderr, "-top 必须为正数: %d\n", *top)
+		os.Exit(2)
+	}
+
+	opts := CountOptions{Lower: *lower}
+	if *stopwordsPath != "" {
+		stopwords, err := readStopwords(*stopwordsPath, *lower)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts.Stopwords = stopwords
+	}
+
+	if err := run(*path, *top, *forceGzip, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// readStopwords 读取 path 文件中的停用词表
+func readStopwords(path string, lower bool) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开停用词表: %w", err)
+	}
+	defer file.Close()
+	return loadStopwords(file, lower)
+}
+
+// run 统计 path 文件（为空时为标准输入）中的单词并输出前 top 个
+func run(path string, top int, forceGzip bool, opts CountOptions) error {
+	PrintMemUsage("开始读取文件前")
+	start := time.Now()
+
+	var source io.Reader = os.Stdin
+	if path != "" {
+		// 打开文件
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("无法打开文件: %w", err)
+		}
+		// os.Open 返回错误时 file 为 nil，因此在错误处理之后再设置 defer
+		defer func() {
+			if closeErr := file.Close(); closeErr != nil {
+				log.Printf("Error closing file: %v", closeErr)
+			}
+		}()
+		source = file
+	}
+
+	input, err := openInput(source, forceGzip)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	sorted, err := CountWords(input, opts)
+	if err != nil {
+		return fmt.Errorf("统计单词失败: %w", err)
+	}
+
+	// 输出排序后的结果
+	PrintMemUsage("结果排序完毕后")
+	printTopWords(sorted, top)
+	fmt.Println(time.Since(start))
+	return nil
+}
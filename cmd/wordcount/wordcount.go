@@ -5,13 +5,12 @@ package main
 import (
 	"bufio" // 缓冲IO读写
 	"fmt"   // 格式化IO
+	"io"
 	"log"
-	"os"      // 操作系统功能
 	"runtime" // 运行时信息
 	"sort"    // 排序功能
 	"strings"
-	"sync" // 并发控制
-	"time"
+	"sync"    // 并发控制
 	"unicode" // Unicode字符处理
 )
 
@@ -21,45 +20,36 @@ type WordCount struct {
 	Count int    // 出现次数
 }
 
-func main() {
-	PrintMemUsage("开始读取文件前")
-	start := time.Now()
+// CountOptions 统计单词时的处理选项
+type CountOptions struct {
+	Lower     bool                // 统计前将单词转为小写，使大小写不同的同一单词合并计数
+	Stopwords map[string]struct{} // 不参与统计的单词，与处理后（Lower 时为小写）的单词比较
+}
+
+// CountWords 逐行读取 reader 并发统计单词出现次数，按频率降序返回，频率相同时按字母排序
+func CountWords(reader io.Reader, opts CountOptions) ([]WordCount, error) {
 	var wg sync.WaitGroup                        // 协程同步控制器
 	lines := make(chan string, 100000)           // 带缓冲的行通道（减少IO等待）
 	results := make(chan map[string]int, 100000) // 结果收集通道
-	resultChan := make(chan []WordCount, 100000)
+	resultChan := make(chan []WordCount, 1)
 	buf := make([]byte, 0, 1024*1024) // 初始化1MB缓冲区
 
-	// 打开文件
-	file, err := os.OpenFile("/Users/anker/text_data.txt", os.O_RDONLY, 0) //openfile指令,改为只读
-
-	if err != nil {
-		fmt.Printf("无法打开文件: %v\n", err)
-		return
-	}
-	// 立即设置defer并处理关闭错误
-	defer func() {
-		if closeErr := file.Close(); closeErr != nil {
-			log.Printf("Error closing file: %v", closeErr)
-		}
-	}() // 如果移动到os.Open后，会导致空指针崩溃风险：os.Open返回错误时，file是nil。因此在错误处理之前执行defer file.Close()的话，如果err存在，file是nil，那么defer会调用nil.Close()，导致运行时错误。
 	// 初始化并发参数
-	numWorkers := runtime.NumCPU() // 使用CPU核心数作为工作协程数
+	numWorkers := runtime.NumCPU() * 2 // 使用CPU核心数的两倍作为工作协程数
 
 	// 启动工作协程池
-	for i := 0; i < numWorkers*2; i++ {
+	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
-		go countWordsWorker(lines, results, &wg)
+		go countWordsWorker(lines, results, &wg, opts)
 	}
 
-	// 启动结果合并协程
-
+	// 启动结果合并协程，需要收齐每个工作协程的结果
 	go func() {
 		resultChan <- aggregateWordCounts(results, numWorkers)
 	}()
 
-	// 使用缓冲扫描器读取文件
-	scanner := bufio.NewScanner(file)
+	// 使用缓冲扫描器读取输入
+	scanner := bufio.NewScanner(reader)
 	scanner.Buffer(buf, 10*1024*1024) // 设置最大行长度为10MB
 
 	// 逐行读取并发送到通道
@@ -67,22 +57,21 @@ func main() {
 		lines <- scanner.Text()
 	}
 
-	//AI说这两个close是安全的，不会引发panic
+	// 读取出错时也要关闭通道，让工作协程和合并协程正常退出
 	close(lines) // 关闭通道触发工作协程结束
 	// 等待所有工作协程完成
 	wg.Wait()
 	close(results) // 关闭结果通道
 
-	// 获取排序后的结果并输出
 	sorted := <-resultChan
-	PrintMemUsage("结果排序完毕后")
-	printTopWords(sorted, 30)
-	end := time.Now()
-	fmt.Println(end.Sub(start))
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取输入失败: %w", err)
+	}
+	return sorted, nil
 }
 
 // 行处理工作协程，只能接受的通道lines，只能发送的通道res
-func countWordsWorker(lines <-chan string, results chan<- map[string]int, wg *sync.WaitGroup) {
+func countWordsWorker(lines <-chan string, results chan<- map[string]int, wg *sync.WaitGroup, opts CountOptions) {
 	defer wg.Done()
 	localCount := make(map[string]int) // 本地计数器
 
@@ -90,6 +79,12 @@ func countWordsWorker(lines <-chan string, results chan<- map[string]int, wg *sy
 	for line := range lines {
 		words := splitToWords(line) // 分词处理
 		for _, word := range words {
+			if opts.Lower {
+				word = strings.ToLower(word)
+			}
+			if _, skip := opts.Stopwords[word]; skip {
+				continue
+			}
 			localCount[word]++ // 统计单词
 		}
 	}
@@ -104,7 +99,7 @@ func splitToWords(line string) []string {
 	idx := 0
 	// words := make([]string, 0, len(fields)) // 预分配容量
 	for _, word := range fields {
-		// 使用索引操作代替多次append  AI润色的结果
+		// 使用索引操作代替多次append
 		clean := strings.TrimFunc(word, func(r rune) bool {
 			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
 		})
@@ -116,6 +111,24 @@ func splitToWords(line string) []string {
 	return fields[:idx]
 }
 
+// loadStopwords 读取停用词表，单词之间以空白分隔，按统计时相同的规则去掉两端的标点，lower 为 true 时转为小写
+func loadStopwords(reader io.Reader, lower bool) (map[string]struct{}, error) {
+	stopwords := make(map[string]struct{})
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		for _, word := range splitToWords(scanner.Text()) {
+			if lower {
+				word = strings.ToLower(word)
+			}
+			stopwords[word] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取停用词表失败: %w", err)
+	}
+	return stopwords, nil
+}
+
 // 合并协程
 func aggregateWordCounts(results <-chan map[string]int, workers int) []WordCount {
 	total := make(map[string]int) // 全局计数器
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 测试统计结果按频率降序、频率相同时按字母排序，并去掉单词两端的标点
+func TestCountWords(t *testing.T) {
+	input := "the cat, the dog.\n\n\"dog\" the END\n"
+
+	got, err := CountWords(strings.NewReader(input), CountOptions{})
+	if err != nil {
+		t.Fatalf("统计单词失败: %v", err)
+	}
+
+	want := []WordCount{{"the", 3}, {"dog", 2}, {"END", 1}, {"cat", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("统计结果错误: 期望=%v, 实际=%v", want, got)
+	}
+}
+
+// 测试统计结果包含所有工作协程的计数，不随行数增加而丢失
+func TestCountWordsManyLines(t *testing.T) {
+	input := strings.Repeat("go\n", 10000)
+
+	got, err := CountWords(strings.NewReader(input), CountOptions{})
+	if err != nil {
+		t.Fatalf("统计单词失败: %v", err)
+	}
+	if len(got) != 1 || got[0].Count != 10000 {
+		t.Errorf("统计结果错误: %v", got)
+	}
+}
+
+// gzipped 返回 text 的 gzip 压缩数据
+func gzipped(t *testing.T, text string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(text)); err != nil {
+		t.Fatalf("压缩测试数据失败: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("压缩测试数据失败: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// 测试输入按魔数识别 gzip 格式，普通文本和空输入原样读取，-gzip 强制解压
+func TestOpenInput(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		forceGzip bool
+		want      string
+		wantErr   bool
+	}{
+		{name: "普通文本", input: []byte("hello world"), want: "hello world"},
+		{name: "空输入", input: nil, want: ""},
+		{name: "单字节输入", input: []byte{0x1f}, want: "\x1f"},
+		{name: "按魔数识别gzip", input: gzipped(t, "hello gzip"), want: "hello gzip"},
+		{name: "强制gzip", input: gzipped(t, "forced"), forceGzip: true, want: "forced"},
+		{name: "强制gzip但不是gzip格式", input: []byte("plain"), forceGzip: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input, err := openInput(bytes.NewReader(tt.input), tt.forceGzip)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("应返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("打开输入失败: %v", err)
+			}
+			defer input.Close()
+
+			got, err := io.ReadAll(input)
+			if err != nil {
+				t.Fatalf("读取输入失败: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("读取内容错误: 期望=%q, 实际=%q", tt.want, got)
+			}
+		})
+	}
+}
+
+// 测试统计 gzip 压缩的输入
+func TestCountWordsGzipInput(t *testing.T) {
+	input, err := openInput(bytes.NewReader(gzipped(t, "b a b\n")), false)
+	if err != nil {
+		t.Fatalf("打开输入失败: %v", err)
+	}
+	defer input.Close()
+
+	got, err := CountWords(input, CountOptions{})
+	if err != nil {
+		t.Fatalf("统计单词失败: %v", err)
+	}
+	want := []WordCount{{"b", 2}, {"a", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("统计结果错误: 期望=%v, 实际=%v", want, got)
+	}
+}
+
+// 测试转为小写后合并计数，停用词不参与统计
+func TestCountWordsLowerAndStopwords(t *testing.T) {
+	input := "The cat and the dog. THE END, and \"the\" end\n"
+
+	got, err := CountWords(strings.NewReader(input), CountOptions{Lower: true})
+	if err != nil {
+		t.Fatalf("统计单词失败: %v", err)
+	}
+	want := []WordCount{{"the", 4}, {"and", 2}, {"end", 2}, {"cat", 1}, {"dog", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("小写统计结果错误: 期望=%v, 实际=%v", want, got)
+	}
+
+	stopwords, err := loadStopwords(strings.NewReader("The\nand, a\n"), true)
+	if err != nil {
+		t.Fatalf("读取停用词表失败: %v", err)
+	}
+	got, err = CountWords(strings.NewReader(input), CountOptions{Lower: true, Stopwords: stopwords})
+	if err != nil {
+		t.Fatalf("统计单词失败: %v", err)
+	}
+	want = []WordCount{{"end", 2}, {"cat", 1}, {"dog", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("去掉停用词后统计结果错误: 期望=%v, 实际=%v", want, got)
+	}
+
+	// 不转小写时停用词按原样比较
+	stopwords, err = loadStopwords(strings.NewReader("the"), false)
+	if err != nil {
+		t.Fatalf("读取停用词表失败: %v", err)
+	}
+	got, err = CountWords(strings.NewReader("The the THE"), CountOptions{Stopwords: stopwords})
+	if err != nil {
+		t.Fatalf("统计单词失败: %v", err)
+	}
+	want = []WordCount{{"THE", 1}, {"The", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("区分大小写的停用词统计结果错误: 期望=%v, 实际=%v", want, got)
+	}
+}
+
+// 比较统计时转小写对性能的影响
+func BenchmarkCountWords(b *testing.B) {
+	line := "The quick brown Fox jumps over the lazy Dog, while THE cat watches; Über straße naïve café.\n"
+	input := strings.Repeat(line, 20000)
+
+	for _, bm := range []struct {
+		name string
+		opts CountOptions
+	}{
+		{"original-case", CountOptions{}},
+		{"lower", CountOptions{Lower: true}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				if _, err := CountWords(strings.NewReader(input), bm.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
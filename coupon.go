@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// ErrInvalidCoupon 优惠码不存在、已过期或已用完
+var ErrInvalidCoupon = errors.New("优惠码无效")
+
+// 优惠方式
+const (
+	CouponPercent = "percent" // 按百分比折扣，DiscountValue 为折扣百分比
+	CouponFixed   = "fixed"   // 固定金额减免，DiscountValue 为减免金额
+)
+
+// Coupon 首次付费可用的优惠码
+type Coupon struct {
+	ID            int64      `json:"id"`
+	Code          string     `json:"code"`
+	DiscountType  string     `json:"discount_type"`
+	DiscountValue float64    `json:"discount_value"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"` // 为空时不过期
+	MaxUses       int        `json:"max_uses"`
+	UsedCount     int        `json:"used_count"`
+}
+
+// Validate 检查优惠码在 now 时刻是否可用
+func (c *Coupon) Validate(now time.Time) error {
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return fmt.Errorf("%w: %s 已过期", ErrInvalidCoupon, c.Code)
+	}
+	if c.UsedCount >= c.MaxUses {
+		return fmt.Errorf("%w: %s 已被使用", ErrInvalidCoupon, c.Code)
+	}
+	return nil
+}
+
+// Apply 返回使用优惠后的金额，按分取整且不低于0
+func (c *Coupon) Apply(amount float64) float64 {
+	switch c.DiscountType {
+	case CouponPercent:
+		amount = amount * (100 - c.DiscountValue) / 100
+	case CouponFixed:
+		amount -= c.DiscountValue
+	}
+	return math.Max(0, math.Round(amount*100)/100)
+}
+
+// applyCoupon 校验优惠码在 now 时刻可用，返回 amount 使用优惠后的金额
+func (s *SubscriptionService) applyCoupon(ctx context.Context, code string, amount float64, now time.Time) (float64, error) {
+	coupon, err := s.db.GetCoupon(ctx, code)
+	if err != nil {
+		log.Printf("获取优惠码失败: %v", err)
+		return 0, err
+	}
+	if err := coupon.Validate(now); err != nil {
+		log.Printf("优惠码不可用: %v", err)
+		return 0, err
+	}
+	return coupon.Apply(amount), nil
+}
+
+// redeemCoupon 在事务内占用一次优惠码使用次数，并发使用同一优惠码时只有一个请求成功
+func redeemCoupon(ctx context.Context, tx *sql.Tx, code string) error {
+	result, err := tx.ExecContext(ctx,
+		`UPDATE coupons SET used_count = used_count + 1 WHERE code = ? AND used_count < max_uses`,
+		code,
+	)
+	if err != nil {
+		return fmt.Errorf("更新优惠码使用次数失败: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("更新优惠码使用次数失败: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: %s 已被使用", ErrInvalidCoupon, code)
+	}
+	return nil
+}
+
+// releaseCoupon 在事务内归还一次优惠码使用次数，用于首次支付最终失败的情况
+func releaseCoupon(ctx context.Context, tx *sql.Tx, code string) error {
+	_, err := tx.ExecContext(ctx,
+		`UPDATE coupons SET used_count = used_count - 1 WHERE code = ? AND used_count > 0`,
+		code,
+	)
+	if err != nil {
+		return fmt.Errorf("归还优惠码使用次数失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"time"
+)
+
+// 一次保活探测取出并探测所有空闲连接的超时时间
+const keepalivePingTimeout = 5 * time.Second
+
+// retryDB 包装连接池，语句因 driver.ErrBadConn 失败时重试一次
+// ErrBadConn 表示语句尚未发送到服务器，重试写操作也不会重复执行
+type retryDB struct {
+	*sql.DB
+	statementTimeout time.Duration // 单条语句的执行时间上限，0表示不限制
+}
+
+// Exec 执行语句，连接失效时重试一次
+func (db retryDB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext 在 ctx 内执行语句，连接失效时重试一次
+func (db retryDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+
+	var result sql.Result
+	err := withBadConnRetry(func() error {
+		var err error
+		result, err = db.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// Query 执行查询，连接失效时重试一次
+func (db retryDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext 在 ctx 内执行查询，连接失效时重试一次
+// 执行时间上限只约束到结果返回为止，之后由调用方逐行读取，不受时限影响
+func (db retryDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, stop := db.executionContext(ctx)
+	defer stop()
+
+	var rows *sql.Rows
+	err := withBadConnRetry(func() error {
+		var err error
+		rows, err = db.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRow 执行单行查询，连接失效时重试一次
+func (db retryDB) QueryRow(query string, args ...any) *sql.Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext 在 ctx 内执行单行查询，连接失效时重试一次
+// 与 QueryContext 相同，执行时间上限不影响之后的 Scan
+func (db retryDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, stop := db.executionContext(ctx)
+	defer stop()
+
+	var row *sql.Row
+	withBadConnRetry(func() error {
+		row = db.DB.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	return row
+}
+
+// statementContext 为单条写语句附加执行时间上限，调用方在语句执行完后调用返回的 cancel 释放定时器
+// 服务器端的 max_execution_time 只对 SELECT 生效，写操作依靠客户端的截止时间中止
+func (db retryDB) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.statementTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, db.statementTimeout)
+}
+
+// executionContext 为查询附加执行时间上限，只约束语句执行到结果返回为止
+// 查询结果在函数返回后仍需读取，不能使用截止时间：调用方拿到结果后调用 stop 停止定时器，之后读取结果不会被中断
+func (db retryDB) executionContext(ctx context.Context) (context.Context, func() bool) {
+	if db.statementTimeout <= 0 {
+		return ctx, func() bool { return false }
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(db.statementTimeout, cancel)
+	return ctx, timer.Stop
+}
+
+// withBadConnRetry 执行 op，遇到 driver.ErrBadConn 时重试一次，其他错误直接返回
+func withBadConnRetry(op func() error) error {
+	err := op()
+	if errors.Is(err, driver.ErrBadConn) {
+		log.Printf("数据库连接已失效，重试一次: %v", err)
+		err = op()
+	}
+	return err
+}
+
+// StartKeepalive 按 interval 定期探测空闲连接，避免连接空闲超过服务器 wait_timeout 后被断开
+// 探测失败的连接会被连接池丢弃，下次使用时重新建立
+func (s *DatabaseService) StartKeepalive(interval time.Duration) {
+	s.stopKeepalive = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.pingIdleConns()
+			case <-s.stopKeepalive:
+				return
+			}
+		}
+	}()
+
+	log.Printf("数据库连接保活已启动，间隔: %v", interval)
+}
+
+// pingIdleConns 取出当前所有的空闲连接后逐个探测，全部探测完再归还
+// 连接池总是复用最近归还的连接，取一个归还一个只会反复探测同一个连接
+func (s *DatabaseService) pingIdleConns() {
+	ctx, cancel := context.WithTimeout(context.Background(), keepalivePingTimeout)
+	defer cancel()
+
+	idle := s.db.Stats().Idle
+	conns := make([]*sql.Conn, 0, idle)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < idle; i++ {
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			log.Printf("数据库连接保活获取连接失败: %v", err)
+			break
+		}
+		conns = append(conns, conn)
+	}
+
+	// 探测失败的连接在归还时被连接池丢弃
+	for _, conn := range conns {
+		if err := conn.PingContext(ctx); err != nil {
+			log.Printf("数据库连接保活探测失败: %v", err)
+		}
+	}
+}
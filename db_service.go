@@ -1,43 +1,178 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
+// ErrUserNotFound 用户不存在
+var ErrUserNotFound = errors.New("用户不存在")
+
+// ErrSubscriptionNotFound 订阅不存在
+var ErrSubscriptionNotFound = errors.New("订阅不存在")
+
+// ErrDuplicateEmail 邮箱已被其他用户使用
+var ErrDuplicateEmail = errors.New("邮箱已被使用")
+
+// MySQL 唯一约束冲突错误码
+const mysqlErrDuplicateEntry = 1062
+
+// MySQL 连接池参数的默认值
+const (
+	defaultDBMaxOpenConns    = 100       // 最大连接数
+	defaultDBMaxIdleConns    = 20        // 最大空闲连接数
+	defaultDBConnMaxLifetime = time.Hour // 连接最长生命周期
+)
+
+// DBPoolConfig MySQL 连接池参数，各项不大于0时使用默认值
+// SQLite 后端使用固定的连接池，不受这些参数影响
+type DBPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// withDefaults 返回未设置的参数替换为默认值后的连接池参数
+func (p DBPoolConfig) withDefaults() DBPoolConfig {
+	if p.MaxOpenConns <= 0 {
+		p.MaxOpenConns = defaultDBMaxOpenConns
+	}
+	if p.MaxIdleConns <= 0 {
+		p.MaxIdleConns = min(defaultDBMaxIdleConns, p.MaxOpenConns)
+	}
+	if p.ConnMaxLifetime <= 0 {
+		p.ConnMaxLifetime = defaultDBConnMaxLifetime
+	}
+	return p
+}
+
 // DatabaseService 数据库服务
 type DatabaseService struct {
-	db *sql.DB
+	db            retryDB
+	dialect       sqlDialect
+	stopKeepalive chan struct{}
+	closeOnce     sync.Once
+	closeErr      error
 }
 
-func NewDatabaseService(dsn string) (*DatabaseService, error) {
+// NewDatabaseService 连接数据库，statementTimeout 大于0时限制每条语句的执行时间
+// DSN 以 "sqlite:" 开头时使用 SQLite 后端，否则连接 MySQL
+func NewDatabaseService(dsn string, statementTimeout time.Duration, pool DBPoolConfig) (*DatabaseService, error) {
+	if isSQLiteDSN(dsn) {
+		return newSQLiteDatabaseService(dsn, statementTimeout)
+	}
+
+	dsn, err := normalizeDSN(dsn, statementTimeout)
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("数据库连接失败: %w", err)
 	}
 
 	// 设置连接池参数
-	db.SetMaxOpenConns(100)          // 最大连接数
-	db.SetMaxIdleConns(20)           // 最大空闲连接数
-	db.SetConnMaxLifetime(time.Hour) // 连接最长生命周期
+	pool = pool.withDefaults()
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	log.Printf("数据库连接池: 最大连接数=%d, 最大空闲连接数=%d, 连接最长生命周期=%v",
+		pool.MaxOpenConns, pool.MaxIdleConns, pool.ConnMaxLifetime)
 
 	// 验证连接
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("数据库连接验证失败: %w", err)
 	}
 
-	return &DatabaseService{db: db}, nil
+	if err := migrateSchema(context.Background(), db, dialectMySQL); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &DatabaseService{db: retryDB{DB: db, statementTimeout: statementTimeout}}, nil
+}
+
+// columnMigration 建表之后新增的列：新建的数据库由建表语句直接包含，已有的数据库在启动时补齐
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+	index      string // 不为空时为该列创建同名的唯一索引
+}
+
+// columnMigrations 按新增顺序排列，只能追加
+var columnMigrations = []columnMigration{
+	{table: "payments", column: "refund_reference", definition: "VARCHAR(64) NULL", index: "idx_payments_refund_reference"},
+}
+
+// migrateSchema 为已有的表补齐缺少的列和索引，表还不存在时跳过，由建表语句创建
+func migrateSchema(ctx context.Context, db *sql.DB, dialect sqlDialect) error {
+	for _, m := range columnMigrations {
+		columns, err := tableColumns(ctx, db, dialect, m.table)
+		if err != nil {
+			return fmt.Errorf("读取表 %s 的结构失败: %w", m.table, err)
+		}
+		if len(columns) == 0 || columns[m.column] {
+			continue
+		}
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("为表 %s 添加列 %s 失败: %w", m.table, m.column, err)
+		}
+		if m.index != "" {
+			if _, err := db.ExecContext(ctx, fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", m.index, m.table, m.column)); err != nil {
+				return fmt.Errorf("为表 %s 创建索引 %s 失败: %w", m.table, m.index, err)
+			}
+		}
+		log.Printf("数据库迁移: 表 %s 已添加列 %s", m.table, m.column)
+	}
+	return nil
+}
+
+// tableColumns 返回表的列名集合，表不存在时为空
+func tableColumns(ctx context.Context, db *sql.DB, dialect sqlDialect, table string) (map[string]bool, error) {
+	query := `SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`
+	if dialect == dialectSQLite {
+		query = `SELECT name FROM pragma_table_info(?)`
+	}
+
+	rows, err := db.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(column)] = true
+	}
+	return columns, rows.Err()
 }
 
 // 创建用户
-func (s *DatabaseService) CreateUser(user *User) (int64, error) {
+func (s *DatabaseService) CreateUser(ctx context.Context, user *User) (int64, error) {
 	query := `INSERT INTO users (name, email) VALUES (?, ?)`
 
-	result, err := s.db.Exec(query, user.Name, user.Email)
+	result, err := s.db.ExecContext(ctx, query, user.Name, user.Email)
+	if isDuplicateEntry(err) {
+		return 0, fmt.Errorf("%w: %s", ErrDuplicateEmail, user.Email)
+	}
 	if err != nil {
 		return 0, fmt.Errorf("创建用户失败: %w", err)
 	}
@@ -51,11 +186,33 @@ func (s *DatabaseService) CreateUser(user *User) (int64, error) {
 }
 
 // 用户查询相关方法
-func (s *DatabaseService) GetUserByID(id int64) (*User, error) {
+func (s *DatabaseService) GetUserByID(ctx context.Context, id int64) (*User, error) {
 	query := `SELECT id, name, email, created_at FROM users WHERE id = ?`
 
 	var user User
-	err := s.db.QueryRow(query, id).Scan(
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.Name,
+		&user.Email,
+		&user.CreatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("查询用户失败: %w", err)
+	}
+
+	return &user, nil
+}
+
+// 按邮箱查询用户
+func (s *DatabaseService) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	query := `SELECT id, name, email, created_at FROM users WHERE email = ?`
+
+	var user User
+	err := s.db.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
 		&user.Name,
 		&user.Email,
@@ -64,7 +221,7 @@ func (s *DatabaseService) GetUserByID(id int64) (*User, error) {
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("用户不存在")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("查询用户失败: %w", err)
 	}
@@ -72,12 +229,46 @@ func (s *DatabaseService) GetUserByID(id int64) (*User, error) {
 	return &user, nil
 }
 
+// 更新用户姓名和邮箱
+func (s *DatabaseService) UpdateUser(ctx context.Context, userID int64, name, email string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET name = ?, email = ? WHERE id = ?`, name, email, userID)
+	if isDuplicateEntry(err) {
+		return fmt.Errorf("%w: %s", ErrDuplicateEmail, email)
+	}
+	if err != nil {
+		return fmt.Errorf("更新用户失败: %w", err)
+	}
+
+	// 内容未变化时影响行数也为0，需要确认用户是否存在
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		var exists int
+		err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE id = ?`, userID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("查询用户失败: %w", err)
+		}
+		if exists == 0 {
+			return ErrUserNotFound
+		}
+	}
+
+	return nil
+}
+
+// isDuplicateEntry 判断是否为唯一约束冲突
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrDuplicateEntry
+	}
+	return isSQLiteUniqueViolation(err)
+}
+
 // 获取用户订阅
-func (s *DatabaseService) GetUserSubscriptions(userID int64) ([]Subscription, error) {
-	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference 
+func (s *DatabaseService) GetUserSubscriptions(ctx context.Context, userID int64) ([]Subscription, error) {
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at
               FROM subscriptions WHERE user_id = ?`
 
-	rows, err := s.db.Query(query, userID)
+	rows, err := s.db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, fmt.Errorf("获取用户订阅失败: %w", err)
 	}
@@ -95,6 +286,9 @@ func (s *DatabaseService) GetUserSubscriptions(userID int64) ([]Subscription, er
 			&sub.Status,
 			&sub.NotificationSent,
 			&sub.RenewalPreference,
+			&sub.Version,
+			&sub.CreatedAt,
+			&sub.UpdatedAt,
 		); err != nil {
 			return nil, fmt.Errorf("解析订阅数据失败: %w", err)
 		}
@@ -105,14 +299,14 @@ func (s *DatabaseService) GetUserSubscriptions(userID int64) ([]Subscription, er
 }
 
 // 获取用户当前活跃订阅
-func (s *DatabaseService) GetActiveSubscription(userID int64) (*Subscription, error) {
-	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference 
+func (s *DatabaseService) GetActiveSubscription(ctx context.Context, userID int64) (*Subscription, error) {
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at
              FROM subscriptions 
              WHERE user_id = ? AND (status = ? OR status = ?) 
              ORDER BY end_date DESC LIMIT 1`
 
 	var sub Subscription
-	err := s.db.QueryRow(query, userID, StatusSubscribed, StatusRenewed).Scan(
+	err := s.db.QueryRowContext(ctx, query, userID, StatusSubscribed, StatusRenewed).Scan(
 		&sub.ID,
 		&sub.UserID,
 		&sub.Plan,
@@ -121,6 +315,9 @@ func (s *DatabaseService) GetActiveSubscription(userID int64) (*Subscription, er
 		&sub.Status,
 		&sub.NotificationSent,
 		&sub.RenewalPreference,
+		&sub.Version,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
 	)
 
 	if err != nil {
@@ -133,16 +330,15 @@ func (s *DatabaseService) GetActiveSubscription(userID int64) (*Subscription, er
 	return &sub, nil
 }
 
-// 获取需要发送通知的即将到期订阅（未发送通知且3天内到期）
-func (s *DatabaseService) GetExpiringSubscriptionsForNotification() ([]Subscription, error) {
-	// 获取3天内到期且未发送通知的订阅
-	threedays := time.Now().AddDate(0, 0, 3)
-	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference 
+// 获取处于提醒窗口内的即将到期订阅（leadDays天内到期且尚未到期）
+func (s *DatabaseService) GetExpiringSubscriptionsForNotification(now time.Time, leadDays int) ([]Subscription, error) {
+	windowEnd := now.AddDate(0, 0, leadDays)
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at
               FROM subscriptions 
-              WHERE end_date <= ? AND end_date > NOW() 
-              AND (status = ? OR status = ?) AND notification_sent = false`
+              WHERE end_date <= ? AND end_date > ? 
+              AND (status = ? OR status = ?)`
 
-	rows, err := s.db.Query(query, threedays, StatusSubscribed, StatusRenewed)
+	rows, err := s.db.Query(query, windowEnd, now, StatusSubscribed, StatusRenewed)
 	if err != nil {
 		return nil, fmt.Errorf("获取即将到期订阅失败: %w", err)
 	}
@@ -160,6 +356,9 @@ func (s *DatabaseService) GetExpiringSubscriptionsForNotification() ([]Subscript
 			&sub.Status,
 			&sub.NotificationSent,
 			&sub.RenewalPreference,
+			&sub.Version,
+			&sub.CreatedAt,
+			&sub.UpdatedAt,
 		); err != nil {
 			return nil, fmt.Errorf("解析订阅数据失败: %w", err)
 		}
@@ -169,15 +368,161 @@ func (s *DatabaseService) GetExpiringSubscriptionsForNotification() ([]Subscript
 	return subscriptions, nil
 }
 
-// 获取需要更新状态的订阅
-func (s *DatabaseService) GetExpiredSubscriptions() ([]Subscription, error) {
-	// 获取已过期的订阅
-	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference 
+// 检查订阅在指定时间之后是否已成功发送过某类通知，因每日上限推迟的通知视为已发送
+func (s *DatabaseService) HasNotificationSince(subscriptionID int64, notificationType string, since time.Time) (bool, error) {
+	query := `SELECT COUNT(*) FROM notifications 
+              WHERE subscription_id = ? AND type = ? AND status IN ('sent', 'deferred') AND sent_at >= ?`
+
+	var count int
+	err := s.db.QueryRow(query, subscriptionID, notificationType, since).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("查询通知记录失败: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// 获取待重试的失败通知：失败时间早于 before 且重试次数未达上限
+func (s *DatabaseService) GetRetryableNotifications(before time.Time, maxRetries int) ([]Notification, error) {
+	query := `SELECT id, user_id, subscription_id, type, content, sent_at, status, retry_count
+              FROM notifications
+              WHERE status = 'failed' AND sent_at <= ? AND retry_count < ?
+              ORDER BY sent_at`
+
+	rows, err := s.db.Query(query, before, maxRetries)
+	if err != nil {
+		return nil, fmt.Errorf("获取待重试通知失败: %w", err)
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(
+			&n.ID,
+			&n.UserID,
+			&n.SubscriptionID,
+			&n.Type,
+			&n.Content,
+			&n.SentAt,
+			&n.Status,
+			&n.RetryCount,
+		); err != nil {
+			return nil, fmt.Errorf("解析通知数据失败: %w", err)
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, nil
+}
+
+// 记录一次通知重试的结果，重试次数加一
+func (s *DatabaseService) RecordNotificationRetry(id int64, status, channel string, sentAt time.Time) error {
+	query := `UPDATE notifications 
+              SET status = ?, channel = ?, sent_at = ?, retry_count = retry_count + 1 
+              WHERE id = ?`
+
+	_, err := s.db.Exec(query, status, channel, sentAt, id)
+	if err != nil {
+		return fmt.Errorf("更新通知重试结果失败: %w", err)
+	}
+
+	return nil
+}
+
+// 统计用户在 [since, until) 内成功发送的通知数
+func (s *DatabaseService) CountUserNotificationsSent(userID int64, since, until time.Time) (int, error) {
+	query := `SELECT COUNT(*) FROM notifications 
+              WHERE user_id = ? AND status = 'sent' AND sent_at >= ? AND sent_at < ?`
+
+	var count int
+	if err := s.db.QueryRow(query, userID, since, until).Scan(&count); err != nil {
+		return 0, fmt.Errorf("统计用户通知数失败: %w", err)
+	}
+
+	return count, nil
+}
+
+// 获取计划发送时间不晚于 now 的推迟通知
+func (s *DatabaseService) GetDueDeferredNotifications(now time.Time) ([]Notification, error) {
+	query := `SELECT id, user_id, subscription_id, type, content, sent_at, status, retry_count
+              FROM notifications
+              WHERE status = 'deferred' AND sent_at <= ?
+              ORDER BY sent_at, id`
+
+	rows, err := s.db.Query(query, now)
+	if err != nil {
+		return nil, fmt.Errorf("获取推迟通知失败: %w", err)
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(
+			&n.ID,
+			&n.UserID,
+			&n.SubscriptionID,
+			&n.Type,
+			&n.Content,
+			&n.SentAt,
+			&n.Status,
+			&n.RetryCount,
+		); err != nil {
+			return nil, fmt.Errorf("解析通知数据失败: %w", err)
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, nil
+}
+
+// 将推迟通知的计划发送时间改为 at
+func (s *DatabaseService) RescheduleNotification(id int64, at time.Time) error {
+	_, err := s.db.Exec("UPDATE notifications SET sent_at = ? WHERE id = ?", at, id)
+	if err != nil {
+		return fmt.Errorf("更新通知发送时间失败: %w", err)
+	}
+
+	return nil
+}
+
+// 记录推迟通知的发送结果，不计入重试次数
+func (s *DatabaseService) UpdateNotificationDelivery(id int64, status, channel string, sentAt time.Time) error {
+	query := `UPDATE notifications SET status = ?, channel = ?, sent_at = ? WHERE id = ?`
+
+	_, err := s.db.Exec(query, status, channel, sentAt, id)
+	if err != nil {
+		return fmt.Errorf("更新通知发送结果失败: %w", err)
+	}
+
+	return nil
+}
+
+// 更新通知状态
+func (s *DatabaseService) UpdateNotificationStatus(id int64, status string) error {
+	_, err := s.db.Exec("UPDATE notifications SET status = ? WHERE id = ?", status, id)
+	if err != nil {
+		return fmt.Errorf("更新通知状态失败: %w", err)
+	}
+
+	return nil
+}
+
+// 获取需要更新状态的订阅：在 now 之前已过期且状态在 expirableStatuses 中
+func (s *DatabaseService) GetExpiredSubscriptions(now time.Time) ([]Subscription, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(expirableStatuses)), ", ")
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at
               FROM subscriptions 
-              WHERE end_date < NOW() 
-              AND (status = ? OR status = ?)`
+              WHERE end_date < ? 
+              AND status IN (` + placeholders + `)`
+
+	args := []any{now}
+	for _, status := range expirableStatuses {
+		args = append(args, status)
+	}
 
-	rows, err := s.db.Query(query, StatusSubscribed, StatusUnsubscribed)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("获取已过期订阅失败: %w", err)
 	}
@@ -195,20 +540,105 @@ func (s *DatabaseService) GetExpiredSubscriptions() ([]Subscription, error) {
 			&sub.Status,
 			&sub.NotificationSent,
 			&sub.RenewalPreference,
+			&sub.Version,
+			&sub.CreatedAt,
+			&sub.UpdatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("解析订阅数据失败: %w", err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	return subscriptions, nil
+}
+
+// 获取到期日在 before 之前的已续约订阅
+func (s *DatabaseService) GetRenewedSubscriptionsEndingBefore(ctx context.Context, before time.Time) ([]Subscription, error) {
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at
+              FROM subscriptions 
+              WHERE status = ? AND end_date < ?`
+
+	rows, err := s.db.QueryContext(ctx, query, StatusRenewed, before)
+	if err != nil {
+		return nil, fmt.Errorf("获取已续约订阅失败: %w", err)
+	}
+	defer rows.Close()
+
+	var subscriptions []Subscription
+	for rows.Next() {
+		var sub Subscription
+		if err := rows.Scan(
+			&sub.ID,
+			&sub.UserID,
+			&sub.Plan,
+			&sub.StartDate,
+			&sub.EndDate,
+			&sub.Status,
+			&sub.NotificationSent,
+			&sub.RenewalPreference,
+			&sub.Version,
+			&sub.CreatedAt,
+			&sub.UpdatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("解析订阅数据失败: %w", err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("获取已续约订阅失败: %w", err)
+	}
+
+	return subscriptions, nil
+}
+
+// 获取续订扣款失败、最近一次扣款在 before 之前的订阅，即已到下次重试时间的订阅
+func (s *DatabaseService) GetPastDueSubscriptions(ctx context.Context, before time.Time) ([]PastDueSubscription, error) {
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at,
+                     dunning_attempts, dunning_last_at
+              FROM subscriptions
+              WHERE status = ? AND dunning_last_at <= ?
+              ORDER BY id`
+
+	rows, err := s.db.QueryContext(ctx, query, StatusPastDue, before)
+	if err != nil {
+		return nil, fmt.Errorf("获取扣款失败的订阅失败: %w", err)
+	}
+	defer rows.Close()
+
+	var subscriptions []PastDueSubscription
+	for rows.Next() {
+		var sub PastDueSubscription
+		if err := rows.Scan(
+			&sub.ID,
+			&sub.UserID,
+			&sub.Plan,
+			&sub.StartDate,
+			&sub.EndDate,
+			&sub.Status,
+			&sub.NotificationSent,
+			&sub.RenewalPreference,
+			&sub.Version,
+			&sub.CreatedAt,
+			&sub.UpdatedAt,
+			&sub.DunningAttempts,
+			&sub.LastAttemptAt,
 		); err != nil {
 			return nil, fmt.Errorf("解析订阅数据失败: %w", err)
 		}
 		subscriptions = append(subscriptions, sub)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历订阅数据失败: %w", err)
+	}
 
 	return subscriptions, nil
 }
 
 // 更新订阅状态
-func (s *DatabaseService) UpdateSubscriptionStatus(id int64, status string) error {
-	query := `UPDATE subscriptions SET status = ? WHERE id = ?`
+func (s *DatabaseService) UpdateSubscriptionStatus(ctx context.Context, id int64, status string) error {
+	query := `UPDATE subscriptions SET status = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
 
-	_, err := s.db.Exec(query, status, id)
+	_, err := s.db.ExecContext(ctx, query, status, id)
 	if err != nil {
 		return fmt.Errorf("更新订阅状态失败: %w", err)
 	}
@@ -218,7 +648,7 @@ func (s *DatabaseService) UpdateSubscriptionStatus(id int64, status string) erro
 
 // 更新订阅通知状态
 func (s *DatabaseService) UpdateSubscriptionNotificationSent(id int64, sent bool) error {
-	query := `UPDATE subscriptions SET notification_sent = ? WHERE id = ?`
+	query := `UPDATE subscriptions SET notification_sent = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
 
 	_, err := s.db.Exec(query, sent, id)
 	if err != nil {
@@ -229,10 +659,10 @@ func (s *DatabaseService) UpdateSubscriptionNotificationSent(id int64, sent bool
 }
 
 // 更新订阅续订偏好
-func (s *DatabaseService) UpdateRenewalPreference(id int64, preference string) error {
-	query := `UPDATE subscriptions SET renewal_preference = ? WHERE id = ?`
+func (s *DatabaseService) UpdateRenewalPreference(ctx context.Context, id int64, preference string) error {
+	query := `UPDATE subscriptions SET renewal_preference = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
 
-	_, err := s.db.Exec(query, preference, id)
+	_, err := s.db.ExecContext(ctx, query, preference, id)
 	if err != nil {
 		return fmt.Errorf("更新续订偏好失败: %w", err)
 	}
@@ -242,7 +672,7 @@ func (s *DatabaseService) UpdateRenewalPreference(id int64, preference string) e
 
 // 获取用户付款记录
 func (s *DatabaseService) GetUserPayments(userID int64) ([]Payment, error) {
-	query := `SELECT id, user_id, subscription_id, amount, payment_date, status, type
+	query := `SELECT id, user_id, subscription_id, amount, payment_date, status, type, reason, original_payment_id, refund_reference
               FROM payments WHERE user_id = ?`
 
 	rows, err := s.db.Query(query, userID)
@@ -251,74 +681,490 @@ func (s *DatabaseService) GetUserPayments(userID int64) ([]Payment, error) {
 	}
 	defer rows.Close()
 
-	var payments []Payment
-	for rows.Next() {
-		var payment Payment
-		if err := rows.Scan(
-			&payment.ID,
-			&payment.UserID,
-			&payment.SubscriptionID,
-			&payment.Amount,
-			&payment.PaymentDate,
-			&payment.Status,
-			&payment.Type,
-		); err != nil {
-			return nil, fmt.Errorf("解析付款数据失败: %w", err)
-		}
-		payments = append(payments, payment)
-	}
-
-	return payments, nil
+	return scanPayments(rows)
 }
 
-// 获取特定订阅
-func (s *DatabaseService) GetSubscriptionByID(id int64) (*Subscription, error) {
-	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference 
-              FROM subscriptions WHERE id = ?`
+// 分页获取用户付款记录（按支付时间倒序），同时返回记录总数
+func (s *DatabaseService) GetUserPaymentsPaged(ctx context.Context, userID int64, limit, offset int) ([]Payment, int, error) {
+	var total int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM payments WHERE user_id = ?", userID).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("获取用户付款记录总数失败: %w", err)
+	}
 
-	var sub Subscription
-	err := s.db.QueryRow(query, id).Scan(
-		&sub.ID,
-		&sub.UserID,
-		&sub.Plan,
-		&sub.StartDate,
-		&sub.EndDate,
-		&sub.Status,
-		&sub.NotificationSent,
-		&sub.RenewalPreference,
-	)
+	query := `SELECT id, user_id, subscription_id, amount, payment_date, status, type, reason, original_payment_id, refund_reference
+              FROM payments WHERE user_id = ?
+              ORDER BY payment_date DESC, id DESC
+              LIMIT ? OFFSET ?`
 
+	rows, err := s.db.QueryContext(ctx, query, userID, limit, offset)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("订阅不存在")
-		}
-		return nil, fmt.Errorf("获取订阅失败: %w", err)
+		return nil, 0, fmt.Errorf("获取用户付款记录失败: %w", err)
 	}
+	defer rows.Close()
 
-	return &sub, nil
+	payments, err := scanPayments(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return payments, total, nil
 }
 
-// 更新订阅日期
-func (s *DatabaseService) UpdateSubscriptionDates(id int64, startDate, endDate time.Time) error {
-	query := `UPDATE subscriptions SET start_date = ?, end_date = ? WHERE id = ?`
+// 分页获取用户及其最近的订阅（按用户ID升序），status 不为空时只返回最近订阅为该状态的用户，同时返回总数
+func (s *DatabaseService) ListUsers(ctx context.Context, status string, limit, offset int) ([]UserWithSubscription, int, error) {
+	from := ` FROM users u
+              LEFT JOIN subscriptions s
+                  ON s.id = (SELECT MAX(id) FROM subscriptions WHERE user_id = u.id)`
+	var args []any
+	if status != "" {
+		from += ` WHERE s.status = ?`
+		args = append(args, status)
+	}
 
-	_, err := s.db.Exec(query, startDate, endDate, id)
-	if err != nil {
-		return fmt.Errorf("更新订阅日期失败: %w", err)
+	var total int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*)"+from, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("获取用户总数失败: %w", err)
 	}
 
-	return nil
-}
+	query := `SELECT u.id, u.name, u.email, u.created_at, s.id, s.plan, s.status, s.end_date` + from + `
+              ORDER BY u.id
+              LIMIT ? OFFSET ?`
 
-// 统计方法 - 用户总数
-func (s *DatabaseService) GetTotalUserCount() (int, error) {
-	var count int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, offset)...)
 	if err != nil {
-		return 0, fmt.Errorf("获取用户总数失败: %w", err)
+		return nil, 0, fmt.Errorf("获取用户列表失败: %w", err)
+	}
+	defer rows.Close()
+
+	var users []UserWithSubscription
+	for rows.Next() {
+		var user UserWithSubscription
+		var subscriptionID sql.NullInt64
+		var plan, subStatus sql.NullString
+		var endDate sql.NullTime
+		if err := rows.Scan(
+			&user.ID,
+			&user.Name,
+			&user.Email,
+			&user.CreatedAt,
+			&subscriptionID,
+			&plan,
+			&subStatus,
+			&endDate,
+		); err != nil {
+			return nil, 0, fmt.Errorf("解析用户数据失败: %w", err)
+		}
+		user.SubscriptionID = subscriptionID.Int64
+		user.Plan = plan.String
+		user.Status = subStatus.String
+		if endDate.Valid {
+			user.EndDate = &endDate.Time
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("读取用户数据失败: %w", err)
+	}
+
+	return users, total, nil
+}
+
+// likeEscaper 转义 LIKE 的通配符，使搜索词按字面匹配；转义符使用 '!'，MySQL 和 SQLite 写法一致
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// 按用户名或邮箱包含 query 搜索用户，最多返回 limit 条
+func (s *DatabaseService) SearchUsers(ctx context.Context, query string, limit int) ([]User, error) {
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, name, email, created_at FROM users 
+        WHERE name LIKE ? ESCAPE '!' OR email LIKE ? ESCAPE '!' 
+        ORDER BY id 
+        LIMIT ?`,
+		pattern, pattern, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("搜索用户失败: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("解析用户数据失败: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("读取用户数据失败: %w", err)
+	}
+
+	return users, nil
+}
+
+// 按退款引用查询退款记录的语句，事务内外的查询共用，结果由 refundByReference 读取
+const refundByReferenceQuery = `SELECT id, user_id, subscription_id, amount, payment_date, status, type, reason, original_payment_id, refund_reference
+    FROM payments WHERE refund_reference = ?`
+
+// refundByReference 读取按引用查到的退款记录，引用已用于其他支付的退款时返回 ErrRefundReferenceConflict
+func refundByReference(row *sql.Row, paymentID int64) (*Payment, error) {
+	var refund Payment
+	var originalPaymentID sql.NullInt64
+	var reference string
+	err := row.Scan(&refund.ID, &refund.UserID, &refund.SubscriptionID, &refund.Amount, &refund.PaymentDate,
+		&refund.Status, &refund.Type, &refund.Reason, &originalPaymentID, &reference)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询退款记录失败: %w", err)
+	}
+	if !originalPaymentID.Valid || originalPaymentID.Int64 != paymentID {
+		return nil, fmt.Errorf("%w: %s", ErrRefundReferenceConflict, reference)
+	}
+	refund.OriginalPaymentID = &originalPaymentID.Int64
+	refund.RefundReference = &reference
+	return &refund, nil
+}
+
+// 按退款引用获取退款记录，引用不存在时返回 sql.ErrNoRows
+func (s *DatabaseService) GetRefundByReference(ctx context.Context, reference string, paymentID int64) (*Payment, error) {
+	return refundByReference(s.db.QueryRowContext(ctx, refundByReferenceQuery, reference), paymentID)
+}
+
+// 解析付款记录
+func scanPayments(rows *sql.Rows) ([]Payment, error) {
+	var payments []Payment
+	for rows.Next() {
+		var payment Payment
+		var originalPaymentID sql.NullInt64
+		var refundReference sql.NullString
+		if err := rows.Scan(
+			&payment.ID,
+			&payment.UserID,
+			&payment.SubscriptionID,
+			&payment.Amount,
+			&payment.PaymentDate,
+			&payment.Status,
+			&payment.Type,
+			&payment.Reason,
+			&originalPaymentID,
+			&refundReference,
+		); err != nil {
+			return nil, fmt.Errorf("解析付款数据失败: %w", err)
+		}
+		if originalPaymentID.Valid {
+			payment.OriginalPaymentID = &originalPaymentID.Int64
+		}
+		if refundReference.Valid {
+			payment.RefundReference = &refundReference.String
+		}
+		payments = append(payments, payment)
+	}
+
+	return payments, nil
+}
+
+// 获取订阅累计实付金额：成功的支付之和，退款记录为负数，全额和按比例的退款都直接抵扣
+func (s *DatabaseService) GetSubscriptionPaymentTotal(ctx context.Context, subscriptionID int64) (float64, error) {
+	query := `SELECT COALESCE(SUM(amount), 0) FROM payments
+              WHERE subscription_id = ? AND status = 'success'`
+
+	var total float64
+	err := s.db.QueryRowContext(ctx, query, subscriptionID).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("获取订阅累计支付金额失败: %w", err)
+	}
+
+	return total, nil
+}
+
+// 获取订阅最近一次成功的首次订阅或续订支付金额，没有支付记录时返回0
+// 退款和升级差价不代表周期价格，不计入
+func (s *DatabaseService) GetLastPaymentAmount(ctx context.Context, subscriptionID int64) (float64, error) {
+	query := `SELECT amount FROM payments
+              WHERE subscription_id = ? AND status = 'success' AND type IN ('initial', 'renewal')
+              ORDER BY payment_date DESC, id DESC
+              LIMIT 1`
+
+	var amount float64
+	err := s.db.QueryRowContext(ctx, query, subscriptionID).Scan(&amount)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("获取最近支付金额失败: %w", err)
+	}
+
+	return amount, nil
+}
+
+// 获取特定订阅
+func (s *DatabaseService) GetSubscriptionByID(ctx context.Context, id int64) (*Subscription, error) {
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at
+              FROM subscriptions WHERE id = ?`
+
+	var sub Subscription
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&sub.ID,
+		&sub.UserID,
+		&sub.Plan,
+		&sub.StartDate,
+		&sub.EndDate,
+		&sub.Status,
+		&sub.NotificationSent,
+		&sub.RenewalPreference,
+		&sub.Version,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, fmt.Errorf("获取订阅失败: %w", err)
+	}
+
+	return &sub, nil
+}
+
+// 获取属于指定用户的订阅，订阅不存在或属于其他用户时都返回 ErrSubscriptionNotFound，不暴露其他用户的订阅是否存在
+func (s *DatabaseService) GetSubscriptionByIDForUser(ctx context.Context, subID, userID int64) (*Subscription, error) {
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at
+              FROM subscriptions WHERE id = ? AND user_id = ?`
+
+	var sub Subscription
+	err := s.db.QueryRowContext(ctx, query, subID, userID).Scan(
+		&sub.ID,
+		&sub.UserID,
+		&sub.Plan,
+		&sub.StartDate,
+		&sub.EndDate,
+		&sub.Status,
+		&sub.NotificationSent,
+		&sub.RenewalPreference,
+		&sub.Version,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, fmt.Errorf("获取订阅失败: %w", err)
+	}
+
+	return &sub, nil
+}
+
+// 按优惠码查询优惠券
+func (s *DatabaseService) GetCoupon(ctx context.Context, code string) (*Coupon, error) {
+	query := `SELECT id, code, discount_type, discount_value, expires_at, max_uses, used_count 
+              FROM coupons WHERE code = ?`
+
+	var coupon Coupon
+	err := s.db.QueryRowContext(ctx, query, code).Scan(
+		&coupon.ID,
+		&coupon.Code,
+		&coupon.DiscountType,
+		&coupon.DiscountValue,
+		&coupon.ExpiresAt,
+		&coupon.MaxUses,
+		&coupon.UsedCount,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %s 不存在", ErrInvalidCoupon, code)
+		}
+		return nil, fmt.Errorf("获取优惠码失败: %w", err)
+	}
+
+	return &coupon, nil
+}
+
+// subscriptionWhere 根据筛选条件构造 WHERE 子句及参数
+func subscriptionWhere(filter SubscriptionFilter) (string, []any) {
+	var conditions []string
+	var args []any
+
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Plan != "" {
+		conditions = append(conditions, "plan = ?")
+		args = append(args, filter.Plan)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// 按筛选条件逐行读取订阅并交给 fn 处理，不在内存中保留整个结果集
+func (s *DatabaseService) EachSubscription(ctx context.Context, filter SubscriptionFilter, fn func(*Subscription) error) error {
+	where, args := subscriptionWhere(filter)
+	query := `SELECT id, user_id, plan, start_date, end_date, status, notification_sent, renewal_preference, version, created_at, updated_at
+              FROM subscriptions` + where + ` ORDER BY id`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("查询订阅失败: %w", err)
+	}
+	defer rows.Close()
+
+	var sub Subscription
+	for rows.Next() {
+		if err := rows.Scan(
+			&sub.ID,
+			&sub.UserID,
+			&sub.Plan,
+			&sub.StartDate,
+			&sub.EndDate,
+			&sub.Status,
+			&sub.NotificationSent,
+			&sub.RenewalPreference,
+			&sub.Version,
+			&sub.CreatedAt,
+			&sub.UpdatedAt,
+		); err != nil {
+			return fmt.Errorf("解析订阅数据失败: %w", err)
+		}
+		if err := fn(&sub); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("读取订阅数据失败: %w", err)
+	}
+	return nil
+}
+
+// 逐行读取 [start, end] 内的成功支付并交给 fn 处理，不在内存中保留整个结果集
+func (s *DatabaseService) StreamPaymentsByTimeRange(ctx context.Context, start, end time.Time, fn func(*Payment) error) error {
+	query := `SELECT id, user_id, subscription_id, amount, payment_date, status, type
+              FROM payments
+              WHERE status = 'success' AND payment_date >= ? AND payment_date <= ?
+              ORDER BY payment_date, id`
+
+	rows, err := s.db.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return fmt.Errorf("查询支付记录失败: %w", err)
+	}
+	defer rows.Close()
+
+	var payment Payment
+	for rows.Next() {
+		if err := rows.Scan(
+			&payment.ID,
+			&payment.UserID,
+			&payment.SubscriptionID,
+			&payment.Amount,
+			&payment.PaymentDate,
+			&payment.Status,
+			&payment.Type,
+		); err != nil {
+			return fmt.Errorf("解析支付数据失败: %w", err)
+		}
+		if err := fn(&payment); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("读取支付数据失败: %w", err)
+	}
+	return nil
+}
+
+// 逐行读取 [start, end] 内 category 类别的分析数据，按日期和维度聚合，只返回有数据的组合
+func (s *DatabaseService) StreamAnalytics(ctx context.Context, category string, start, end time.Time, fn func(*AnalyticsRecord) error) error {
+	var query string
+	var args []any
+	switch category {
+	case AnalyticsSubscriptions:
+		query = `SELECT day, event, plan, '', COUNT(*), 0 FROM (
+                     SELECT DATE(p.payment_date) AS day, ? AS event, s.plan AS plan
+                     FROM payments p JOIN subscriptions s ON s.id = p.subscription_id
+                     WHERE p.type = 'initial' AND p.status = 'success' AND p.payment_date >= ? AND p.payment_date <= ?
+                     UNION ALL
+                     SELECT DATE(e.created_at), e.event_type, s.plan
+                     FROM subscription_events e JOIN subscriptions s ON s.id = e.subscription_id
+                     WHERE e.event_type = ? AND e.created_at >= ? AND e.created_at <= ?
+                 ) t
+                 GROUP BY day, event, plan
+                 ORDER BY day, event, plan`
+		args = []any{EventActivation, start, end, EventTrialStart, start, end}
+	case AnalyticsPayments:
+		query = `SELECT DATE(payment_date), type, '', status, COUNT(*), COALESCE(SUM(amount), 0)
+                 FROM payments
+                 WHERE payment_date >= ? AND payment_date <= ?
+                 GROUP BY DATE(payment_date), type, status
+                 ORDER BY DATE(payment_date), type, status`
+		args = []any{start, end}
+	case AnalyticsChurn:
+		query = `SELECT DATE(e.created_at), e.event_type, s.plan, '', COUNT(*), 0
+                 FROM subscription_events e JOIN subscriptions s ON s.id = e.subscription_id
+                 WHERE e.event_type = ? AND e.created_at >= ? AND e.created_at <= ?
+                 GROUP BY DATE(e.created_at), e.event_type, s.plan
+                 ORDER BY DATE(e.created_at), e.event_type, s.plan`
+		args = []any{EventCancellation, start, end}
+	default:
+		return fmt.Errorf("未知的分析数据类别: %s", category)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("查询%s分析数据失败: %w", category, err)
+	}
+	defer rows.Close()
+
+	record := AnalyticsRecord{Category: category}
+	for rows.Next() {
+		var day sqlDate
+		if err := rows.Scan(&day, &record.Event, &record.Plan, &record.Status, &record.Count, &record.Amount); err != nil {
+			return fmt.Errorf("解析%s分析数据失败: %w", category, err)
+		}
+		record.Date = day.Format("2006-01-02")
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("读取%s分析数据失败: %w", category, err)
+	}
+	return nil
+}
+
+// 更新订阅日期
+func (s *DatabaseService) UpdateSubscriptionDates(id int64, startDate, endDate time.Time) error {
+	query := `UPDATE subscriptions SET start_date = ?, end_date = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+
+	_, err := s.db.Exec(query, startDate, endDate, id)
+	if err != nil {
+		return fmt.Errorf("更新订阅日期失败: %w", err)
 	}
-	return count, nil
-}
+
+	return nil
+}
+
+// 统计方法 - 用户总数
+func (s *DatabaseService) GetTotalUserCount() (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("获取用户总数失败: %w", err)
+	}
+	return count, nil
+}
 
 // 统计方法 - 付款总金额
 func (s *DatabaseService) GetTotalPaymentAmount() (float64, error) {
@@ -332,6 +1178,45 @@ func (s *DatabaseService) GetTotalPaymentAmount() (float64, error) {
 	return total, nil
 }
 
+// 统计方法 - 按套餐统计活跃订阅数量
+func (s *DatabaseService) GetActiveSubscriptionsByPlan() (map[string]int, error) {
+	query := `SELECT plan, COUNT(*) FROM subscriptions 
+              WHERE status IN (?, ?) 
+              GROUP BY plan`
+
+	rows, err := s.db.Query(query, StatusSubscribed, StatusRenewed)
+	if err != nil {
+		return nil, fmt.Errorf("按套餐获取活跃订阅数失败: %w", err)
+	}
+	defer rows.Close()
+
+	byPlan := make(map[string]int)
+	for rows.Next() {
+		var plan string
+		var count int
+		if err := rows.Scan(&plan, &count); err != nil {
+			return nil, fmt.Errorf("解析套餐活跃订阅数失败: %w", err)
+		}
+		byPlan[plan] = count
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历套餐活跃订阅数失败: %w", err)
+	}
+
+	return byPlan, nil
+}
+
+// 统计方法 - 支付失败记录数
+func (s *DatabaseService) GetFailedPaymentsCount() (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM payments WHERE status = ?", StatusFailed).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("获取支付失败记录数失败: %w", err)
+	}
+	return count, nil
+}
+
 // 统计方法 - 获取活跃订阅数量
 func (s *DatabaseService) GetActiveSubscriptionsCount() (int, error) {
 	query := `SELECT COUNT(*) FROM subscriptions 
@@ -366,9 +1251,8 @@ func (s *DatabaseService) GetActiveSubscriptionsCount() (int, error) {
 //
 // 新增: 获取本月新增订阅数
 func (s *DatabaseService) GetNewSubscriptionsMonth() (int, error) {
-	// 获取本月第一天
-	now := time.Now()
-	firstDayOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	// 获取本月第一天（UTC）
+	firstDayOfMonth := monthStartUTC(time.Now())
 
 	query := `SELECT COUNT(*) FROM payments 
               WHERE payment_date >= ? AND status = 'success' AND type = 'initial'`
@@ -384,9 +1268,8 @@ func (s *DatabaseService) GetNewSubscriptionsMonth() (int, error) {
 
 // 新增: 获取本月新增付费金额
 func (s *DatabaseService) GetNewPaymentAmountMonth() (float64, error) {
-	// 获取本月第一天
-	now := time.Now()
-	firstDayOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	// 获取本月第一天（UTC）
+	firstDayOfMonth := monthStartUTC(time.Now())
 
 	query := `SELECT COALESCE(SUM(amount), 0) FROM payments 
               WHERE payment_date >= ? AND status = 'success' AND type = 'initial'`
@@ -402,9 +1285,8 @@ func (s *DatabaseService) GetNewPaymentAmountMonth() (float64, error) {
 
 // 新增: 获取本月续订数
 func (s *DatabaseService) GetRenewalsMonth() (int, error) {
-	// 获取本月第一天
-	now := time.Now()
-	firstDayOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	// 获取本月第一天（UTC）
+	firstDayOfMonth := monthStartUTC(time.Now())
 
 	query := `SELECT COUNT(*) FROM payments 
               WHERE payment_date >= ? AND status = 'success' AND type = 'renewal'`
@@ -420,9 +1302,8 @@ func (s *DatabaseService) GetRenewalsMonth() (int, error) {
 
 // 新增: 获取本月续订金额
 func (s *DatabaseService) GetRenewalAmountMonth() (float64, error) {
-	// 获取本月第一天
-	now := time.Now()
-	firstDayOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	// 获取本月第一天（UTC）
+	firstDayOfMonth := monthStartUTC(time.Now())
 
 	query := `SELECT COALESCE(SUM(amount), 0) FROM payments 
               WHERE payment_date >= ? AND status = 'success' AND type = 'renewal'`
@@ -436,42 +1317,530 @@ func (s *DatabaseService) GetRenewalAmountMonth() (float64, error) {
 	return total, nil
 }
 
-// 新增: 按时间段查询付费用户数和付费金额
-func (s *DatabaseService) GetPaymentStatsByTimeRange(start, end time.Time) (*TimeRangeStats, error) {
-	// 查询期间内有付费记录的唯一用户数
-	userQuery := `SELECT COUNT(DISTINCT user_id) FROM payments 
-                  WHERE payment_date >= ? AND payment_date <= ? AND status = 'success'`
+// 新增: 按时间段查询付费用户数和付费金额，付费金额按首次订阅和续订拆分
+func (s *DatabaseService) GetPaymentStatsByTimeRange(ctx context.Context, start, end time.Time) (*TimeRangeStats, error) {
+	// 一次查询得到期间内的付费用户数、付费总额及首次订阅和续订的金额拆分
+	query := `SELECT COUNT(DISTINCT user_id),
+                     COALESCE(SUM(amount), 0),
+                     COALESCE(SUM(CASE WHEN type = 'initial' THEN amount ELSE 0 END), 0),
+                     COALESCE(SUM(CASE WHEN type = 'renewal' THEN amount ELSE 0 END), 0)
+              FROM payments
+              WHERE payment_date >= ? AND payment_date <= ? AND status = 'success'`
+
+	stats := &TimeRangeStats{StartTime: start, EndTime: end}
+	err := s.db.QueryRowContext(ctx, query, start, end).Scan(
+		&stats.PaidUsers,
+		&stats.TotalPayments,
+		&stats.InitialPayments,
+		&stats.RenewalPayments,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("查询时间段内付费统计失败: %w", err)
+	}
+
+	return stats, nil
+}
+
+// 按套餐统计时间段内的退款金额（正数），套餐取退款所属订阅的当前套餐
+func (s *DatabaseService) GetRefundsByPlan(ctx context.Context, start, end time.Time) (map[string]float64, error) {
+	query := `SELECT s.plan, COALESCE(SUM(-p.amount), 0)
+              FROM payments p
+              JOIN subscriptions s ON s.id = p.subscription_id
+              WHERE p.type = 'refund' AND p.status = 'success'
+              AND p.payment_date >= ? AND p.payment_date <= ?
+              GROUP BY s.plan`
+
+	rows, err := s.db.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("按套餐查询退款金额失败: %w", err)
+	}
+	defer rows.Close()
+
+	byPlan := make(map[string]float64)
+	for rows.Next() {
+		var plan string
+		var amount float64
+		if err := rows.Scan(&plan, &amount); err != nil {
+			return nil, fmt.Errorf("解析套餐退款金额失败: %w", err)
+		}
+		byPlan[plan] = amount
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历套餐退款金额失败: %w", err)
+	}
+
+	return byPlan, nil
+}
+
+// 统计时间段内注册的用户到达漏斗各阶段的人数，阶段事件同样需发生在时间段内
+func (s *DatabaseService) GetConversionFunnel(ctx context.Context, start, end time.Time) (*Funnel, error) {
+	query := `SELECT COUNT(DISTINCT u.id),
+                     COUNT(DISTINCT t.user_id),
+                     COUNT(DISTINCT a.user_id),
+                     COUNT(DISTINCT CASE WHEN t.user_id IS NOT NULL THEN a.user_id END),
+                     COUNT(DISTINCT r.user_id)
+              FROM users u
+              LEFT JOIN subscription_events t
+                  ON t.user_id = u.id AND t.event_type = ? AND t.created_at <= ?
+              LEFT JOIN payments a
+                  ON a.user_id = u.id AND a.type = 'initial' AND a.status = 'success' AND a.payment_date <= ?
+              LEFT JOIN payments r
+                  ON r.user_id = u.id AND r.type = 'renewal' AND r.status = 'success' AND r.payment_date <= ?
+              WHERE u.created_at >= ? AND u.created_at <= ?`
+
+	funnel := &Funnel{StartTime: start, EndTime: end}
+	err := s.db.QueryRowContext(ctx, query, EventTrialStart, end, end, end, start, end).Scan(
+		&funnel.Users,
+		&funnel.Trials,
+		&funnel.Activated,
+		&funnel.TrialActivated,
+		&funnel.Renewed,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("查询转化漏斗失败: %w", err)
+	}
+
+	return funnel, nil
+}
+
+// 汇总 [start, end) 内的成功支付，生成月度结账报表的各项金额和笔数
+func (s *DatabaseService) GetMonthlyReport(ctx context.Context, start, end time.Time) (*MonthlyReport, error) {
+	query := `SELECT COALESCE(SUM(CASE WHEN type = 'initial' THEN 1 ELSE 0 END), 0),
+                     COALESCE(SUM(CASE WHEN type = 'initial' THEN amount ELSE 0 END), 0),
+                     COALESCE(SUM(CASE WHEN type = 'renewal' THEN 1 ELSE 0 END), 0),
+                     COALESCE(SUM(CASE WHEN type = 'renewal' THEN amount ELSE 0 END), 0),
+                     COALESCE(SUM(CASE WHEN type = 'refund' THEN 1 ELSE 0 END), 0),
+                     COALESCE(SUM(CASE WHEN type = 'refund' THEN -amount ELSE 0 END), 0),
+                     COALESCE(SUM(amount), 0)
+              FROM payments
+              WHERE status = 'success' AND payment_date >= ? AND payment_date < ?`
+
+	var report MonthlyReport
+	err := s.db.QueryRowContext(ctx, query, start, end).Scan(
+		&report.NewSubscriptions, &report.NewRevenue,
+		&report.Renewals, &report.RenewalRevenue,
+		&report.Refunds, &report.RefundAmount,
+		&report.NetRevenue,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("查询月度报表失败: %w", err)
+	}
+
+	return &report, nil
+}
+
+// 按天统计 [start, end] 内注册的用户数，只返回有注册的日期
+func (s *DatabaseService) GetNewUserCounts(ctx context.Context, start, end time.Time) ([]DailyCount, error) {
+	query := `SELECT DATE(created_at), COUNT(*)
+              FROM users
+              WHERE created_at >= ? AND created_at <= ?
+              GROUP BY DATE(created_at)
+              ORDER BY DATE(created_at)`
+
+	rows, err := s.db.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("查询每日新用户数失败: %w", err)
+	}
+	defer rows.Close()
+
+	var counts []DailyCount
+	for rows.Next() {
+		var day sqlDate
+		var count DailyCount
+		if err := rows.Scan(&day, &count.Count); err != nil {
+			return nil, fmt.Errorf("解析每日新用户数失败: %w", err)
+		}
+		count.Date = day.Format("2006-01-02")
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("查询每日新用户数失败: %w", err)
+	}
+
+	return counts, nil
+}
+
+// 按月汇总 [start, end] 内的成功支付，首次订阅和续订分开统计，只返回有支付的月份
+func (s *DatabaseService) GetMonthlyRevenueSeries(ctx context.Context, start, end time.Time) ([]MonthlyRevenue, error) {
+	year, month := s.dialect.year("payment_date"), s.dialect.month("payment_date")
+	query := `SELECT ` + year + `, ` + month + `,
+                     COALESCE(SUM(CASE WHEN type = 'initial' THEN amount ELSE 0 END), 0),
+                     COALESCE(SUM(CASE WHEN type = 'renewal' THEN amount ELSE 0 END), 0),
+                     COALESCE(SUM(CASE WHEN type NOT IN ('initial', 'renewal') THEN amount ELSE 0 END), 0),
+                     COALESCE(SUM(amount), 0)
+              FROM payments
+              WHERE status = 'success' AND payment_date >= ? AND payment_date <= ?
+              GROUP BY ` + year + `, ` + month + `
+              ORDER BY ` + year + `, ` + month
+
+	rows, err := s.db.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("查询月度收入失败: %w", err)
+	}
+	defer rows.Close()
+
+	var series []MonthlyRevenue
+	for rows.Next() {
+		var year, month int
+		var revenue MonthlyRevenue
+		if err := rows.Scan(&year, &month, &revenue.Initial, &revenue.Renewal, &revenue.Other, &revenue.Total); err != nil {
+			return nil, fmt.Errorf("解析月度收入失败: %w", err)
+		}
+		revenue.Month = fmt.Sprintf("%04d-%02d", year, month)
+		series = append(series, revenue)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("查询月度收入失败: %w", err)
+	}
+
+	return series, nil
+}
+
+// 获取 [start, end] 内激活的订阅从激活到首次做出续订决定的平均时长
+// 激活时间为首次订阅支付时间，决定时间为其后最早的续约或取消续订事件，尚未做出决定的订阅不计入
+// 续约的扣款可能推迟到新周期开始或重试成功时，扣款时间不代表用户做出决定的时间
+func (s *DatabaseService) GetAvgTimeToDecision(ctx context.Context, start, end time.Time) (time.Duration, error) {
+	query := `SELECT a.activated_at, MIN(d.decided_at)
+              FROM (
+                  SELECT subscription_id, MIN(payment_date) AS activated_at
+                  FROM payments WHERE type = 'initial' AND status = 'success'
+                  GROUP BY subscription_id
+              ) a
+              JOIN (
+                  SELECT subscription_id, created_at AS decided_at
+                  FROM subscription_events WHERE event_type IN (?, ?)
+              ) d ON d.subscription_id = a.subscription_id AND d.decided_at >= a.activated_at
+              WHERE a.activated_at >= ? AND a.activated_at <= ?
+              GROUP BY a.subscription_id, a.activated_at`
+
+	rows, err := s.db.QueryContext(ctx, query, EventRenewal, EventCancellation, start, end)
+	if err != nil {
+		return 0, fmt.Errorf("查询续订决定时长失败: %w", err)
+	}
+	defer rows.Close()
+
+	var total time.Duration
+	count := 0
+	for rows.Next() {
+		var activatedAt, decidedAt time.Time
+		if err := rows.Scan(&activatedAt, &decidedAt); err != nil {
+			return 0, fmt.Errorf("解析续订决定时长失败: %w", err)
+		}
+		total += decidedAt.Sub(activatedAt)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("查询续订决定时长失败: %w", err)
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+	return total / time.Duration(count), nil
+}
+
+// 预测 [monthStart, monthEnd) 内的续订收入：到期日落在该区间、仍在订阅中且未拒绝续订的订阅
+// 下次扣款日即当前 end_date，金额按该订阅最近一次首次订阅或续订支付计算，
+// 没有支付记录时按 prices 中该套餐的价格，套餐不在 prices 中时按 defaultAmount
+func (s *DatabaseService) GetProjectedRevenue(ctx context.Context, monthStart, monthEnd time.Time, prices map[string]float64, defaultAmount float64) (float64, error) {
+	// 按套餐取价格的 CASE 表达式，套餐按名称排序使查询语句保持稳定
+	listPrice := "?"
+	var args []any
+	if len(prices) > 0 {
+		var cases strings.Builder
+		cases.WriteString("CASE s.plan")
+		for _, plan := range slices.Sorted(maps.Keys(prices)) {
+			cases.WriteString(" WHEN ? THEN ?")
+			args = append(args, plan, prices[plan])
+		}
+		cases.WriteString(" ELSE ? END")
+		listPrice = cases.String()
+	}
+	args = append(args, defaultAmount, StatusSubscribed, StatusRenewed, monthStart, monthEnd)
+
+	query := `SELECT COALESCE(SUM(COALESCE(
+                  (SELECT p.amount FROM payments p
+                   WHERE p.subscription_id = s.id AND p.status = 'success' AND p.type IN ('initial', 'renewal')
+                   ORDER BY p.payment_date DESC, p.id DESC LIMIT 1),
+                  ` + listPrice + `)), 0)
+              FROM subscriptions s
+              WHERE s.status IN (?, ?)
+              AND s.renewal_preference IN ('yes', 'undecided')
+              AND s.end_date >= ? AND s.end_date < ?`
+
+	var total float64
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("预测续订收入失败: %w", err)
+	}
+
+	return total, nil
+}
+
+// 获取每个订阅最近一次成功的首次订阅、续订或赠送支付，没有这类支付的订阅不返回
+// 升级差价和退款不代表周期的付费状态，不参与比较
+func (s *DatabaseService) GetSubscriptionPaymentStates(ctx context.Context) ([]SubscriptionPaymentState, error) {
+	query := `SELECT s.id, s.user_id, s.plan, s.start_date, s.end_date, s.status,
+                     p.id, p.type, p.payment_date,
+                     (SELECT COUNT(*) FROM payments r WHERE r.original_payment_id = p.id)
+              FROM subscriptions s
+              JOIN payments p ON p.subscription_id = s.id
+              WHERE p.status = 'success' AND p.type IN ('initial', 'renewal', 'comped')
+              ORDER BY s.id, p.payment_date DESC, p.id DESC`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("查询订阅支付状态失败: %w", err)
+	}
+	defer rows.Close()
+
+	var states []SubscriptionPaymentState
+	for rows.Next() {
+		var state SubscriptionPaymentState
+		var refunds int
+		if err := rows.Scan(&state.ID, &state.UserID, &state.Plan, &state.StartDate, &state.EndDate, &state.Status,
+			&state.PaymentID, &state.PaymentType, &state.PaymentDate, &refunds); err != nil {
+			return nil, fmt.Errorf("读取订阅支付状态失败: %w", err)
+		}
+		// 按支付时间倒序，每个订阅只保留第一行
+		if len(states) > 0 && states[len(states)-1].ID == state.ID {
+			continue
+		}
+		state.Refunded = refunds > 0
+		states = append(states, state)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("查询订阅支付状态失败: %w", err)
+	}
+
+	return states, nil
+}
+
+// 记录定时任务处理失败的订阅
+func (s *DatabaseService) CreateProcessingFailure(failure *ProcessingFailure) (int64, error) {
+	query := `INSERT INTO processing_failures (run_at, subscription_id, error, resolved)
+              VALUES (?, ?, ?, ?)`
+
+	result, err := s.db.Exec(query, failure.RunAt, failure.SubscriptionID, failure.Error, false)
+	if err != nil {
+		return 0, fmt.Errorf("记录处理失败信息失败: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("获取处理失败记录ID失败: %w", err)
+	}
+
+	return id, nil
+}
+
+// 获取未解决的处理失败记录
+func (s *DatabaseService) GetUnresolvedProcessingFailures(ctx context.Context) ([]ProcessingFailure, error) {
+	query := `SELECT id, run_at, subscription_id, error, resolved, resolved_at
+              FROM processing_failures
+              WHERE resolved = false
+              ORDER BY run_at DESC, id DESC`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("获取处理失败记录失败: %w", err)
+	}
+	defer rows.Close()
+
+	var failures []ProcessingFailure
+	for rows.Next() {
+		var failure ProcessingFailure
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(
+			&failure.ID,
+			&failure.RunAt,
+			&failure.SubscriptionID,
+			&failure.Error,
+			&failure.Resolved,
+			&resolvedAt,
+		); err != nil {
+			return nil, fmt.Errorf("解析处理失败记录失败: %w", err)
+		}
+		if resolvedAt.Valid {
+			failure.ResolvedAt = &resolvedAt.Time
+		}
+		failures = append(failures, failure)
+	}
+
+	return failures, nil
+}
+
+// 将处理失败记录标记为已解决
+func (s *DatabaseService) ResolveProcessingFailure(ctx context.Context, id int64) error {
+	query := `UPDATE processing_failures SET resolved = true, resolved_at = ?
+              WHERE id = ? AND resolved = false`
+
+	result, err := s.db.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("更新处理失败记录失败: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取影响行数失败: %w", err)
+	}
+	if affected == 0 {
+		return errors.New("处理失败记录不存在或已解决")
+	}
+
+	return nil
+}
+
+// 记录订阅事件
+func (s *DatabaseService) CreateSubscriptionEvent(ctx context.Context, event *SubscriptionEvent) error {
+	query := `INSERT INTO subscription_events (subscription_id, user_id, event_type, detail, created_at)
+              VALUES (?, ?, ?, ?, ?)`
 
-	var userCount int
-	err := s.db.QueryRow(userQuery, start, end).Scan(&userCount)
+	_, err := s.db.ExecContext(ctx, query, event.SubscriptionID, event.UserID, event.EventType, event.Detail, event.CreatedAt)
 	if err != nil {
-		return nil, fmt.Errorf("查询时间段内付费用户数失败: %w", err)
+		return fmt.Errorf("记录订阅事件失败: %w", err)
+	}
+
+	return nil
+}
+
+// 获取全系统最近的动态：注册、激活、续订、取消和退款按时间倒序合并
+func (s *DatabaseService) GetRecentActivity(ctx context.Context, limit int) ([]ActivityEvent, error) {
+	query := `SELECT event_type, user_id, subscription_id, amount, occurred_at FROM (
+                  SELECT ? AS event_type, id AS user_id, 0 AS subscription_id, 0 AS amount, created_at AS occurred_at
+                  FROM users
+                  UNION ALL
+                  SELECT CASE type WHEN 'initial' THEN ? ELSE type END, user_id, subscription_id, amount, payment_date
+                  FROM payments WHERE status = 'success'
+                  UNION ALL
+                  SELECT event_type, user_id, subscription_id, 0, created_at
+                  FROM subscription_events WHERE event_type = ?
+              ) activity
+              ORDER BY occurred_at DESC
+              LIMIT ?`
+
+	rows, err := s.db.QueryContext(ctx, query, EventSignup, EventActivation, EventCancellation, limit)
+	if err != nil {
+		return nil, fmt.Errorf("获取系统动态失败: %w", err)
+	}
+	defer rows.Close()
+
+	var events []ActivityEvent
+	for rows.Next() {
+		var event ActivityEvent
+		if err := rows.Scan(
+			&event.Type,
+			&event.UserID,
+			&event.SubscriptionID,
+			&event.Amount,
+			&event.OccurredAt,
+		); err != nil {
+			return nil, fmt.Errorf("解析系统动态失败: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// 获取数据库中保存的运行时设置
+func (s *DatabaseService) GetSettings(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, value FROM settings`)
+	if err != nil {
+		return nil, fmt.Errorf("获取设置失败: %w", err)
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("解析设置失败: %w", err)
+		}
+		settings[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历设置失败: %w", err)
 	}
 
-	// 查询期间内的付费总金额
-	amountQuery := `SELECT COALESCE(SUM(amount), 0) FROM payments 
-                    WHERE payment_date >= ? AND payment_date <= ? AND status = 'success'`
+	return settings, nil
+}
 
-	var totalAmount float64
-	err = s.db.QueryRow(amountQuery, start, end).Scan(&totalAmount)
+// 在一个事务中保存多项运行时设置
+func (s *DatabaseService) SaveSettings(ctx context.Context, settings map[string]string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("查询时间段内付费总额失败: %w", err)
+		return fmt.Errorf("开始事务失败: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := s.dialect.upsert(`INSERT INTO settings (name, value, updated_at) VALUES (?, ?, ?)`,
+		"name", "value", "updated_at")
+	for name, value := range settings {
+		_, err := tx.ExecContext(ctx, query, name, value, time.Now())
+		if err != nil {
+			return fmt.Errorf("保存设置 %s 失败: %w", name, err)
+		}
 	}
 
-	return &TimeRangeStats{
-		PaidUsers:     userCount,
-		TotalPayments: totalAmount,
-		StartTime:     start,
-		EndTime:       end,
-	}, nil
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交设置失败: %w", err)
+	}
+	return nil
 }
 
 // BeginTx 开始事务
-func (s *DatabaseService) BeginTx() (*sql.Tx, error) {
-	return s.db.Begin()
+func (s *DatabaseService) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	return s.db.BeginTx(ctx, nil)
 }
 
-// Close 关闭数据库连接
+// ForUpdate 为事务内的查询加上行锁，语法由数据库方言决定
+func (s *DatabaseService) ForUpdate(query string) string {
+	return s.dialect.forUpdate(query)
+}
+
+// normalizeDSN 统一以UTC读写时间：开启parseTime并将loc固定为UTC，
+// 同时把会话时区设为UTC，使 NOW()、CURDATE() 等服务器端时间函数与Go端写入的时间一致
+// statementTimeout 大于0时为每个连接设置会话级 max_execution_time，由服务器终止超时的查询
+func normalizeDSN(dsn string, statementTimeout time.Duration) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", fmt.Errorf("数据库DSN格式错误: %w", err)
+	}
+
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	if statementTimeout > 0 {
+		cfg.Params["max_execution_time"] = strconv.FormatInt(statementTimeout.Milliseconds(), 10)
+	}
+
+	return cfg.FormatDSN(), nil
+}
+
+// monthStartUTC 返回 t 所在月份第一天的UTC零点
+func monthStartUTC(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// HealthCheck 检查数据库是否可达
+// 连接池在数据库恢复后会自动建立新连接，这里只负责探测当前状态
+func (s *DatabaseService) HealthCheck(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close 停止连接保活并关闭数据库连接，重复调用时返回第一次关闭的结果
 func (s *DatabaseService) Close() error {
-	return s.db.Close()
+	s.closeOnce.Do(func() {
+		if s.stopKeepalive != nil {
+			close(s.stopKeepalive)
+		}
+		s.closeErr = s.db.Close()
+	})
+	return s.closeErr
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLite DSN 前缀：DATABASE_DSN 以此开头时使用 SQLite 后端，例如 "sqlite::memory:" 或 "sqlite:/tmp/subs.db"
+// SQLite 后端用于测试模式和本地开发，不需要外部数据库
+const sqliteDSNPrefix = "sqlite:"
+
+// 内存数据库的路径
+const sqliteMemoryPath = ":memory:"
+
+// 等待其他连接释放写锁的时间
+const sqliteBusyTimeout = 5 * time.Second
+
+//go:embed subs_sqlite.sql
+var sqliteSchema string
+
+// 内存数据库序号，每次打开都得到一个独立的数据库
+var sqliteMemorySeq atomic.Int64
+
+// sqlDialect 数据库方言，屏蔽 MySQL 与 SQLite 在语法上的差异
+type sqlDialect int
+
+const (
+	dialectMySQL sqlDialect = iota
+	dialectSQLite
+)
+
+// forUpdate 为事务内的查询加上行锁
+// SQLite 的写事务本身互斥，不支持也不需要 FOR UPDATE
+func (d sqlDialect) forUpdate(query string) string {
+	if d == dialectSQLite {
+		return query
+	}
+	return query + " FOR UPDATE"
+}
+
+// upsert 在 insert 语句后追加主键冲突时更新 columns 的子句，key 为冲突的主键列
+func (d sqlDialect) upsert(insert, key string, columns ...string) string {
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		if d == dialectSQLite {
+			assignments[i] = column + " = excluded." + column
+		} else {
+			assignments[i] = column + " = VALUES(" + column + ")"
+		}
+	}
+
+	if d == dialectSQLite {
+		return insert + " ON CONFLICT(" + key + ") DO UPDATE SET " + strings.Join(assignments, ", ")
+	}
+	return insert + " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+}
+
+// year 返回取 column 年份的表达式
+func (d sqlDialect) year(column string) string {
+	if d == dialectSQLite {
+		return "CAST(strftime('%Y', " + column + ") AS INTEGER)"
+	}
+	return "YEAR(" + column + ")"
+}
+
+// month 返回取 column 月份的表达式
+func (d sqlDialect) month(column string) string {
+	if d == dialectSQLite {
+		return "CAST(strftime('%m', " + column + ") AS INTEGER)"
+	}
+	return "MONTH(" + column + ")"
+}
+
+// sqlDate 扫描 DATE() 的结果：MySQL 返回时间，SQLite 返回 "2006-01-02" 格式的文本
+type sqlDate struct {
+	time.Time
+}
+
+// Scan 实现 sql.Scanner
+func (d *sqlDate) Scan(src any) error {
+	switch v := src.(type) {
+	case time.Time:
+		d.Time = v
+		return nil
+	case string:
+		return d.parse(v)
+	case []byte:
+		return d.parse(string(v))
+	default:
+		return fmt.Errorf("无法将 %T 解析为日期", src)
+	}
+}
+
+func (d *sqlDate) parse(value string) error {
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return fmt.Errorf("日期格式错误: %w", err)
+	}
+	d.Time = t
+	return nil
+}
+
+// isSQLiteDSN 判断 DSN 是否指定了 SQLite 后端
+func isSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, sqliteDSNPrefix)
+}
+
+// newSQLiteDatabaseService 打开 SQLite 数据库并创建表结构
+// 路径为 ":memory:" 时使用进程内的内存数据库，关闭后数据即丢失
+func newSQLiteDatabaseService(dsn string, statementTimeout time.Duration) (*DatabaseService, error) {
+	path := strings.TrimPrefix(dsn, sqliteDSNPrefix)
+	if path == "" {
+		return nil, errors.New("SQLite数据库路径不能为空")
+	}
+
+	// memdb 允许多个连接共享同一个内存数据库，普通的 :memory: 每个连接各自独立
+	name := "file:" + path
+	if path == sqliteMemoryPath {
+		name = fmt.Sprintf("file:/subs-%d?vfs=memdb", sqliteMemorySeq.Add(1))
+	}
+	separator := "?"
+	if strings.Contains(name, "?") {
+		separator = "&"
+	}
+	name += fmt.Sprintf("%s_pragma=busy_timeout(%d)&_time_format=sqlite", separator, sqliteBusyTimeout.Milliseconds())
+
+	db, err := sql.Open("sqlite", name)
+	if err != nil {
+		return nil, fmt.Errorf("数据库连接失败: %w", err)
+	}
+
+	// 内存数据库在最后一个连接关闭时释放，空闲连接不能过期
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+
+	// 先为已有的数据库补齐新增的列，建表语句中为这些列创建的索引才能执行
+	if err := migrateSchema(context.Background(), db, dialectSQLite); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.ExecContext(context.Background(), sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("创建数据库表结构失败: %w", err)
+	}
+
+	return &DatabaseService{
+		db:      retryDB{DB: db, statementTimeout: statementTimeout},
+		dialect: dialectSQLite,
+	}, nil
+}
+
+// isSQLiteUniqueViolation 判断错误是否为 SQLite 唯一约束冲突
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// 续订扣款失败后的重试规则：每天重试一次，最多重试3次，仍失败时结束订阅
+const (
+	dunningRetryInterval = 24 * time.Hour
+	dunningMaxRetries    = 3
+)
+
+// RenewalCharger 续订扣款渠道，新周期按套餐价格扣款时调用
+// idempotencyKey 标识一次扣款，渠道对相同的 key 只扣款一次，重复调用返回第一次的结果
+type RenewalCharger interface {
+	Charge(ctx context.Context, userID, subscriptionID int64, amount float64, idempotencyKey string) error
+}
+
+// offlineCharger 未接入扣款渠道时使用，扣款总是成功，只由系统记录支付
+type offlineCharger struct{}
+
+func (offlineCharger) Charge(ctx context.Context, userID, subscriptionID int64, amount float64, idempotencyKey string) error {
+	return nil
+}
+
+// renewalChargeKey 返回待确认的续订支付对应的扣款幂等键
+func renewalChargeKey(paymentID int64) string {
+	return fmt.Sprintf("renewal-payment-%d", paymentID)
+}
+
+// renewalAmount 返回订阅进入新周期时的扣款金额和支付原因
+// 套餐不在目录中时与手动续订一样按 unknown_plan_policy 处理：拒绝时返回 ErrUnknownPlan，后备时按后备价格扣款
+func (s *SubscriptionService) renewalAmount(ctx context.Context, sub Subscription) (float64, string, error) {
+	plan, ok := s.plans[sub.Plan]
+	if !ok {
+		if s.settings.String(SettingUnknownPlanPolicy) != UnknownPlanFallback {
+			log.Printf("订阅 %d 的套餐 %s 不在目录中，拒绝新周期扣款", sub.ID, sub.Plan)
+			return 0, "", fmt.Errorf("%w: %s", ErrUnknownPlan, sub.Plan)
+		}
+		amount := s.settings.Float(SettingFallbackPlanPrice)
+		log.Printf("警告: 订阅 %d 的套餐 %s 不在目录中，新周期按后备价格 %.2f 扣款", sub.ID, sub.Plan, amount)
+		return amount, PaymentReasonPlanFallback, nil
+	}
+
+	previousAmount, err := s.db.GetLastPaymentAmount(ctx, sub.ID)
+	if err != nil {
+		return 0, "", err
+	}
+	return plan.Price, paymentReason(plan.Price, plan.Price, previousAmount), nil
+}
+
+// renewedCycleStart 返回已续约订阅续约时已支付的计费周期的开始时间
+// 续约时到期日顺延了一个计费周期，该周期从到期日往前推一个计费周期开始
+func (s *SubscriptionService) renewedCycleStart(sub Subscription) time.Time {
+	return s.planDuration(sub.Plan).SubtractFrom(sub.EndDate)
+}
+
+// insertRenewalPayment 在事务中记录一笔新周期的续订扣款，返回支付ID
+func insertRenewalPayment(ctx context.Context, tx *sql.Tx, sub Subscription, amount float64, status, reason string, at time.Time) (int64, error) {
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO payments
+        (user_id, subscription_id, amount, payment_date, status, type, reason)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sub.UserID,
+		sub.ID,
+		amount,
+		at,
+		status,
+		"renewal",
+		reason,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("创建续订支付记录失败: %w", err)
+	}
+	paymentID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("获取续订支付ID失败: %w", err)
+	}
+	return paymentID, nil
+}
+
+// claimRenewalCharge 扣款前按读取时的版本占用订阅，并在同一事务中记录一笔待确认的续订支付，返回支付ID
+// 订阅已被其他操作修改或已被并发运行的任务占用时返回 ErrVersionConflict，调用方不应扣款
+func (s *SubscriptionService) claimRenewalCharge(ctx context.Context, sub Subscription, amount float64, reason string, at time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("开始事务失败: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE subscriptions SET version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND version = ?`,
+		sub.ID,
+		sub.Version,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("占用订阅失败: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("占用订阅失败: %w", err)
+	}
+	if affected == 0 {
+		err = fmt.Errorf("%w: 订阅 %d 已被其他操作修改", ErrVersionConflict, sub.ID)
+		return 0, err
+	}
+
+	paymentID, err := insertRenewalPayment(ctx, tx, sub, amount, StatusPending, reason, at)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("提交事务失败: %w", err)
+	}
+	return paymentID, nil
+}
+
+// settleRenewalCharge 按扣款结果在同一事务中更新待确认的续订支付和订阅，update 按占用后的版本更新订阅
+// 扣款已经发生，订阅在此期间被其他操作修改时仍提交支付结果，并返回 ErrVersionConflict 以便记录排查
+func (s *SubscriptionService) settleRenewalCharge(ctx context.Context, subscriptionID, paymentID int64, paymentStatus, update string, args ...any) error {
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx, `UPDATE payments SET status = ? WHERE id = ? AND status = ?`,
+		paymentStatus, paymentID, StatusPending)
+	if err != nil {
+		return fmt.Errorf("更新续订支付状态失败: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("更新续订支付状态失败: %w", err)
+	}
+	if affected == 0 {
+		err = fmt.Errorf("%w: %d", ErrPaymentNotPending, paymentID)
+		return err
+	}
+
+	if result, err = tx.ExecContext(ctx, update, args...); err != nil {
+		return fmt.Errorf("更新订阅扣款状态失败: %w", err)
+	}
+	if affected, err = result.RowsAffected(); err != nil {
+		return fmt.Errorf("更新订阅扣款状态失败: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: 订阅 %d 在扣款期间被修改，支付 %d 已记录为 %s", ErrVersionConflict, subscriptionID, paymentID, paymentStatus)
+	}
+	return nil
+}
+
+// chargeRenewedCycle charge 方式下已续约订阅进入新周期：先占用订阅并记录待确认的续订支付，再按套餐价格扣款，
+// 扣款成功时进入续约的周期，失败时转为扣款失败状态，由 ProcessPastDueSubscriptions 重试
+func (s *SubscriptionService) chargeRenewedCycle(ctx context.Context, sub Subscription, newStart, runAt time.Time) error {
+	amount, reason, err := s.renewalAmount(ctx, sub)
+	if err != nil {
+		return err
+	}
+	paymentID, err := s.claimRenewalCharge(ctx, sub, amount, reason, runAt)
+	if err != nil {
+		return err
+	}
+	claimed := sub.Version + 1
+
+	if chargeErr := s.charger.Charge(ctx, sub.UserID, sub.ID, amount, renewalChargeKey(paymentID)); chargeErr != nil {
+		log.Printf("订阅 %d 新周期扣款失败: %v", sub.ID, chargeErr)
+		return s.startDunning(ctx, sub, claimed, paymentID, runAt)
+	}
+
+	err = s.settleRenewalCharge(ctx, sub.ID, paymentID, StatusSuccess,
+		`UPDATE subscriptions
+    SET start_date = ?, status = ?, notification_sent = ?, renewal_preference = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND version = ?`,
+		newStart,
+		StatusSubscribed,
+		false,
+		"undecided",
+		sub.ID,
+		claimed,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("订阅 %d 新周期扣款成功，状态从已续约更新为已订阅，进入新周期 %s - %s",
+		sub.ID, newStart.Format("2006-01-02"), sub.EndDate.Format("2006-01-02"))
+	return nil
+}
+
+// startDunning 已续约订阅进入新周期扣款失败：将待确认的续订支付记为失败，订阅转为扣款失败状态等待重试，并提醒用户
+// 订阅的日期保持不变，重试成功后进入续约的周期
+func (s *SubscriptionService) startDunning(ctx context.Context, sub Subscription, version int, paymentID int64, runAt time.Time) error {
+	err := s.settleRenewalCharge(ctx, sub.ID, paymentID, StatusFailed,
+		`UPDATE subscriptions
+    SET status = ?, dunning_attempts = ?, dunning_last_at = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND version = ?`,
+		StatusPastDue,
+		1,
+		runAt,
+		sub.ID,
+		version,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("订阅 %d 续订扣款失败，转为扣款失败状态，%v 后重试", sub.ID, dunningRetryInterval)
+	// 扣款失败状态不计入活跃订阅
+	s.cache.apply(statsDelta{
+		activeByPlan:   map[string]int{sub.Plan: -1},
+		failedPayments: 1,
+	})
+	s.notifyAsync("payment_failed", sub.UserID, sub.ID)
+	return nil
+}
+
+// ProcessPastDueSubscriptions 重试已到重试时间的续订扣款
+// 扣款成功的订阅进入续约的周期；失败时记录失败的支付并提醒用户，重试次数用完后订阅结束
+func (s *SubscriptionService) ProcessPastDueSubscriptions() {
+	log.Printf("开始重试续订扣款失败的订阅")
+
+	ctx := context.Background()
+	runAt := s.clock.Now()
+	subscriptions, err := s.db.GetPastDueSubscriptions(ctx, runAt.Add(-dunningRetryInterval))
+	if err != nil {
+		log.Printf("获取扣款失败的订阅失败: %v", err)
+		return
+	}
+
+	log.Printf("找到 %d 个需要重试扣款的订阅", len(subscriptions))
+
+	for _, sub := range subscriptions {
+		if err := s.retryPastDue(ctx, sub, runAt); err != nil {
+			log.Printf("重试订阅 %d 的续订扣款失败: %v", sub.ID, err)
+			s.recordProcessingFailure(runAt, sub.ID, err)
+		}
+	}
+
+	if len(subscriptions) > 0 {
+		if err := s.cache.refreshCache(); err != nil {
+			log.Printf("刷新缓存失败: %v", err)
+		}
+	}
+}
+
+// retryPastDue 重试一个订阅的续订扣款：先按读取时的版本占用订阅并记录待确认的支付，再扣款并按结果更新订阅和支付
+// 期间订阅被其他操作修改或被并发运行的任务占用时放弃本次重试，不扣款
+func (s *SubscriptionService) retryPastDue(ctx context.Context, sub PastDueSubscription, runAt time.Time) error {
+	amount, reason, err := s.renewalAmount(ctx, sub.Subscription)
+	if err != nil {
+		return err
+	}
+
+	paymentID, err := s.claimRenewalCharge(ctx, sub.Subscription, amount, reason, runAt)
+	if errors.Is(err, ErrVersionConflict) {
+		log.Printf("订阅 %d 在重试扣款前被修改，跳过本次重试", sub.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	claimed := sub.Version + 1
+
+	chargeErr := s.charger.Charge(ctx, sub.UserID, sub.ID, amount, renewalChargeKey(paymentID))
+	attempts := sub.DunningAttempts + 1
+	exhausted := attempts-1 >= dunningMaxRetries // 第一次失败之后的扣款都是重试
+
+	newStart := s.renewedCycleStart(sub.Subscription)
+	status := StatusFailed
+	switch {
+	case chargeErr == nil:
+		status = StatusSuccess
+		err = s.settleRenewalCharge(ctx, sub.ID, paymentID, status,
+			`UPDATE subscriptions
+    SET start_date = ?, status = ?, notification_sent = ?, renewal_preference = ?,
+        dunning_attempts = 0, dunning_last_at = NULL, version = version + 1, updated_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND version = ?`,
+			newStart,
+			StatusSubscribed,
+			false,
+			"undecided",
+			sub.ID,
+			claimed,
+		)
+	case exhausted:
+		err = s.settleRenewalCharge(ctx, sub.ID, paymentID, status,
+			`UPDATE subscriptions
+    SET status = ?, dunning_attempts = ?, dunning_last_at = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND version = ?`,
+			StatusInactive,
+			attempts,
+			runAt,
+			sub.ID,
+			claimed,
+		)
+	default:
+		err = s.settleRenewalCharge(ctx, sub.ID, paymentID, status,
+			`UPDATE subscriptions
+    SET dunning_attempts = ?, dunning_last_at = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND version = ?`,
+			attempts,
+			runAt,
+			sub.ID,
+			claimed,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case chargeErr == nil:
+		log.Printf("订阅 %d 第 %d 次扣款成功，进入新周期 %s - %s",
+			sub.ID, attempts, newStart.Format("2006-01-02"), sub.EndDate.Format("2006-01-02"))
+		s.cache.apply(statsDelta{activeByPlan: map[string]int{sub.Plan: 1}})
+	case exhausted:
+		log.Printf("订阅 %d 第 %d 次扣款失败，重试次数已用完，订阅结束: %v", sub.ID, attempts, chargeErr)
+		// 进入扣款失败状态时已从活跃订阅中减去，结束时活跃订阅数不变
+		s.cache.apply(statsDelta{failedPayments: 1})
+		s.notifyAsync("subscription_ended", sub.UserID, sub.ID)
+	default:
+		log.Printf("订阅 %d 第 %d 次扣款失败，%v 后重试: %v", sub.ID, attempts, dunningRetryInterval, chargeErr)
+		s.cache.apply(statsDelta{failedPayments: 1})
+		s.notifyAsync("payment_failed", sub.UserID, sub.ID)
+	}
+	return nil
+}
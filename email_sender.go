@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"strings"
+)
+
+// EmailSender 邮件发送接口
+type EmailSender interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPSender 通过SMTP服务器发送邮件
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// NewSMTPSender 创建SMTP邮件发送器
+func NewSMTPSender(host string, port int, username, password, from string) *SMTPSender {
+	return &SMTPSender{Host: host, Port: port, Username: username, Password: password, From: from}
+}
+
+// Send 发送纯文本邮件
+func (s *SMTPSender) Send(to, subject, body string) error {
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	headers := []string{
+		"From: " + s.From,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	msg := strings.Join(headers, "\r\n") + "\r\n\r\n" + body
+
+	if err := smtp.SendMail(addr, auth, s.From, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("SMTP发送邮件失败: %w", err)
+	}
+
+	return nil
+}
+
+// NoopSender 不实际发送邮件，仅记录日志，用于测试和未配置SMTP的环境
+type NoopSender struct{}
+
+// Send 只记录日志
+func (NoopSender) Send(to, subject, body string) error {
+	log.Printf("[未配置邮件服务] 跳过发送邮件: 收件人=%s, 主题=%s", to, subject)
+	return nil
+}
+
+// newEmailSender 根据配置创建邮件发送器，未配置SMTP时使用 NoopSender
+func newEmailSender(config *Config) EmailSender {
+	if config.SMTPHost == "" {
+		return NoopSender{}
+	}
+	return NewSMTPSender(config.SMTPHost, config.SMTPPort, config.SMTPUsername, config.SMTPPassword, config.SMTPFrom)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// 健康检查状态
+const (
+	HealthHealthy   = "healthy"   // 所有依赖正常
+	HealthDegraded  = "degraded"  // 非关键依赖异常，服务仍可用
+	HealthUnhealthy = "unhealthy" // 关键依赖异常，服务不可用
+)
+
+// 单个依赖的检查超时
+const healthCheckTimeout = 3 * time.Second
+
+// HealthDependency 健康检查依赖项
+type HealthDependency struct {
+	Name     string                          // 依赖名称，例如 database、redis
+	Critical bool                            // 关键依赖异常时整体状态为 unhealthy，否则为 degraded
+	Check    func(ctx context.Context) error // 检查函数，返回nil表示正常
+}
+
+// 单个依赖的检查结果
+type DependencyStatus struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Latency  string `json:"latency"`
+}
+
+// 健康检查报告
+type HealthReport struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+	CheckedAt    time.Time          `json:"checked_at"`
+}
+
+// 后台探测数据库状态的间隔
+const databaseMonitorInterval = 30 * time.Second
+
+// HealthService 按配置的依赖列表执行健康检查
+type HealthService struct {
+	dependencies []HealthDependency
+	dbCheck      func(ctx context.Context) error
+	dbHealthy    bool
+	stopChan     chan struct{}
+}
+
+// NewHealthService 创建健康检查服务，数据库始终作为关键依赖
+// 同时启动后台协程，记录数据库在可用与不可用之间的切换
+func NewHealthService(db *DatabaseService, dependencies []HealthDependency) *HealthService {
+	deps := []HealthDependency{{Name: "database", Critical: true, Check: db.HealthCheck}}
+	deps = append(deps, dependencies...)
+
+	h := &HealthService{
+		dependencies: deps,
+		dbCheck:      db.HealthCheck,
+		dbHealthy:    true,
+		stopChan:     make(chan struct{}),
+	}
+
+	go h.monitorDatabase()
+
+	return h
+}
+
+// monitorDatabase 定期探测数据库状态
+func (h *HealthService) monitorDatabase() {
+	ticker := time.NewTicker(databaseMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.observeDatabase()
+		case <-h.stopChan:
+			return
+		}
+	}
+}
+
+// observeDatabase 探测一次数据库，状态发生变化时记录日志并返回 true
+func (h *HealthService) observeDatabase() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	err := h.dbCheck(ctx)
+	cancel()
+
+	healthy := err == nil
+	if healthy == h.dbHealthy {
+		return false
+	}
+
+	h.dbHealthy = healthy
+	if healthy {
+		log.Printf("数据库已恢复可用")
+	} else {
+		log.Printf("数据库不可用: %v", err)
+	}
+	return true
+}
+
+// Stop 停止后台探测
+func (h *HealthService) Stop() {
+	close(h.stopChan)
+}
+
+// Check 依次检查所有依赖并汇总整体状态
+func (h *HealthService) Check() HealthReport {
+	report := HealthReport{
+		Status:       HealthHealthy,
+		Dependencies: make([]DependencyStatus, 0, len(h.dependencies)),
+		CheckedAt:    time.Now(),
+	}
+
+	for _, dep := range h.dependencies {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		start := time.Now()
+		err := dep.Check(ctx)
+		cancel()
+
+		status := DependencyStatus{
+			Name:     dep.Name,
+			Status:   HealthHealthy,
+			Critical: dep.Critical,
+			Latency:  time.Since(start).String(),
+		}
+
+		if err != nil {
+			log.Printf("依赖 %s 健康检查失败: %v", dep.Name, err)
+			status.Status = HealthUnhealthy
+			status.Error = err.Error()
+
+			if dep.Critical {
+				report.Status = HealthUnhealthy
+			} else if report.Status == HealthHealthy {
+				report.Status = HealthDegraded
+			}
+		}
+
+		report.Dependencies = append(report.Dependencies, status)
+	}
+
+	return report
+}
@@ -1,14 +1,66 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// writeJSON 先将响应编码到缓冲区再写出，编码失败时还未发送任何内容，可以返回完整的500响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		log.Printf("编码响应失败: %v", err)
+		http.Error(w, "服务器错误", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("写入响应失败: %v", err)
+	}
+}
+
+// 请求体大小上限
+const maxRequestBodyBytes = 1 << 20
+
+// decodeJSONBody 将JSON请求体解析到 dst，请求体超过 maxRequestBodyBytes 或包含未知字段时拒绝
+// 解析失败时写入400响应并返回 false，过大、未知字段和格式错误分别给出不同的提示
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(dst)
+	if err == nil {
+		if decoder.Decode(&struct{}{}) == io.EOF {
+			return true
+		}
+		err = errTrailingJSON
+	}
+
+	var tooLarge *http.MaxBytesError
+	message := "无效的请求数据"
+	switch {
+	case errors.As(err, &tooLarge):
+		message = fmt.Sprintf("请求体过大，不能超过 %d 字节", tooLarge.Limit)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json 没有为未知字段导出错误类型，只能从错误信息中取出字段名
+		message = "请求包含未知字段: " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	}
+	http.Error(w, message, http.StatusBadRequest)
+	log.Printf("解析请求体失败: %v", err)
+	return false
+}
+
 // SubscriptionHandler HTTP处理器
 type SubscriptionHandler struct {
 	service *SubscriptionService
@@ -19,6 +71,18 @@ func NewSubscriptionHandler(service *SubscriptionService) *SubscriptionHandler {
 	return &SubscriptionHandler{service: service}
 }
 
+// RequireFeature 功能开关 flag 关闭时接口返回404，开关在运行时设置中修改，每个请求都重新检查
+func (h *SubscriptionHandler) RequireFeature(flag string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.service.FeatureEnabled(flag) {
+			http.NotFound(w, r)
+			log.Printf("功能 %s 已关闭，拒绝请求: %s %s", flag, r.Method, r.URL.Path)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // HandleUserSubscriptions 处理用户订阅查询请求
 func (h *SubscriptionHandler) HandleUserSubscriptions(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -30,34 +94,181 @@ func (h *SubscriptionHandler) HandleUserSubscriptions(w http.ResponseWriter, r *
 		return
 	}
 
+	userID, ok := parseUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	subscriptions, err := h.service.GetUserSubscriptionInfo(r.Context(), userID)
+	if err != nil {
+		log.Printf("获取用户订阅失败: %v", err)
+		http.Error(w, "获取订阅信息失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, subscriptions)
+
+	log.Printf("处理用户订阅查询请求完成，耗时: %v", time.Since(start))
+}
+
+// parseUserIDParam 解析查询参数中的 user_id，失败时写入400响应并返回 false
+func parseUserIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
 	userIDStr := r.URL.Query().Get("user_id")
 	if userIDStr == "" {
 		http.Error(w, "缺少user_id参数", http.StatusBadRequest)
 		log.Printf("缺少必要参数: user_id")
-		return
+		return 0, false
 	}
 
 	userID, err := strconv.ParseInt(userIDStr, 10, 64)
 	if err != nil {
 		http.Error(w, "user_id格式不正确", http.StatusBadRequest)
 		log.Printf("参数格式错误: user_id=%s", userIDStr)
+		return 0, false
+	}
+
+	return userID, true
+}
+
+// parsePagination 解析分页参数 limit 和 offset：默认20条，最多100条，失败时写入400响应并返回 false
+func parsePagination(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	var err error
+	limit, offset := 20, 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit格式不正确", http.StatusBadRequest)
+			log.Printf("参数格式错误: limit=%s", limitStr)
+			return 0, 0, false
+		}
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset格式不正确", http.StatusBadRequest)
+			log.Printf("参数格式错误: offset=%s", offsetStr)
+			return 0, 0, false
+		}
+	}
+
+	return limit, offset, true
+}
+
+// HandleSubscriptionDetail 处理订阅详情查询请求，支持 include=total_paid
+func (h *SubscriptionHandler) HandleSubscriptionDetail(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到订阅详情查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
 		return
 	}
 
-	subscriptions, err := h.service.GetUserSubscriptionInfo(userID)
+	query := r.URL.Query()
+	subscriptionID, err := strconv.ParseInt(query.Get("subscription_id"), 10, 64)
 	if err != nil {
-		log.Printf("获取用户订阅失败: %v", err)
-		http.Error(w, "获取订阅信息失败", http.StatusInternalServerError)
+		http.Error(w, "subscription_id格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: subscription_id=%s", query.Get("subscription_id"))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(subscriptions); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
+	userID, err := strconv.ParseInt(query.Get("user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "user_id格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: user_id=%s", query.Get("user_id"))
+		return
 	}
 
-	log.Printf("处理用户订阅查询请求完成，耗时: %v", time.Since(start))
+	includeTotalPaid := false
+	for _, include := range strings.Split(query.Get("include"), ",") {
+		if strings.TrimSpace(include) == "total_paid" {
+			includeTotalPaid = true
+		}
+	}
+
+	detail, err := h.service.GetSubscriptionDetail(r.Context(), subscriptionID, userID, includeTotalPaid)
+	if err != nil {
+		log.Printf("获取订阅详情失败: %v", err)
+		if errors.Is(err, ErrSubscriptionNotFound) {
+			http.Error(w, "订阅不存在", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "获取订阅详情失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+
+	log.Printf("处理订阅详情查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleActiveSubscription 处理用户活跃订阅查询请求，没有活跃订阅时返回204
+func (h *SubscriptionHandler) HandleActiveSubscription(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到活跃订阅查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	userID, ok := parseUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	subscription, err := h.service.GetActiveSubscription(r.Context(), userID)
+	if err != nil {
+		log.Printf("获取活跃订阅失败: %v", err)
+		http.Error(w, "获取活跃订阅失败", http.StatusInternalServerError)
+		return
+	}
+	if subscription == nil {
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("用户 %d 没有活跃订阅，耗时: %v", userID, time.Since(start))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, subscription)
+
+	log.Printf("处理活跃订阅查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleEntitlementSnapshot 处理用户权益快照查询请求
+func (h *SubscriptionHandler) HandleEntitlementSnapshot(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到权益快照查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	userID, ok := parseUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	snapshot, err := h.service.GetEntitlementSnapshot(r.Context(), userID)
+	if err != nil {
+		log.Printf("获取权益快照失败: %v", err)
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "获取权益快照失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, snapshot)
+
+	log.Printf("处理权益快照查询请求完成，耗时: %v", time.Since(start))
 }
 
 // HandleUserPayments 处理用户支付记录查询请求
@@ -71,36 +282,100 @@ func (h *SubscriptionHandler) HandleUserPayments(w http.ResponseWriter, r *http.
 		return
 	}
 
-	userIDStr := r.URL.Query().Get("user_id")
-	if userIDStr == "" {
-		http.Error(w, "缺少user_id参数", http.StatusBadRequest)
-		log.Printf("缺少必要参数: user_id")
+	userID, ok := parseUserIDParam(w, r)
+	if !ok {
 		return
 	}
 
-	userID, err := strconv.ParseInt(userIDStr, 10, 64)
-	if err != nil {
-		http.Error(w, "user_id格式不正确", http.StatusBadRequest)
-		log.Printf("参数格式错误: user_id=%s", userIDStr)
+	limit, offset, ok := parsePagination(w, r)
+	if !ok {
 		return
 	}
 
-	payments, err := h.service.GetUserPaymentHistory(userID)
+	page, err := h.service.GetUserPaymentHistory(r.Context(), userID, limit, offset)
 	if err != nil {
 		log.Printf("获取用户支付记录失败: %v", err)
 		http.Error(w, "获取支付记录失败", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(payments); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
-	}
+	writeJSON(w, http.StatusOK, page)
 
 	log.Printf("处理用户支付记录查询请求完成，耗时: %v", time.Since(start))
 }
 
+// 退款引用的最大长度，与 payments.refund_reference 列的长度一致
+const maxRefundReferenceLength = 64
+
+// HandleRefundPayment 处理退款请求
+func (h *SubscriptionHandler) HandleRefundPayment(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到退款请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	// 解析请求体
+	var request RefundRequest
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	if request.UserID <= 0 || request.PaymentID <= 0 {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: user_id或payment_id")
+		return
+	}
+
+	if len(request.RefundReference) > maxRefundReferenceLength {
+		http.Error(w, fmt.Sprintf("refund_reference不能超过%d个字符", maxRefundReferenceLength), http.StatusBadRequest)
+		log.Printf("退款引用过长: %d", len(request.RefundReference))
+		return
+	}
+
+	refund, err := h.service.RefundPayment(r.Context(), request.PaymentID, request.UserID, request.RefundReference)
+	if err != nil {
+		log.Printf("退款失败: %v", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrWithinCommitment) || errors.Is(err, ErrAlreadyRefunded) || errors.Is(err, ErrRefundReferenceConflict) {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("退款失败: %v", err), status)
+		return
+	}
+
+	response := map[string]interface{}{
+		"message": "退款成功",
+		"refund":  refund,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理退款请求完成，耗时: %v", time.Since(start))
+}
+
+// statsETag 根据统计快照的刷新时间生成 ETag，缓存未刷新时保持不变
+func statsETag(resource string, lastUpdated time.Time) string {
+	return fmt.Sprintf(`"%s-%d"`, resource, lastUpdated.UnixNano())
+}
+
+// notModified 设置 ETag 响应头，请求的 If-None-Match 与之匹配时写出304并返回 true
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
 // HandleSystemStats 处理系统统计信息查询请求
 func (h *SubscriptionHandler) HandleSystemStats(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -113,13 +388,13 @@ func (h *SubscriptionHandler) HandleSystemStats(w http.ResponseWriter, r *http.R
 	}
 
 	stats := h.service.GetSystemStats()
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(stats); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
+	if notModified(w, r, statsETag("stats", stats.LastUpdated)) {
+		log.Printf("系统统计信息未变化，返回304")
+		return
 	}
 
+	writeJSON(w, http.StatusOK, stats)
+
 	log.Printf("处理系统统计信息查询请求完成，耗时: %v", time.Since(start))
 }
 
@@ -140,16 +415,21 @@ func (h *SubscriptionHandler) HandleCreateUser(w http.ResponseWriter, r *http.Re
 		Email string `json:"email"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "无效的请求数据", http.StatusBadRequest)
-		log.Printf("解析请求体失败: %v", err)
+	if !decodeJSONBody(w, r, &request) {
 		return
 	}
 
-	userID, err := h.service.CreateUser(request.Name, request.Email)
+	userID, err := h.service.CreateUser(r.Context(), request.Name, request.Email)
 	if err != nil {
 		log.Printf("创建用户失败: %v", err)
-		http.Error(w, fmt.Sprintf("创建用户失败: %v", err), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrInvalidProfile):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrDuplicateEmail):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("创建用户失败: %v", err), status)
 		return
 	}
 
@@ -158,22 +438,62 @@ func (h *SubscriptionHandler) HandleCreateUser(w http.ResponseWriter, r *http.Re
 		"message": "用户创建成功",
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
-	}
+	writeJSON(w, http.StatusOK, response)
 
 	log.Printf("处理创建用户请求完成，耗时: %v", time.Since(start))
 }
 
-// HandleActivateSubscription 处理激活订阅请求
-func (h *SubscriptionHandler) HandleActivateSubscription(w http.ResponseWriter, r *http.Request) {
+// HandleUsers 按请求方法分发用户请求：GET 查询用户，POST 创建用户，PATCH 更新用户资料
+func (h *SubscriptionHandler) HandleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.HandleGetUser(w, r)
+	case http.MethodPatch:
+		h.HandleUpdateUser(w, r)
+	default:
+		h.HandleCreateUser(w, r)
+	}
+}
+
+// HandleGetUser 处理查询单个用户请求，用户不存在时返回404
+func (h *SubscriptionHandler) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	log.Printf("收到激活订阅请求: %s %s", r.Method, r.URL.Path)
+	log.Printf("收到用户查询请求: %s %s", r.Method, r.URL.Path)
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	userID, ok := parseUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.service.GetUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("查询用户失败: %v", err)
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "查询用户失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+
+	log.Printf("处理用户查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleUpdateUser 处理更新用户姓名和邮箱的请求，邮箱已被使用时返回409
+func (h *SubscriptionHandler) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到更新用户请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPatch {
+		http.Error(w, "只支持PATCH请求", http.StatusMethodNotAllowed)
 		log.Printf("请求方法不允许: %s", r.Method)
 		return
 	}
@@ -181,45 +501,49 @@ func (h *SubscriptionHandler) HandleActivateSubscription(w http.ResponseWriter,
 	// 解析请求体
 	var request struct {
 		UserID int64  `json:"user_id"`
-		Plan   string `json:"plan"`
+		Name   string `json:"name"`
+		Email  string `json:"email"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "无效的请求数据", http.StatusBadRequest)
-		log.Printf("解析请求体失败: %v", err)
+	if !decodeJSONBody(w, r, &request) {
 		return
 	}
 
-	if request.UserID <= 0 || request.Plan == "" {
+	if request.UserID <= 0 {
 		http.Error(w, "缺少必要参数", http.StatusBadRequest)
-		log.Printf("缺少必要参数: user_id或plan")
+		log.Printf("缺少必要参数: user_id")
 		return
 	}
 
-	err := h.service.ActivateSubscription(request.UserID, request.Plan)
+	err := h.service.UpdateUserProfile(r.Context(), request.UserID, request.Name, request.Email)
 	if err != nil {
-		log.Printf("激活订阅失败: %v", err)
-		http.Error(w, fmt.Sprintf("激活订阅失败: %v", err), http.StatusInternalServerError)
+		log.Printf("更新用户失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrInvalidProfile):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrUserNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrDuplicateEmail):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("更新用户失败: %v", err), status)
 		return
 	}
 
 	response := map[string]string{
-		"message": "订阅激活成功",
+		"message": "用户资料更新成功",
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
-	}
+	writeJSON(w, http.StatusOK, response)
 
-	log.Printf("处理激活订阅请求完成，耗时: %v", time.Since(start))
+	log.Printf("处理更新用户请求完成，耗时: %v", time.Since(start))
 }
 
-// HandleRenewSubscription 处理续订请求
-func (h *SubscriptionHandler) HandleRenewSubscription(w http.ResponseWriter, r *http.Request) {
+// HandleActivateSubscription 处理激活订阅请求
+func (h *SubscriptionHandler) HandleActivateSubscription(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	log.Printf("收到续订请求: %s %s", r.Method, r.URL.Path)
+	log.Printf("收到激活订阅请求: %s %s", r.Method, r.URL.Path)
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
@@ -228,48 +552,57 @@ func (h *SubscriptionHandler) HandleRenewSubscription(w http.ResponseWriter, r *
 	}
 
 	// 解析请求体
-	var request RenewalRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "无效的请求数据", http.StatusBadRequest)
-		log.Printf("解析请求体失败: %v", err)
-		return
+	var request struct {
+		UserID     int64  `json:"user_id"`
+		Plan       string `json:"plan"`
+		CouponCode string `json:"coupon_code"` // 可选的优惠码
 	}
 
-	if request.UserID <= 0 || request.SubscriptionID <= 0 {
-		http.Error(w, "缺少必要参数", http.StatusBadRequest)
-		log.Printf("缺少必要参数: user_id或subscription_id")
+	if !decodeJSONBody(w, r, &request) {
 		return
 	}
 
-	// 设置默认金额（如果请求中没有提供）
-	if request.Amount <= 0 {
-		request.Amount = SubscriptionPrice
+	if request.UserID <= 0 || request.Plan == "" {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: user_id或plan")
+		return
 	}
 
-	err := h.service.RenewSubscription(request)
+	err := h.service.ActivateSubscription(r.Context(), request.UserID, request.Plan, request.CouponCode)
 	if err != nil {
-		log.Printf("续订失败: %v", err)
-		http.Error(w, fmt.Sprintf("续订失败: %v", err), http.StatusInternalServerError)
+		log.Printf("激活订阅失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrInvalidCoupon), errors.Is(err, ErrUnknownPlan):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrActivationPending):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("激活订阅失败: %v", err), status)
 		return
 	}
 
 	response := map[string]string{
-		"message": "续订成功",
+		"message": "订阅激活成功",
+		"status":  StatusSubscribed,
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
+	if h.service.PaymentsAsync() {
+		// 支付由网关异步确认，确认成功后订阅才会激活
+		response = map[string]string{
+			"message": "已创建待确认的支付，支付成功后激活订阅",
+			"status":  StatusPending,
+		}
 	}
 
-	log.Printf("处理续订请求完成，耗时: %v", time.Since(start))
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理激活订阅请求完成，耗时: %v", time.Since(start))
 }
 
-// HandleCancelRenewal 处理取消续订请求
-func (h *SubscriptionHandler) HandleCancelRenewal(w http.ResponseWriter, r *http.Request) {
+// HandlePaymentWebhook 处理支付网关的支付结果回调，签名通过 Stripe-Signature 请求头传递
+func (h *SubscriptionHandler) HandlePaymentWebhook(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	log.Printf("收到取消续订请求: %s %s", r.Method, r.URL.Path)
+	log.Printf("收到支付回调请求: %s %s", r.Method, r.URL.Path)
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
@@ -277,54 +610,299 @@ func (h *SubscriptionHandler) HandleCancelRenewal(w http.ResponseWriter, r *http
 		return
 	}
 
-	// 解析请求体
-	var request CancelRenewalRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+	// 签名基于原始请求体计算，需先完整读取
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
 		http.Error(w, "无效的请求数据", http.StatusBadRequest)
-		log.Printf("解析请求体失败: %v", err)
-		return
-	}
-
-	if request.UserID <= 0 || request.SubscriptionID <= 0 {
-		http.Error(w, "缺少必要参数", http.StatusBadRequest)
-		log.Printf("缺少必要参数: user_id或subscription_id")
+		log.Printf("读取请求体失败: %v", err)
 		return
 	}
 
-	err := h.service.CancelRenewal(request)
+	err = h.service.HandlePaymentWebhook(r.Context(), r.Header.Get("Stripe-Signature"), body)
 	if err != nil {
-		log.Printf("取消续订失败: %v", err)
-		http.Error(w, fmt.Sprintf("取消续订失败: %v", err), http.StatusInternalServerError)
+		log.Printf("处理支付回调失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrInvalidSignature):
+			status = http.StatusUnauthorized
+		case errors.Is(err, ErrInvalidWebhookEvent):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrPaymentNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrPaymentNotPending):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("处理支付回调失败: %v", err), status)
 		return
 	}
 
 	response := map[string]string{
-		"message": "取消续订成功",
+		"message": "支付结果已处理",
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
-	}
+	writeJSON(w, http.StatusOK, response)
 
-	log.Printf("处理取消续订请求完成，耗时: %v", time.Since(start))
+	log.Printf("处理支付回调请求完成，耗时: %v", time.Since(start))
 }
 
-// HandleMonthlyStats 处理月度统计查询请求（新增功能）
-func (h *SubscriptionHandler) HandleMonthlyStats(w http.ResponseWriter, r *http.Request) {
+// HandleStartTrial 处理开始试用请求
+func (h *SubscriptionHandler) HandleStartTrial(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	log.Printf("收到月度统计查询请求: %s %s", r.Method, r.URL.Path)
+	log.Printf("收到开始试用请求: %s %s", r.Method, r.URL.Path)
 
-	if r.Method != http.MethodGet {
-		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
 		log.Printf("请求方法不允许: %s", r.Method)
 		return
 	}
 
-	stats := h.service.GetSystemStats()
+	// 解析请求体
+	var request struct {
+		UserID int64  `json:"user_id"`
+		Plan   string `json:"plan"`
+	}
 
-	// 提取运营关注的月度统计数据
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	if request.UserID <= 0 || request.Plan == "" {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: user_id或plan")
+		return
+	}
+
+	err := h.service.StartTrial(r.Context(), request.UserID, request.Plan)
+	if err != nil {
+		log.Printf("开始试用失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrUnknownPlan):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrTrialUsed):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("开始试用失败: %v", err), status)
+		return
+	}
+
+	response := map[string]string{
+		"message": "试用已开始",
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理开始试用请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleRenewSubscription 处理续订请求
+func (h *SubscriptionHandler) HandleRenewSubscription(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到续订请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	// 解析请求体
+	var request RenewalRequest
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	if request.UserID <= 0 || request.SubscriptionID <= 0 {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: user_id或subscription_id")
+		return
+	}
+
+	if request.Amount < 0 {
+		http.Error(w, "续订金额不能为负数", http.StatusBadRequest)
+		log.Printf("续订金额为负数: %.2f", request.Amount)
+		return
+	}
+
+	// 请求中没有提供金额时由服务按套餐的目录价格续订
+	response, err := h.service.RenewSubscription(r.Context(), request)
+	if err != nil {
+		log.Printf("续订失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrSubscriptionNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrInvalidCoupon) || errors.Is(err, ErrInvalidAmount):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrAlreadyRenewed):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("续订失败: %v", err), status)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理续订请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleCancelRenewal 处理取消续订请求
+func (h *SubscriptionHandler) HandleCancelRenewal(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到取消续订请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	// 解析请求体
+	var request CancelRenewalRequest
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	if request.UserID <= 0 || request.SubscriptionID <= 0 {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: user_id或subscription_id")
+		return
+	}
+
+	// immediate=false（默认）：只取消续约，访问保留到当前周期结束，届时由定时任务转为未激活
+	// immediate=true：立即终止访问，可通过 refund=true 按剩余时长比例退款
+	if request.Refund && !request.Immediate {
+		http.Error(w, "只有立即终止时才能退款", http.StatusBadRequest)
+		log.Printf("参数错误: refund=true 但 immediate=false")
+		return
+	}
+
+	err := h.service.CancelRenewal(r.Context(), request)
+	if err != nil {
+		log.Printf("取消续订失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrSubscriptionNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrWithinCommitment):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("取消续订失败: %v", err), status)
+		return
+	}
+
+	message := "取消续订成功"
+	if request.Immediate {
+		message = "订阅已立即终止"
+	}
+	response := map[string]string{
+		"message": message,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理取消续订请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleChangePlan 处理周期中途变更套餐请求
+func (h *SubscriptionHandler) HandleChangePlan(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到套餐变更请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	// 解析请求体
+	var request ChangePlanRequest
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	if request.UserID <= 0 || request.SubscriptionID <= 0 || request.Plan == "" {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: user_id、subscription_id或plan")
+		return
+	}
+
+	err := h.service.ChangePlan(r.Context(), request.UserID, request.SubscriptionID, request.Plan)
+	if err != nil {
+		log.Printf("变更套餐失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrDowngradeMidCycle), errors.Is(err, ErrTransitionNotAllowed), errors.Is(err, ErrUnknownPlan):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrSubscriptionNotFound):
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("变更套餐失败: %v", err), status)
+		return
+	}
+
+	response := map[string]string{
+		"message": "套餐变更成功",
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理套餐变更请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleEligiblePlans 处理可变更套餐查询请求
+func (h *SubscriptionHandler) HandleEligiblePlans(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到可变更套餐查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	userID, ok := parseUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	options, err := h.service.GetEligiblePlanChanges(r.Context(), userID)
+	if err != nil {
+		log.Printf("获取可变更套餐失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrNoActiveSubscription), errors.Is(err, ErrUnknownPlan):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("获取可变更套餐失败: %v", err), status)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, options)
+
+	log.Printf("处理可变更套餐查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleMonthlyStats 处理月度统计查询请求（新增功能）
+func (h *SubscriptionHandler) HandleMonthlyStats(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到月度统计查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	stats := h.service.GetSystemStats()
+	if notModified(w, r, statsETag("monthly-stats", stats.LastUpdated)) {
+		log.Printf("月度统计未变化，返回304")
+		return
+	}
+
+	// 提取运营关注的月度统计数据
 	monthlyStats := map[string]interface{}{
 		"new_subscriptions_month":  stats.NewSubscriptionsMonth,
 		"new_payment_amount_month": stats.NewPaymentAmountMonth,
@@ -333,11 +911,7 @@ func (h *SubscriptionHandler) HandleMonthlyStats(w http.ResponseWriter, r *http.
 		"last_updated":             stats.LastUpdated,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(monthlyStats); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
-	}
+	writeJSON(w, http.StatusOK, monthlyStats)
 
 	log.Printf("处理月度统计查询请求完成，耗时: %v", time.Since(start))
 }
@@ -355,9 +929,7 @@ func (h *SubscriptionHandler) HandleTimeRangeStats(w http.ResponseWriter, r *htt
 
 	// 解析请求体
 	var request TimeRangeQuery
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "无效的请求数据", http.StatusBadRequest)
-		log.Printf("解析请求体失败: %v", err)
+	if !decodeJSONBody(w, r, &request) {
 		return
 	}
 
@@ -374,18 +946,1027 @@ func (h *SubscriptionHandler) HandleTimeRangeStats(w http.ResponseWriter, r *htt
 		return
 	}
 
-	stats, err := h.service.GetPaymentStatsByTimeRange(request)
+	stats, err := h.service.GetPaymentStatsByTimeRange(r.Context(), request)
 	if err != nil {
 		log.Printf("查询时间段统计失败: %v", err)
 		http.Error(w, fmt.Sprintf("查询统计失败: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(stats); err != nil {
-		log.Printf("编码响应失败: %v", err)
-		http.Error(w, "服务器错误", http.StatusInternalServerError)
-	}
+	writeJSON(w, http.StatusOK, stats)
 
 	log.Printf("处理时间段统计查询请求完成，耗时: %v", time.Since(start))
 }
+
+// HandleRevenueSeries 处理月度收入序列查询请求，返回时间段内每个月的收入，没有收入的月份为0
+func (h *SubscriptionHandler) HandleRevenueSeries(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到月度收入序列查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	// 解析请求体
+	var request TimeRangeQuery
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	// 验证时间范围
+	if request.StartTime.IsZero() || request.EndTime.IsZero() {
+		http.Error(w, "开始时间和结束时间不能为空", http.StatusBadRequest)
+		log.Printf("缺少必要参数: start_time或end_time")
+		return
+	}
+
+	if request.EndTime.Before(request.StartTime) {
+		http.Error(w, "结束时间不能早于开始时间", http.StatusBadRequest)
+		log.Printf("参数错误: end_time早于start_time")
+		return
+	}
+
+	series, err := h.service.GetMonthlyRevenueSeries(r.Context(), request.StartTime, request.EndTime)
+	if err != nil {
+		log.Printf("查询月度收入序列失败: %v", err)
+		http.Error(w, "查询月度收入序列失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, series)
+
+	log.Printf("处理月度收入序列查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleNewUserCounts 处理每日新用户数查询请求，start 和 end 为RFC3339格式，没有注册的日期为0
+func (h *SubscriptionHandler) HandleNewUserCounts(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到每日新用户数查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	startTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "start格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: start=%s", r.URL.Query().Get("start"))
+		return
+	}
+
+	endTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, "end格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: end=%s", r.URL.Query().Get("end"))
+		return
+	}
+
+	if endTime.Before(startTime) {
+		http.Error(w, "结束时间不能早于开始时间", http.StatusBadRequest)
+		log.Printf("参数错误: end早于start")
+		return
+	}
+
+	counts, err := h.service.GetNewUserCounts(r.Context(), startTime, endTime)
+	if err != nil {
+		log.Printf("查询每日新用户数失败: %v", err)
+		http.Error(w, "查询每日新用户数失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, counts)
+
+	log.Printf("处理每日新用户数查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleListUsers 分页列出用户及其最近的订阅，status 参数按订阅状态筛选
+func (h *SubscriptionHandler) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到用户列表查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	limit, offset, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := h.service.ListUsers(r.Context(), r.URL.Query().Get("status"), limit, offset)
+	if err != nil {
+		log.Printf("获取用户列表失败: %v", err)
+		http.Error(w, "获取用户列表失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+
+	log.Printf("处理用户列表查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleSearchUsers 处理用户搜索请求，按 q 匹配用户名或邮箱的部分内容，limit 默认25、最大100
+func (h *SubscriptionHandler) HandleSearchUsers(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到用户搜索请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "缺少搜索内容q", http.StatusBadRequest)
+		log.Printf("参数错误: q为空")
+		return
+	}
+
+	limit := defaultUserSearchLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit格式不正确", http.StatusBadRequest)
+			log.Printf("参数格式错误: limit=%s", limitStr)
+			return
+		}
+		limit = min(parsed, 100)
+	}
+
+	users, err := h.service.SearchUsers(r.Context(), query, limit)
+	if err != nil {
+		log.Printf("搜索用户失败: %v", err)
+		http.Error(w, "搜索用户失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, users)
+
+	log.Printf("处理用户搜索请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleConversionFunnel 处理转化漏斗查询请求，start_time 和 end_time 为RFC3339格式
+func (h *SubscriptionHandler) HandleConversionFunnel(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到转化漏斗查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	startTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("start_time"))
+	if err != nil {
+		http.Error(w, "start_time格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: start_time=%s", r.URL.Query().Get("start_time"))
+		return
+	}
+
+	endTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("end_time"))
+	if err != nil {
+		http.Error(w, "end_time格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: end_time=%s", r.URL.Query().Get("end_time"))
+		return
+	}
+
+	if endTime.Before(startTime) {
+		http.Error(w, "结束时间不能早于开始时间", http.StatusBadRequest)
+		log.Printf("参数错误: end_time早于start_time")
+		return
+	}
+
+	funnel, err := h.service.GetConversionFunnel(r.Context(), startTime, endTime)
+	if err != nil {
+		log.Printf("查询转化漏斗失败: %v", err)
+		http.Error(w, "查询转化漏斗失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, funnel)
+
+	log.Printf("处理转化漏斗查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleRefundsByPlan 处理按套餐统计退款金额请求，start_time 和 end_time 为RFC3339格式
+func (h *SubscriptionHandler) HandleRefundsByPlan(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到套餐退款统计请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	startTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("start_time"))
+	if err != nil {
+		http.Error(w, "start_time格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: start_time=%s", r.URL.Query().Get("start_time"))
+		return
+	}
+
+	endTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("end_time"))
+	if err != nil {
+		http.Error(w, "end_time格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: end_time=%s", r.URL.Query().Get("end_time"))
+		return
+	}
+
+	if endTime.Before(startTime) {
+		http.Error(w, "结束时间不能早于开始时间", http.StatusBadRequest)
+		log.Printf("参数错误: end_time早于start_time")
+		return
+	}
+
+	refunds, err := h.service.GetRefundsByPlan(r.Context(), startTime, endTime)
+	if err != nil {
+		log.Printf("查询套餐退款统计失败: %v", err)
+		http.Error(w, "查询套餐退款统计失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"start_time": startTime,
+		"end_time":   endTime,
+		"refunds":    refunds,
+	})
+
+	log.Printf("处理套餐退款统计请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleAvgTimeToDecision 处理平均续订决定时长查询请求
+func (h *SubscriptionHandler) HandleAvgTimeToDecision(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到续订决定时长查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	startTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("start_time"))
+	if err != nil {
+		http.Error(w, "start_time格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: start_time=%s", r.URL.Query().Get("start_time"))
+		return
+	}
+
+	endTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("end_time"))
+	if err != nil {
+		http.Error(w, "end_time格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: end_time=%s", r.URL.Query().Get("end_time"))
+		return
+	}
+
+	if endTime.Before(startTime) {
+		http.Error(w, "结束时间不能早于开始时间", http.StatusBadRequest)
+		log.Printf("参数错误: end_time早于start_time")
+		return
+	}
+
+	avg, err := h.service.GetAvgTimeToDecision(r.Context(), startTime, endTime)
+	if err != nil {
+		log.Printf("查询续订决定时长失败: %v", err)
+		http.Error(w, "查询续订决定时长失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"start_time":  startTime,
+		"end_time":    endTime,
+		"avg_seconds": avg.Seconds(),
+		"avg":         avg.String(),
+	})
+
+	log.Printf("处理续订决定时长查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleProjectedRevenue 处理续订收入预测请求，month 格式为 2006-01，默认下个月
+func (h *SubscriptionHandler) HandleProjectedRevenue(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到续订收入预测请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	month := monthStartUTC(time.Now()).AddDate(0, 1, 0)
+	if monthStr := r.URL.Query().Get("month"); monthStr != "" {
+		parsed, err := time.Parse("2006-01", monthStr)
+		if err != nil {
+			http.Error(w, "month格式不正确，应为YYYY-MM", http.StatusBadRequest)
+			log.Printf("参数格式错误: month=%s", monthStr)
+			return
+		}
+		month = parsed
+	}
+
+	revenue, err := h.service.GetProjectedRevenue(r.Context(), month)
+	if err != nil {
+		log.Printf("预测续订收入失败: %v", err)
+		http.Error(w, "预测续订收入失败", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"month":             month.Format("2006-01"),
+		"projected_revenue": revenue,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理续订收入预测请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleMonthlyReport 处理月度结账报表请求，month 格式为 2006-01，默认上个月
+// format 为 csv 时以附件形式返回CSV，否则返回JSON
+func (h *SubscriptionHandler) HandleMonthlyReport(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到月度报表请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	month := monthStartUTC(time.Now()).AddDate(0, -1, 0)
+	if monthStr := r.URL.Query().Get("month"); monthStr != "" {
+		parsed, err := time.Parse("2006-01", monthStr)
+		if err != nil {
+			http.Error(w, "month格式不正确，应为YYYY-MM", http.StatusBadRequest)
+			log.Printf("参数格式错误: month=%s", monthStr)
+			return
+		}
+		month = parsed
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format只支持json或csv", http.StatusBadRequest)
+		log.Printf("参数错误: format=%s", format)
+		return
+	}
+
+	report, err := h.service.GetMonthlyReport(r.Context(), month)
+	if err != nil {
+		log.Printf("生成月度报表失败: %v", err)
+		http.Error(w, "生成月度报表失败", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="monthly_report_%s.csv"`, report.Month))
+
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"month", "new_subscriptions", "new_revenue", "renewals", "renewal_revenue",
+			"refunds", "refund_amount", "net_revenue"})
+		writer.Write([]string{
+			report.Month,
+			strconv.Itoa(report.NewSubscriptions),
+			strconv.FormatFloat(report.NewRevenue, 'f', 2, 64),
+			strconv.Itoa(report.Renewals),
+			strconv.FormatFloat(report.RenewalRevenue, 'f', 2, 64),
+			strconv.Itoa(report.Refunds),
+			strconv.FormatFloat(report.RefundAmount, 'f', 2, 64),
+			strconv.FormatFloat(report.NetRevenue, 'f', 2, 64),
+		})
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			log.Printf("写出月度报表CSV失败: %v", err)
+		}
+	} else {
+		writeJSON(w, http.StatusOK, report)
+	}
+
+	log.Printf("处理月度报表请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleExportSubscriptions 按 status、plan 筛选导出订阅CSV，逐行写出响应
+func (h *SubscriptionHandler) HandleExportSubscriptions(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到订阅导出请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	filter := SubscriptionFilter{
+		Status: r.URL.Query().Get("status"),
+		Plan:   r.URL.Query().Get("plan"),
+	}
+
+	// 表头在第一行数据或查询完成时才写出，查询失败时仍可返回500
+	writer := csv.NewWriter(w)
+	started := false
+	writeHeader := func() error {
+		started = true
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="subscriptions.csv"`)
+		return writer.Write([]string{"id", "user_id", "plan", "start_date", "end_date", "status", "renewal_preference"})
+	}
+
+	count := 0
+	err := h.service.ExportSubscriptions(r.Context(), filter, func(sub *Subscription) error {
+		if !started {
+			if err := writeHeader(); err != nil {
+				return err
+			}
+		}
+		count++
+		return writer.Write([]string{
+			strconv.FormatInt(sub.ID, 10),
+			strconv.FormatInt(sub.UserID, 10),
+			sub.Plan,
+			sub.StartDate.Format(time.RFC3339),
+			sub.EndDate.Format(time.RFC3339),
+			sub.Status,
+			sub.RenewalPreference,
+		})
+	})
+	if err == nil && !started {
+		err = writeHeader()
+	}
+
+	if err != nil {
+		log.Printf("导出订阅失败: %v", err)
+		if !started {
+			http.Error(w, "导出订阅失败", http.StatusInternalServerError)
+			return
+		}
+		// 响应已开始写出，无法再返回错误状态码，输出到此为止
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("写出订阅CSV失败: %v", err)
+	}
+
+	log.Printf("处理订阅导出请求完成，导出 %d 条，耗时: %v", count, time.Since(start))
+}
+
+// HandleExportPayments 导出 start 到 end 之间的成功支付CSV，逐行写出响应
+func (h *SubscriptionHandler) HandleExportPayments(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到支付导出请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	startTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "start格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: start=%s", r.URL.Query().Get("start"))
+		return
+	}
+
+	endTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, "end格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: end=%s", r.URL.Query().Get("end"))
+		return
+	}
+
+	if endTime.Before(startTime) {
+		http.Error(w, "结束时间不能早于开始时间", http.StatusBadRequest)
+		log.Printf("参数错误: end早于start")
+		return
+	}
+
+	// 表头在第一行数据或查询完成时才写出，查询失败时仍可返回500
+	writer := csv.NewWriter(w)
+	started := false
+	writeHeader := func() error {
+		started = true
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="payments_%s_%s.csv"`,
+			startTime.Format("20060102"), endTime.Format("20060102")))
+		return writer.Write([]string{"payment_id", "user_id", "subscription_id", "amount", "payment_date", "type"})
+	}
+
+	count := 0
+	err = h.service.ExportPayments(r.Context(), startTime, endTime, func(payment *Payment) error {
+		if !started {
+			if err := writeHeader(); err != nil {
+				return err
+			}
+		}
+		count++
+		return writer.Write([]string{
+			strconv.FormatInt(payment.ID, 10),
+			strconv.FormatInt(payment.UserID, 10),
+			strconv.FormatInt(payment.SubscriptionID, 10),
+			strconv.FormatFloat(payment.Amount, 'f', 2, 64),
+			payment.PaymentDate.Format(time.RFC3339),
+			payment.Type,
+		})
+	})
+	if err == nil && !started {
+		err = writeHeader()
+	}
+
+	if err != nil {
+		log.Printf("导出支付记录失败: %v", err)
+		if !started {
+			http.Error(w, "导出支付记录失败", http.StatusInternalServerError)
+			return
+		}
+		// 响应已开始写出，无法再返回错误状态码，输出到此为止
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("写出支付CSV失败: %v", err)
+	}
+
+	log.Printf("处理支付导出请求完成，导出 %d 条，耗时: %v", count, time.Since(start))
+}
+
+// HandlePatchSubscription 处理管理员修改订阅单个字段的请求，请求体只需包含要修改的字段
+// 可在请求体中带上读取到的 version，订阅已被其他操作修改时返回409
+func (h *SubscriptionHandler) HandlePatchSubscription(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到修改订阅请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPatch {
+		http.Error(w, "只支持PATCH请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	subscriptionID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || subscriptionID <= 0 {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: id")
+		return
+	}
+
+	var changes map[string]any
+	if !decodeJSONBody(w, r, &changes) {
+		return
+	}
+
+	if err := h.service.PatchSubscription(r.Context(), subscriptionID, changes); err != nil {
+		log.Printf("修改订阅失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrInvalidPatch):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrSubscriptionNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrVersionConflict):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("修改订阅失败: %v", err), status)
+		return
+	}
+
+	response := map[string]string{
+		"message": "订阅修改成功",
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理修改订阅请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleAnalyticsExport 处理分析数据导出请求，以换行分隔的JSON逐行输出匿名的聚合数据
+// categories 为逗号分隔的类别，未指定时导出全部类别
+func (h *SubscriptionHandler) HandleAnalyticsExport(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到分析数据导出请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	startTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "start格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: start=%s", r.URL.Query().Get("start"))
+		return
+	}
+
+	endTime, err := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, "end格式不正确", http.StatusBadRequest)
+		log.Printf("参数格式错误: end=%s", r.URL.Query().Get("end"))
+		return
+	}
+
+	if endTime.Before(startTime) {
+		http.Error(w, "结束时间不能早于开始时间", http.StatusBadRequest)
+		log.Printf("参数错误: end早于start")
+		return
+	}
+
+	var categories []string
+	if value := r.URL.Query().Get("categories"); value != "" {
+		for _, category := range strings.Split(value, ",") {
+			category = strings.TrimSpace(category)
+			switch category {
+			case AnalyticsSubscriptions, AnalyticsPayments, AnalyticsChurn:
+				categories = append(categories, category)
+			default:
+				http.Error(w, fmt.Sprintf("未知的类别: %s", category), http.StatusBadRequest)
+				log.Printf("参数错误: categories=%s", value)
+				return
+			}
+		}
+	}
+
+	// 响应头在第一行数据或查询完成时才写出，查询失败时仍可返回500
+	encoder := json.NewEncoder(w)
+	started := false
+	writeHeader := func() {
+		started = true
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="analytics_%s_%s.ndjson"`,
+			startTime.Format("20060102"), endTime.Format("20060102")))
+	}
+
+	count := 0
+	err = h.service.ExportAnalytics(r.Context(), startTime, endTime, categories, func(record *AnalyticsRecord) error {
+		if !started {
+			writeHeader()
+		}
+		count++
+		return encoder.Encode(record)
+	})
+	if err == nil && !started {
+		writeHeader()
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if err != nil {
+		log.Printf("导出分析数据失败: %v", err)
+		if !started {
+			http.Error(w, "导出分析数据失败", http.StatusInternalServerError)
+			return
+		}
+		// 响应已开始写出，无法再返回错误状态码，输出到此为止
+	}
+
+	log.Printf("处理分析数据导出请求完成，导出 %d 行，耗时: %v", count, time.Since(start))
+}
+
+// HandleSettings 处理运行时设置请求：GET 返回所有设置，PUT 更新请求体中的设置项
+func (h *SubscriptionHandler) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到运行时设置请求: %s %s", r.Method, r.URL.Path)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// 请求体为设置项名称到取值的映射，例如 {"fallback_plan_price": "19.99"}
+		var updates map[string]string
+		if !decodeJSONBody(w, r, &updates) {
+			return
+		}
+		if len(updates) == 0 {
+			http.Error(w, "无效的请求数据", http.StatusBadRequest)
+			log.Printf("请求体中没有设置项")
+			return
+		}
+
+		if err := h.service.UpdateSettings(r.Context(), updates); err != nil {
+			log.Printf("更新运行时设置失败: %v", err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrInvalidSetting) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, fmt.Sprintf("更新设置失败: %v", err), status)
+			return
+		}
+	default:
+		http.Error(w, "只支持GET和PUT请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	settings, err := h.service.GetSettings(r.Context())
+	if err != nil {
+		log.Printf("获取运行时设置失败: %v", err)
+		http.Error(w, "获取设置失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, settings)
+
+	log.Printf("处理运行时设置请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleProcessingFailures 处理未解决的定时任务失败记录查询请求
+func (h *SubscriptionHandler) HandleProcessingFailures(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到处理失败记录查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	failures, err := h.service.GetProcessingFailures(r.Context())
+	if err != nil {
+		log.Printf("获取处理失败记录失败: %v", err)
+		http.Error(w, "获取处理失败记录失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, failures)
+
+	log.Printf("处理失败记录查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleResolveProcessingFailure 处理将失败记录标记为已解决的请求
+func (h *SubscriptionHandler) HandleResolveProcessingFailure(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到处理失败记录解决请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	// 解析请求体
+	var request struct {
+		ID int64 `json:"id"`
+	}
+
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	if request.ID <= 0 {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: id")
+		return
+	}
+
+	err := h.service.ResolveProcessingFailure(r.Context(), request.ID)
+	if err != nil {
+		log.Printf("标记处理失败记录失败: %v", err)
+		http.Error(w, fmt.Sprintf("标记处理失败记录失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{
+		"message": "处理失败记录已标记为已解决",
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理失败记录解决请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleResendOnboarding 处理重新发送新用户引导通知的请求
+func (h *SubscriptionHandler) HandleResendOnboarding(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到重新发送引导通知请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	// 解析请求体
+	var request struct {
+		UserID int64 `json:"user_id"`
+	}
+
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	if request.UserID <= 0 {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: user_id")
+		return
+	}
+
+	err := h.service.ResendOnboarding(r.Context(), request.UserID)
+	if err != nil {
+		log.Printf("重新发送引导通知失败: %v", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrNoActiveSubscription):
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("重新发送引导通知失败: %v", err), status)
+		return
+	}
+
+	response := map[string]string{
+		"message": "引导通知已重新发送",
+	}
+
+	writeJSON(w, http.StatusOK, response)
+
+	log.Printf("处理重新发送引导通知请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleRecentActivity 处理系统动态查询请求
+func (h *SubscriptionHandler) HandleRecentActivity(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到系统动态查询请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	// 默认返回20条，最多100条
+	limit := 20
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit格式不正确", http.StatusBadRequest)
+			log.Printf("参数格式错误: limit=%s", limitStr)
+			return
+		}
+		limit = parsed
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	events, err := h.service.GetRecentActivity(r.Context(), limit)
+	if err != nil {
+		log.Printf("获取系统动态失败: %v", err)
+		http.Error(w, "获取系统动态失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, events)
+
+	log.Printf("处理系统动态查询请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleHealthz 处理健康检查请求，关键依赖异常时返回503
+func (h *SubscriptionHandler) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "只支持GET请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := h.service.CheckHealth()
+
+	status := http.StatusOK
+	if report.Status == HealthUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// HandleSimulateLifecycle 处理订阅生命周期模拟请求（测试用，在沙箱副本上运行定时任务，不修改数据）
+func (h *SubscriptionHandler) HandleSimulateLifecycle(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到生命周期模拟请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	var request SimulateLifecycleRequest
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+
+	if request.SubscriptionID <= 0 {
+		http.Error(w, "缺少必要参数", http.StatusBadRequest)
+		log.Printf("缺少必要参数: subscription_id")
+		return
+	}
+	if request.FailedCharges < 0 {
+		http.Error(w, "failed_charges 不能为负数", http.StatusBadRequest)
+		log.Printf("参数无效: failed_charges=%d", request.FailedCharges)
+		return
+	}
+
+	steps, err := h.service.SimulateLifecycle(r.Context(), request)
+	if err != nil {
+		log.Printf("模拟生命周期失败: %v", err)
+		http.Error(w, fmt.Sprintf("模拟生命周期失败: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, steps)
+
+	log.Printf("处理生命周期模拟请求完成，耗时: %v", time.Since(start))
+}
+
+// HandleProcessExpiredTask 立即处理已过期订阅，不等待定时任务，用于故障恢复
+func (h *SubscriptionHandler) HandleProcessExpiredTask(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到手动处理已过期订阅请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	summary, err := h.service.ProcessExpiredSubscriptions()
+	if err != nil {
+		log.Printf("手动处理已过期订阅失败: %v", err)
+		http.Error(w, "处理已过期订阅失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, summary)
+
+	log.Printf("处理手动处理已过期订阅请求完成，结果: %+v，耗时: %v", summary, time.Since(start))
+}
+
+// HandleCheckExpiringTask 立即检查即将到期的订阅并发送提醒，不等待定时任务，用于故障恢复
+func (h *SubscriptionHandler) HandleCheckExpiringTask(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	log.Printf("收到手动检查即将到期订阅请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	summary, err := h.service.CheckExpiringSubscriptions()
+	if err != nil {
+		log.Printf("手动检查即将到期订阅失败: %v", err)
+		http.Error(w, "检查即将到期订阅失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, summary)
+
+	log.Printf("处理手动检查即将到期订阅请求完成，结果: %+v，耗时: %v", summary, time.Since(start))
+}
+
+// SchedulerHandler 定时任务调度器的管理接口
+type SchedulerHandler struct {
+	scheduler *TaskScheduler
+}
+
+// NewSchedulerHandler 创建调度器管理处理器
+func NewSchedulerHandler(scheduler *TaskScheduler) *SchedulerHandler {
+	return &SchedulerHandler{scheduler: scheduler}
+}
+
+// HandlePause 处理暂停调度器请求
+func (h *SchedulerHandler) HandlePause(w http.ResponseWriter, r *http.Request) {
+	h.toggle(w, r, true)
+}
+
+// HandleResume 处理恢复调度器请求
+func (h *SchedulerHandler) HandleResume(w http.ResponseWriter, r *http.Request) {
+	h.toggle(w, r, false)
+}
+
+// toggle 暂停或恢复调度器并返回当前状态
+func (h *SchedulerHandler) toggle(w http.ResponseWriter, r *http.Request, pause bool) {
+	log.Printf("收到调度器控制请求: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		log.Printf("请求方法不允许: %s", r.Method)
+		return
+	}
+
+	if pause {
+		h.scheduler.Pause()
+	} else {
+		h.scheduler.Resume()
+	}
+
+	response := map[string]bool{
+		"paused": h.scheduler.Paused(),
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
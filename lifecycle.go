@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 生命周期模拟的默认参数
+const (
+	defaultSimulationStep     = 24 * time.Hour
+	defaultSimulationMaxSteps = 800
+)
+
+// 模拟请求
+type SimulateLifecycleRequest struct {
+	SubscriptionID int64 `json:"subscription_id"`
+	StepHours      int   `json:"step_hours"`     // 每一步虚拟时钟前进的小时数，默认24
+	MaxSteps       int   `json:"max_steps"`      // 最多模拟的步数，默认800
+	FailedCharges  int   `json:"failed_charges"` // 模拟的前几次续订扣款失败，用于推演扣款重试，默认0
+}
+
+// 模拟过程中的一个状态变化、扣款或通知
+type LifecycleStep struct {
+	At      time.Time `json:"at"`
+	Event   string    `json:"event"`            // start、new_cycle、past_due、extended、expired、renewal_charge 或通知类型
+	Detail  string    `json:"detail,omitempty"` // 扣款的支付状态或通知的发送状态
+	Status  string    `json:"status"`
+	EndDate time.Time `json:"end_date"`
+}
+
+// 沙箱中复制的表及筛选列，按外键依赖顺序排列
+var simulationTables = []struct {
+	table  string
+	column string
+	byUser bool // 按用户ID筛选，否则按订阅ID筛选
+}{
+	{"users", "id", true},
+	{"subscriptions", "id", false},
+	{"payments", "subscription_id", false},
+	{"notifications", "subscription_id", false},
+	{"subscription_events", "subscription_id", false},
+}
+
+// SimulateLifecycle 在虚拟时钟上推演订阅的到期流程并返回状态序列
+// 订阅及其用户、支付、通知和事件记录复制到内存 SQLite 沙箱中，每一步在沙箱上运行与定时任务相同的批处理，
+// 提醒档位、通知屏蔽时段、续约周期扣款、扣款重试和到期规则都与线上一致；不修改真实数据，也不发送通知或扣款
+func (s *SubscriptionService) SimulateLifecycle(ctx context.Context, request SimulateLifecycleRequest) ([]LifecycleStep, error) {
+	log.Printf("模拟订阅 %d 的生命周期", request.SubscriptionID)
+
+	sub, err := s.db.GetSubscriptionByID(ctx, request.SubscriptionID)
+	if err != nil {
+		log.Printf("获取订阅信息失败: %v", err)
+		return nil, err
+	}
+
+	if sub.Status == StatusInactive {
+		return nil, errors.New("未激活的订阅无法模拟生命周期")
+	}
+
+	step := defaultSimulationStep
+	if request.StepHours > 0 {
+		step = time.Duration(request.StepHours) * time.Hour
+	}
+	maxSteps := defaultSimulationMaxSteps
+	if request.MaxSteps > 0 {
+		maxSteps = request.MaxSteps
+	}
+
+	clock := newVirtualClock(s.clock.Now())
+	sandbox, err := s.newSimulationSandbox(ctx, clock, request.FailedCharges)
+	if err != nil {
+		return nil, err
+	}
+	defer sandbox.Close()
+
+	if err := copySimulationData(ctx, s.db, sandbox.db, *sub); err != nil {
+		return nil, fmt.Errorf("复制订阅数据失败: %w", err)
+	}
+	current, err := sandbox.db.GetSubscriptionByID(ctx, sub.ID)
+	if err != nil {
+		return nil, fmt.Errorf("读取模拟订阅失败: %w", err)
+	}
+	lastPayment, err := lastSimulationRowID(ctx, sandbox.db, "payments", sub.ID)
+	if err != nil {
+		return nil, err
+	}
+	lastNotification, err := lastSimulationRowID(ctx, sandbox.db, "notifications", sub.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []LifecycleStep{{At: clock.Now(), Event: "start", Status: current.Status, EndDate: current.EndDate}}
+	for i := 0; i < maxSteps && current.Status != StatusInactive; i++ {
+		now := clock.Advance(step)
+		if err := sandbox.runScheduledTasks(ctx); err != nil {
+			return nil, fmt.Errorf("模拟定时任务失败: %w", err)
+		}
+
+		next, err := sandbox.db.GetSubscriptionByID(ctx, sub.ID)
+		if err != nil {
+			return nil, fmt.Errorf("读取模拟订阅失败: %w", err)
+		}
+
+		// 同一步内先列出扣款，再列出状态变化，最后列出因此发送的通知
+		charges, err := newSimulationRows(ctx, sandbox.db, "payments", sub.ID, &lastPayment)
+		if err != nil {
+			return nil, err
+		}
+		for _, charge := range charges {
+			if charge.kind == "renewal" {
+				steps = append(steps, LifecycleStep{At: now, Event: "renewal_charge", Detail: charge.status, Status: next.Status, EndDate: next.EndDate})
+			}
+		}
+		if event := lifecycleEvent(*current, *next); event != "" {
+			steps = append(steps, LifecycleStep{At: now, Event: event, Status: next.Status, EndDate: next.EndDate})
+		}
+		notices, err := newSimulationRows(ctx, sandbox.db, "notifications", sub.ID, &lastNotification)
+		if err != nil {
+			return nil, err
+		}
+		for _, notice := range notices {
+			steps = append(steps, LifecycleStep{At: now, Event: notice.kind, Detail: notice.status, Status: next.Status, EndDate: next.EndDate})
+		}
+
+		current = next
+	}
+
+	return steps, nil
+}
+
+// lifecycleEvent 根据相邻两步的订阅返回状态变化事件，没有变化时返回空字符串
+func lifecycleEvent(prev, next Subscription) string {
+	switch {
+	case next.Status == prev.Status && next.EndDate.Equal(prev.EndDate):
+		return ""
+	case next.Status == prev.Status:
+		return "extended" // 到期日处于通知屏蔽时段内被顺延
+	case next.Status == StatusInactive:
+		return "expired"
+	case next.Status == StatusPastDue:
+		return "past_due"
+	case next.Status == StatusSubscribed:
+		return "new_cycle"
+	default:
+		return next.Status
+	}
+}
+
+// newSimulationSandbox 创建使用内存 SQLite 和虚拟时钟的沙箱服务，配置与设置的生效值与当前服务相同
+// 沙箱的通知只记录不发送，续订扣款由 simulatedCharger 模拟
+func (s *SubscriptionService) newSimulationSandbox(ctx context.Context, clock Clock, failedCharges int) (*SubscriptionService, error) {
+	settings, err := s.settings.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("读取设置失败: %w", err)
+	}
+
+	db, err := NewDatabaseService(sqliteDSNPrefix+sqliteMemoryPath, 0, DBPoolConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("创建模拟数据库失败: %w", err)
+	}
+
+	notificationSvc := NewNotificationService(db, NoopSender{})
+	notificationSvc.dedupWindow = s.notificationSvc.dedupWindow
+	notificationSvc.suppression = s.notificationSvc.suppression
+	notificationSvc.dailyLimit = s.notificationSvc.dailyLimit
+
+	sandbox := &SubscriptionService{
+		db:              db,
+		cache:           NewSubscriptionCache(db, 0),
+		notificationSvc: notificationSvc,
+		notices:         NewNotificationQueue(defaultNotificationQueueSize, defaultNotificationQueueWorkers, notificationSvc.sendByType),
+		health:          NewHealthService(db, nil),
+		plans:           s.plans,
+		transitions:     s.transitions,
+		settings:        NewSettingsStore(db, settings),
+		suppressExtend:  s.suppressExtend,
+		drainTimeout:    s.drainTimeout,
+		charger:         &simulatedCharger{failures: failedCharges},
+	}
+	sandbox.setClock(clock)
+	return sandbox, nil
+}
+
+// runScheduledTasks 依次运行一轮定时任务，并等待后台通知写完发送记录
+func (s *SubscriptionService) runScheduledTasks(ctx context.Context) error {
+	if _, err := s.CheckExpiringSubscriptions(); err != nil {
+		return err
+	}
+	if _, err := s.ProcessExpiredSubscriptions(); err != nil {
+		return err
+	}
+	s.ProcessPastDueSubscriptions()
+	s.RetryFailedNotifications()
+	s.SendDeferredNotifications()
+	return s.DrainNotifications(ctx)
+}
+
+// simulatedCharger 模拟的扣款渠道：前 failures 次扣款失败，之后总是成功
+type simulatedCharger struct {
+	mu       sync.Mutex
+	failures int
+}
+
+func (c *simulatedCharger) Charge(ctx context.Context, userID, subscriptionID int64, amount float64, idempotencyKey string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("模拟扣款失败")
+	}
+	return nil
+}
+
+// copySimulationData 将订阅、所属用户及订阅的支付、通知和事件记录按原ID复制到沙箱数据库
+func copySimulationData(ctx context.Context, src, dst *DatabaseService, sub Subscription) error {
+	for _, t := range simulationTables {
+		id := sub.ID
+		if t.byUser {
+			id = sub.UserID
+		}
+		if err := copySimulationRows(ctx, src, dst, t.table, t.column, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySimulationRows 复制 table 中 column 等于 id 的行，两种数据库的表结构一致，按列名逐列写入
+func copySimulationRows(ctx context.Context, src, dst *DatabaseService, table, column string, id int64) error {
+	rows, err := src.db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE %s = ?", table, column), id)
+	if err != nil {
+		return fmt.Errorf("读取%s失败: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("读取%s的列失败: %w", table, err)
+	}
+	quoted := make([]string, len(columns))
+	for i, name := range columns {
+		quoted[i] = `"` + name + `"`
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+
+	for rows.Next() {
+		values := make([]any, len(columns))
+		targets := make([]any, len(columns))
+		for i := range values {
+			targets[i] = &values[i]
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return fmt.Errorf("读取%s失败: %w", table, err)
+		}
+		// MySQL 驱动将文本和小数列读为 []byte，转为字符串写入，避免在 SQLite 中存为 BLOB
+		for i, value := range values {
+			if b, ok := value.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		if _, err := dst.db.ExecContext(ctx, insert, values...); err != nil {
+			return fmt.Errorf("写入%s失败: %w", table, err)
+		}
+	}
+	return rows.Err()
+}
+
+// lastSimulationRowID 返回 table 中订阅的最大记录ID，没有记录时为0
+func lastSimulationRowID(ctx context.Context, db *DatabaseService, table string, subscriptionID int64) (int64, error) {
+	var id int64
+	err := db.db.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT COALESCE(MAX(id), 0) FROM %s WHERE subscription_id = ?", table), subscriptionID).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("读取%s失败: %w", table, err)
+	}
+	return id, nil
+}
+
+// 模拟中新产生的支付或通知记录
+type simulationRow struct {
+	id     int64
+	kind   string // 支付或通知的类型
+	status string
+}
+
+// newSimulationRows 按ID顺序返回 table 中订阅在 *last 之后新增的记录，并将 *last 更新为最新的记录ID
+func newSimulationRows(ctx context.Context, db *DatabaseService, table string, subscriptionID int64, last *int64) ([]simulationRow, error) {
+	rows, err := db.db.QueryContext(ctx,
+		fmt.Sprintf("SELECT id, type, status FROM %s WHERE subscription_id = ? AND id > ? ORDER BY id", table),
+		subscriptionID, *last)
+	if err != nil {
+		return nil, fmt.Errorf("读取%s失败: %w", table, err)
+	}
+	defer rows.Close()
+
+	var result []simulationRow
+	for rows.Next() {
+		var row simulationRow
+		if err := rows.Scan(&row.id, &row.kind, &row.status); err != nil {
+			return nil, fmt.Errorf("读取%s失败: %w", table, err)
+		}
+		result = append(result, row)
+		*last = row.id
+	}
+	return result, rows.Err()
+}
@@ -2,30 +2,425 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // 系统配置
 type Config struct {
-	DatabaseDSN string
-	ServerPort  int
-	LogFile     string
+	DatabaseDSN             string
+	ServerPort              int
+	LogFile                 string
+	DBKeepaliveInterval     time.Duration      // 空闲连接保活间隔，应小于MySQL的wait_timeout，0表示不保活
+	DBStatementTimeout      time.Duration      // 单条SQL语句的执行时间上限，超时由服务器终止，0表示不限制
+	DBMaxOpenConns          int                // MySQL连接池的最大连接数，0表示使用默认值（100）
+	DBMaxIdleConns          int                // MySQL连接池的最大空闲连接数，0表示使用默认值（20）
+	DBConnMaxLifetime       time.Duration      // MySQL连接的最长生命周期，0表示使用默认值（1小时）
+	ExpiryNoticeTiers       []int              // 到期提醒的提前天数档位的默认值，例如 [7, 3, 1]，每个档位在一个计费周期内只提醒一次，运行时可通过设置修改
+	NotificationDedupWindow time.Duration      // 到期通知去重窗口，窗口内同一订阅不重复发送
+	NotificationSuppression SuppressionWindow  // 到期和结束通知的屏蔽时段，时段内只记录不发送
+	ExtendSuppressed        bool               // 是否将到期日处于屏蔽时段内的订阅顺延屏蔽时段的时长
+	NotificationDailyLimit  int                // 每个用户每天最多收到的通知数，超出的推迟到次日，交易类通知不受限制，0表示不限制
+	HealthDependencies      []HealthDependency // 健康检查的额外依赖（数据库始终作为关键依赖检查）
+	Plans                   []Plan             // 套餐目录及各自的计费周期，未配置时使用默认目录
+	PlanTransitions         PlanTransitions    // 允许的套餐变更路径，未配置时不限制
+	UnknownPlanPolicy       string             // 续订时套餐不在目录中的处理方式：reject（默认）或 fallback
+	FallbackPlanPrice       float64            // fallback 时的续订价格，未配置时使用 SubscriptionPrice
+	RenewedCyclePolicy      string             // 已续约订阅到期进入新周期时的扣款方式：prepaid（默认，不再扣款）或 charge
+	ZeroAmountRenewalPolicy string             // 续订实付金额为0时的处理方式：comp（默认，记录赠送并续订）或 reject
+	SMTPHost                string             // SMTP服务器地址，为空时不实际发送邮件
+	SMTPPort                int                // SMTP端口
+	SMTPUsername            string             // SMTP认证用户名，为空时不认证
+	SMTPPassword            string             // SMTP认证密码
+	SMTPFrom                string             // 发件人地址
+	PaymentWebhookSecret    string             // 支付网关 webhook 签名密钥，配置后激活订阅需等待支付确认
+	JWTSecret               string             // 用户和管理接口认证令牌的签名密钥，未设置时必须显式设置 AuthDisabled
+	AuthDisabled            bool               // 仅用于本地开发：未设置 JWTSecret 时不做认证
+	RateLimitPerMinute      int                // 每个客户端IP每分钟最多请求数的默认值，0表示不限流，运行时可通过设置修改
+	AccessLog               bool               // 是否为每个请求记录方法、路径、状态码和耗时
+	ShutdownTimeout         time.Duration      // 优雅关闭的总时限，HTTP请求、定时任务和后台通知共享这一时限
+	NoticeDrainTimeout      time.Duration      // 关闭订阅服务时等待后台通知发送完成的时限，0表示使用默认值
+	CacheUpdateInterval     time.Duration      // 统计缓存的定期刷新间隔，0表示使用默认值（5分钟）
+	ExpiryCheckInterval     time.Duration      // 检查即将到期订阅的间隔，0表示使用默认值（6小时）
+	ExpiredProcessInterval  time.Duration      // 处理已过期订阅的间隔，0表示使用默认值（12小时）
+
+	NotificationChannels     map[string]NotificationChannel // 邮件以外的通知渠道，设置 SMS_GATEWAY_URL 时包含 sms
+	NotificationChannelOrder map[string][]string            // 各通知类型依次尝试的渠道，未配置的类型只发邮件
 }
 
-// 加载配置（在实际应用中通常从环境变量或配置文件中加载）
-func loadConfig() *Config {
-	// 这里为了演示简化，使用硬编码的配置
+// 加载配置：从环境变量读取，端口和日志文件有默认值，数据库DSN必须显式提供
+func loadConfig() (*Config, error) {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		return nil, errors.New("未设置环境变量 DATABASE_DSN")
+	}
+
+	port := 8080
+	if portStr := os.Getenv("SERVER_PORT"); portStr != "" {
+		parsed, err := strconv.Atoi(portStr)
+		if err != nil || parsed <= 0 || parsed > 65535 {
+			return nil, fmt.Errorf("环境变量 SERVER_PORT 无效: %s", portStr)
+		}
+		port = parsed
+	}
+
+	logFile := "subscription_service.log"
+	if value, ok := os.LookupEnv("LOG_FILE"); ok {
+		logFile = value // 设置为空时只输出到标准输出
+	}
+
+	keepalive := 5 * time.Minute
+	if value := os.Getenv("DB_KEEPALIVE_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("环境变量 DB_KEEPALIVE_INTERVAL 无效: %s", value)
+		}
+		keepalive = parsed
+	}
+
+	var statementTimeout time.Duration
+	if value := os.Getenv("DB_STATEMENT_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("环境变量 DB_STATEMENT_TIMEOUT 无效: %s", value)
+		}
+		statementTimeout = parsed
+	}
+
+	// 连接池参数未设置时为0，由 NewDatabaseService 使用默认值，只设置最大连接数时空闲连接数不会超过它
+	var maxOpenConns, maxIdleConns int
+	if value := os.Getenv("DB_MAX_OPEN_CONNS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("环境变量 DB_MAX_OPEN_CONNS 无效: %s", value)
+		}
+		maxOpenConns = parsed
+	}
+
+	if value := os.Getenv("DB_MAX_IDLE_CONNS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("环境变量 DB_MAX_IDLE_CONNS 无效: %s", value)
+		}
+		maxIdleConns = parsed
+	}
+
+	var connMaxLifetime time.Duration
+	if value := os.Getenv("DB_CONN_MAX_LIFETIME"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("环境变量 DB_CONN_MAX_LIFETIME 无效: %s", value)
+		}
+		connMaxLifetime = parsed
+	}
+
+	// 通知屏蔽时段，时间格式为 RFC3339，开始和结束需同时设置
+	var suppression SuppressionWindow
+	startStr, endStr := os.Getenv("NOTIFICATION_SUPPRESS_START"), os.Getenv("NOTIFICATION_SUPPRESS_END")
+	if startStr != "" || endStr != "" {
+		start, err := time.Parse(time.RFC3339, startStr)
+		if err != nil {
+			return nil, fmt.Errorf("环境变量 NOTIFICATION_SUPPRESS_START 无效: %s", startStr)
+		}
+		end, err := time.Parse(time.RFC3339, endStr)
+		if err != nil || !end.After(start) {
+			return nil, fmt.Errorf("环境变量 NOTIFICATION_SUPPRESS_END 无效: %s", endStr)
+		}
+		suppression = SuppressionWindow{Start: start, End: end}
+	}
+
+	extendSuppressed := false
+	if value := os.Getenv("NOTIFICATION_SUPPRESS_EXTEND"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("环境变量 NOTIFICATION_SUPPRESS_EXTEND 无效: %s", value)
+		}
+		extendSuppressed = parsed
+	}
+
+	dailyLimit := 0
+	if value := os.Getenv("NOTIFICATION_DAILY_LIMIT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("环境变量 NOTIFICATION_DAILY_LIMIT 无效: %s", value)
+		}
+		dailyLimit = parsed
+	}
+
+	rateLimit := 120
+	if value := os.Getenv("RATE_LIMIT_PER_MINUTE"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("环境变量 RATE_LIMIT_PER_MINUTE 无效: %s", value)
+		}
+		rateLimit = parsed
+	}
+
+	authDisabled := false
+	if value := os.Getenv("AUTH_DISABLED"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("环境变量 AUTH_DISABLED 无效: %s", value)
+		}
+		authDisabled = parsed
+	}
+
+	accessLog := true
+	if value := os.Getenv("ACCESS_LOG"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("环境变量 ACCESS_LOG 无效: %s", value)
+		}
+		accessLog = parsed
+	}
+
+	smtpPort := 587
+	if portStr := os.Getenv("SMTP_PORT"); portStr != "" {
+		parsed, err := strconv.Atoi(portStr)
+		if err != nil || parsed <= 0 || parsed > 65535 {
+			return nil, fmt.Errorf("环境变量 SMTP_PORT 无效: %s", portStr)
+		}
+		smtpPort = parsed
+	}
+
+	// 到期提醒档位，逗号分隔的提前天数，最大档位即提醒窗口，例如 "7,3,1"
+	noticeTiers := []int{3, 1}
+	if value := os.Getenv("EXPIRY_NOTICE_TIERS"); value != "" {
+		noticeTiers = nil
+		for _, part := range strings.Split(value, ",") {
+			days, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return nil, fmt.Errorf("环境变量 EXPIRY_NOTICE_TIERS 无效: %s", value)
+			}
+			noticeTiers = append(noticeTiers, days)
+		}
+	}
+
+	shutdownTimeout := 30 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("环境变量 SHUTDOWN_TIMEOUT 无效: %s", value)
+		}
+		shutdownTimeout = parsed
+	}
+
+	drainTimeout := defaultNoticeDrainTimeout
+	if value := os.Getenv("NOTIFICATION_DRAIN_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("环境变量 NOTIFICATION_DRAIN_TIMEOUT 无效: %s", value)
+		}
+		drainTimeout = parsed
+	}
+
+	cacheInterval := defaultCacheUpdateInterval
+	if value := os.Getenv("CACHE_UPDATE_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("环境变量 CACHE_UPDATE_INTERVAL 无效: %s", value)
+		}
+		cacheInterval = parsed
+	}
+
+	checkInterval := defaultExpiryCheckInterval
+	if value := os.Getenv("EXPIRY_CHECK_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("环境变量 EXPIRY_CHECK_INTERVAL 无效: %s", value)
+		}
+		checkInterval = parsed
+	}
+
+	processInterval := defaultExpiredProcessInterval
+	if value := os.Getenv("EXPIRED_PROCESS_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("环境变量 EXPIRED_PROCESS_INTERVAL 无效: %s", value)
+		}
+		processInterval = parsed
+	}
+
+	// 短信网关地址，设置后启用 sms 渠道
+	var channels map[string]NotificationChannel
+	if value := os.Getenv("SMS_GATEWAY_URL"); value != "" {
+		parsed, err := url.Parse(value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("环境变量 SMS_GATEWAY_URL 无效: %s", value)
+		}
+		channels = map[string]NotificationChannel{ChannelSMS: newSMSGatewayChannel(value)}
+	}
+
+	// 各通知类型的渠道顺序，例如 "payment_failed=email,sms"，未列出的类型只发邮件
+	var channelOrder map[string][]string
+	if value := os.Getenv("NOTIFICATION_CHANNEL_ORDER"); value != "" {
+		parsed, err := parseChannelOrder(value)
+		if err != nil {
+			return nil, fmt.Errorf("环境变量 NOTIFICATION_CHANNEL_ORDER 无效: %w", err)
+		}
+		channelOrder = parsed
+	}
+
 	return &Config{
-		DatabaseDSN: "root:181900@tcp(127.0.0.1:3306)/subscription_test_db?parseTime=true",
-		ServerPort:  8080,
-		LogFile:     "subscription_service.log",
+		DatabaseDSN:             dsn,
+		ServerPort:              port,
+		LogFile:                 logFile,
+		DBKeepaliveInterval:     keepalive,
+		DBStatementTimeout:      statementTimeout,
+		DBMaxOpenConns:          maxOpenConns,
+		DBMaxIdleConns:          maxIdleConns,
+		DBConnMaxLifetime:       connMaxLifetime,
+		ExpiryNoticeTiers:       noticeTiers,
+		NotificationDedupWindow: 10 * time.Minute,
+		NotificationSuppression: suppression,
+		ExtendSuppressed:        extendSuppressed,
+		NotificationDailyLimit:  dailyLimit,
+		SMTPHost:                os.Getenv("SMTP_HOST"),
+		SMTPPort:                smtpPort,
+		SMTPUsername:            os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:            os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:                os.Getenv("SMTP_FROM"),
+		PaymentWebhookSecret:    os.Getenv("PAYMENT_WEBHOOK_SECRET"),
+		JWTSecret:               os.Getenv("JWT_SECRET"),
+		AuthDisabled:            authDisabled,
+		RateLimitPerMinute:      rateLimit,
+		AccessLog:               accessLog,
+		ShutdownTimeout:         shutdownTimeout,
+		NoticeDrainTimeout:      drainTimeout,
+		CacheUpdateInterval:     cacheInterval,
+		ExpiryCheckInterval:     checkInterval,
+		ExpiredProcessInterval:  processInterval,
+
+		NotificationChannels:     channels,
+		NotificationChannelOrder: channelOrder,
+	}, nil
+}
+
+// Validate 检查配置的取值，返回发现的全部问题，便于启动时一次性报告
+// 只检查取值本身，不连接数据库或SMTP服务器
+func (c *Config) Validate() []error {
+	var errs []error
+
+	if c.DatabaseDSN == "" {
+		errs = append(errs, errors.New("数据库DSN不能为空"))
+	} else if isSQLiteDSN(c.DatabaseDSN) {
+		if c.DatabaseDSN == sqliteDSNPrefix {
+			errs = append(errs, errors.New("SQLite数据库路径不能为空"))
+		}
+	} else if _, err := normalizeDSN(c.DatabaseDSN, c.DBStatementTimeout); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ServerPort <= 0 || c.ServerPort > 65535 {
+		errs = append(errs, fmt.Errorf("服务端口无效: %d", c.ServerPort))
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"数据库保活间隔", c.DBKeepaliveInterval},
+		{"SQL语句超时", c.DBStatementTimeout},
+		{"数据库连接最长生命周期", c.DBConnMaxLifetime},
+		{"通知去重窗口", c.NotificationDedupWindow},
+		{"关闭时限", c.ShutdownTimeout},
+		{"通知排空时限", c.NoticeDrainTimeout},
+		{"缓存刷新间隔", c.CacheUpdateInterval},
+		{"到期检查间隔", c.ExpiryCheckInterval},
+		{"过期处理间隔", c.ExpiredProcessInterval},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s不能为负数: %v", d.name, d.value))
+		}
+	}
+
+	if c.DBMaxOpenConns < 0 {
+		errs = append(errs, fmt.Errorf("数据库最大连接数不能为负数: %d", c.DBMaxOpenConns))
+	}
+	if c.DBMaxIdleConns < 0 {
+		errs = append(errs, fmt.Errorf("数据库最大空闲连接数不能为负数: %d", c.DBMaxIdleConns))
+	}
+	if c.DBMaxOpenConns > 0 && c.DBMaxIdleConns > c.DBMaxOpenConns {
+		errs = append(errs, fmt.Errorf("数据库最大空闲连接数 %d 不能超过最大连接数 %d", c.DBMaxIdleConns, c.DBMaxOpenConns))
+	}
+
+	if _, err := normalizeNoticeTiers(c.ExpiryNoticeTiers); err != nil {
+		errs = append(errs, err)
+	}
+	if c.NotificationSuppression.End.Before(c.NotificationSuppression.Start) {
+		errs = append(errs, fmt.Errorf("通知屏蔽时段无效: %v - %v", c.NotificationSuppression.Start, c.NotificationSuppression.End))
+	}
+	if c.NotificationDailyLimit < 0 {
+		errs = append(errs, fmt.Errorf("每日通知上限不能为负数: %d", c.NotificationDailyLimit))
+	}
+
+	// 套餐变更路径只在套餐目录有效时检查，避免同一问题重复报告
+	if catalog, err := newPlanCatalog(c.Plans); err != nil {
+		errs = append(errs, err)
+	} else {
+		for from, targets := range c.PlanTransitions {
+			for _, plan := range append([]string{from}, targets...) {
+				if _, ok := catalog[plan]; !ok {
+					errs = append(errs, fmt.Errorf("套餐变更路径引用了未知套餐: %s", plan))
+				}
+			}
+		}
+	}
+	if _, err := validateUnknownPlanPolicy(c.UnknownPlanPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := validateRenewedCyclePolicy(c.RenewedCyclePolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := validateZeroAmountRenewalPolicy(c.ZeroAmountRenewalPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if c.FallbackPlanPrice < 0 {
+		errs = append(errs, fmt.Errorf("fallback 续订价格不能为负数: %.2f", c.FallbackPlanPrice))
 	}
+
+	// 未设置签名密钥时所有用户和管理接口都不做认证，只允许在显式关闭认证的开发环境中启动
+	if c.JWTSecret == "" && !c.AuthDisabled {
+		errs = append(errs, errors.New("未设置 JWT_SECRET，仅在开发环境中可设置 AUTH_DISABLED=true 关闭认证"))
+	}
+
+	if c.RateLimitPerMinute < 0 {
+		errs = append(errs, fmt.Errorf("每分钟请求上限不能为负数: %d", c.RateLimitPerMinute))
+	}
+
+	if c.SMTPHost != "" {
+		if c.SMTPPort <= 0 || c.SMTPPort > 65535 {
+			errs = append(errs, fmt.Errorf("SMTP端口无效: %d", c.SMTPPort))
+		}
+		if c.SMTPFrom == "" {
+			errs = append(errs, errors.New("配置了SMTP服务器但未设置发件人地址"))
+		}
+	}
+
+	for notificationType, order := range c.NotificationChannelOrder {
+		if _, ok := notificationSubjects[notificationType]; !ok {
+			errs = append(errs, fmt.Errorf("渠道顺序中的通知类型未知: %s", notificationType))
+		}
+		for _, name := range order {
+			if _, ok := c.NotificationChannels[name]; !ok && name != ChannelEmail {
+				errs = append(errs, fmt.Errorf("通知类型 %s 使用了未配置的渠道: %s", notificationType, name))
+			}
+		}
+	}
+
+	return errs
 }
 
 // 初始化日志
@@ -45,7 +440,17 @@ func initLogger(logFile string) {
 
 func main() {
 	// 加载配置
-	config := loadConfig()
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		log.Printf("配置校验失败，共 %d 个问题:", len(errs))
+		for _, err := range errs {
+			log.Printf("  - %v", err)
+		}
+		os.Exit(1)
+	}
 
 	// 初始化日志
 	initLogger(config.LogFile)
@@ -53,41 +458,121 @@ func main() {
 	log.Println("订阅系统服务正在启动...")
 
 	// 创建订阅服务
-	service, err := NewSubscriptionService(config.DatabaseDSN)
+	service, err := NewSubscriptionService(config)
 	if err != nil {
 		log.Fatalf("创建订阅服务失败: %v", err)
 	}
 
 	// 启动任务调度器
-	scheduler := NewTaskScheduler(service)
+	scheduler := NewTaskScheduler(service, config.ExpiryCheckInterval, config.ExpiredProcessInterval)
+	log.Printf("缓存和定时任务间隔: 缓存刷新=%v, 到期检查=%v, 过期处理=%v",
+		service.cache.updateInterval, scheduler.checkInterval, scheduler.processInterval)
 	scheduler.Start()
 
 	// 创建HTTP处理器
 	handler := NewSubscriptionHandler(service)
 
-	// 注册API路由
+	// 注册API路由，所有处理器都记录请求指标
 	mux := http.NewServeMux()
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, instrumentHandler(pattern, h))
+	}
+
+	// 用户接口要求令牌中的用户与请求的 user_id 一致，管理接口要求管理员令牌
+	handleUser := func(pattern string, h http.HandlerFunc, publicMethods ...string) {
+		handle(pattern, h)
+	}
+	handleAdmin := handle
+	if config.JWTSecret != "" {
+		auth := NewJWTAuth(config.JWTSecret)
+		handleUser = func(pattern string, h http.HandlerFunc, publicMethods ...string) {
+			handle(pattern, auth.RequireUser(h, publicMethods...))
+		}
+		handleAdmin = func(pattern string, h http.HandlerFunc) {
+			handle(pattern, auth.RequireAdmin(h))
+		}
+	} else {
+		log.Println("警告: AUTH_DISABLED=true 且未设置 JWT_SECRET，用户和管理接口不做认证，只能用于开发环境")
+	}
+
+	// 监控指标包含收入等经营数据，需要管理员令牌
+	handleAdmin("/metrics", promhttp.Handler().ServeHTTP)
+
+	// 健康检查
+	handle("/healthz", handler.HandleHealthz)
 
-	// 用户相关API
-	mux.HandleFunc("/api/subscriptions", handler.HandleUserSubscriptions)
-	mux.HandleFunc("/api/payments", handler.HandleUserPayments)
-	mux.HandleFunc("/api/users", handler.HandleCreateUser)
-	mux.HandleFunc("/api/subscriptions/activate", handler.HandleActivateSubscription)
-	mux.HandleFunc("/api/subscriptions/renew", handler.HandleRenewSubscription)
-	mux.HandleFunc("/api/subscriptions/cancel", handler.HandleCancelRenewal)
+	// 用户相关API，注册用户（POST /api/users）不需要认证
+	// 最初版本之后新增的接口由功能开关控制，不受控制的接口见 settings.go 中功能开关的说明
+	handleUser("/api/subscriptions", handler.HandleUserSubscriptions)
+	handleUser("/api/subscriptions/detail", handler.RequireFeature(FeatureSubscriptionDetail, handler.HandleSubscriptionDetail))
+	handleUser("/api/subscriptions/active", handler.RequireFeature(FeatureSubscriptionDetail, handler.HandleActiveSubscription))
+	handleUser("/api/payments", handler.HandleUserPayments)
+	handleUser("/api/users", handler.HandleUsers, http.MethodPost)
+	handleUser("/api/subscriptions/activate", handler.HandleActivateSubscription)
+	handleUser("/api/subscriptions/trial", handler.RequireFeature(FeatureTrial, handler.HandleStartTrial))
+	handleUser("/api/subscriptions/renew", handler.HandleRenewSubscription)
+	handleUser("/api/subscriptions/cancel", handler.HandleCancelRenewal)
+	handleUser("/api/subscriptions/change-plan", handler.RequireFeature(FeatureChangePlan, handler.HandleChangePlan))
+	handleUser("/api/subscriptions/eligible-plans", handler.RequireFeature(FeatureEligiblePlans, handler.HandleEligiblePlans))
+	handleUser("/api/payments/refund", handler.RequireFeature(FeatureRefunds, handler.HandleRefundPayment))
+	handleUser("/api/entitlements/snapshot", handler.RequireFeature(FeatureEntitlementSnapshot, handler.HandleEntitlementSnapshot))
 
-	// 管理相关API
-	mux.HandleFunc("/api/admin/stats", handler.HandleSystemStats)
-	mux.HandleFunc("/api/admin/monthly-stats", handler.HandleMonthlyStats)
-	mux.HandleFunc("/api/admin/time-range-stats", handler.HandleTimeRangeStats)
+	// 支付网关回调，使用 webhook 签名认证
+	handle("/api/webhooks/payment", handler.HandlePaymentWebhook)
+
+	// 管理相关API，新增接口同样由功能开关控制，运行时设置接口不受控制，保证开关可以重新开启
+	handleAdmin("/api/admin/stats", handler.HandleSystemStats)
+	handleAdmin("/api/admin/monthly-stats", handler.HandleMonthlyStats)
+	handleAdmin("/api/admin/time-range-stats", handler.HandleTimeRangeStats)
+	handleAdmin("/api/admin/revenue-series", handler.RequireFeature(FeatureAnalytics, handler.HandleRevenueSeries))
+	handleAdmin("/api/admin/funnel", handler.RequireFeature(FeatureAnalytics, handler.HandleConversionFunnel))
+	handleAdmin("/api/admin/new-users", handler.RequireFeature(FeatureAnalytics, handler.HandleNewUserCounts))
+	handleAdmin("/api/admin/projected-revenue", handler.RequireFeature(FeatureAnalytics, handler.HandleProjectedRevenue))
+	handleAdmin("/api/admin/monthly-report", handler.RequireFeature(FeatureAnalytics, handler.HandleMonthlyReport))
+	handleAdmin("/api/admin/time-to-decision", handler.RequireFeature(FeatureAnalytics, handler.HandleAvgTimeToDecision))
+	handleAdmin("/api/admin/refunds-by-plan", handler.RequireFeature(FeatureRefundsByPlan, handler.HandleRefundsByPlan))
+	handleAdmin("/api/admin/subscriptions", handler.RequireFeature(FeatureSubscriptionPatch, handler.HandlePatchSubscription))
+	handleAdmin("/api/admin/subscriptions/export", handler.RequireFeature(FeatureExports, handler.HandleExportSubscriptions))
+	handleAdmin("/api/admin/payments/export", handler.RequireFeature(FeatureExports, handler.HandleExportPayments))
+	handleAdmin("/api/admin/analytics-export", handler.RequireFeature(FeatureAnalytics, handler.HandleAnalyticsExport))
+	handleAdmin("/api/admin/processing-failures", handler.RequireFeature(FeatureProcessingFailures, handler.HandleProcessingFailures))
+	handleAdmin("/api/admin/processing-failures/resolve", handler.RequireFeature(FeatureProcessingFailures, handler.HandleResolveProcessingFailure))
+	handleAdmin("/api/admin/activity", handler.RequireFeature(FeatureRecentActivity, handler.HandleRecentActivity))
+	handleAdmin("/api/admin/simulate-lifecycle", handler.RequireFeature(FeatureAdminTasks, handler.HandleSimulateLifecycle))
+	handleAdmin("/api/admin/tasks/process-expired", handler.RequireFeature(FeatureAdminTasks, handler.HandleProcessExpiredTask))
+	handleAdmin("/api/admin/tasks/check-expiring", handler.RequireFeature(FeatureAdminTasks, handler.HandleCheckExpiringTask))
+	handleAdmin("/api/admin/settings", handler.HandleSettings)
+	handleAdmin("/api/admin/users", handler.RequireFeature(FeatureUserAdmin, handler.HandleListUsers))
+	handleAdmin("/api/admin/users/search", handler.RequireFeature(FeatureUserAdmin, handler.HandleSearchUsers))
+	handleAdmin("/api/admin/users/resend-onboarding", handler.RequireFeature(FeatureUserAdmin, handler.HandleResendOnboarding))
+
+	// 调度器管理API
+	schedulerHandler := NewSchedulerHandler(scheduler)
+	handleAdmin("/api/admin/scheduler/pause", schedulerHandler.HandlePause)
+	handleAdmin("/api/admin/scheduler/resume", schedulerHandler.HandleResume)
+
+	// 按客户端IP限流，上限是运行时设置，修改后立即生效，为0时不限流
+	limiter := NewDynamicRateLimiter(service.RateLimitPerMinute)
+	limiter.StartEviction(rateLimitEvictInterval)
+	var rootHandler http.Handler = limiter.Middleware(mux)
+
+	// 访问日志在最外层，被限流的请求也会记录
+	if config.AccessLog {
+		rootHandler = accessLog(rootHandler)
+	}
+
+	// 请求上下文派生自 baseCtx，关闭超时后取消它以中止仍在执行的数据库查询
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 
 	// 创建HTTP服务器
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", config.ServerPort),
-		Handler:      mux,
+		Handler:      rootHandler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
 	}
 
 	// 创建一个通道来接收终止信号
@@ -108,17 +593,23 @@ func main() {
 		<-quit
 		log.Println("订阅系统服务收到终止信号，准备关闭...")
 
-		// 首先停止接收新的请求
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		server.SetKeepAlivesEnabled(false)
-		if err := server.Shutdown(ctx); err != nil {
-			log.Fatalf("HTTP服务器强制关闭: %v", err)
-		}
+		// 停止接收新的请求并等待处理中的请求、定时任务和后台通知完成，三者共享同一个时限
+		gracefulShutdown(config.ShutdownTimeout,
+			shutdownStep{"HTTP服务器", func(ctx context.Context) error {
+				server.SetKeepAlivesEnabled(false)
+				if err := server.Shutdown(ctx); err != nil {
+					log.Printf("HTTP服务器未能在时限内关闭，取消未完成的请求: %v", err)
+					cancelRequests()
+					server.Close()
+					return err
+				}
+				return nil
+			}},
+			shutdownStep{"定时任务调度器", scheduler.Stop},
+			shutdownStep{"后台通知", service.DrainNotifications},
+		)
 
-		// 停止任务调度器
-		scheduler.Stop()
+		limiter.Stop()
 
 		// 关闭服务
 		if err := service.Close(); err != nil {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 系统统计指标，每次 refreshCache 后更新
+var (
+	metricTotalUsers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "subs_users_total",
+		Help: "用户总数",
+	})
+	metricActiveSubscriptions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "subs_active_subscriptions",
+		Help: "当前活跃订阅数",
+	})
+	metricTotalPaymentAmount = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "subs_payment_amount_total",
+		Help: "成功支付总金额",
+	})
+	metricNewSubscriptionsMonth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "subs_new_subscriptions_month",
+		Help: "本月新增订阅数",
+	})
+	metricRenewalsMonth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "subs_renewals_month",
+		Help: "本月续订数",
+	})
+	metricFailedPayments = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "subs_failed_payments",
+		Help: "支付失败记录数",
+	})
+)
+
+// 等待后台发送的通知数，入队和取出时更新
+var metricNotificationQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "subs_notification_queue_depth",
+	Help: "后台通知队列中等待发送的通知数",
+})
+
+// HTTP请求指标
+var (
+	metricHTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "subs_http_requests_total",
+		Help: "HTTP请求数，按处理器和状态码统计",
+	}, []string{"handler", "code"})
+	metricHTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "subs_http_request_duration_seconds",
+		Help:    "HTTP请求耗时，按处理器统计",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+)
+
+// publishStatsMetrics 用最新的统计快照更新指标
+func publishStatsMetrics(stats SystemStats) {
+	metricTotalUsers.Set(float64(stats.TotalUsers))
+	metricActiveSubscriptions.Set(float64(stats.ActiveSubscriptions))
+	metricTotalPaymentAmount.Set(stats.TotalPaymentAmount)
+	metricNewSubscriptionsMonth.Set(float64(stats.NewSubscriptionsMonth))
+	metricRenewalsMonth.Set(float64(stats.RenewalsMonth))
+	metricFailedPayments.Set(float64(stats.FailedPayments))
+}
+
+// statusRecorder 记录处理器写出的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentHandler 记录处理器的请求数、状态码和耗时
+func instrumentHandler(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next(recorder, r)
+
+		metricHTTPDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		metricHTTPRequests.WithLabelValues(name, strconv.Itoa(recorder.status)).Inc()
+	}
+}
+
+// accessLog 记录每个请求的方法、路径、响应状态码和耗时
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		log.Printf("请求完成: %s %s 状态码=%d 耗时=%v", r.Method, r.URL.Path, recorder.status, time.Since(start))
+	})
+}
@@ -11,6 +11,8 @@ const (
 	StatusSubscribed   = "subscribed"   // 已订阅
 	StatusRenewed      = "renewed"      // 已续约
 	StatusUnsubscribed = "unsubscribed" // 已退订
+	StatusTrial        = "trial"        // 试用中
+	StatusPastDue      = "past_due"     // 续订扣款失败，等待重试
 )
 
 // 模型定义
@@ -30,16 +32,105 @@ type Subscription struct {
 	Status            string    `json:"status"`
 	NotificationSent  bool      `json:"notification_sent"`  // 是否已发送通知
 	RenewalPreference string    `json:"renewal_preference"` // yes, no, undecided
+	Version           int       `json:"version"`            // 每次修改订阅时递增，用于乐观并发检查
+	CreatedAt         time.Time `json:"created_at"`         // 订阅记录的创建时间
+	UpdatedAt         time.Time `json:"updated_at"`         // 订阅记录最近一次修改的时间
+}
+
+// 续订扣款失败、等待重试的订阅
+type PastDueSubscription struct {
+	Subscription
+	DunningAttempts int       `json:"dunning_attempts"` // 已失败的扣款次数
+	LastAttemptAt   time.Time `json:"last_attempt_at"`  // 最近一次扣款失败的时间
+}
+
+// 订阅及其最近一次成功的首次订阅、续订或赠送支付，用于按支付记录校正订阅状态
+type SubscriptionPaymentState struct {
+	Subscription
+	PaymentID   int64
+	PaymentType string
+	PaymentDate time.Time
+	Refunded    bool // 该支付是否已退款
+}
+
+// 订阅列表的筛选条件，字段为空时不筛选
+type SubscriptionFilter struct {
+	Status string `json:"status"`
+	Plan   string `json:"plan"`
 }
 
 type Payment struct {
-	ID             int64     `json:"id"`
-	UserID         int64     `json:"user_id"`
-	SubscriptionID int64     `json:"subscription_id"`
-	Amount         float64   `json:"amount"`
-	PaymentDate    time.Time `json:"payment_date"`
-	Status         string    `json:"status"`
-	Type           string    `json:"type"` // initial(首次订阅) 或 renewal(续订)
+	ID                int64     `json:"id"`
+	UserID            int64     `json:"user_id"`
+	SubscriptionID    int64     `json:"subscription_id"`
+	Amount            float64   `json:"amount"`
+	PaymentDate       time.Time `json:"payment_date"`
+	Status            string    `json:"status"`                        // pending、success 或 failed
+	Type              string    `json:"type"`                          // initial(首次订阅)、renewal(续订)、comped(0元赠送续订)、upgrade(周期中途升级) 或 refund(退款)
+	Reason            string    `json:"reason"`                        // 实收金额与目录价格的差异原因，见 PaymentReason* 常量
+	OriginalPaymentID *int64    `json:"original_payment_id,omitempty"` // 退款记录对应的原支付ID
+	RefundReference   *string   `json:"refund_reference,omitempty"`    // 退款请求提供的幂等引用
+}
+
+// 分页的付款记录
+type PaymentPage struct {
+	Payments []Payment `json:"payments"`
+	Total    int       `json:"total"`
+	Limit    int       `json:"limit"`
+	Offset   int       `json:"offset"`
+}
+
+// 用户及其最近的订阅，没有订阅时订阅字段为空
+type UserWithSubscription struct {
+	ID             int64      `json:"id"`
+	Name           string     `json:"name"`
+	Email          string     `json:"email"`
+	CreatedAt      time.Time  `json:"created_at"`
+	SubscriptionID int64      `json:"subscription_id,omitempty"`
+	Plan           string     `json:"plan,omitempty"`
+	Status         string     `json:"status,omitempty"`
+	EndDate        *time.Time `json:"end_date,omitempty"`
+}
+
+// 分页的用户列表
+type UserPage struct {
+	Users  []UserWithSubscription `json:"users"`
+	Total  int                    `json:"total"`
+	Limit  int                    `json:"limit"`
+	Offset int                    `json:"offset"`
+}
+
+// 支付金额差异原因
+const (
+	PaymentReasonStandard      = "standard"      // 按目录价格收费
+	PaymentReasonGrandfathered = "grandfathered" // 沿用该订阅此前的成交价格
+	PaymentReasonCoupon        = "coupon"        // 使用优惠码后的金额
+	PaymentReasonProrated      = "prorated"      // 按剩余时长比例计算的金额
+	PaymentReasonPlanFallback  = "plan_fallback" // 套餐不在目录中，按后备价格收费
+	PaymentReasonCustomAmount  = "custom_amount" // 其他金额（人工调整等）
+	PaymentReasonRefund        = "refund"        // 全额退还原支付
+)
+
+// 支付状态常量
+const (
+	StatusPending = "pending" // 等待支付网关确认
+	StatusSuccess = "success" // 支付成功
+	StatusFailed  = "failed"  // 支付失败
+)
+
+// 支付状态允许的转换：只有待确认的支付可以变为成功或失败
+var paymentTransitions = map[string][]string{
+	StatusPending: {StatusSuccess, StatusFailed},
+}
+
+// canTransitionPayment 判断支付状态是否允许从 from 变为 to
+func canTransitionPayment(from, to string) bool {
+	for _, target := range paymentTransitions[from] {
+		if target == to {
+			return true
+		}
+	}
+	return false
 }
 
 type Notification struct {
@@ -49,20 +140,55 @@ type Notification struct {
 	Type           string    `json:"type"` // 通知类型：expiration_notice, renewal_confirmation等
 	Content        string    `json:"content"`
 	SentAt         time.Time `json:"sent_at"`
-	Status         string    `json:"status"` // sent, failed
+	Status         string    `json:"status"`      // sent, failed, superseded(已被后续成功发送取代), suppressed(屏蔽时段内未发送), deferred(当天已达上限，sent_at 为计划发送时间)
+	RetryCount     int       `json:"retry_count"` // 失败后已重试的次数
+	Channel        string    `json:"channel"`     // 最终送达的渠道：email, sms，未送达时为空
+}
+
+// 订阅事件类型
+const (
+	EventSignup       = "signup"       // 用户注册
+	EventTrialStart   = "trial_start"  // 开始试用
+	EventActivation   = "activation"   // 首次激活
+	EventRenewal      = "renewal"      // 续订
+	EventCancellation = "cancellation" // 取消续订
+	EventRefund       = "refund"       // 退款
+	EventAdminPatch   = "admin_patch"  // 管理员修改订阅字段
+)
+
+// 订阅事件（审计记录）
+type SubscriptionEvent struct {
+	ID             int64     `json:"id"`
+	SubscriptionID int64     `json:"subscription_id"`
+	UserID         int64     `json:"user_id"`
+	EventType      string    `json:"event_type"`
+	Detail         string    `json:"detail,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// 系统动态中的一条事件
+type ActivityEvent struct {
+	Type           string    `json:"type"`
+	UserID         int64     `json:"user_id"`
+	SubscriptionID int64     `json:"subscription_id,omitempty"`
+	Amount         float64   `json:"amount,omitempty"`
+	OccurredAt     time.Time `json:"occurred_at"`
+}
+
+// 定时任务处理失败记录
+type ProcessingFailure struct {
+	ID             int64      `json:"id"`
+	RunAt          time.Time  `json:"run_at"` // 所属任务的执行时间
+	SubscriptionID int64      `json:"subscription_id"`
+	Error          string     `json:"error"`
+	Resolved       bool       `json:"resolved"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
 }
 
 // Cache 缓存结构
 type Cache struct {
-	mutex                 sync.RWMutex
-	totalUsers            int
-	totalPaymentAmount    float64
-	activeSubscriptions   int
-	newSubscriptionsMonth int     // 本月新增订阅数
-	newPaymentAmountMonth float64 // 本月新增付费金额
-	renewalsMonth         int     // 本月续订数
-	renewalAmountMonth    float64 // 本月续订金额
-	lastUpdated           time.Time
+	mutex sync.RWMutex
+	stats SystemStats // 最近一次刷新得到的完整统计快照，整体替换以保证各指标一致
 }
 
 // 订阅创建请求
@@ -76,25 +202,84 @@ type SubscriptionRequest struct {
 type RenewalRequest struct {
 	SubscriptionID int64   `json:"subscription_id"`
 	UserID         int64   `json:"user_id"`
-	Amount         float64 `json:"amount"`
+	Amount         float64 `json:"amount"`                // 为0时按套餐的目录价格
+	CouponCode     string  `json:"coupon_code,omitempty"` // 可选，优惠后的金额为0时记录为赠送
+}
+
+// 单项功能当前是否可用
+type FeatureEntitlement struct {
+	Feature string `json:"feature"`
+	Usable  bool   `json:"usable"`
+}
+
+// 用户当前的权益快照：生效中的订阅及目录中每项功能的可用状态，没有生效中的订阅时所有功能都不可用
+type EntitlementSnapshot struct {
+	UserID   int64                `json:"user_id"`
+	Active   bool                 `json:"active"`
+	Plan     string               `json:"plan,omitempty"`
+	Status   string               `json:"status,omitempty"`
+	EndDate  *time.Time           `json:"end_date,omitempty"`
+	Features []FeatureEntitlement `json:"features"`
+}
+
+// 当前订阅可以变更到的套餐及现在变更需补交的差价
+type PlanOption struct {
+	Plan     string       `json:"plan"`
+	Price    float64      `json:"price"` // 每个计费周期的目录价格，变更后下次续订起按此价格计费
+	Duration PlanDuration `json:"duration"`
+	Features []string     `json:"features"`
+	Charge   float64      `json:"charge"` // 周期中途变更需补交的差价，与 ChangePlan 的计算一致
+}
+
+// 订阅详情
+type SubscriptionDetail struct {
+	Subscription
+	TotalPaid *float64 `json:"total_paid,omitempty"` // 仅在 include=total_paid 时返回
+}
+
+// 续订结果
+type RenewalResponse struct {
+	Message        string    `json:"message"`
+	SubscriptionID int64     `json:"subscription_id"`
+	Status         string    `json:"status"`
+	EndDate        time.Time `json:"end_date"`
+	Amount         float64   `json:"amount"`
+}
+
+// 退款请求
+type RefundRequest struct {
+	PaymentID       int64  `json:"payment_id"`
+	UserID          int64  `json:"user_id"`
+	RefundReference string `json:"refund_reference,omitempty"` // 可选，相同引用的重复请求返回已有的退款
+}
+
+// 套餐变更请求
+type ChangePlanRequest struct {
+	SubscriptionID int64  `json:"subscription_id"`
+	UserID         int64  `json:"user_id"`
+	Plan           string `json:"plan"`
 }
 
 // 取消续订请求
 type CancelRenewalRequest struct {
 	SubscriptionID int64 `json:"subscription_id"`
 	UserID         int64 `json:"user_id"`
+	Immediate      bool  `json:"immediate"` // true 时立即终止访问，false 时保留到当前周期结束
+	Refund         bool  `json:"refund"`    // 立即终止时是否按剩余时长比例退还最近一次支付
 }
 
 // 系统状态响应
 type SystemStats struct {
-	TotalUsers            int       `json:"total_users"`
-	TotalPaymentAmount    float64   `json:"total_payment_amount"`
-	ActiveSubscriptions   int       `json:"active_subscriptions"`
-	NewSubscriptionsMonth int       `json:"new_subscriptions_month"`
-	NewPaymentAmountMonth float64   `json:"new_payment_amount_month"`
-	RenewalsMonth         int       `json:"renewals_month"`
-	RenewalAmountMonth    float64   `json:"renewal_amount_month"`
-	LastUpdated           time.Time `json:"last_updated"`
+	TotalUsers            int            `json:"total_users"`
+	TotalPaymentAmount    float64        `json:"total_payment_amount"`
+	ActiveSubscriptions   int            `json:"active_subscriptions"`
+	ActiveByPlan          map[string]int `json:"active_by_plan"` // 各套餐的活跃订阅数
+	NewSubscriptionsMonth int            `json:"new_subscriptions_month"`
+	NewPaymentAmountMonth float64        `json:"new_payment_amount_month"`
+	RenewalsMonth         int            `json:"renewals_month"`
+	RenewalAmountMonth    float64        `json:"renewal_amount_month"`
+	FailedPayments        int            `json:"failed_payments"` // 支付失败的记录数，用于监控拒付率
+	LastUpdated           time.Time      `json:"last_updated"`
 }
 
 // 时间段查询请求
@@ -103,10 +288,80 @@ type TimeRangeQuery struct {
 	EndTime   time.Time `json:"end_time"`
 }
 
+// 单月的成功支付金额，Month 格式为 2006-01
+type MonthlyRevenue struct {
+	Month   string  `json:"month"`
+	Initial float64 `json:"initial"` // 首次订阅
+	Renewal float64 `json:"renewal"` // 续订
+	Other   float64 `json:"other"`   // 升级差价和退款
+	Total   float64 `json:"total"`
+}
+
+// 月度结账报表：当月成功支付按类型汇总，Month 格式为 2006-01
+type MonthlyReport struct {
+	Month            string  `json:"month"`
+	NewSubscriptions int     `json:"new_subscriptions"` // 首次订阅支付笔数
+	NewRevenue       float64 `json:"new_revenue"`
+	Renewals         int     `json:"renewals"` // 续订支付笔数
+	RenewalRevenue   float64 `json:"renewal_revenue"`
+	Refunds          int     `json:"refunds"`       // 退款笔数
+	RefundAmount     float64 `json:"refund_amount"` // 退款总额，为正数
+	NetRevenue       float64 `json:"net_revenue"`   // 全部成功支付之和，含升级差价并扣除退款
+}
+
+// 单日的计数，Date 格式为 2006-01-02
+type DailyCount struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// 分析数据导出的类别
+const (
+	AnalyticsSubscriptions = "subscriptions" // 每日按套餐统计的激活和试用开始数
+	AnalyticsPayments      = "payments"      // 每日按类型和状态统计的支付笔数和金额
+	AnalyticsChurn         = "churn"         // 每日按套餐统计的取消续订数
+)
+
+// 分析数据导出的一行：按日期和维度聚合的计数，不含用户ID、姓名或邮箱
+type AnalyticsRecord struct {
+	Date     string  `json:"date"`             // 格式为 2006-01-02
+	Category string  `json:"category"`         // 见 Analytics* 常量
+	Event    string  `json:"event"`            // subscriptions 为 activation 或 trial_start，payments 为支付类型，churn 为 cancellation
+	Plan     string  `json:"plan,omitempty"`   // subscriptions 和 churn 按套餐分组
+	Status   string  `json:"status,omitempty"` // payments 按支付状态分组
+	Count    int     `json:"count"`
+	Amount   float64 `json:"amount,omitempty"` // payments 的金额合计
+}
+
+// 转化漏斗：时间段内注册的用户依次到达各阶段的人数及阶段间转化率
+type Funnel struct {
+	Users          int       `json:"users"`           // 注册用户数
+	Trials         int       `json:"trials"`          // 开始试用的用户数
+	Activated      int       `json:"activated"`       // 首次付费激活的用户数，包括未试用直接激活的用户
+	TrialActivated int       `json:"trial_activated"` // 试用过且激活的用户数
+	Renewed        int       `json:"renewed"`         // 续订过的用户数
+	TrialRate      float64   `json:"trial_rate"`      // 试用数 / 注册数
+	ActivationRate float64   `json:"activation_rate"` // 试用过且激活数 / 试用数
+	RenewalRate    float64   `json:"renewal_rate"`    // 续订数 / 激活数
+	StartTime      time.Time `json:"start_time"`
+	EndTime        time.Time `json:"end_time"`
+}
+
 // 时间段统计结果
 type TimeRangeStats struct {
-	PaidUsers     int       `json:"paid_users"`     // 付费用户数
-	TotalPayments float64   `json:"total_payments"` // 付费总金额
-	StartTime     time.Time `json:"start_time"`
-	EndTime       time.Time `json:"end_time"`
+	PaidUsers       int       `json:"paid_users"`       // 付费用户数
+	TotalPayments   float64   `json:"total_payments"`   // 付费总金额
+	InitialPayments float64   `json:"initial_payments"` // 其中首次订阅的付费金额
+	RenewalPayments float64   `json:"renewal_payments"` // 其中续订的付费金额
+	AvgPerUser      float64   `json:"avg_per_user"`     // 付费用户的人均付费金额，按分取整
+	StartTime       time.Time `json:"start_time"`
+	EndTime         time.Time `json:"end_time"`
+}
+
+// 批处理任务的结果汇总，计数只在对应的写入成功后增加，写入失败的订阅只计入 Failed
+// 本次运行前已经处理过（例如当前档位已提醒过）的订阅不计入任何计数
+type BatchSummary struct {
+	Processed int `json:"processed"` // 本次运行中状态或日期更新成功、或到期提醒处理完成的订阅数
+	Notified  int `json:"notified"`  // 处理成功后发送了通知的订阅数，是 Processed 的子集
+	Failed    int `json:"failed"`    // 读取或写入失败、保持原状态的订阅数
 }
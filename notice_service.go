@@ -1,68 +1,168 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 )
 
+const (
+	// 默认通知去重窗口：窗口内同一订阅的同类通知只发送一次
+	defaultNotificationDedupWindow = 10 * time.Minute
+
+	// 失败通知超过该时长后重试
+	notificationRetryDelay = time.Hour
+
+	// 失败通知最多重试次数
+	maxNotificationRetries = 3
+)
+
+// NoticeResult 通知发送结果
+type NoticeResult string
+
+const (
+	NoticeSent         NoticeResult = "sent"         // 已发送
+	NoticeDeduplicated NoticeResult = "deduplicated" // 窗口内已发送过同类通知，本次跳过
+	NoticeSuppressed   NoticeResult = "suppressed"   // 处于通知屏蔽时段，只记录不发送
+	NoticeDeferred     NoticeResult = "deferred"     // 用户当天通知已达上限，推迟到次日发送
+)
+
+// 确认扣款或退款的交易类通知，不受每日通知上限限制
+var dailyLimitExempt = map[string]bool{
+	"renewal_confirmation": true,
+	"welcome_notice":       true,
+	"cancel_confirmation":  true,
+}
+
+// SuppressionWindow 通知屏蔽时段，例如我方故障期间不向用户发送到期和结束通知
+// Start 和 End 均为零值时表示不屏蔽
+type SuppressionWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Contains 判断 t 是否处于屏蔽时段 [Start, End) 内
+func (w SuppressionWindow) Contains(t time.Time) bool {
+	if w.Start.IsZero() && w.End.IsZero() {
+		return false
+	}
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// ErrDeliveryFailed 邮件发送失败，通知记录已以 failed 状态保存
+var ErrDeliveryFailed = errors.New("通知邮件发送失败")
+
+// 各类通知的邮件主题
+var notificationSubjects = map[string]string{
+	"expiration_notice":    "您的订阅即将到期",
+	"final_notice":         "最后提醒：您的订阅即将到期",
+	"renewal_confirmation": "续约成功",
+	"cancel_confirmation":  "已取消自动续约",
+	"subscription_ended":   "您的订阅已结束",
+	"welcome_notice":       "欢迎订阅",
+	"trial_ended":          "免费试用已结束",
+	"payment_failed":       "续订扣款失败",
+}
+
 // NotificationService 处理系统通知
 type NotificationService struct {
-	db *DatabaseService
+	db           *DatabaseService
+	sender       EmailSender
+	channels     map[string]NotificationChannel // email 以外的通知渠道
+	channelOrder map[string][]string            // 各通知类型依次尝试的渠道
+	clock        Clock
+	dedupWindow  time.Duration
+	suppression  SuppressionWindow // 到期和结束通知的屏蔽时段
+	dailyLimit   int               // 每个用户每天最多发送的通知数，0表示不限制
 }
 
 // NewNotificationService 创建通知服务实例
-func NewNotificationService(db *DatabaseService) *NotificationService {
-	return &NotificationService{db: db}
+func NewNotificationService(db *DatabaseService, sender EmailSender) *NotificationService {
+	return &NotificationService{
+		db:           db,
+		sender:       sender,
+		channels:     make(map[string]NotificationChannel),
+		channelOrder: make(map[string][]string),
+		clock:        realClock{},
+		dedupWindow:  defaultNotificationDedupWindow,
+	}
 }
 
 // SendExpirationNotice 发送即将到期通知
-func (s *NotificationService) SendExpirationNotice(userID, subscriptionID int64) error {
+// 去重窗口内已为该订阅发送过到期通知时不再发送，返回 NoticeDeduplicated
+func (s *NotificationService) SendExpirationNotice(userID, subscriptionID int64) (NoticeResult, error) {
+	return s.sendExpiryReminder(userID, subscriptionID, "expiration_notice")
+}
+
+// SendFinalNotice 发送到期前的最后一次提醒，与到期通知分别去重
+func (s *NotificationService) SendFinalNotice(userID, subscriptionID int64) (NoticeResult, error) {
+	return s.sendExpiryReminder(userID, subscriptionID, "final_notice")
+}
+
+// sendExpiryReminder 发送 expiration_notice 或 final_notice 类型的到期提醒
+func (s *NotificationService) sendExpiryReminder(userID, subscriptionID int64, notificationType string) (NoticeResult, error) {
 	// 记录日志
-	log.Printf("正在发送订阅到期通知: 用户ID=%d, 订阅ID=%d", userID, subscriptionID)
+	log.Printf("正在发送订阅到期提醒: 类型=%s, 用户ID=%d, 订阅ID=%d", notificationType, userID, subscriptionID)
+
+	// 检查去重窗口内是否已发送过相同通知
+	sent, err := s.db.HasNotificationSince(subscriptionID, notificationType, s.clock.Now().Add(-s.dedupWindow))
+	if err != nil {
+		log.Printf("检查通知去重失败: %v", err)
+		return "", fmt.Errorf("检查通知去重失败: %w", err)
+	}
+	if sent {
+		log.Printf("订阅 %d 在 %v 内已发送过%s，跳过本次发送", subscriptionID, s.dedupWindow, notificationType)
+		return NoticeDeduplicated, nil
+	}
 
 	// 获取用户信息
-	user, err := s.db.GetUserByID(userID)
+	user, err := s.db.GetUserByID(context.Background(), userID)
 	if err != nil {
 		log.Printf("获取用户信息失败: %v", err)
-		return fmt.Errorf("获取用户信息失败: %w", err)
+		return "", fmt.Errorf("获取用户信息失败: %w", err)
 	}
 
 	// 获取订阅信息
-	subscription, err := s.db.GetSubscriptionByID(subscriptionID)
+	subscription, err := s.db.GetSubscriptionByID(context.Background(), subscriptionID)
 	if err != nil {
 		log.Printf("获取订阅信息失败: %v", err)
-		return fmt.Errorf("获取订阅信息失败: %w", err)
+		return "", fmt.Errorf("获取订阅信息失败: %w", err)
 	}
 
 	// 构建通知内容
-	content := fmt.Sprintf(
-		"亲爱的%s，您的订阅将于%s到期，请考虑是否续订。",
-		user.Name,
-		subscription.EndDate.Format("2006-01-02"),
-	)
-
-	// 在实际系统中，这里会发送邮件或推送通知
-	// 这里仅记录日志和存储通知记录
-	log.Printf("向用户 %d 发送订阅到期通知: %s", userID, content)
+	format := "亲爱的%s，您的订阅将于%s到期，请考虑是否续订。"
+	if notificationType == "final_notice" {
+		format = "亲爱的%s，您的订阅将于%s到期，这是最后一次提醒，如需继续使用请及时续订。"
+	}
+	content := fmt.Sprintf(format, user.Name, subscription.EndDate.Format("2006-01-02"))
 
 	// 记录通知
 	notification := &Notification{
 		UserID:         userID,
 		SubscriptionID: subscriptionID,
-		Type:           "expiration_notice",
+		Type:           notificationType,
 		Content:        content,
-		SentAt:         time.Now(),
-		Status:         "sent",
+		SentAt:         s.clock.Now(),
 	}
 
-	err = s.saveNotification(notification)
-	if err != nil {
-		log.Printf("保存通知记录失败: %v", err)
-		return fmt.Errorf("保存通知记录失败: %w", err)
+	if s.suppression.Contains(notification.SentAt) {
+		if err := s.suppress(notification); err != nil {
+			return "", err
+		}
+		return NoticeSuppressed, nil
 	}
 
-	return nil
+	// 发送邮件，并按发送结果保存通知记录
+	if err := s.deliver(user, notification); err != nil {
+		return "", err
+	}
+	if notification.Status == "deferred" {
+		return NoticeDeferred, nil
+	}
+
+	return NoticeSent, nil
 }
 
 // SendRenewalConfirmation 发送续约成功通知
@@ -71,14 +171,14 @@ func (s *NotificationService) SendRenewalConfirmation(userID, subscriptionID int
 	log.Printf("正在发送续约确认通知: 用户ID=%d, 订阅ID=%d", userID, subscriptionID)
 
 	// 获取用户信息
-	user, err := s.db.GetUserByID(userID)
+	user, err := s.db.GetUserByID(context.Background(), userID)
 	if err != nil {
 		log.Printf("获取用户信息失败: %v", err)
 		return fmt.Errorf("获取用户信息失败: %w", err)
 	}
 
 	// 获取订阅信息
-	subscription, err := s.db.GetSubscriptionByID(subscriptionID)
+	subscription, err := s.db.GetSubscriptionByID(context.Background(), subscriptionID)
 	if err != nil {
 		log.Printf("获取订阅信息失败: %v", err)
 		return fmt.Errorf("获取订阅信息失败: %w", err)
@@ -91,23 +191,18 @@ func (s *NotificationService) SendRenewalConfirmation(userID, subscriptionID int
 		subscription.EndDate.Format("2006-01-02"),
 	)
 
-	// 在实际系统中，这里会发送邮件或推送通知
-	log.Printf("向用户 %d 发送续约成功通知: %s", userID, content)
-
 	// 记录通知
 	notification := &Notification{
 		UserID:         userID,
 		SubscriptionID: subscriptionID,
 		Type:           "renewal_confirmation",
 		Content:        content,
-		SentAt:         time.Now(),
-		Status:         "sent",
+		SentAt:         s.clock.Now(),
 	}
 
-	err = s.saveNotification(notification)
-	if err != nil {
-		log.Printf("保存通知记录失败: %v", err)
-		return fmt.Errorf("保存通知记录失败: %w", err)
+	// 发送邮件，并按发送结果保存通知记录
+	if err := s.deliver(user, notification); err != nil {
+		return err
 	}
 
 	return nil
@@ -119,14 +214,14 @@ func (s *NotificationService) SendCancelConfirmation(userID, subscriptionID int6
 	log.Printf("正在发送取消续约通知: 用户ID=%d, 订阅ID=%d", userID, subscriptionID)
 
 	// 获取用户信息
-	user, err := s.db.GetUserByID(userID)
+	user, err := s.db.GetUserByID(context.Background(), userID)
 	if err != nil {
 		log.Printf("获取用户信息失败: %v", err)
 		return fmt.Errorf("获取用户信息失败: %w", err)
 	}
 
 	// 获取订阅信息
-	subscription, err := s.db.GetSubscriptionByID(subscriptionID)
+	subscription, err := s.db.GetSubscriptionByID(context.Background(), subscriptionID)
 	if err != nil {
 		log.Printf("获取订阅信息失败: %v", err)
 		return fmt.Errorf("获取订阅信息失败: %w", err)
@@ -139,23 +234,18 @@ func (s *NotificationService) SendCancelConfirmation(userID, subscriptionID int6
 		subscription.EndDate.Format("2006-01-02"),
 	)
 
-	// 在实际系统中，这里会发送邮件或推送通知
-	log.Printf("向用户 %d 发送取消续约确认通知: %s", userID, content)
-
 	// 记录通知
 	notification := &Notification{
 		UserID:         userID,
 		SubscriptionID: subscriptionID,
 		Type:           "cancel_confirmation",
 		Content:        content,
-		SentAt:         time.Now(),
-		Status:         "sent",
+		SentAt:         s.clock.Now(),
 	}
 
-	err = s.saveNotification(notification)
-	if err != nil {
-		log.Printf("保存通知记录失败: %v", err)
-		return fmt.Errorf("保存通知记录失败: %w", err)
+	// 发送邮件，并按发送结果保存通知记录
+	if err := s.deliver(user, notification); err != nil {
+		return err
 	}
 
 	return nil
@@ -167,7 +257,7 @@ func (s *NotificationService) SendSubscriptionEndedNotice(userID, subscriptionID
 	log.Printf("正在发送订阅结束通知: 用户ID=%d, 订阅ID=%d", userID, subscriptionID)
 
 	// 获取用户信息
-	user, err := s.db.GetUserByID(userID)
+	user, err := s.db.GetUserByID(context.Background(), userID)
 	if err != nil {
 		log.Printf("获取用户信息失败: %v", err)
 		return fmt.Errorf("获取用户信息失败: %w", err)
@@ -179,21 +269,158 @@ func (s *NotificationService) SendSubscriptionEndedNotice(userID, subscriptionID
 		user.Name,
 	)
 
-	// 在实际系统中，这里会发送邮件或推送通知
-	log.Printf("向用户 %d 发送订阅结束通知: %s", userID, content)
-
 	// 记录通知
 	notification := &Notification{
 		UserID:         userID,
 		SubscriptionID: subscriptionID,
 		Type:           "subscription_ended",
 		Content:        content,
-		SentAt:         time.Now(),
-		Status:         "sent",
+		SentAt:         s.clock.Now(),
+	}
+
+	if s.suppression.Contains(notification.SentAt) {
+		return s.suppress(notification)
+	}
+
+	// 发送邮件，并按发送结果保存通知记录
+	if err := s.deliver(user, notification); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SendWelcomeNotice 发送订阅激活欢迎通知
+func (s *NotificationService) SendWelcomeNotice(userID, subscriptionID int64) error {
+	// 记录日志
+	log.Printf("正在发送欢迎通知: 用户ID=%d, 订阅ID=%d", userID, subscriptionID)
+
+	// 获取用户信息
+	user, err := s.db.GetUserByID(context.Background(), userID)
+	if err != nil {
+		log.Printf("获取用户信息失败: %v", err)
+		return fmt.Errorf("获取用户信息失败: %w", err)
+	}
+
+	// 获取订阅信息
+	subscription, err := s.db.GetSubscriptionByID(context.Background(), subscriptionID)
+	if err != nil {
+		log.Printf("获取订阅信息失败: %v", err)
+		return fmt.Errorf("获取订阅信息失败: %w", err)
+	}
+
+	// 构建通知内容
+	content := fmt.Sprintf(
+		"亲爱的%s，欢迎订阅%s套餐！您的订阅已成功激活，有效期至%s。",
+		user.Name,
+		subscription.Plan,
+		subscription.EndDate.Format("2006-01-02"),
+	)
+
+	// 记录通知
+	notification := &Notification{
+		UserID:         userID,
+		SubscriptionID: subscriptionID,
+		Type:           "welcome_notice",
+		Content:        content,
+		SentAt:         s.clock.Now(),
+	}
+
+	// 发送邮件，并按发送结果保存通知记录
+	if err := s.deliver(user, notification); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// QueueFailedNotification 记录发送失败的通知，等待后续重试
+func (s *NotificationService) QueueFailedNotification(userID, subscriptionID int64, notificationType string) error {
+	log.Printf("记录发送失败的通知以便重试: 用户ID=%d, 订阅ID=%d, 类型=%s", userID, subscriptionID, notificationType)
+
+	notification := &Notification{
+		UserID:         userID,
+		SubscriptionID: subscriptionID,
+		Type:           notificationType,
+		Content:        "",
+		SentAt:         s.clock.Now(),
+		Status:         "failed",
+	}
+
+	if err := s.saveNotification(notification); err != nil {
+		log.Printf("保存失败通知记录失败: %v", err)
+		return fmt.Errorf("保存失败通知记录失败: %w", err)
+	}
+
+	return nil
+}
+
+// deliver 按渠道顺序发送通知，并按发送结果将通知记录保存为 sent 或 failed
+// 用户当天通知已达上限时保存为 deferred，由 SendDeferredNotifications 次日发送
+// 发送失败时返回 ErrDeliveryFailed，此时失败记录已保存，无需调用方重复记录
+func (s *NotificationService) deliver(user *User, notification *Notification) error {
+	if next, err := s.deferUntil(notification.UserID, notification.Type); err != nil {
+		return err
+	} else if !next.IsZero() {
+		log.Printf("用户 %d 当天通知已达上限 %d 条，%s推迟到 %s 发送",
+			notification.UserID, s.dailyLimit, notification.Type, next.Format("2006-01-02"))
+		notification.Status = "deferred"
+		notification.SentAt = next
+		if err := s.saveNotification(notification); err != nil {
+			log.Printf("保存通知记录失败: %v", err)
+			return fmt.Errorf("保存通知记录失败: %w", err)
+		}
+		return nil
+	}
+
+	channel, sendErr := s.dispatch(user, notification.Type, notification.Content)
+	if sendErr != nil {
+		notification.Status = "failed"
+	} else {
+		notification.Status = "sent"
+		notification.Channel = channel
+	}
+
+	if err := s.saveNotification(notification); err != nil {
+		log.Printf("保存通知记录失败: %v", err)
+		return fmt.Errorf("保存通知记录失败: %w", err)
+	}
+
+	if sendErr != nil {
+		return fmt.Errorf("%w: %v", ErrDeliveryFailed, sendErr)
+	}
+
+	return nil
+}
+
+// deferUntil 检查用户当天已发送的通知数，达到上限时返回次日零点，否则返回零值
+func (s *NotificationService) deferUntil(userID int64, notificationType string) (time.Time, error) {
+	if s.dailyLimit <= 0 || dailyLimitExempt[notificationType] {
+		return time.Time{}, nil
 	}
 
-	err = s.saveNotification(notification)
+	now := s.clock.Now()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	nextDay := dayStart.AddDate(0, 0, 1)
+	count, err := s.db.CountUserNotificationsSent(userID, dayStart, nextDay)
 	if err != nil {
+		log.Printf("查询用户 %d 当天通知数失败: %v", userID, err)
+		return time.Time{}, fmt.Errorf("查询用户当天通知数失败: %w", err)
+	}
+	if count < s.dailyLimit {
+		return time.Time{}, nil
+	}
+	return nextDay, nil
+}
+
+// suppress 处于屏蔽时段时只保存 suppressed 状态的通知记录，不实际发送
+// suppressed 记录不计入去重和提醒档位判断，屏蔽时段结束后仍会正常提醒
+func (s *NotificationService) suppress(notification *Notification) error {
+	log.Printf("处于通知屏蔽时段，不发送%s: 用户ID=%d, 订阅ID=%d",
+		notification.Type, notification.UserID, notification.SubscriptionID)
+
+	notification.Status = "suppressed"
+	if err := s.saveNotification(notification); err != nil {
 		log.Printf("保存通知记录失败: %v", err)
 		return fmt.Errorf("保存通知记录失败: %w", err)
 	}
@@ -201,11 +428,61 @@ func (s *NotificationService) SendSubscriptionEndedNotice(userID, subscriptionID
 	return nil
 }
 
+// dispatch 按通知类型配置的渠道顺序依次尝试发送，返回最终送达的渠道
+func (s *NotificationService) dispatch(user *User, notificationType, content string) (string, error) {
+	subject, ok := notificationSubjects[notificationType]
+	if !ok {
+		subject = "订阅通知"
+	}
+
+	order, ok := s.channelOrder[notificationType]
+	if !ok {
+		order = defaultChannelOrder
+	}
+
+	var lastErr error
+	for _, name := range order {
+		channel, ok := s.channel(name)
+		if !ok {
+			log.Printf("通知渠道 %s 未配置，跳过", name)
+			continue
+		}
+
+		if err := channel.Deliver(user, subject, content); err != nil {
+			log.Printf("通过%s向用户 %d 发送%s失败: %v", name, user.ID, notificationType, err)
+			lastErr = err
+			continue
+		}
+
+		log.Printf("通过%s向用户 %d 发送%s成功: %s", name, user.ID, notificationType, content)
+		return name, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("通知类型 %s 没有可用的发送渠道", notificationType)
+	}
+	return "", lastErr
+}
+
+// channel 按名称查找通知渠道，email 渠道始终可用
+func (s *NotificationService) channel(name string) (NotificationChannel, bool) {
+	if name == ChannelEmail {
+		return emailChannel{sender: s.sender}, true
+	}
+	channel, ok := s.channels[name]
+	return channel, ok
+}
+
+// RegisterChannel 注册额外的通知渠道，例如短信
+func (s *NotificationService) RegisterChannel(name string, channel NotificationChannel) {
+	s.channels[name] = channel
+}
+
 // saveNotification 保存通知记录到数据库
 func (s *NotificationService) saveNotification(notification *Notification) error {
 	query := `INSERT INTO notifications 
-              (user_id, subscription_id, type, content, sent_at, status) 
-              VALUES (?, ?, ?, ?, ?, ?)`
+              (user_id, subscription_id, type, content, sent_at, status, channel) 
+              VALUES (?, ?, ?, ?, ?, ?, ?)`
 
 	_, err := s.db.db.Exec(
 		query,
@@ -215,6 +492,7 @@ func (s *NotificationService) saveNotification(notification *Notification) error
 		notification.Content,
 		notification.SentAt,
 		notification.Status,
+		notification.Channel,
 	)
 
 	if err != nil {
@@ -223,3 +501,210 @@ func (s *NotificationService) saveNotification(notification *Notification) error
 
 	return nil
 }
+
+// SendTrialEndedNotice 发送试用结束通知
+func (s *NotificationService) SendTrialEndedNotice(userID, subscriptionID int64) error {
+	// 记录日志
+	log.Printf("正在发送试用结束通知: 用户ID=%d, 订阅ID=%d", userID, subscriptionID)
+
+	// 获取用户信息
+	user, err := s.db.GetUserByID(context.Background(), userID)
+	if err != nil {
+		log.Printf("获取用户信息失败: %v", err)
+		return fmt.Errorf("获取用户信息失败: %w", err)
+	}
+
+	// 构建通知内容
+	content := fmt.Sprintf(
+		"亲爱的%s，您的免费试用已结束，如需继续使用服务，请激活订阅。",
+		user.Name,
+	)
+
+	// 记录通知
+	notification := &Notification{
+		UserID:         userID,
+		SubscriptionID: subscriptionID,
+		Type:           "trial_ended",
+		Content:        content,
+		SentAt:         s.clock.Now(),
+	}
+
+	// 发送邮件，并按发送结果保存通知记录
+	if err := s.deliver(user, notification); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SendPaymentFailedNotice 发送续订扣款失败通知
+func (s *NotificationService) SendPaymentFailedNotice(userID, subscriptionID int64) error {
+	// 记录日志
+	log.Printf("正在发送续订扣款失败通知: 用户ID=%d, 订阅ID=%d", userID, subscriptionID)
+
+	// 获取用户信息
+	user, err := s.db.GetUserByID(context.Background(), userID)
+	if err != nil {
+		log.Printf("获取用户信息失败: %v", err)
+		return fmt.Errorf("获取用户信息失败: %w", err)
+	}
+
+	// 构建通知内容
+	content := fmt.Sprintf(
+		"亲爱的%s，您的订阅续订扣款失败，我们将在之后几天每天自动重试，请确认您的支付方式可用，以免订阅结束。",
+		user.Name,
+	)
+
+	// 记录通知
+	notification := &Notification{
+		UserID:         userID,
+		SubscriptionID: subscriptionID,
+		Type:           "payment_failed",
+		Content:        content,
+		SentAt:         s.clock.Now(),
+	}
+
+	// 发送邮件，并按发送结果保存通知记录
+	if err := s.deliver(user, notification); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RetryFailedNotifications 重试失败超过一小时的通知，每条最多重试3次
+// 已有内容的通知直接重发原内容；发送前就失败的占位记录重新走对应的发送流程
+func (s *NotificationService) RetryFailedNotifications() (int, error) {
+	now := s.clock.Now()
+	notifications, err := s.db.GetRetryableNotifications(now.Add(-notificationRetryDelay), maxNotificationRetries)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("找到 %d 条待重试的失败通知", len(notifications))
+
+	succeeded := 0
+	for _, n := range notifications {
+		// 失败之后已经成功发送过同类通知的，不再重试
+		sent, err := s.db.HasNotificationSince(n.SubscriptionID, n.Type, n.SentAt)
+		if err != nil {
+			log.Printf("检查通知 %d 的后续发送记录失败: %v", n.ID, err)
+			continue
+		}
+		if sent {
+			if err := s.db.UpdateNotificationStatus(n.ID, "superseded"); err != nil {
+				log.Printf("更新通知 %d 状态失败: %v", n.ID, err)
+			}
+			continue
+		}
+
+		if s.retryNotification(n, now) {
+			succeeded++
+		}
+	}
+
+	return succeeded, nil
+}
+
+// SendDeferredNotifications 发送已到期的推迟通知，返回发送成功的条数
+// 用户当天仍达上限的继续推迟到次日；发送失败的转为 failed，由失败重试流程处理
+func (s *NotificationService) SendDeferredNotifications() (int, error) {
+	now := s.clock.Now()
+	notifications, err := s.db.GetDueDeferredNotifications(now)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("找到 %d 条待发送的推迟通知", len(notifications))
+
+	succeeded := 0
+	for _, n := range notifications {
+		next, err := s.deferUntil(n.UserID, n.Type)
+		if err != nil {
+			continue
+		}
+		if !next.IsZero() {
+			if err := s.db.RescheduleNotification(n.ID, next); err != nil {
+				log.Printf("推迟通知 %d 失败: %v", n.ID, err)
+			}
+			continue
+		}
+
+		status, channel := "failed", ""
+		user, err := s.db.GetUserByID(context.Background(), n.UserID)
+		if err != nil {
+			log.Printf("获取用户信息失败: %v", err)
+		} else if channel, err = s.dispatch(user, n.Type, n.Content); err != nil {
+			log.Printf("推迟通知 %d 发送失败: %v", n.ID, err)
+		} else {
+			status = "sent"
+			succeeded++
+		}
+
+		if err := s.db.UpdateNotificationDelivery(n.ID, status, channel, now); err != nil {
+			log.Printf("记录通知 %d 发送结果失败: %v", n.ID, err)
+		}
+	}
+
+	return succeeded, nil
+}
+
+// retryNotification 重试单条失败通知，返回是否发送成功
+func (s *NotificationService) retryNotification(n Notification, now time.Time) bool {
+	log.Printf("重试通知 %d: 类型=%s, 第%d次", n.ID, n.Type, n.RetryCount+1)
+
+	// 占位记录没有内容，重新执行对应的发送流程，新的发送结果会单独记录
+	if n.Content == "" {
+		err := s.sendByType(n)
+		if err == nil || errors.Is(err, ErrDeliveryFailed) {
+			if err := s.db.UpdateNotificationStatus(n.ID, "superseded"); err != nil {
+				log.Printf("更新通知 %d 状态失败: %v", n.ID, err)
+			}
+			return err == nil
+		}
+		log.Printf("重试通知 %d 失败: %v", n.ID, err)
+		if err := s.db.RecordNotificationRetry(n.ID, "failed", "", now); err != nil {
+			log.Printf("记录通知 %d 重试结果失败: %v", n.ID, err)
+		}
+		return false
+	}
+
+	status, channel := "failed", ""
+	user, err := s.db.GetUserByID(context.Background(), n.UserID)
+	if err != nil {
+		log.Printf("获取用户信息失败: %v", err)
+	} else if channel, err = s.dispatch(user, n.Type, n.Content); err != nil {
+		log.Printf("重试通知 %d 发送失败: %v", n.ID, err)
+	} else {
+		status = "sent"
+	}
+
+	if err := s.db.RecordNotificationRetry(n.ID, status, channel, now); err != nil {
+		log.Printf("记录通知 %d 重试结果失败: %v", n.ID, err)
+	}
+
+	return status == "sent"
+}
+
+// sendByType 按通知类型执行发送流程，用于失败重试和后台通知队列
+func (s *NotificationService) sendByType(n Notification) error {
+	switch n.Type {
+	case "expiration_notice", "final_notice":
+		_, err := s.sendExpiryReminder(n.UserID, n.SubscriptionID, n.Type)
+		return err
+	case "renewal_confirmation":
+		return s.SendRenewalConfirmation(n.UserID, n.SubscriptionID)
+	case "cancel_confirmation":
+		return s.SendCancelConfirmation(n.UserID, n.SubscriptionID)
+	case "subscription_ended":
+		return s.SendSubscriptionEndedNotice(n.UserID, n.SubscriptionID)
+	case "welcome_notice":
+		return s.SendWelcomeNotice(n.UserID, n.SubscriptionID)
+	case "trial_ended":
+		return s.SendTrialEndedNotice(n.UserID, n.SubscriptionID)
+	case "payment_failed":
+		return s.SendPaymentFailedNotice(n.UserID, n.SubscriptionID)
+	default:
+		return fmt.Errorf("未知的通知类型: %s", n.Type)
+	}
+}
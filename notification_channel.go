@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 通知渠道名称
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// 未配置渠道顺序的通知类型只通过邮件发送
+var defaultChannelOrder = []string{ChannelEmail}
+
+// NotificationChannel 通知发送渠道，例如邮件、短信
+type NotificationChannel interface {
+	Deliver(user *User, subject, body string) error
+}
+
+// emailChannel 通过邮件发送器投递到用户邮箱
+type emailChannel struct {
+	sender EmailSender
+}
+
+// Deliver 向用户邮箱发送通知
+func (c emailChannel) Deliver(user *User, subject, body string) error {
+	return c.sender.Send(user.Email, subject, body)
+}
+
+// 短信网关请求的超时时间
+const smsGatewayTimeout = 10 * time.Second
+
+// smsGatewayChannel 将通知提交给短信网关发送，用户的手机号由网关按用户ID查找
+type smsGatewayChannel struct {
+	url    string
+	client *http.Client
+}
+
+// newSMSGatewayChannel 创建向 url 提交通知的短信渠道
+func newSMSGatewayChannel(url string) *smsGatewayChannel {
+	return &smsGatewayChannel{url: url, client: &http.Client{Timeout: smsGatewayTimeout}}
+}
+
+// Deliver 以 JSON 提交用户ID、主题和正文，网关返回非2xx状态码时视为发送失败
+func (c *smsGatewayChannel) Deliver(user *User, subject, body string) error {
+	payload, err := json.Marshal(map[string]any{
+		"user_id": user.ID,
+		"subject": subject,
+		"body":    body,
+	})
+	if err != nil {
+		return fmt.Errorf("编码短信请求失败: %w", err)
+	}
+
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("短信网关请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("短信网关返回状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// parseChannelOrder 解析各通知类型的渠道顺序，格式为 "类型=渠道,渠道;类型=渠道"，
+// 例如 "payment_failed=email,sms;subscription_ended=email,sms"
+func parseChannelOrder(value string) (map[string][]string, error) {
+	orders := make(map[string][]string)
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		notificationType, channels, ok := strings.Cut(entry, "=")
+		notificationType = strings.TrimSpace(notificationType)
+		if !ok || notificationType == "" {
+			return nil, fmt.Errorf("渠道顺序格式错误: %s", entry)
+		}
+
+		var order []string
+		for _, name := range strings.Split(channels, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				order = append(order, name)
+			}
+		}
+		if len(order) == 0 {
+			return nil, fmt.Errorf("通知类型 %s 未指定渠道", notificationType)
+		}
+		orders[notificationType] = order
+	}
+	return orders, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// 后台通知队列的默认容量和发送协程数
+const (
+	defaultNotificationQueueSize    = 256
+	defaultNotificationQueueWorkers = 4
+)
+
+// NotificationQueue 后台发送通知的有界队列：固定数量的协程从缓冲通道中取出通知依次发送
+// 队列已满时 Enqueue 阻塞，突发的大量续订只会让请求等待，不会无限制地创建协程同时访问数据库
+type NotificationQueue struct {
+	jobs    chan Notification
+	send    func(Notification) error
+	pending sync.WaitGroup // 已入队但尚未发送完成的通知
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewNotificationQueue 创建容量为 size 的队列并启动 workers 个发送协程，send 负责发送单条通知
+func NewNotificationQueue(size, workers int, send func(Notification) error) *NotificationQueue {
+	q := &NotificationQueue{
+		jobs: make(chan Notification, size),
+		send: send,
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue 将通知加入队列，队列已满时等待空位；队列关闭后不再接收，只记录日志
+func (q *NotificationQueue) Enqueue(n Notification) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		log.Printf("通知队列已关闭，丢弃用户 %d 订阅 %d 的%s通知", n.UserID, n.SubscriptionID, n.Type)
+		return
+	}
+
+	q.pending.Add(1)
+	q.jobs <- n
+	metricNotificationQueueDepth.Set(float64(len(q.jobs)))
+}
+
+// Depth 返回等待发送的通知数
+func (q *NotificationQueue) Depth() int {
+	return len(q.jobs)
+}
+
+// work 依次发送队列中的通知，直到队列关闭且取空
+func (q *NotificationQueue) work() {
+	for n := range q.jobs {
+		metricNotificationQueueDepth.Set(float64(len(q.jobs)))
+		if err := q.send(n); err != nil {
+			log.Printf("发送用户 %d 订阅 %d 的%s通知失败: %v", n.UserID, n.SubscriptionID, n.Type, err)
+		}
+		q.pending.Done()
+	}
+}
+
+// Drain 等待已入队的通知发送完成，ctx 结束时不再等待并返回错误
+func (q *NotificationQueue) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("后台通知已全部发送完成")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("等待后台通知发送超时，仍有 %d 条未发送: %w", q.Depth(), ctx.Err())
+	}
+}
+
+// Close 停止接收新通知，发送协程处理完队列中剩余的通知后退出
+func (q *NotificationQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// ErrTransitionNotAllowed 套餐变更不在允许的转换矩阵中
+var ErrTransitionNotAllowed = errors.New("不允许的套餐变更")
+
+// ErrDowngradeMidCycle 周期中途只能升级到按天计费更高的套餐
+var ErrDowngradeMidCycle = errors.New("周期中途不能降级套餐")
+
+// ErrUnknownPlan 订阅的套餐不在当前套餐目录中
+var ErrUnknownPlan = errors.New("套餐不在目录中")
+
+// ErrWithinCommitment 订阅仍在套餐的最短承诺期内，不能退款
+var ErrWithinCommitment = errors.New("订阅仍在最短承诺期内")
+
+// 续订时套餐不在目录中的处理方式
+const (
+	UnknownPlanReject   = "reject"   // 拒绝续订
+	UnknownPlanFallback = "fallback" // 按后备价格和按月周期续订，并标记支付记录
+)
+
+// PlanDuration 套餐的计费周期，按 time.AddDate 的年、月、日累加
+type PlanDuration struct {
+	Years  int `json:"years,omitempty"`
+	Months int `json:"months,omitempty"`
+	Days   int `json:"days,omitempty"`
+}
+
+// AddTo 返回 t 之后一个计费周期的时间
+func (d PlanDuration) AddTo(t time.Time) time.Time {
+	return t.AddDate(d.Years, d.Months, d.Days)
+}
+
+// SubtractFrom 返回 t 之前一个计费周期的时间，按月累加时月末日期可能与 AddTo 的结果相差几天
+func (d PlanDuration) SubtractFrom(t time.Time) time.Time {
+	return t.AddDate(-d.Years, -d.Months, -d.Days)
+}
+
+// Plan 套餐目录中的一项
+type Plan struct {
+	Name              string       `json:"name"`
+	Duration          PlanDuration `json:"duration"`
+	Price             float64      `json:"price,omitempty"`               // 每个计费周期的价格，用于激活、续订、新周期扣款和套餐变更的差价计算，为0时按 SubscriptionPrice
+	Features          []string     `json:"features,omitempty"`            // 套餐包含的功能
+	MinCommitmentDays int          `json:"min_commitment_days,omitempty"` // 最短承诺期天数，承诺期内不能退款，0表示不限制
+}
+
+// 未在目录中的套餐沿用按月计费
+var defaultPlanDuration = PlanDuration{Months: 1}
+
+// 默认套餐目录
+var defaultPlanCatalog = []Plan{
+	{Name: "basic", Duration: PlanDuration{Months: 1}, Price: 29.99,
+		Features: []string{"standard_content"}},
+	{Name: "premium", Duration: PlanDuration{Months: 1}, Price: 49.99,
+		Features: []string{"standard_content", "premium_content", "offline_download", "priority_support"}},
+	{Name: "quarterly", Duration: PlanDuration{Months: 3}, Price: 79.99,
+		Features: []string{"standard_content", "offline_download"}},
+	{Name: "annual", Duration: PlanDuration{Years: 1}, Price: 299.99,
+		Features: []string{"standard_content", "premium_content", "offline_download", "priority_support"}},
+}
+
+// newPlanCatalog 校验套餐配置并按名称建立索引，未配置时使用默认目录
+func newPlanCatalog(plans []Plan) (map[string]Plan, error) {
+	if len(plans) == 0 {
+		plans = defaultPlanCatalog
+	}
+
+	catalog := make(map[string]Plan, len(plans))
+	for _, plan := range plans {
+		if plan.Name == "" {
+			return nil, fmt.Errorf("套餐名称不能为空")
+		}
+		d := plan.Duration
+		if d.Years < 0 || d.Months < 0 || d.Days < 0 || d == (PlanDuration{}) {
+			return nil, fmt.Errorf("套餐 %s 的计费周期无效: %+v", plan.Name, d)
+		}
+		if plan.Price < 0 {
+			return nil, fmt.Errorf("套餐 %s 的价格无效: %.2f", plan.Name, plan.Price)
+		}
+		if plan.MinCommitmentDays < 0 {
+			return nil, fmt.Errorf("套餐 %s 的最短承诺期无效: %d", plan.Name, plan.MinCommitmentDays)
+		}
+		if plan.Price == 0 {
+			plan.Price = SubscriptionPrice
+		}
+		if _, exists := catalog[plan.Name]; exists {
+			return nil, fmt.Errorf("套餐 %s 重复配置", plan.Name)
+		}
+		catalog[plan.Name] = plan
+	}
+
+	return catalog, nil
+}
+
+// catalogFeatures 返回目录中所有套餐包含的功能，去重后按名称排序
+func catalogFeatures(catalog map[string]Plan) []string {
+	var features []string
+	for _, plan := range catalog {
+		for _, feature := range plan.Features {
+			if !slices.Contains(features, feature) {
+				features = append(features, feature)
+			}
+		}
+	}
+	slices.Sort(features)
+	return features
+}
+
+// upgradeCharge 计算周期中途从 from 变更到 to 需补交的差价，end 为已支付的周期的结束时间
+// 退还旧套餐剩余时长的价值，按新套餐的日均价格收取剩余时长的费用，结果按分取整
+func upgradeCharge(from, to Plan, end, now time.Time) float64 {
+	remaining := end.Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+
+	// 旧套餐当前周期从 end 往前推一个计费周期
+	cycleStart := from.Duration.SubtractFrom(end)
+	credit := from.Price * float64(remaining) / float64(end.Sub(cycleStart))
+	cost := to.Price * float64(remaining) / float64(to.Duration.AddTo(now).Sub(now))
+
+	return math.Round((cost-credit)*100) / 100
+}
+
+// validateUnknownPlanPolicy 校验未知套餐处理方式，未配置时拒绝续订
+func validateUnknownPlanPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return UnknownPlanReject, nil
+	case UnknownPlanReject, UnknownPlanFallback:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("未知套餐处理方式无效: %s", policy)
+	}
+}
+
+// 已续约订阅到期进入新周期时的扣款方式
+const (
+	RenewedCyclePrepaid = "prepaid" // 续约时支付新周期费用，进入新周期时不再扣款
+	RenewedCycleCharge  = "charge"  // 续约时不收费，进入新周期时按套餐价格扣款并记录一笔续订支付
+)
+
+// validateRenewedCyclePolicy 校验已续约订阅进入新周期时的扣款方式，未配置时不再扣款
+func validateRenewedCyclePolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return RenewedCyclePrepaid, nil
+	case RenewedCyclePrepaid, RenewedCycleCharge:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("新周期扣款方式无效: %s", policy)
+	}
+}
+
+// 续订实付金额为0（例如使用全额减免的优惠码）时的处理方式
+const (
+	ZeroAmountRenewalComp   = "comp"   // 不经过扣款，记录一笔 comped 类型的0元支付并正常续订
+	ZeroAmountRenewalReject = "reject" // 拒绝续订
+)
+
+// validateZeroAmountRenewalPolicy 校验0元续订的处理方式，未配置时按赠送处理
+func validateZeroAmountRenewalPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return ZeroAmountRenewalComp, nil
+	case ZeroAmountRenewalComp, ZeroAmountRenewalReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("0元续订处理方式无效: %s", policy)
+	}
+}
+
+// PlanTransitions 允许的套餐变更矩阵：源套餐 -> 可变更到的目标套餐列表
+// 为 nil 时不限制套餐之间的变更
+type PlanTransitions map[string][]string
+
+// Allows 判断是否允许从 from 变更到 to
+func (t PlanTransitions) Allows(from, to string) bool {
+	if t == nil {
+		return true
+	}
+	for _, target := range t[from] {
+		if target == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlanTransition 校验套餐变更，所有变更套餐的操作都应先调用此函数
+func checkPlanTransition(transitions PlanTransitions, from, to string) error {
+	if from == to {
+		return nil
+	}
+	if !transitions.Allows(from, to) {
+		return fmt.Errorf("%w: %s -> %s", ErrTransitionNotAllowed, from, to)
+	}
+	return nil
+}
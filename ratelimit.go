@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 清理空闲令牌桶的间隔
+const rateLimitEvictInterval = 5 * time.Minute
+
+// 令牌桶从空到满所需的时间：桶容量为每分钟请求数，按同样的速率补充，与上限取值无关
+const rateLimitRefillTime = time.Minute
+
+// 不做限流的路径：健康检查和监控指标由基础设施频繁访问
+var rateLimitExemptPaths = map[string]bool{
+	"/healthz": true,
+	"/metrics": true,
+}
+
+// tokenBucket 单个客户端的令牌桶
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter 按客户端IP限流的令牌桶，状态只保存在内存中
+// 每个IP的桶容量为每分钟请求数，令牌按该速率匀速补充
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	limit   func() int // 每分钟请求数，每次请求时读取，修改后立即生效；不大于0时不限流
+	clock   Clock
+	stop    chan struct{}
+}
+
+// NewRateLimiter 创建每个IP每分钟最多 perMinute 个请求的限流器
+func NewRateLimiter(perMinute int) *RateLimiter {
+	return NewDynamicRateLimiter(func() int { return perMinute })
+}
+
+// NewDynamicRateLimiter 创建每次请求时通过 limit 读取每分钟请求数的限流器，用于可在运行时修改的上限
+// 上限调低后已有的桶按新的容量截断，调为0时不再限流
+func NewDynamicRateLimiter(limit func() int) *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		limit:   limit,
+		clock:   realClock{},
+	}
+}
+
+// Allow 为 key 消耗一个令牌；令牌不足时返回 false 和补充一个令牌所需的时间
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	perMinute := l.limit()
+	if perMinute <= 0 {
+		return true, 0
+	}
+	rate := float64(perMinute) / rateLimitRefillTime.Seconds() // 每秒补充的令牌数
+	burst := float64(perMinute)                                // 桶容量
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+		bucket.updated = now
+	}
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Middleware 限流中间件，超出限制时返回429并通过 Retry-After 告知需要等待的秒数
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		if ok, wait := l.Allow(ip); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "请求过于频繁，请稍后重试", http.StatusTooManyRequests)
+			log.Printf("客户端 %s 请求过于频繁，已限流: %s %s", ip, r.Method, r.URL.Path)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// evict 删除已经补满的令牌桶，它们与新建的桶等价，删除不影响限流结果
+func (l *RateLimiter) evict() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	evicted := 0
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= rateLimitRefillTime {
+			delete(l.buckets, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// StartEviction 按 interval 定期清理空闲的令牌桶，避免内存随客户端数量无限增长
+func (l *RateLimiter) StartEviction(interval time.Duration) {
+	l.stop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if evicted := l.evict(); evicted > 0 {
+					log.Printf("已清理 %d 个空闲的限流令牌桶", evicted)
+				}
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止定期清理
+func (l *RateLimiter) Stop() {
+	if l.stop != nil {
+		close(l.stop)
+	}
+}
+
+// clientIP 返回请求的客户端IP
+// 不信任 X-Forwarded-For 等请求头，避免客户端伪造IP绕过限流
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// ErrInvalidSetting 设置项不存在或取值无效
+var ErrInvalidSetting = errors.New("设置项无效")
+
+// 可在运行时修改的设置项
+const (
+	SettingUnknownPlanPolicy = "unknown_plan_policy"   // 续订时套餐不在目录中的处理方式
+	SettingFallbackPlanPrice = "fallback_plan_price"   // 按后备方式续订时的价格
+	SettingRenewedCycle      = "renewed_cycle"         // 已续约订阅进入新周期时的扣款方式
+	SettingZeroAmountRenewal = "zero_amount_renewal"   // 续订实付金额为0时的处理方式
+	SettingExpiryNoticeTiers = "expiry_notice_tiers"   // 到期提醒档位，逗号分隔的提前天数，最大档位即提醒窗口
+	SettingRateLimit         = "rate_limit_per_minute" // 每个客户端IP每分钟最多请求数，0表示不限流
+)
+
+// 新接口的功能开关，同样保存在 settings 表中，关闭后接口返回404，修改后立即生效
+// 最初版本就有的接口不受开关控制；健康检查、监控指标、支付回调、运行时设置和调度器控制接口同样不受控制，
+// 关闭它们会影响监控和收款，或者无法再通过设置接口重新开启开关
+const (
+	FeatureEntitlementSnapshot = "feature_entitlement_snapshot" // 用户权益快照接口
+	FeatureEligiblePlans       = "feature_eligible_plans"       // 可变更套餐接口
+	FeatureRefundsByPlan       = "feature_refunds_by_plan"      // 按套餐统计退款接口
+	FeatureSubscriptionDetail  = "feature_subscription_detail"  // 订阅详情和活跃订阅查询接口
+	FeatureTrial               = "feature_trial"                // 开始试用接口
+	FeatureChangePlan          = "feature_change_plan"          // 变更套餐接口
+	FeatureRefunds             = "feature_refunds"              // 退款接口
+	FeatureAnalytics           = "feature_analytics"            // 收入序列、转化漏斗、月报等分析接口
+	FeatureExports             = "feature_exports"              // 订阅和付款导出接口
+	FeatureUserAdmin           = "feature_user_admin"           // 用户列表、搜索和重发引导邮件接口
+	FeatureAdminTasks          = "feature_admin_tasks"          // 手动触发定时任务和生命周期模拟接口
+	FeatureSubscriptionPatch   = "feature_subscription_patch"   // 管理员修改订阅接口
+	FeatureProcessingFailures  = "feature_processing_failures"  // 处理失败记录的查询和标记接口
+	FeatureRecentActivity      = "feature_recent_activity"      // 最近活动接口
+)
+
+// 功能开关的取值
+const (
+	FeatureOn  = "on"
+	FeatureOff = "off"
+)
+
+// featureFlags 所有功能开关，默认开启，每个开关都须在 settingValidators 中登记
+var featureFlags = []string{
+	FeatureEntitlementSnapshot,
+	FeatureEligiblePlans,
+	FeatureRefundsByPlan,
+	FeatureSubscriptionDetail,
+	FeatureTrial,
+	FeatureChangePlan,
+	FeatureRefunds,
+	FeatureAnalytics,
+	FeatureExports,
+	FeatureUserAdmin,
+	FeatureAdminTasks,
+	FeatureSubscriptionPatch,
+	FeatureProcessingFailures,
+	FeatureRecentActivity,
+}
+
+// validateFeatureFlag 校验功能开关的取值
+func validateFeatureFlag(value string) error {
+	if value != FeatureOn && value != FeatureOff {
+		return fmt.Errorf("只能为 %s 或 %s", FeatureOn, FeatureOff)
+	}
+	return nil
+}
+
+// settingValidators 各设置项的取值校验
+var settingValidators = map[string]func(string) error{
+	SettingUnknownPlanPolicy: func(value string) error {
+		if value != UnknownPlanReject && value != UnknownPlanFallback {
+			return fmt.Errorf("只能为 %s 或 %s", UnknownPlanReject, UnknownPlanFallback)
+		}
+		return nil
+	},
+	SettingRenewedCycle: func(value string) error {
+		if value != RenewedCyclePrepaid && value != RenewedCycleCharge {
+			return fmt.Errorf("只能为 %s 或 %s", RenewedCyclePrepaid, RenewedCycleCharge)
+		}
+		return nil
+	},
+	SettingZeroAmountRenewal: func(value string) error {
+		if value != ZeroAmountRenewalComp && value != ZeroAmountRenewalReject {
+			return fmt.Errorf("只能为 %s 或 %s", ZeroAmountRenewalComp, ZeroAmountRenewalReject)
+		}
+		return nil
+	},
+	SettingFallbackPlanPrice: func(value string) error {
+		price, err := strconv.ParseFloat(value, 64)
+		if err != nil || price <= 0 {
+			return errors.New("必须为正数")
+		}
+		return nil
+	},
+	SettingExpiryNoticeTiers: func(value string) error {
+		_, err := parseNoticeTiers(value)
+		return err
+	},
+	SettingRateLimit: func(value string) error {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return errors.New("必须为非负整数")
+		}
+		return nil
+	},
+
+	FeatureEntitlementSnapshot: validateFeatureFlag,
+	FeatureEligiblePlans:       validateFeatureFlag,
+	FeatureRefundsByPlan:       validateFeatureFlag,
+	FeatureSubscriptionDetail:  validateFeatureFlag,
+	FeatureTrial:               validateFeatureFlag,
+	FeatureChangePlan:          validateFeatureFlag,
+	FeatureRefunds:             validateFeatureFlag,
+	FeatureAnalytics:           validateFeatureFlag,
+	FeatureExports:             validateFeatureFlag,
+	FeatureUserAdmin:           validateFeatureFlag,
+	FeatureAdminTasks:          validateFeatureFlag,
+	FeatureSubscriptionPatch:   validateFeatureFlag,
+	FeatureProcessingFailures:  validateFeatureFlag,
+	FeatureRecentActivity:      validateFeatureFlag,
+}
+
+// SettingsStore 运行时设置，持久化在 settings 表中
+// 读取走内存缓存，更新后使缓存失效，下次读取时重新加载
+type SettingsStore struct {
+	db       *DatabaseService
+	defaults map[string]string // 未在数据库中设置时使用的值，来自启动配置
+
+	mu         sync.RWMutex
+	values     map[string]string // 缓存的生效值，为 nil 时需要重新加载
+	generation uint64            // 每次使缓存失效时递增，用于丢弃失效前开始的加载结果
+}
+
+// NewSettingsStore 创建设置存储，defaults 须覆盖所有设置项
+func NewSettingsStore(db *DatabaseService, defaults map[string]string) *SettingsStore {
+	return &SettingsStore{db: db, defaults: defaults}
+}
+
+// All 返回所有设置项的生效值
+func (s *SettingsStore) All(ctx context.Context) (map[string]string, error) {
+	values, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]string, len(values))
+	for name, value := range values {
+		all[name] = value
+	}
+	return all, nil
+}
+
+// Update 校验并保存设置，任一项无效时不保存任何一项
+func (s *SettingsStore) Update(ctx context.Context, updates map[string]string) error {
+	for name, value := range updates {
+		validate, ok := settingValidators[name]
+		if !ok {
+			return fmt.Errorf("%w: 未知的设置项 %s", ErrInvalidSetting, name)
+		}
+		if err := validate(value); err != nil {
+			return fmt.Errorf("%w: %s %v", ErrInvalidSetting, name, err)
+		}
+	}
+
+	if err := s.db.SaveSettings(ctx, updates); err != nil {
+		return err
+	}
+
+	s.invalidate()
+	return nil
+}
+
+// String 返回设置项的字符串值
+func (s *SettingsStore) String(name string) string {
+	values, err := s.load(context.Background())
+	if err != nil {
+		log.Printf("加载设置失败，使用默认值: %v", err)
+		return s.defaults[name]
+	}
+	return values[name]
+}
+
+// Enabled 返回功能开关是否开启
+func (s *SettingsStore) Enabled(name string) bool {
+	return s.String(name) != FeatureOff
+}
+
+// Float 返回设置项的浮点数值，无法解析时使用默认值
+func (s *SettingsStore) Float(name string) float64 {
+	value, err := strconv.ParseFloat(s.String(name), 64)
+	if err != nil {
+		log.Printf("设置项 %s 不是有效的数值，使用默认值: %v", name, err)
+		value, _ = strconv.ParseFloat(s.defaults[name], 64)
+	}
+	return value
+}
+
+// Int 返回设置项的整数值，无法解析时使用默认值
+func (s *SettingsStore) Int(name string) int {
+	value, err := strconv.Atoi(s.String(name))
+	if err != nil {
+		log.Printf("设置项 %s 不是有效的整数，使用默认值: %v", name, err)
+		value, _ = strconv.Atoi(s.defaults[name])
+	}
+	return value
+}
+
+// load 返回缓存的生效值，缓存失效时从数据库重新加载
+func (s *SettingsStore) load(ctx context.Context) (map[string]string, error) {
+	s.mu.RLock()
+	values, generation := s.values, s.generation
+	s.mu.RUnlock()
+	if values != nil {
+		return values, nil
+	}
+
+	stored, err := s.db.GetSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values = make(map[string]string, len(s.defaults))
+	for name, value := range s.defaults {
+		values[name] = value
+	}
+	for name, value := range stored {
+		if _, ok := settingValidators[name]; ok {
+			values[name] = value
+		}
+	}
+
+	s.store(values, generation)
+	return values, nil
+}
+
+// store 缓存加载结果，加载期间缓存已失效（设置被修改）时丢弃，避免修改前读到的值覆盖新值
+func (s *SettingsStore) store(values map[string]string, generation uint64) {
+	s.mu.Lock()
+	if s.generation == generation {
+		s.values = values
+	}
+	s.mu.Unlock()
+}
+
+// invalidate 使缓存失效，正在进行的加载结果不再写入缓存
+func (s *SettingsStore) invalidate() {
+	s.mu.Lock()
+	s.values = nil
+	s.generation++
+	s.mu.Unlock()
+}
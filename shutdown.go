@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// 时限已过后，后续组件仍以已结束的 ctx 调用，最多再等待这么久，让它们完成不需要等待的清理
+const shutdownStepGrace = 100 * time.Millisecond
+
+// shutdownStep 关闭流程中的一个组件，stop 应在 ctx 结束时尽快返回
+type shutdownStep struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// gracefulShutdown 依次关闭各组件，所有组件共享 timeout 这一个时限
+// 组件未在时限内返回时不再等待，继续以已结束的 ctx 关闭后续组件
+// 返回超时或关闭失败的组件名
+func gracefulShutdown(timeout time.Duration, steps ...shutdownStep) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var laggards []string
+	for _, step := range steps {
+		done := make(chan error, 1)
+		go func() {
+			done <- step.stop(ctx)
+		}()
+
+		wait := ctx
+		if ctx.Err() != nil {
+			var cancelGrace context.CancelFunc
+			wait, cancelGrace = context.WithTimeout(context.Background(), shutdownStepGrace)
+			defer cancelGrace()
+		}
+
+		var err error
+		select {
+		case err = <-done:
+		case <-wait.Done():
+			log.Printf("%s未能在关闭时限 %v 内完成，不再等待", step.name, timeout)
+			laggards = append(laggards, step.name)
+			continue
+		}
+		if err != nil {
+			log.Printf("关闭%s失败: %v", step.name, err)
+			laggards = append(laggards, step.name)
+		}
+	}
+
+	return laggards
+}
@@ -0,0 +1,105 @@
+-- 订阅系统数据库结构
+
+-- 用户表
+CREATE TABLE IF NOT EXISTS users (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE INDEX idx_users_email (email)
+);
+
+-- 订阅表
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    `plan` VARCHAR(50) NOT NULL,
+    start_date DATETIME NOT NULL,
+    end_date DATETIME NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    notification_sent BOOLEAN NOT NULL DEFAULT FALSE,
+    renewal_preference VARCHAR(20) NOT NULL DEFAULT 'undecided',
+    version INT NOT NULL DEFAULT 0,
+    dunning_attempts INT NOT NULL DEFAULT 0,
+    dunning_last_at DATETIME NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_subscriptions_user (user_id),
+    INDEX idx_subscriptions_status_end (status, end_date)
+);
+
+-- 支付记录表
+CREATE TABLE IF NOT EXISTS payments (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    subscription_id BIGINT NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    payment_date DATETIME NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    reason VARCHAR(30) NOT NULL DEFAULT 'standard',
+    original_payment_id BIGINT NULL,
+    coupon_code VARCHAR(50) NULL,
+    refund_reference VARCHAR(64) NULL,
+    INDEX idx_payments_user (user_id),
+    INDEX idx_payments_date (payment_date),
+    INDEX idx_payments_original (original_payment_id),
+    UNIQUE INDEX idx_payments_refund_reference (refund_reference)
+);
+
+-- 优惠码表
+CREATE TABLE IF NOT EXISTS coupons (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    code VARCHAR(50) NOT NULL,
+    discount_type VARCHAR(20) NOT NULL,
+    discount_value DECIMAL(10, 2) NOT NULL,
+    expires_at DATETIME NULL,
+    max_uses INT NOT NULL DEFAULT 1,
+    used_count INT NOT NULL DEFAULT 0,
+    UNIQUE INDEX idx_coupons_code (code)
+);
+
+-- 通知记录表
+CREATE TABLE IF NOT EXISTS notifications (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    subscription_id BIGINT NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    content TEXT NOT NULL,
+    sent_at DATETIME NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    retry_count INT NOT NULL DEFAULT 0,
+    channel VARCHAR(20) NOT NULL DEFAULT '',
+    INDEX idx_notifications_user_type (user_id, type),
+    INDEX idx_notifications_status (status, sent_at)
+);
+
+-- 定时任务处理失败记录表
+CREATE TABLE IF NOT EXISTS processing_failures (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    run_at DATETIME NOT NULL,
+    subscription_id BIGINT NOT NULL,
+    error TEXT NOT NULL,
+    resolved BOOLEAN NOT NULL DEFAULT FALSE,
+    resolved_at DATETIME NULL,
+    INDEX idx_processing_failures_resolved (resolved)
+);
+
+-- 订阅事件审计表
+CREATE TABLE IF NOT EXISTS subscription_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    subscription_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    detail VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    INDEX idx_subscription_events_created (created_at),
+    INDEX idx_subscription_events_subscription (subscription_id)
+);
+
+-- 运行时设置表
+CREATE TABLE IF NOT EXISTS settings (
+    name VARCHAR(100) PRIMARY KEY,
+    value VARCHAR(255) NOT NULL,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
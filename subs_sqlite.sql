@@ -0,0 +1,103 @@
+-- 订阅系统数据库结构（SQLite，测试模式使用，与 subs.sql 保持一致）
+
+-- 用户表
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(100) NOT NULL,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 订阅表
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id BIGINT NOT NULL,
+    plan VARCHAR(50) NOT NULL,
+    start_date DATETIME NOT NULL,
+    end_date DATETIME NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    notification_sent BOOLEAN NOT NULL DEFAULT FALSE,
+    renewal_preference VARCHAR(20) NOT NULL DEFAULT 'undecided',
+    version INT NOT NULL DEFAULT 0,
+    dunning_attempts INT NOT NULL DEFAULT 0,
+    dunning_last_at DATETIME NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user ON subscriptions (user_id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_status_end ON subscriptions (status, end_date);
+
+-- 支付记录表
+CREATE TABLE IF NOT EXISTS payments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id BIGINT NOT NULL,
+    subscription_id BIGINT NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    payment_date DATETIME NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    reason VARCHAR(30) NOT NULL DEFAULT 'standard',
+    original_payment_id BIGINT NULL,
+    coupon_code VARCHAR(50) NULL,
+    refund_reference VARCHAR(64) NULL
+);
+CREATE INDEX IF NOT EXISTS idx_payments_user ON payments (user_id);
+CREATE INDEX IF NOT EXISTS idx_payments_date ON payments (payment_date);
+CREATE INDEX IF NOT EXISTS idx_payments_original ON payments (original_payment_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_refund_reference ON payments (refund_reference);
+
+-- 优惠码表
+CREATE TABLE IF NOT EXISTS coupons (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    code VARCHAR(50) NOT NULL UNIQUE,
+    discount_type VARCHAR(20) NOT NULL,
+    discount_value DECIMAL(10, 2) NOT NULL,
+    expires_at DATETIME NULL,
+    max_uses INT NOT NULL DEFAULT 1,
+    used_count INT NOT NULL DEFAULT 0
+);
+
+-- 通知记录表
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id BIGINT NOT NULL,
+    subscription_id BIGINT NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    content TEXT NOT NULL,
+    sent_at DATETIME NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    retry_count INT NOT NULL DEFAULT 0,
+    channel VARCHAR(20) NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_user_type ON notifications (user_id, type);
+CREATE INDEX IF NOT EXISTS idx_notifications_status ON notifications (status, sent_at);
+
+-- 定时任务处理失败记录表
+CREATE TABLE IF NOT EXISTS processing_failures (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    run_at DATETIME NOT NULL,
+    subscription_id BIGINT NOT NULL,
+    error TEXT NOT NULL,
+    resolved BOOLEAN NOT NULL DEFAULT FALSE,
+    resolved_at DATETIME NULL
+);
+CREATE INDEX IF NOT EXISTS idx_processing_failures_resolved ON processing_failures (resolved);
+
+-- 订阅事件审计表
+CREATE TABLE IF NOT EXISTS subscription_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    subscription_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    detail VARCHAR(255) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_subscription_events_created ON subscription_events (created_at);
+CREATE INDEX IF NOT EXISTS idx_subscription_events_subscription ON subscription_events (subscription_id);
+
+-- 运行时设置表
+CREATE TABLE IF NOT EXISTS settings (
+    name VARCHAR(100) PRIMARY KEY,
+    value VARCHAR(255) NOT NULL,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
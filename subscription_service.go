@@ -1,54 +1,340 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net/mail"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	// 订阅价格（简化起见，统一价格）
 	SubscriptionPrice = 29.99
+
+	// 免费试用天数
+	TrialPeriodDays = 14
 )
 
+// ErrInvalidProfile 用户资料未通过校验
+var ErrInvalidProfile = errors.New("用户资料无效")
+
+// ErrNoActiveSubscription 用户没有生效中的订阅
+var ErrNoActiveSubscription = errors.New("用户没有生效中的订阅")
+
+// ErrInvalidPatch 订阅修改包含不允许的字段或无效的值
+var ErrInvalidPatch = errors.New("订阅修改无效")
+
+// ErrVersionConflict 订阅已被其他操作修改，请求中的版本已过期
+var ErrVersionConflict = errors.New("订阅版本冲突")
+
+// ErrInvalidAmount 支付金额为负数，或按配置不接受0元续订
+var ErrInvalidAmount = errors.New("支付金额无效")
+
+// ErrAlreadyRenewed 订阅已经续约，重复或并发的续订请求不再扣款
+var ErrAlreadyRenewed = errors.New("订阅已续约")
+
+// ErrTrialUsed 用户已经试用过，每个用户只能试用一次
+var ErrTrialUsed = errors.New("用户已经试用过")
+
+// ErrAlreadyRefunded 支付已经退款，不带退款引用的重复请求不再生成退款记录
+var ErrAlreadyRefunded = errors.New("该支付已退款")
+
+// ErrRefundReferenceConflict 退款引用已用于其他支付的退款
+var ErrRefundReferenceConflict = errors.New("退款引用已用于其他支付")
+
+// 关闭订阅服务时默认等待后台通知发送完成的时限
+const defaultNoticeDrainTimeout = 5 * time.Second
+
+// 默认到期提醒档位：到期前3天提醒一次
+var defaultExpiryNoticeTiers = []int{3, 1}
+
 // SubscriptionService 提供订阅系统业务逻辑
 type SubscriptionService struct {
 	db              *DatabaseService
 	cache           *SubscriptionCache
 	notificationSvc *NotificationService
+	notices         *NotificationQueue // 后台发送的通知，关闭时等待发送完成
+	health          *HealthService
+	clock           Clock
+	plans           map[string]Plan // 套餐目录
+	transitions     PlanTransitions // 允许的套餐变更路径
+	settings        *SettingsStore  // 运行时可修改的设置
+	suppressExtend  bool            // 是否顺延到期日处于通知屏蔽时段内的订阅
+	webhookSecret   string          // 支付网关 webhook 签名密钥，非空时激活订阅需等待支付确认
+	drainTimeout    time.Duration   // 关闭时等待后台通知发送完成的时限
+	charger         RenewalCharger  // 新周期续订扣款渠道
 }
 
 // NewSubscriptionService 创建订阅服务实例
-func NewSubscriptionService(dsn string) (*SubscriptionService, error) {
-	db, err := NewDatabaseService(dsn)
+func NewSubscriptionService(config *Config) (*SubscriptionService, error) {
+	noticeTiers, err := normalizeNoticeTiers(config.ExpiryNoticeTiers)
+	if err != nil {
+		return nil, err
+	}
+
+	plans, err := newPlanCatalog(config.Plans)
+	if err != nil {
+		return nil, err
+	}
+
+	unknownPlan, err := validateUnknownPlanPolicy(config.UnknownPlanPolicy)
+	if err != nil {
+		return nil, err
+	}
+	renewedCycle, err := validateRenewedCyclePolicy(config.RenewedCyclePolicy)
+	if err != nil {
+		return nil, err
+	}
+	zeroAmountRenewal, err := validateZeroAmountRenewalPolicy(config.ZeroAmountRenewalPolicy)
+	if err != nil {
+		return nil, err
+	}
+	fallbackPrice := config.FallbackPlanPrice
+	if fallbackPrice <= 0 {
+		fallbackPrice = SubscriptionPrice
+	}
+
+	db, err := NewDatabaseService(config.DatabaseDSN, config.DBStatementTimeout, DBPoolConfig{
+		MaxOpenConns:    config.DBMaxOpenConns,
+		MaxIdleConns:    config.DBMaxIdleConns,
+		ConnMaxLifetime: config.DBConnMaxLifetime,
+	})
 	if err != nil {
 		log.Printf("创建数据库服务失败: %v", err)
 		return nil, fmt.Errorf("创建数据库服务失败: %w", err)
 	}
+	if config.DBKeepaliveInterval > 0 {
+		db.StartKeepalive(config.DBKeepaliveInterval)
+	}
+
+	cache := NewSubscriptionCache(db, config.CacheUpdateInterval)
+	notificationSvc := NewNotificationService(db, newEmailSender(config))
+	if config.NotificationDedupWindow > 0 {
+		notificationSvc.dedupWindow = config.NotificationDedupWindow
+	}
+	if config.NotificationSuppression.End.Before(config.NotificationSuppression.Start) {
+		return nil, fmt.Errorf("通知屏蔽时段无效: %v - %v", config.NotificationSuppression.Start, config.NotificationSuppression.End)
+	}
+	notificationSvc.suppression = config.NotificationSuppression
+	notificationSvc.dailyLimit = config.NotificationDailyLimit
+	for name, channel := range config.NotificationChannels {
+		notificationSvc.RegisterChannel(name, channel)
+	}
+	for notificationType, order := range config.NotificationChannelOrder {
+		notificationSvc.channelOrder[notificationType] = order
+	}
 
-	cache := NewSubscriptionCache(db)
-	notificationSvc := NewNotificationService(db)
+	settingDefaults := map[string]string{
+		SettingUnknownPlanPolicy: unknownPlan,
+		SettingFallbackPlanPrice: strconv.FormatFloat(fallbackPrice, 'f', 2, 64),
+		SettingRenewedCycle:      renewedCycle,
+		SettingZeroAmountRenewal: zeroAmountRenewal,
+		SettingExpiryNoticeTiers: formatNoticeTiers(noticeTiers),
+		SettingRateLimit:         strconv.Itoa(config.RateLimitPerMinute),
+	}
+	for _, name := range featureFlags {
+		settingDefaults[name] = FeatureOn
+	}
 
 	svc := &SubscriptionService{
 		db:              db,
 		cache:           cache,
 		notificationSvc: notificationSvc,
+		notices:         NewNotificationQueue(defaultNotificationQueueSize, defaultNotificationQueueWorkers, notificationSvc.sendByType),
+		health:          NewHealthService(db, config.HealthDependencies),
+		clock:           realClock{},
+		plans:           plans,
+		transitions:     config.PlanTransitions,
+		settings:        NewSettingsStore(db, settingDefaults),
+		suppressExtend:  config.ExtendSuppressed,
+		webhookSecret:   config.PaymentWebhookSecret,
+		drainTimeout:    config.NoticeDrainTimeout,
+		charger:         offlineCharger{},
+	}
+	if svc.drainTimeout <= 0 {
+		svc.drainTimeout = defaultNoticeDrainTimeout
 	}
 
 	return svc, nil
 }
 
+// normalizeNoticeTiers 校验到期提醒档位并按提前天数降序排列，未配置时使用默认档位
+func normalizeNoticeTiers(tiers []int) ([]int, error) {
+	if len(tiers) == 0 {
+		tiers = defaultExpiryNoticeTiers
+	}
+
+	normalized := make([]int, 0, len(tiers))
+	seen := make(map[int]bool)
+	for _, days := range tiers {
+		if days <= 0 {
+			return nil, fmt.Errorf("到期提醒档位必须为正数: %d", days)
+		}
+		if seen[days] {
+			continue
+		}
+		seen[days] = true
+		normalized = append(normalized, days)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(normalized)))
+	return normalized, nil
+}
+
+// parseNoticeTiers 解析逗号分隔的到期提醒档位，例如 "7,3,1"，校验后按提前天数降序排列
+func parseNoticeTiers(value string) ([]int, error) {
+	var tiers []int
+	for _, part := range strings.Split(value, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("到期提醒档位无效: %s", value)
+		}
+		tiers = append(tiers, days)
+	}
+	return normalizeNoticeTiers(tiers)
+}
+
+// formatNoticeTiers 将到期提醒档位格式化为 parseNoticeTiers 接受的形式
+func formatNoticeTiers(tiers []int) string {
+	parts := make([]string, len(tiers))
+	for i, days := range tiers {
+		parts[i] = strconv.Itoa(days)
+	}
+	return strings.Join(parts, ",")
+}
+
+// noticeTiers 返回当前生效的到期提醒档位（提前天数，降序排列），设置无效时使用启动配置的档位
+func (s *SubscriptionService) noticeTiers() []int {
+	tiers, err := parseNoticeTiers(s.settings.String(SettingExpiryNoticeTiers))
+	if err != nil {
+		log.Printf("到期提醒档位设置无效，使用启动配置: %v", err)
+		tiers, _ = parseNoticeTiers(s.settings.defaults[SettingExpiryNoticeTiers])
+	}
+	return tiers
+}
+
+// planDuration 返回套餐的计费周期，目录中不存在的套餐按月计费
+func (s *SubscriptionService) planDuration(name string) PlanDuration {
+	if plan, ok := s.plans[name]; ok {
+		return plan.Duration
+	}
+	log.Printf("套餐 %s 不在目录中，按月计费", name)
+	return defaultPlanDuration
+}
+
+// planPrice 返回套餐每个计费周期的目录价格，套餐不在目录中时按后备价格
+func (s *SubscriptionService) planPrice(name string) float64 {
+	if plan, ok := s.plans[name]; ok {
+		return plan.Price
+	}
+	return s.settings.Float(SettingFallbackPlanPrice)
+}
+
+// setClock 替换服务使用的时间来源
+func (s *SubscriptionService) setClock(clock Clock) {
+	s.clock = clock
+	s.notificationSvc.clock = clock
+}
+
 // 用户API - 获取订阅信息
-func (s *SubscriptionService) GetUserSubscriptionInfo(userID int64) ([]Subscription, error) {
+func (s *SubscriptionService) GetUserSubscriptionInfo(ctx context.Context, userID int64) ([]Subscription, error) {
 	log.Printf("获取用户 %d 的订阅信息", userID)
-	return s.db.GetUserSubscriptions(userID)
+	return s.db.GetUserSubscriptions(ctx, userID)
 }
 
-// 用户API - 获取付款记录
-func (s *SubscriptionService) GetUserPaymentHistory(userID int64) ([]Payment, error) {
-	log.Printf("获取用户 %d 的支付记录", userID)
-	return s.db.GetUserPayments(userID)
+// 用户API - 获取用户当前活跃的订阅，没有时返回 nil
+func (s *SubscriptionService) GetActiveSubscription(ctx context.Context, userID int64) (*Subscription, error) {
+	log.Printf("获取用户 %d 的活跃订阅", userID)
+	return s.db.GetActiveSubscription(ctx, userID)
+}
+
+// 用户API - 获取订阅详情，includeTotalPaid 为 true 时附带累计实付金额
+func (s *SubscriptionService) GetSubscriptionDetail(ctx context.Context, subscriptionID, userID int64, includeTotalPaid bool) (*SubscriptionDetail, error) {
+	log.Printf("获取订阅 %d 的详情", subscriptionID)
+
+	// 只能获取到属于请求用户的订阅
+	subscription, err := s.db.GetSubscriptionByIDForUser(ctx, subscriptionID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &SubscriptionDetail{Subscription: *subscription}
+	if includeTotalPaid {
+		total, err := s.db.GetSubscriptionPaymentTotal(ctx, subscriptionID)
+		if err != nil {
+			return nil, err
+		}
+		detail.TotalPaid = &total
+	}
+
+	return detail, nil
+}
+
+// 用户API - 分页获取付款记录
+func (s *SubscriptionService) GetUserPaymentHistory(ctx context.Context, userID int64, limit, offset int) (*PaymentPage, error) {
+	log.Printf("获取用户 %d 的支付记录: limit=%d, offset=%d", userID, limit, offset)
+
+	payments, total, err := s.db.GetUserPaymentsPaged(ctx, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if payments == nil {
+		payments = []Payment{}
+	}
+
+	return &PaymentPage{Payments: payments, Total: total, Limit: limit, Offset: offset}, nil
+}
+
+// 管理API - 分页列出用户及其最近的订阅，status 不为空时按订阅状态筛选
+func (s *SubscriptionService) ListUsers(ctx context.Context, status string, limit, offset int) (*UserPage, error) {
+	log.Printf("获取用户列表: status=%s, limit=%d, offset=%d", status, limit, offset)
+
+	users, total, err := s.db.ListUsers(ctx, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if users == nil {
+		users = []UserWithSubscription{}
+	}
+
+	return &UserPage{Users: users, Total: total, Limit: limit, Offset: offset}, nil
+}
+
+// 用户搜索默认返回的最大条数
+const defaultUserSearchLimit = 25
+
+// 管理API - 按用户名或邮箱的部分内容搜索用户，limit 不大于0时使用默认值
+func (s *SubscriptionService) SearchUsers(ctx context.Context, query string, limit int) ([]User, error) {
+	if limit <= 0 {
+		limit = defaultUserSearchLimit
+	}
+	log.Printf("搜索用户: q=%s, limit=%d", query, limit)
+
+	users, err := s.db.SearchUsers(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if users == nil {
+		users = []User{}
+	}
+	return users, nil
+}
+
+// 检查服务及其依赖的健康状态
+func (s *SubscriptionService) CheckHealth() HealthReport {
+	return s.health.Check()
 }
 
 // 管理API - 获取实时统计数据
@@ -58,35 +344,229 @@ func (s *SubscriptionService) GetSystemStats() SystemStats {
 }
 
 // 管理API - 按时间段查询付费数据
-func (s *SubscriptionService) GetPaymentStatsByTimeRange(query TimeRangeQuery) (*TimeRangeStats, error) {
+func (s *SubscriptionService) GetPaymentStatsByTimeRange(ctx context.Context, query TimeRangeQuery) (*TimeRangeStats, error) {
 	log.Printf("按时间段查询付费数据: %s - %s",
 		query.StartTime.Format("2006-01-02"),
 		query.EndTime.Format("2006-01-02"))
 
-	return s.db.GetPaymentStatsByTimeRange(query.StartTime, query.EndTime)
+	stats, err := s.db.GetPaymentStatsByTimeRange(ctx, query.StartTime, query.EndTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.PaidUsers > 0 {
+		stats.AvgPerUser = math.Round(stats.TotalPayments/float64(stats.PaidUsers)*100) / 100
+	}
+	return stats, nil
+}
+
+// 管理API - 按套餐查询时间段内的退款金额
+func (s *SubscriptionService) GetRefundsByPlan(ctx context.Context, start, end time.Time) (map[string]float64, error) {
+	log.Printf("按套餐查询退款金额: %s - %s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+
+	return s.db.GetRefundsByPlan(ctx, start, end)
+}
+
+// 管理API - 按月查询时间段内的收入，没有支付的月份补零，按月份升序返回
+func (s *SubscriptionService) GetMonthlyRevenueSeries(ctx context.Context, start, end time.Time) ([]MonthlyRevenue, error) {
+	log.Printf("查询月度收入序列: %s - %s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+
+	buckets, err := s.db.GetMonthlyRevenueSeries(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	byMonth := make(map[string]MonthlyRevenue, len(buckets))
+	for _, bucket := range buckets {
+		byMonth[bucket.Month] = bucket
+	}
+
+	series := []MonthlyRevenue{}
+	for month := monthStartUTC(start); !month.After(end.UTC()); month = month.AddDate(0, 1, 0) {
+		key := month.Format("2006-01")
+		bucket, ok := byMonth[key]
+		if !ok {
+			bucket = MonthlyRevenue{Month: key}
+		}
+		series = append(series, bucket)
+	}
+
+	return series, nil
+}
+
+// 管理API - 按天查询时间段内的新用户数，没有注册的日期补零，按日期升序返回
+func (s *SubscriptionService) GetNewUserCounts(ctx context.Context, start, end time.Time) ([]DailyCount, error) {
+	log.Printf("查询每日新用户数: %s - %s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+
+	counts, err := s.db.GetNewUserCounts(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	byDate := make(map[string]int, len(counts))
+	for _, count := range counts {
+		byDate[count.Date] = count.Count
+	}
+
+	start, end = start.UTC(), end.UTC()
+	series := []DailyCount{}
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC); !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		series = append(series, DailyCount{Date: date, Count: byDate[date]})
+	}
+
+	return series, nil
+}
+
+// 管理API - 按筛选条件逐条导出订阅
+func (s *SubscriptionService) ExportSubscriptions(ctx context.Context, filter SubscriptionFilter, fn func(*Subscription) error) error {
+	log.Printf("导出订阅: status=%s, plan=%s", filter.Status, filter.Plan)
+	return s.db.EachSubscription(ctx, filter, fn)
+}
+
+// 管理API - 逐条导出时间段内的成功支付，用于财务对账
+func (s *SubscriptionService) ExportPayments(ctx context.Context, start, end time.Time, fn func(*Payment) error) error {
+	log.Printf("导出支付记录: %s - %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	return s.db.StreamPaymentsByTimeRange(ctx, start, end, fn)
+}
+
+// 管理API - 依次导出 categories 中各类别的匿名聚合分析数据，为空时导出全部类别
+func (s *SubscriptionService) ExportAnalytics(ctx context.Context, start, end time.Time, categories []string, fn func(*AnalyticsRecord) error) error {
+	if len(categories) == 0 {
+		categories = []string{AnalyticsSubscriptions, AnalyticsPayments, AnalyticsChurn}
+	}
+	log.Printf("导出分析数据: %s - %s, 类别: %v", start.Format(time.RFC3339), end.Format(time.RFC3339), categories)
+
+	for _, category := range categories {
+		if err := s.db.StreamAnalytics(ctx, category, start, end, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 管理API - 查询时间段内的转化漏斗
+func (s *SubscriptionService) GetConversionFunnel(ctx context.Context, start, end time.Time) (*Funnel, error) {
+	log.Printf("查询转化漏斗: %s - %s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+
+	funnel, err := s.db.GetConversionFunnel(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	funnel.TrialRate = conversionRate(funnel.Trials, funnel.Users)
+	// 未试用直接激活的用户不经过试用阶段，只按试用过的用户计算激活率
+	funnel.ActivationRate = conversionRate(funnel.TrialActivated, funnel.Trials)
+	funnel.RenewalRate = conversionRate(funnel.Renewed, funnel.Activated)
+
+	return funnel, nil
+}
+
+// 管理API - 查询 [start, end] 内激活的订阅从激活到做出续订或取消决定的平均时长
+func (s *SubscriptionService) GetAvgTimeToDecision(ctx context.Context, start, end time.Time) (time.Duration, error) {
+	log.Printf("查询平均续订决定时长: %s - %s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+
+	return s.db.GetAvgTimeToDecision(ctx, start, end)
+}
+
+// conversionRate 计算阶段转化率，上一阶段为0时返回0
+func conversionRate(count, previous int) float64 {
+	if previous == 0 {
+		return 0
+	}
+	return float64(count) / float64(previous)
+}
+
+// 管理API - 预测 month 所在月份的续订收入
+func (s *SubscriptionService) GetProjectedRevenue(ctx context.Context, month time.Time) (float64, error) {
+	monthStart := monthStartUTC(month)
+	log.Printf("预测 %s 的续订收入", monthStart.Format("2006-01"))
+
+	prices := make(map[string]float64, len(s.plans))
+	for name, plan := range s.plans {
+		prices[name] = plan.Price
+	}
+	return s.db.GetProjectedRevenue(ctx, monthStart, monthStart.AddDate(0, 1, 0), prices, s.settings.Float(SettingFallbackPlanPrice))
+}
+
+// 管理API - 生成 month 所在月份的结账报表
+func (s *SubscriptionService) GetMonthlyReport(ctx context.Context, month time.Time) (*MonthlyReport, error) {
+	monthStart := monthStartUTC(month)
+	log.Printf("生成 %s 的月度报表", monthStart.Format("2006-01"))
+
+	report, err := s.db.GetMonthlyReport(ctx, monthStart, monthStart.AddDate(0, 1, 0))
+	if err != nil {
+		return nil, err
+	}
+	report.Month = monthStart.Format("2006-01")
+
+	return report, nil
+}
+
+// 管理API - 获取所有运行时设置
+func (s *SubscriptionService) GetSettings(ctx context.Context) (map[string]string, error) {
+	return s.settings.All(ctx)
+}
+
+// 管理API - 更新运行时设置，立即生效
+func (s *SubscriptionService) UpdateSettings(ctx context.Context, updates map[string]string) error {
+	log.Printf("更新运行时设置: %v", updates)
+	return s.settings.Update(ctx, updates)
+}
+
+// FeatureEnabled 返回功能开关是否开启
+func (s *SubscriptionService) FeatureEnabled(name string) bool {
+	return s.settings.Enabled(name)
+}
+
+// RateLimitPerMinute 返回当前生效的每个客户端IP每分钟请求上限，0表示不限流
+func (s *SubscriptionService) RateLimitPerMinute() int {
+	return s.settings.Int(SettingRateLimit)
+}
+
+// 管理API - 获取全系统最近动态
+func (s *SubscriptionService) GetRecentActivity(ctx context.Context, limit int) ([]ActivityEvent, error) {
+	log.Printf("获取最近 %d 条系统动态", limit)
+	return s.db.GetRecentActivity(ctx, limit)
 }
 
 // 创建新用户
-func (s *SubscriptionService) CreateUser(name, email string) (int64, error) {
+func (s *SubscriptionService) CreateUser(ctx context.Context, name, email string) (int64, error) {
 	if name == "" || email == "" {
-		return 0, errors.New("用户名和邮箱不能为空")
+		return 0, fmt.Errorf("%w: 用户名和邮箱不能为空", ErrInvalidProfile)
+	}
+	if err := validateEmail(email); err != nil {
+		log.Printf("创建用户失败: %v", err)
+		return 0, err
 	}
 
 	log.Printf("创建新用户: name=%s, email=%s", name, email)
 
+	// 先在应用层检查邮箱是否已被使用，并发插入时仍由唯一索引兜底
+	existing, err := s.db.GetUserByEmail(ctx, email)
+	if err == nil {
+		log.Printf("邮箱 %s 已被用户 %d 使用", email, existing.ID)
+		return 0, fmt.Errorf("%w: %s", ErrDuplicateEmail, email)
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		log.Printf("检查邮箱失败: %v", err)
+		return 0, err
+	}
+
 	user := &User{
 		Name:  name,
 		Email: email,
 	}
 
-	userID, err := s.db.CreateUser(user)
+	userID, err := s.db.CreateUser(ctx, user)
 	if err != nil {
 		log.Printf("创建用户失败: %v", err)
 		return 0, err
 	}
+	s.cache.apply(statsDelta{users: 1})
 
 	// 为用户创建未激活订阅
-	err = s.CreateInactiveSubscription(userID)
+	err = s.CreateInactiveSubscription(ctx, userID)
 	if err != nil {
 		log.Printf("为用户 %d 创建初始未激活订阅失败: %v", userID, err)
 		return userID, fmt.Errorf("创建用户成功但初始化订阅失败: %w", err)
@@ -96,8 +576,127 @@ func (s *SubscriptionService) CreateUser(name, email string) (int64, error) {
 	return userID, nil
 }
 
+// 查询单个用户
+func (s *SubscriptionService) GetUser(ctx context.Context, userID int64) (*User, error) {
+	log.Printf("查询用户 %d", userID)
+	return s.db.GetUserByID(ctx, userID)
+}
+
+// 重新发送新用户引导通知（欢迎通知），供客服为不清楚如何使用的新用户补发
+// 欢迎通知介绍的是已激活的订阅，用户没有生效中的订阅时返回 ErrNoActiveSubscription
+// 用户表没有邮箱验证状态，系统也不发送验证邮件，因此引导流程只包含欢迎通知，不补发验证邮件
+func (s *SubscriptionService) ResendOnboarding(ctx context.Context, userID int64) error {
+	log.Printf("重新发送用户 %d 的引导通知", userID)
+
+	if _, err := s.db.GetUserByID(ctx, userID); err != nil {
+		log.Printf("获取用户信息失败: %v", err)
+		return err
+	}
+
+	subscriptions, err := s.db.GetUserSubscriptions(ctx, userID)
+	if err != nil {
+		log.Printf("获取用户订阅失败: %v", err)
+		return err
+	}
+
+	for _, sub := range subscriptions {
+		if sub.Status != StatusSubscribed && sub.Status != StatusRenewed {
+			continue
+		}
+		if err := s.notificationSvc.SendWelcomeNotice(userID, sub.ID); err != nil {
+			log.Printf("重新发送欢迎通知失败: %v", err)
+			return err
+		}
+		log.Printf("用户 %d 的欢迎通知已重新发送", userID)
+		return nil
+	}
+
+	return fmt.Errorf("%w: 用户ID=%d", ErrNoActiveSubscription, userID)
+}
+
+// 获取用户当前的权益快照
+// 试用、已订阅和已续约且尚未到期的订阅视为生效，有多个时取到期最晚的一个
+func (s *SubscriptionService) GetEntitlementSnapshot(ctx context.Context, userID int64) (*EntitlementSnapshot, error) {
+	log.Printf("获取用户 %d 的权益快照", userID)
+
+	if _, err := s.db.GetUserByID(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	subscriptions, err := s.db.GetUserSubscriptions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.clock.Now()
+	var active *Subscription
+	for i, sub := range subscriptions {
+		switch sub.Status {
+		case StatusTrial, StatusSubscribed, StatusRenewed:
+		default:
+			continue
+		}
+		if !sub.EndDate.After(now) {
+			continue
+		}
+		if active == nil || sub.EndDate.After(active.EndDate) {
+			active = &subscriptions[i]
+		}
+	}
+
+	snapshot := &EntitlementSnapshot{UserID: userID}
+	var usable []string
+	if active != nil {
+		snapshot.Active = true
+		snapshot.Plan = active.Plan
+		snapshot.Status = active.Status
+		snapshot.EndDate = &active.EndDate
+		usable = s.plans[active.Plan].Features
+	}
+
+	for _, feature := range catalogFeatures(s.plans) {
+		snapshot.Features = append(snapshot.Features, FeatureEntitlement{
+			Feature: feature,
+			Usable:  slices.Contains(usable, feature),
+		})
+	}
+	if snapshot.Features == nil {
+		snapshot.Features = []FeatureEntitlement{}
+	}
+
+	return snapshot, nil
+}
+
+// 更新用户资料（姓名和邮箱）
+func (s *SubscriptionService) UpdateUserProfile(ctx context.Context, userID int64, name, email string) error {
+	name, email = strings.TrimSpace(name), strings.TrimSpace(email)
+	if name == "" || email == "" {
+		return fmt.Errorf("%w: 用户名和邮箱不能为空", ErrInvalidProfile)
+	}
+	if err := validateEmail(email); err != nil {
+		return err
+	}
+
+	log.Printf("更新用户 %d 的资料: name=%s, email=%s", userID, name, email)
+
+	if err := s.db.UpdateUser(ctx, userID, name, email); err != nil {
+		log.Printf("更新用户资料失败: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// validateEmail 检查邮箱格式，只接受不带显示名的纯地址，例如 user@example.com
+func validateEmail(email string) error {
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return fmt.Errorf("%w: 邮箱格式不正确: %s", ErrInvalidProfile, email)
+	}
+	return nil
+}
+
 // 创建未激活订阅
-func (s *SubscriptionService) CreateInactiveSubscription(userID int64) error {
+func (s *SubscriptionService) CreateInactiveSubscription(ctx context.Context, userID int64) error {
 	log.Printf("为用户 %d 创建未激活订阅", userID)
 
 	now := time.Now()
@@ -114,7 +713,7 @@ func (s *SubscriptionService) CreateInactiveSubscription(userID int64) error {
 	}
 
 	// 开始事务
-	tx, err := s.db.BeginTx()
+	tx, err := s.db.BeginTx(ctx)
 	if err != nil {
 		log.Printf("开始事务失败: %v", err)
 		return fmt.Errorf("开始事务失败: %w", err)
@@ -128,7 +727,7 @@ func (s *SubscriptionService) CreateInactiveSubscription(userID int64) error {
 	}()
 
 	// 创建订阅记录
-	result, err := tx.Exec(
+	result, err := tx.ExecContext(ctx,
 		`INSERT INTO subscriptions 
         (user_id, plan, start_date, end_date, status, notification_sent, renewal_preference) 
         VALUES (?, ?, ?, ?, ?, ?, ?)`,
@@ -161,28 +760,30 @@ func (s *SubscriptionService) CreateInactiveSubscription(userID int64) error {
 		return fmt.Errorf("提交事务失败: %w", err)
 	}
 
-	// 刷新缓存
-	if err = s.cache.refreshCache(); err != nil {
-		log.Printf("刷新缓存失败: %v", err)
-	}
-
 	return nil
 }
 
-// 激活订阅（支付首次订阅费）
-func (s *SubscriptionService) ActivateSubscription(userID int64, plan string) error {
+// 激活订阅（支付首次订阅费），couponCode 为空时按目录价格收费
+func (s *SubscriptionService) ActivateSubscription(ctx context.Context, userID int64, plan, couponCode string) error {
 	log.Printf("激活用户 %d 的订阅，计划: %s", userID, plan)
 
+	// 只能激活目录中的套餐
+	if _, ok := s.plans[plan]; !ok {
+		log.Printf("套餐 %s 不在目录中，拒绝激活", plan)
+		return fmt.Errorf("%w: %s", ErrUnknownPlan, plan)
+	}
+
 	// 检查是否有未激活订阅
-	subscriptions, err := s.db.GetUserSubscriptions(userID)
+	subscriptions, err := s.db.GetUserSubscriptions(ctx, userID)
 	if err != nil {
 		log.Printf("获取用户订阅失败: %v", err)
 		return err
 	}
 
+	// 试用中的订阅可以直接转为付费订阅
 	var inactiveSubscription *Subscription
 	for _, sub := range subscriptions {
-		if sub.Status == StatusInactive {
+		if sub.Status == StatusInactive || sub.Status == StatusTrial {
 			inactiveSubscription = &sub
 			break
 		}
@@ -193,8 +794,21 @@ func (s *SubscriptionService) ActivateSubscription(userID int64, plan string) er
 		return errors.New("找不到未激活的订阅")
 	}
 
+	now := time.Now()
+	amount, reason := s.planPrice(plan), PaymentReasonStandard
+
+	// 校验优惠码，无效时不激活
+	if couponCode != "" {
+		amount, err = s.applyCoupon(ctx, couponCode, amount, now)
+		if err != nil {
+			return err
+		}
+		reason = PaymentReasonCoupon
+		log.Printf("用户 %d 使用优惠码 %s，实付金额: %.2f", userID, couponCode, amount)
+	}
+
 	// 开始事务
-	tx, err := s.db.BeginTx()
+	tx, err := s.db.BeginTx(ctx)
 	if err != nil {
 		log.Printf("开始事务失败: %v", err)
 		return fmt.Errorf("开始事务失败: %w", err)
@@ -207,38 +821,67 @@ func (s *SubscriptionService) ActivateSubscription(userID int64, plan string) er
 		}
 	}()
 
-	// 更新订阅信息
-	now := time.Now()
-	endDate := now.AddDate(0, 1, 0) // 订阅一个月
-
-	_, err = tx.Exec(
-		`UPDATE subscriptions 
-        SET plan = ?, status = ?, start_date = ?, end_date = ?, notification_sent = ? 
-        WHERE id = ?`,
-		plan,
-		StatusSubscribed,
-		now,
-		endDate,
-		false, // 重置通知状态
-		inactiveSubscription.ID,
-	)
+	// 锁定订阅后再检查状态和待确认的首次支付，重复的激活请求不会再次创建支付或占用优惠码
+	var status string
+	err = tx.QueryRowContext(ctx, s.db.ForUpdate(`SELECT status FROM subscriptions WHERE id = ?`), inactiveSubscription.ID).Scan(&status)
+	if err != nil {
+		log.Printf("获取订阅状态失败: %v", err)
+		return fmt.Errorf("获取订阅状态失败: %w", err)
+	}
+	if status != StatusInactive && status != StatusTrial {
+		log.Printf("订阅 %d 已被其他请求激活", inactiveSubscription.ID)
+		err = errors.New("找不到未激活的订阅")
+		return err
+	}
+	var pending int
+	err = tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM payments WHERE subscription_id = ? AND type = ? AND status = ?`,
+		inactiveSubscription.ID, "initial", StatusPending,
+	).Scan(&pending)
+	if err != nil {
+		log.Printf("查询待确认支付失败: %v", err)
+		return fmt.Errorf("查询待确认支付失败: %w", err)
+	}
+	if pending > 0 {
+		log.Printf("订阅 %d 已有待确认的首次支付", inactiveSubscription.ID)
+		err = fmt.Errorf("%w: 订阅 %d", ErrActivationPending, inactiveSubscription.ID)
+		return err
+	}
+
+	// 占用一次优惠码使用次数，并发使用同一优惠码时只有一个请求成功
+	if couponCode != "" {
+		if err = redeemCoupon(ctx, tx, couponCode); err != nil {
+			log.Printf("占用优惠码失败: %v", err)
+			return err
+		}
+	}
 
+	// 配置了支付网关时只记录套餐并创建待确认的支付记录，由 webhook 确认支付成功后再激活
+	paymentStatus := StatusSuccess
+	if s.webhookSecret != "" {
+		paymentStatus = StatusPending
+		_, err = tx.ExecContext(ctx, `UPDATE subscriptions SET plan = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, plan, inactiveSubscription.ID)
+	} else {
+		err = s.activateInTx(ctx, tx, inactiveSubscription.ID, plan, now)
+	}
 	if err != nil {
 		log.Printf("更新订阅状态失败: %v", err)
 		return fmt.Errorf("更新订阅状态失败: %w", err)
 	}
 
-	// 创建支付记录
-	_, err = tx.Exec(
+	// 创建支付记录，记录使用的优惠码以便支付失败时归还
+	_, err = tx.ExecContext(ctx,
 		`INSERT INTO payments 
-        (user_id, subscription_id, amount, payment_date, status, type) 
-        VALUES (?, ?, ?, ?, ?, ?)`,
+        (user_id, subscription_id, amount, payment_date, status, type, reason, coupon_code) 
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
 		userID,
 		inactiveSubscription.ID,
-		SubscriptionPrice,
+		amount,
 		now,
-		"success",
+		paymentStatus,
 		"initial",
+		reason,
+		sql.NullString{String: couponCode, Valid: couponCode != ""},
 	)
 
 	if err != nil {
@@ -252,41 +895,89 @@ func (s *SubscriptionService) ActivateSubscription(userID int64, plan string) er
 		return fmt.Errorf("提交事务失败: %w", err)
 	}
 
-	log.Printf("用户 %d 的订阅激活成功", userID)
-
-	// 刷新缓存
-	if err = s.cache.refreshCache(); err != nil {
-		log.Printf("刷新缓存失败: %v", err)
+	if paymentStatus == StatusPending {
+		log.Printf("用户 %d 的订阅等待支付确认", userID)
+		return nil
 	}
 
+	log.Printf("用户 %d 的订阅激活成功", userID)
+	s.afterActivation(userID, inactiveSubscription.ID, plan, amount)
+
 	return nil
 }
 
-// 处理续订请求
-func (s *SubscriptionService) RenewSubscription(request RenewalRequest) error {
-	log.Printf("处理续订请求: 订阅ID=%d, 用户ID=%d", request.SubscriptionID, request.UserID)
+// activateInTx 在事务中将订阅更新为已订阅，并按套餐计费周期从 now 开始新周期
+func (s *SubscriptionService) activateInTx(ctx context.Context, tx *sql.Tx, subscriptionID int64, plan string, now time.Time) error {
+	endDate := s.planDuration(plan).AddTo(now) // 按套餐计费周期计算到期时间
 
-	// 获取订阅信息
-	subscription, err := s.db.GetSubscriptionByID(request.SubscriptionID)
-	if err != nil {
-		log.Printf("获取订阅信息失败: %v", err)
-		return err
+	_, err := tx.ExecContext(ctx,
+		`UPDATE subscriptions 
+        SET plan = ?, status = ?, start_date = ?, end_date = ?, notification_sent = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP 
+        WHERE id = ?`,
+		plan,
+		StatusSubscribed,
+		now,
+		endDate,
+		false, // 重置通知状态
+		subscriptionID,
+	)
+	return err
+}
+
+// afterActivation 激活成功后更新统计并发送欢迎通知，amount 为首次订阅的实付金额
+func (s *SubscriptionService) afterActivation(userID, subscriptionID int64, plan string, amount float64) {
+	s.cache.apply(statsDelta{
+		activeByPlan:     map[string]int{plan: 1},
+		paymentAmount:    amount,
+		newSubscriptions: 1,
+		newPaymentAmount: amount,
+	})
+
+	// 发送欢迎通知，失败时记录待重试而不影响已完成的激活
+	if err := s.notificationSvc.SendWelcomeNotice(userID, subscriptionID); err != nil {
+		log.Printf("发送欢迎通知失败，加入重试队列: %v", err)
+		// 邮件发送失败时失败记录已保存，其他失败需要单独记录
+		if !errors.Is(err, ErrDeliveryFailed) {
+			if err := s.notificationSvc.QueueFailedNotification(userID, subscriptionID, "welcome_notice"); err != nil {
+				log.Printf("记录待重试的欢迎通知失败: %v", err)
+			}
+		}
 	}
+}
 
-	// 验证用户ID
-	if subscription.UserID != request.UserID {
-		log.Printf("用户ID不匹配: 订阅所属用户=%d, 请求用户=%d", subscription.UserID, request.UserID)
-		return errors.New("用户ID与订阅不匹配")
+// PaymentsAsync 是否通过支付网关 webhook 异步确认支付
+func (s *SubscriptionService) PaymentsAsync() bool {
+	return s.webhookSecret != ""
+}
+
+// HandlePaymentWebhook 校验支付网关回调的签名并按支付结果更新待确认的支付记录
+// 支付成功时激活对应订阅，失败时订阅保持原状态；重复回调相同结果时直接返回成功
+func (s *SubscriptionService) HandlePaymentWebhook(ctx context.Context, signature string, body []byte) error {
+	if s.webhookSecret == "" {
+		return fmt.Errorf("%w: 未配置webhook密钥", ErrInvalidSignature)
+	}
+	if err := verifyWebhookSignature(s.webhookSecret, signature, body, s.clock.Now()); err != nil {
+		log.Printf("支付回调签名校验失败: %v", err)
+		return err
 	}
 
-	// 验证订阅状态
-	if subscription.Status != StatusSubscribed {
-		log.Printf("订阅状态不适合续订: %s", subscription.Status)
-		return errors.New("只有已订阅状态的订阅可以续约")
+	var event PaymentWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return fmt.Errorf("%w: 解析回调内容失败: %v", ErrInvalidWebhookEvent, err)
+	}
+	if event.PaymentID <= 0 || (event.Status != StatusSuccess && event.Status != StatusFailed) {
+		return fmt.Errorf("%w: payment_id=%d, status=%s", ErrInvalidWebhookEvent, event.PaymentID, event.Status)
 	}
 
-	// 开始事务
-	tx, err := s.db.BeginTx()
+	return s.ConfirmPayment(ctx, event.PaymentID, event.Status)
+}
+
+// ConfirmPayment 将待确认的首次订阅支付更新为 success 或 failed，success 时激活订阅
+// 每笔支付只会被移出待确认状态一次；支付失败时订阅保持原状态并归还占用的优惠码，失败记录计入系统统计的 failed_payments
+func (s *SubscriptionService) ConfirmPayment(ctx context.Context, paymentID int64, status string) error {
+	log.Printf("确认支付 %d 的结果: %s", paymentID, status)
+
+	tx, err := s.db.BeginTx(ctx)
 	if err != nil {
 		log.Printf("开始事务失败: %v", err)
 		return fmt.Errorf("开始事务失败: %w", err)
@@ -299,226 +990,1603 @@ func (s *SubscriptionService) RenewSubscription(request RenewalRequest) error {
 		}
 	}()
 
-	// 计算新的结束日期
-	newEndDate := subscription.EndDate.AddDate(0, 1, 0)
+	// 锁定支付记录，防止重复回调并发处理
+	var payment Payment
+	var couponCode sql.NullString
+	err = tx.QueryRowContext(ctx,
+		s.db.ForUpdate(`SELECT id, user_id, subscription_id, amount, status, type, coupon_code FROM payments WHERE id = ?`),
+		paymentID,
+	).Scan(&payment.ID, &payment.UserID, &payment.SubscriptionID, &payment.Amount, &payment.Status, &payment.Type, &couponCode)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("%w: %d", ErrPaymentNotFound, paymentID)
+		return err
+	}
+	if err != nil {
+		log.Printf("获取支付记录失败: %v", err)
+		return fmt.Errorf("获取支付记录失败: %w", err)
+	}
 
-	// 更新订阅状态和结束日期
-	_, err = tx.Exec(
-		`UPDATE subscriptions 
-    SET status = ?, renewal_preference = ?, end_date = ? 
-    WHERE id = ?`,
-		StatusRenewed,
-		"yes",
-		newEndDate,
-		subscription.ID,
-	)
+	// 只有首次订阅支付由回调确认，续订等其他支付的状态由系统自己更新
+	if payment.Type != "initial" {
+		err = fmt.Errorf("%w: 支付 %d 的类型为 %s，不由回调确认", ErrPaymentNotPending, paymentID, payment.Type)
+		return err
+	}
+	if payment.Status == status {
+		log.Printf("支付 %d 已确认为 %s，忽略重复回调", paymentID, status)
+		tx.Rollback()
+		return nil
+	}
+	if !canTransitionPayment(payment.Status, status) {
+		err = fmt.Errorf("%w: 支付 %d 当前状态为 %s，不能变为 %s", ErrPaymentNotPending, paymentID, payment.Status, status)
+		return err
+	}
 
+	// 按状态条件更新，并发的重复回调只有一个能把支付移出待确认状态
+	result, err := tx.ExecContext(ctx, `UPDATE payments SET status = ? WHERE id = ? AND status = ?`, status, paymentID, StatusPending)
 	if err != nil {
-		log.Printf("更新订阅状态失败: %v", err)
-		return fmt.Errorf("更新订阅状态失败: %w", err)
+		log.Printf("更新支付状态失败: %v", err)
+		return fmt.Errorf("更新支付状态失败: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		log.Printf("更新支付状态失败: %v", err)
+		return fmt.Errorf("更新支付状态失败: %w", err)
+	}
+	if affected == 0 {
+		log.Printf("支付 %d 已被其他回调确认，忽略本次回调", paymentID)
+		tx.Rollback()
+		return nil
 	}
 
-	// 创建支付记录
-	now := time.Now()
-	_, err = tx.Exec(
-		`INSERT INTO payments 
-        (user_id, subscription_id, amount, payment_date, status, type) 
-        VALUES (?, ?, ?, ?, ?, ?)`,
-		request.UserID,
-		request.SubscriptionID,
-		request.Amount,
-		now,
-		"success",
-		"renewal",
-	)
+	// 支付失败时归还首次支付占用的优惠码
+	if status != StatusSuccess && couponCode.Valid {
+		if err = releaseCoupon(ctx, tx, couponCode.String); err != nil {
+			log.Printf("归还优惠码失败: %v", err)
+			return err
+		}
+	}
 
-	if err != nil {
-		log.Printf("创建续订支付记录失败: %v", err)
-		return fmt.Errorf("创建续订支付记录失败: %w", err)
+	var plan string
+	if status == StatusSuccess {
+		err = tx.QueryRowContext(ctx, s.db.ForUpdate(`SELECT plan FROM subscriptions WHERE id = ?`), payment.SubscriptionID).Scan(&plan)
+		if err != nil {
+			log.Printf("获取订阅信息失败: %v", err)
+			return fmt.Errorf("获取订阅信息失败: %w", err)
+		}
+		if err = s.activateInTx(ctx, tx, payment.SubscriptionID, plan, s.clock.Now()); err != nil {
+			log.Printf("更新订阅状态失败: %v", err)
+			return fmt.Errorf("更新订阅状态失败: %w", err)
+		}
 	}
 
-	// 提交事务
 	if err = tx.Commit(); err != nil {
 		log.Printf("提交事务失败: %v", err)
 		return fmt.Errorf("提交事务失败: %w", err)
 	}
 
-	log.Printf("订阅 %d 续约成功", subscription.ID)
-
-	// 发送续约成功通知
-	go func() {
-		if err := s.notificationSvc.SendRenewalConfirmation(subscription.UserID, subscription.ID); err != nil {
-			log.Printf("发送续约确认通知失败: %v", err)
-		}
-	}()
-
-	// 刷新缓存
-	if err = s.cache.refreshCache(); err != nil {
-		log.Printf("刷新缓存失败: %v", err)
+	if status != StatusSuccess {
+		log.Printf("支付 %d 失败，订阅 %d 保持未激活", paymentID, payment.SubscriptionID)
+		s.cache.apply(statsDelta{failedPayments: 1})
+		return nil
 	}
 
+	log.Printf("支付 %d 已确认，用户 %d 的订阅激活成功", paymentID, payment.UserID)
+	s.afterActivation(payment.UserID, payment.SubscriptionID, plan, payment.Amount)
+
 	return nil
 }
 
-// 取消续订
-func (s *SubscriptionService) CancelRenewal(request CancelRenewalRequest) error {
-	log.Printf("处理取消续订请求: 订阅ID=%d, 用户ID=%d", request.SubscriptionID, request.UserID)
+// 开始免费试用：将未激活的订阅转为试用状态，试用期内不产生支付记录
+func (s *SubscriptionService) StartTrial(ctx context.Context, userID int64, plan string) error {
+	log.Printf("用户 %d 开始试用，计划: %s", userID, plan)
+
+	// 只能试用目录中的套餐
+	if _, ok := s.plans[plan]; !ok {
+		log.Printf("套餐 %s 不在目录中，拒绝试用", plan)
+		return fmt.Errorf("%w: %s", ErrUnknownPlan, plan)
+	}
 
-	// 获取订阅信息
-	subscription, err := s.db.GetSubscriptionByID(request.SubscriptionID)
+	// 检查是否有未激活订阅
+	subscriptions, err := s.db.GetUserSubscriptions(ctx, userID)
 	if err != nil {
-		log.Printf("获取订阅信息失败: %v", err)
+		log.Printf("获取用户订阅失败: %v", err)
 		return err
 	}
 
-	// 验证用户ID
-	if subscription.UserID != request.UserID {
-		log.Printf("用户ID不匹配: 订阅所属用户=%d, 请求用户=%d", subscription.UserID, request.UserID)
-		return errors.New("用户ID与订阅不匹配")
+	var inactiveSubscription *Subscription
+	for _, sub := range subscriptions {
+		if sub.Status == StatusInactive {
+			inactiveSubscription = &sub
+			break
+		}
 	}
 
-	// 验证订阅状态
-	if subscription.Status != StatusSubscribed && subscription.Status != StatusRenewed {
-		log.Printf("订阅状态不适合取消续约: %s", subscription.Status)
-		return errors.New("只有已订阅或已续约的订阅可以取消续约")
+	if inactiveSubscription == nil {
+		log.Printf("找不到未激活的订阅")
+		return errors.New("找不到未激活的订阅")
 	}
 
-	// 更新订阅状态为已退订
-	err = s.db.UpdateSubscriptionStatus(subscription.ID, StatusUnsubscribed)
+	now := time.Now()
+	endDate := now.AddDate(0, 0, TrialPeriodDays)
+
+	// 开始事务，试用资格检查、订阅更新和试用事件一起提交
+	tx, err := s.db.BeginTx(ctx)
 	if err != nil {
-		log.Printf("更新订阅状态失败: %v", err)
-		return err
+		log.Printf("开始事务失败: %v", err)
+		return fmt.Errorf("开始事务失败: %w", err)
 	}
 
-	// 更新续订偏好
-	err = s.db.UpdateRenewalPreference(subscription.ID, "no")
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
+
+	// 每个用户只能试用一次，以试用事件为准，试用结束后订阅回到未激活状态也不能再次试用
+	var trials int
+	err = tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM subscription_events WHERE user_id = ? AND event_type = ?`,
+		userID, EventTrialStart,
+	).Scan(&trials)
 	if err != nil {
-		log.Printf("更新续订偏好失败: %v", err)
+		log.Printf("查询试用记录失败: %v", err)
+		return fmt.Errorf("查询试用记录失败: %w", err)
+	}
+	if trials > 0 {
+		log.Printf("用户 %d 已经试用过", userID)
+		err = fmt.Errorf("%w: 用户ID=%d", ErrTrialUsed, userID)
 		return err
 	}
 
-	log.Printf("订阅 %d 已标记为已退订", subscription.ID)
+	// 只更新仍为未激活状态的订阅，并发的试用或激活请求只有一个成功
+	result, err := tx.ExecContext(ctx,
+		`UPDATE subscriptions 
+        SET plan = ?, status = ?, start_date = ?, end_date = ?, notification_sent = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP 
+        WHERE id = ? AND status = ?`,
+		plan, StatusTrial, now, endDate, false, inactiveSubscription.ID, StatusInactive,
+	)
+	if err != nil {
+		log.Printf("更新订阅状态失败: %v", err)
+		return fmt.Errorf("开始试用失败: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("开始试用失败: %w", err)
+	}
+	if affected != 1 {
+		log.Printf("订阅 %d 已被其他请求更新", inactiveSubscription.ID)
+		err = errors.New("找不到未激活的订阅")
+		return err
+	}
 
-	// 发送取消续约通知
-	go func() {
-		if err := s.notificationSvc.SendCancelConfirmation(subscription.UserID, subscription.ID); err != nil {
-			log.Printf("发送取消续约确认通知失败: %v", err)
-		}
-	}()
+	// 记录试用事件，用于试用资格检查和转化漏斗统计
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO subscription_events (subscription_id, user_id, event_type, detail, created_at)
+        VALUES (?, ?, ?, ?, ?)`,
+		inactiveSubscription.ID, userID, EventTrialStart, "", now,
+	)
+	if err != nil {
+		log.Printf("记录订阅 %d 试用事件失败: %v", inactiveSubscription.ID, err)
+		return fmt.Errorf("记录试用事件失败: %w", err)
+	}
 
-	// 刷新缓存
-	if err = s.cache.refreshCache(); err != nil {
-		log.Printf("刷新缓存失败: %v", err)
+	// 提交事务
+	if err = tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		return fmt.Errorf("提交事务失败: %w", err)
 	}
 
+	log.Printf("用户 %d 的订阅 %d 开始试用，试用至 %s", userID, inactiveSubscription.ID, endDate.Format("2006-01-02"))
+
 	return nil
 }
 
-// 检查即将到期的订阅并发送通知
-func (s *SubscriptionService) CheckExpiringSubscriptions() {
-	log.Printf("开始检查即将到期的订阅")
+// 处理续订请求
+func (s *SubscriptionService) RenewSubscription(ctx context.Context, request RenewalRequest) (*RenewalResponse, error) {
+	log.Printf("处理续订请求: 订阅ID=%d, 用户ID=%d", request.SubscriptionID, request.UserID)
 
-	subscriptions, err := s.db.GetExpiringSubscriptionsForNotification()
+	// 获取订阅信息，只能获取到属于请求用户的订阅
+	subscription, err := s.db.GetSubscriptionByIDForUser(ctx, request.SubscriptionID, request.UserID)
 	if err != nil {
-		log.Printf("获取即将到期订阅失败: %v", err)
-		return
+		log.Printf("获取订阅信息失败: %v", err)
+		return nil, err
+	}
+
+	// 验证订阅状态
+	if subscription.Status == StatusRenewed {
+		log.Printf("订阅 %d 已续约，不再重复续订", subscription.ID)
+		return nil, ErrAlreadyRenewed
+	}
+	if subscription.Status != StatusSubscribed {
+		log.Printf("订阅状态不适合续订: %s", subscription.Status)
+		return nil, errors.New("只有已订阅状态的订阅可以续约")
 	}
 
-	log.Printf("找到 %d 个需要发送通知的即将到期订阅", len(subscriptions))
+	if request.Amount < 0 {
+		log.Printf("续订金额为负数: %.2f", request.Amount)
+		return nil, fmt.Errorf("%w: %.2f", ErrInvalidAmount, request.Amount)
+	}
 
-	for _, sub := range subscriptions {
-		// 发送即将到期通知
-		err = s.notificationSvc.SendExpirationNotice(sub.UserID, sub.ID)
-		if err != nil {
-			log.Printf("发送订阅 %d 到期通知失败: %v", sub.ID, err)
-			continue
+	// 与此前成交价格比较，记录实收金额与目录价格的差异原因
+	previousAmount, err := s.db.GetLastPaymentAmount(ctx, subscription.ID)
+	if err != nil {
+		log.Printf("获取订阅最近支付金额失败: %v", err)
+		return nil, err
+	}
+	// 未指定金额时按套餐的目录价格续订
+	listPrice := s.planPrice(subscription.Plan)
+	if request.Amount == 0 {
+		request.Amount = listPrice
+	}
+	reason := paymentReason(request.Amount, listPrice, previousAmount)
+
+	// 套餐已从目录中移除时按配置拒绝，或以后备价格续订并标记支付记录
+	if _, ok := s.plans[subscription.Plan]; !ok {
+		if s.settings.String(SettingUnknownPlanPolicy) != UnknownPlanFallback {
+			log.Printf("订阅 %d 的套餐 %s 不在目录中，拒绝续订", subscription.ID, subscription.Plan)
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPlan, subscription.Plan)
 		}
+		request.Amount = s.settings.Float(SettingFallbackPlanPrice)
+		log.Printf("警告: 订阅 %d 的套餐 %s 不在目录中，按后备价格 %.2f 续订", subscription.ID, subscription.Plan, request.Amount)
+		reason = PaymentReasonPlanFallback
+	}
 
-		// 更新通知已发送标志
-		err = s.db.UpdateSubscriptionNotificationSent(sub.ID, true)
+	// 扣款方式为 charge 时续约不收费，续约的周期开始时由 advanceRenewedCycle 按套餐价格扣款
+	deferCharge := s.settings.String(SettingRenewedCycle) == RenewedCycleCharge
+	if deferCharge && request.CouponCode != "" {
+		return nil, fmt.Errorf("%w: 新周期开始时扣款的续约不能使用优惠码", ErrInvalidCoupon)
+	}
+
+	// 校验优惠码，无效时不续订
+	now := time.Now()
+	if request.CouponCode != "" {
+		request.Amount, err = s.applyCoupon(ctx, request.CouponCode, request.Amount, now)
 		if err != nil {
-			log.Printf("更新订阅 %d 通知状态失败: %v", sub.ID, err)
-		} else {
-			log.Printf("订阅 %d 到期通知已发送", sub.ID)
+			return nil, err
 		}
+		reason = PaymentReasonCoupon
+		log.Printf("订阅 %d 续订使用优惠码 %s，实付金额: %.2f", subscription.ID, request.CouponCode, request.Amount)
 	}
-}
 
-// 处理已过期订阅
-func (s *SubscriptionService) ProcessExpiredSubscriptions() {
-	log.Printf("开始处理已过期的订阅")
+	// 实付金额为0时不产生扣款，按配置记录为赠送或拒绝续订
+	paymentType := "renewal"
+	if deferCharge {
+		request.Amount = 0
+	} else if sameAmount(request.Amount, 0) {
+		if s.settings.String(SettingZeroAmountRenewal) != ZeroAmountRenewalComp {
+			log.Printf("订阅 %d 续订实付金额为0，按配置拒绝续订", subscription.ID)
+			return nil, fmt.Errorf("%w: 不接受0元续订", ErrInvalidAmount)
+		}
+		request.Amount, paymentType = 0, "comped"
+		log.Printf("订阅 %d 续订实付金额为0，记录为赠送", subscription.ID)
+	}
 
-	subscriptions, err := s.db.GetExpiredSubscriptions()
+	// 开始事务
+	tx, err := s.db.BeginTx(ctx)
 	if err != nil {
-		log.Printf("获取已过期订阅失败: %v", err)
-		return
+		log.Printf("开始事务失败: %v", err)
+		return nil, fmt.Errorf("开始事务失败: %w", err)
 	}
 
-	log.Printf("找到 %d 个已过期的订阅需要处理", len(subscriptions))
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
 
-	for _, sub := range subscriptions {
-		var newStatus string
+	if request.CouponCode != "" {
+		if err = redeemCoupon(ctx, tx, request.CouponCode); err != nil {
+			log.Printf("占用优惠码失败: %v", err)
+			return nil, err
+		}
+	}
 
-		// 根据当前状态判断转换为什么状态
-		switch sub.Status {
-		case StatusRenewed:
-			// 已续约 -> 已订阅（开始新周期）
-			newStatus = StatusSubscribed
-
-			// // 更新订阅日期为下一个周期
-			// err = s.db.UpdateSubscriptionDates(sub.ID, sub.EndDate, sub.EndDate.AddDate(0, 1, 0))
-			// if err != nil {
-			// 	log.Printf("更新订阅 %d 日期失败: %v", sub.ID, err)
-			// 	continue
-			// }
-
-			// 重置通知状态
-			err = s.db.UpdateSubscriptionNotificationSent(sub.ID, false)
-			if err != nil {
-				log.Printf("重置订阅 %d 通知状态失败: %v", sub.ID, err)
-			}
+	// 计算新的结束日期
+	newEndDate := s.planDuration(subscription.Plan).AddTo(subscription.EndDate)
 
-			log.Printf("订阅 %d 状态从已续约更新为已订阅，进入新周期", sub.ID)
-			// 重置续订偏好为undecided
-			err = s.db.UpdateRenewalPreference(sub.ID, "undecided")
-			if err != nil {
-				log.Printf("重置订阅 %d 续订偏好失败: %v", sub.ID, err)
-			}
+	// 更新订阅状态和结束日期，已被其他请求续约时不记录支付
+	if err = markRenewed(ctx, tx, subscription.ID, newEndDate); err != nil {
+		log.Printf("更新订阅状态失败: %v", err)
+		return nil, err
+	}
 
-			log.Printf("订阅 %d 状态从已续约更新为已订阅，进入新周期", sub.ID)
+	// 创建支付记录
+	if !deferCharge {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO payments 
+        (user_id, subscription_id, amount, payment_date, status, type, reason) 
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			request.UserID,
+			request.SubscriptionID,
+			request.Amount,
+			now,
+			"success",
+			paymentType,
+			reason,
+		)
 
-		case StatusUnsubscribed, StatusSubscribed:
-			// 已退订/已订阅但没有操作 -> 未激活
-			newStatus = StatusInactive
+		if err != nil {
+			log.Printf("创建续订支付记录失败: %v", err)
+			return nil, fmt.Errorf("创建续订支付记录失败: %w", err)
+		}
+	}
 
-			// 发送订阅结束通知
-			go func(userID, subscriptionID int64) {
-				if err := s.notificationSvc.SendSubscriptionEndedNotice(userID, subscriptionID); err != nil {
-					log.Printf("发送订阅结束通知失败: %v", err)
-				}
-			}(sub.UserID, sub.ID)
+	// 提交事务
+	if err = tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		return nil, fmt.Errorf("提交事务失败: %w", err)
+	}
 
-			log.Printf("订阅 %d 状态更新为未激活", sub.ID)
-		}
+	log.Printf("订阅 %d 续约成功", subscription.ID)
 
-		// 更新状态
-		err = s.db.UpdateSubscriptionStatus(sub.ID, newStatus)
-		if err != nil {
-			log.Printf("更新订阅 %d 状态为 %s 失败: %v", sub.ID, newStatus, err)
-			continue
-		}
+	// 记录续约事件，续约决定的时间以此为准，不受扣款时间影响
+	event := &SubscriptionEvent{
+		SubscriptionID: subscription.ID,
+		UserID:         subscription.UserID,
+		EventType:      EventRenewal,
+		CreatedAt:      now,
+	}
+	if err := s.db.CreateSubscriptionEvent(ctx, event); err != nil {
+		log.Printf("记录订阅 %d 续约事件失败: %v", subscription.ID, err)
 	}
 
-	// 刷新缓存
-	if err = s.cache.refreshCache(); err != nil {
-		log.Printf("刷新缓存失败: %v", err)
+	// 发送续约成功通知
+	s.notifyAsync("renewal_confirmation", subscription.UserID, subscription.ID)
+
+	// 已订阅转为已续约，活跃订阅数不变；赠送和未收费的续订不计入续订统计
+	if paymentType == "renewal" && !deferCharge {
+		s.cache.apply(statsDelta{
+			paymentAmount: request.Amount,
+			renewals:      1,
+			renewalAmount: request.Amount,
+		})
 	}
+
+	return &RenewalResponse{
+		Message:        "续订成功",
+		SubscriptionID: subscription.ID,
+		Status:         StatusRenewed,
+		EndDate:        newEndDate,
+		Amount:         request.Amount,
+	}, nil
 }
 
-// 关闭服务
-func (s *SubscriptionService) Close() error {
-	// 停止缓存更新
+// markRenewed 在事务中将仍为已订阅状态的订阅转为已续约并顺延到期日
+// 并发的续订请求读到的都是已订阅状态，只有一个能更新成功，其余的返回 ErrAlreadyRenewed
+func markRenewed(ctx context.Context, tx *sql.Tx, subscriptionID int64, newEndDate time.Time) error {
+	result, err := tx.ExecContext(ctx,
+		`UPDATE subscriptions 
+    SET status = ?, renewal_preference = ?, end_date = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP 
+    WHERE id = ? AND status = ?`,
+		StatusRenewed,
+		"yes",
+		newEndDate,
+		subscriptionID,
+		StatusSubscribed,
+	)
+	if err != nil {
+		return fmt.Errorf("更新订阅状态失败: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("更新订阅状态失败: %w", err)
+	}
+	if affected != 1 {
+		return fmt.Errorf("%w: 订阅 %d 已被其他请求续约或修改", ErrAlreadyRenewed, subscriptionID)
+	}
+	return nil
+}
+
+// 取消续订
+func (s *SubscriptionService) CancelRenewal(ctx context.Context, request CancelRenewalRequest) error {
+	log.Printf("处理取消续订请求: 订阅ID=%d, 用户ID=%d", request.SubscriptionID, request.UserID)
+
+	// 获取订阅信息，只能获取到属于请求用户的订阅
+	subscription, err := s.db.GetSubscriptionByIDForUser(ctx, request.SubscriptionID, request.UserID)
+	if err != nil {
+		log.Printf("获取订阅信息失败: %v", err)
+		return err
+	}
+
+	// 验证订阅状态
+	if subscription.Status != StatusSubscribed && subscription.Status != StatusRenewed {
+		log.Printf("订阅状态不适合取消续约: %s", subscription.Status)
+		return errors.New("只有已订阅或已续约的订阅可以取消续约")
+	}
+
+	detail, refunded := "period_end", 0.0
+	if request.Immediate {
+		// 立即终止：结束日期改为当前时间，状态转为未激活
+		refunded, err = s.cancelImmediately(ctx, subscription, request.Refund)
+		if err != nil {
+			return err
+		}
+		detail = "immediate"
+		log.Printf("订阅 %d 已立即终止，退款金额: %.2f", subscription.ID, refunded)
+	} else {
+		// 更新订阅状态为已退订，保留访问至当前周期结束
+		err = s.db.UpdateSubscriptionStatus(ctx, subscription.ID, StatusUnsubscribed)
+		if err != nil {
+			log.Printf("更新订阅状态失败: %v", err)
+			return err
+		}
+
+		// 更新续订偏好
+		err = s.db.UpdateRenewalPreference(ctx, subscription.ID, "no")
+		if err != nil {
+			log.Printf("更新续订偏好失败: %v", err)
+			return err
+		}
+
+		log.Printf("订阅 %d 已标记为已退订", subscription.ID)
+	}
+
+	// 记录取消事件
+	event := &SubscriptionEvent{
+		SubscriptionID: subscription.ID,
+		UserID:         subscription.UserID,
+		EventType:      EventCancellation,
+		Detail:         detail,
+		CreatedAt:      time.Now(),
+	}
+	if err := s.db.CreateSubscriptionEvent(ctx, event); err != nil {
+		log.Printf("记录订阅 %d 取消事件失败: %v", subscription.ID, err)
+	}
+
+	// 发送取消续约通知
+	s.notifyAsync("cancel_confirmation", subscription.UserID, subscription.ID)
+
+	// 已退订和未激活都不计入活跃订阅
+	s.cache.apply(statsDelta{
+		activeByPlan:  map[string]int{subscription.Plan: -1},
+		paymentAmount: -refunded,
+	})
+
+	return nil
+}
+
+// 周期中途变更套餐：退还当前套餐剩余时长的价值，按新套餐收取剩余时长的费用并记录 upgrade 支付
+// 周期结束时间不变，之后的续订和新周期扣款都按新套餐的目录价格计费；补差价不为正的变更视为降级，周期中途不允许
+func (s *SubscriptionService) ChangePlan(ctx context.Context, userID, subscriptionID int64, newPlan string) error {
+	log.Printf("处理套餐变更请求: 订阅ID=%d, 用户ID=%d, 新套餐=%s", subscriptionID, userID, newPlan)
+
+	to, ok := s.plans[newPlan]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPlan, newPlan)
+	}
+
+	// 检查订阅属于请求用户，订阅不存在或属于其他用户时都返回 ErrSubscriptionNotFound
+	if _, err := s.db.GetSubscriptionByIDForUser(ctx, subscriptionID, userID); err != nil {
+		log.Printf("获取订阅信息失败: %v", err)
+		return err
+	}
+
+	// 开始事务
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		log.Printf("开始事务失败: %v", err)
+		return fmt.Errorf("开始事务失败: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
+
+	// 锁定订阅，防止与续订、取消并发修改；订阅的所属用户不会变化，锁定时同样按用户过滤
+	var sub Subscription
+	err = tx.QueryRowContext(ctx,
+		s.db.ForUpdate(`SELECT id, user_id, plan, start_date, end_date, status FROM subscriptions WHERE id = ? AND user_id = ?`),
+		subscriptionID,
+		userID,
+	).Scan(&sub.ID, &sub.UserID, &sub.Plan, &sub.StartDate, &sub.EndDate, &sub.Status)
+	if err == sql.ErrNoRows {
+		err = ErrSubscriptionNotFound
+		return err
+	}
+	if err != nil {
+		log.Printf("获取订阅信息失败: %v", err)
+		return fmt.Errorf("获取订阅信息失败: %w", err)
+	}
+
+	// 验证订阅状态
+	if sub.Status != StatusSubscribed && sub.Status != StatusRenewed {
+		log.Printf("订阅状态不适合变更套餐: %s", sub.Status)
+		err = errors.New("只有已订阅或已续约的订阅可以变更套餐")
+		return err
+	}
+
+	if sub.Plan == newPlan {
+		err = fmt.Errorf("订阅已是 %s 套餐", newPlan)
+		return err
+	}
+	if err = checkPlanTransition(s.transitions, sub.Plan, newPlan); err != nil {
+		return err
+	}
+
+	from, ok := s.plans[sub.Plan]
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrUnknownPlan, sub.Plan)
+		return err
+	}
+
+	// 只对已支付的周期补差价，进入新周期时才扣款的续约周期届时按新套餐的价格扣款
+	now := time.Now()
+	charge := upgradeCharge(from, to, s.paidCycles(&sub)[0].end, now)
+	if charge <= 0 {
+		log.Printf("套餐 %s -> %s 补差价为 %.2f，视为降级", sub.Plan, newPlan, charge)
+		err = fmt.Errorf("%w: %s -> %s", ErrDowngradeMidCycle, sub.Plan, newPlan)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE subscriptions SET plan = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, newPlan, sub.ID)
+	if err != nil {
+		log.Printf("更新订阅套餐失败: %v", err)
+		return fmt.Errorf("更新订阅套餐失败: %w", err)
+	}
+
+	// 创建升级差价支付记录
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO payments 
+        (user_id, subscription_id, amount, payment_date, status, type, reason) 
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID,
+		sub.ID,
+		charge,
+		now,
+		"success",
+		"upgrade",
+		PaymentReasonProrated,
+	)
+	if err != nil {
+		log.Printf("创建升级支付记录失败: %v", err)
+		return fmt.Errorf("创建升级支付记录失败: %w", err)
+	}
+
+	// 提交事务
+	if err = tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		return fmt.Errorf("提交事务失败: %w", err)
+	}
+
+	log.Printf("订阅 %d 套餐由 %s 变更为 %s，补差价: %.2f", sub.ID, sub.Plan, newPlan, charge)
+
+	s.cache.apply(statsDelta{
+		activeByPlan:  map[string]int{sub.Plan: -1, newPlan: 1},
+		paymentAmount: charge,
+	})
+
+	return nil
+}
+
+// GetEligiblePlanChanges 返回用户当前订阅现在可以变更到的套餐，按价格升序排列
+// 只包含 ChangePlan 会接受的目标：在转换矩阵中允许、且补差价为正（周期中途不能降级）
+// 沿用的历史成交价只适用于原套餐的续订，变更后按目标套餐的目录价格计费
+func (s *SubscriptionService) GetEligiblePlanChanges(ctx context.Context, userID int64) ([]PlanOption, error) {
+	log.Printf("获取用户 %d 可变更的套餐", userID)
+
+	if _, err := s.db.GetUserByID(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	subscriptions, err := s.db.GetUserSubscriptions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// 只有已订阅或已续约的订阅可以变更套餐，有多个时取到期最晚的一个
+	now := s.clock.Now()
+	var current *Subscription
+	for i, sub := range subscriptions {
+		if sub.Status != StatusSubscribed && sub.Status != StatusRenewed {
+			continue
+		}
+		if !sub.EndDate.After(now) {
+			continue
+		}
+		if current == nil || sub.EndDate.After(current.EndDate) {
+			current = &subscriptions[i]
+		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("%w: 用户ID=%d", ErrNoActiveSubscription, userID)
+	}
+
+	from, ok := s.plans[current.Plan]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPlan, current.Plan)
+	}
+
+	options := []PlanOption{}
+	for name, to := range s.plans {
+		if name == current.Plan || checkPlanTransition(s.transitions, current.Plan, name) != nil {
+			continue
+		}
+		charge := upgradeCharge(from, to, s.paidCycles(current)[0].end, now)
+		if charge <= 0 {
+			continue
+		}
+		features := to.Features
+		if features == nil {
+			features = []string{}
+		}
+		options = append(options, PlanOption{
+			Plan:     name,
+			Price:    to.Price,
+			Duration: to.Duration,
+			Features: features,
+			Charge:   charge,
+		})
+	}
+
+	sort.Slice(options, func(i, j int) bool {
+		if options[i].Price != options[j].Price {
+			return options[i].Price < options[j].Price
+		}
+		return options[i].Plan < options[j].Plan
+	})
+
+	log.Printf("用户 %d 的订阅 %d (%s) 可变更到 %d 个套餐", userID, current.ID, current.Plan, len(options))
+	return options, nil
+}
+
+// patchableSubscriptionFields 管理员可以单独修改的订阅字段，值为校验并转换请求值的函数
+var patchableSubscriptionFields = map[string]func(s *SubscriptionService, value any) (any, error){
+	"plan": func(s *SubscriptionService, value any) (any, error) {
+		plan, ok := value.(string)
+		if _, known := s.plans[plan]; !ok || !known {
+			return nil, fmt.Errorf("未知套餐: %v", value)
+		}
+		return plan, nil
+	},
+	"status": func(_ *SubscriptionService, value any) (any, error) {
+		status, _ := value.(string)
+		switch status {
+		case StatusInactive, StatusSubscribed, StatusRenewed, StatusUnsubscribed, StatusTrial, StatusPastDue:
+			return status, nil
+		}
+		return nil, fmt.Errorf("未知状态: %v", value)
+	},
+	"start_date":         parsePatchTime,
+	"end_date":           parsePatchTime,
+	"renewal_preference": parsePatchPreference,
+	"notification_sent": func(_ *SubscriptionService, value any) (any, error) {
+		sent, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("必须为布尔值: %v", value)
+		}
+		return sent, nil
+	},
+}
+
+func parsePatchTime(_ *SubscriptionService, value any) (any, error) {
+	text, _ := value.(string)
+	t, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		return nil, fmt.Errorf("必须为RFC3339格式的时间: %v", value)
+	}
+	return t, nil
+}
+
+func parsePatchPreference(_ *SubscriptionService, value any) (any, error) {
+	preference, _ := value.(string)
+	switch preference {
+	case "yes", "no", "undecided":
+		return preference, nil
+	}
+	return nil, fmt.Errorf("只能为 yes、no 或 undecided: %v", value)
+}
+
+// PatchSubscription 只修改 changes 中给出的订阅字段，字段名必须在 patchableSubscriptionFields 中
+// changes 中的 version 为调用方读取到的版本，与当前版本不一致时返回 ErrVersionConflict；未给出时以读取到的当前版本检查
+func (s *SubscriptionService) PatchSubscription(ctx context.Context, id int64, changes map[string]any) error {
+	log.Printf("管理员修改订阅 %d: %v", id, changes)
+
+	var expectedVersion *int
+	fields := make(map[string]any, len(changes))
+	for name, value := range changes {
+		if name == "version" {
+			version, ok := value.(float64)
+			if !ok || version != math.Trunc(version) {
+				return fmt.Errorf("%w: version 必须为整数", ErrInvalidPatch)
+			}
+			v := int(version)
+			expectedVersion = &v
+			continue
+		}
+		convert, ok := patchableSubscriptionFields[name]
+		if !ok {
+			return fmt.Errorf("%w: 不允许修改字段 %s", ErrInvalidPatch, name)
+		}
+		converted, err := convert(s, value)
+		if err != nil {
+			return fmt.Errorf("%w: %s %v", ErrInvalidPatch, name, err)
+		}
+		fields[name] = converted
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("%w: 没有需要修改的字段", ErrInvalidPatch)
+	}
+
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		log.Printf("开始事务失败: %v", err)
+		return fmt.Errorf("开始事务失败: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
+
+	var sub Subscription
+	err = tx.QueryRowContext(ctx,
+		s.db.ForUpdate(`SELECT user_id, start_date, end_date, version FROM subscriptions WHERE id = ?`),
+		id,
+	).Scan(&sub.UserID, &sub.StartDate, &sub.EndDate, &sub.Version)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("%w: %d", ErrSubscriptionNotFound, id)
+		return err
+	}
+	if err != nil {
+		log.Printf("获取订阅失败: %v", err)
+		return fmt.Errorf("获取订阅失败: %w", err)
+	}
+
+	if expectedVersion != nil && *expectedVersion != sub.Version {
+		err = fmt.Errorf("%w: 当前版本为 %d，请求版本为 %d", ErrVersionConflict, sub.Version, *expectedVersion)
+		return err
+	}
+
+	// 修改后的周期必须有效
+	if v, ok := fields["start_date"]; ok {
+		sub.StartDate = v.(time.Time)
+	}
+	if v, ok := fields["end_date"]; ok {
+		sub.EndDate = v.(time.Time)
+	}
+	if !sub.EndDate.After(sub.StartDate) {
+		err = fmt.Errorf("%w: 到期时间必须晚于开始时间", ErrInvalidPatch)
+		return err
+	}
+
+	// 按字段名排序，生成的语句和审计记录都是确定的
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	assignments := make([]string, 0, len(names)+1)
+	args := make([]any, 0, len(names)+2)
+	details := make([]string, 0, len(names))
+	for _, name := range names {
+		assignments = append(assignments, name+" = ?")
+		args = append(args, fields[name])
+		details = append(details, fmt.Sprintf("%s=%v", name, changes[name]))
+	}
+	assignments = append(assignments, "version = version + 1, updated_at = CURRENT_TIMESTAMP")
+	args = append(args, id, sub.Version)
+
+	var result sql.Result
+	result, err = tx.ExecContext(ctx,
+		`UPDATE subscriptions SET `+strings.Join(assignments, ", ")+` WHERE id = ? AND version = ?`,
+		args...,
+	)
+	if err != nil {
+		log.Printf("修改订阅失败: %v", err)
+		return fmt.Errorf("修改订阅失败: %w", err)
+	}
+	var affected int64
+	if affected, err = result.RowsAffected(); err == nil && affected == 0 {
+		err = fmt.Errorf("%w: 订阅 %d 在修改期间被更新", ErrVersionConflict, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	detail := strings.Join(details, ", ")
+	if len(detail) > 255 {
+		detail = detail[:255]
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO subscription_events (subscription_id, user_id, event_type, detail, created_at) VALUES (?, ?, ?, ?, ?)`,
+		id,
+		sub.UserID,
+		EventAdminPatch,
+		detail,
+		time.Now(),
+	)
+	if err != nil {
+		log.Printf("记录订阅修改事件失败: %v", err)
+		return fmt.Errorf("记录订阅修改事件失败: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		return fmt.Errorf("提交事务失败: %w", err)
+	}
+
+	log.Printf("订阅 %d 已修改: %s，版本 %d -> %d", id, detail, sub.Version, sub.Version+1)
+
+	// 状态和套餐影响活跃订阅统计
+	_, statusChanged := fields["status"]
+	_, planChanged := fields["plan"]
+	if statusChanged || planChanged {
+		if err := s.cache.refreshCache(); err != nil {
+			log.Printf("刷新缓存失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// cancelImmediately 在事务中立即终止订阅，refund 为 true 时按剩余时长比例退还尚未结束的计费周期对应的未退款支付
+// 返回退款总额，没有可退款的支付时为0
+func (s *SubscriptionService) cancelImmediately(ctx context.Context, subscription *Subscription, refund bool) (float64, error) {
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		log.Printf("开始事务失败: %v", err)
+		return 0, fmt.Errorf("开始事务失败: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
+
+	now := s.clock.Now()
+	if refund && subscription.EndDate.After(now) {
+		if err = s.checkCommitment(ctx, tx, subscription, now); err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE subscriptions SET status = ?, end_date = ?, renewal_preference = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		StatusInactive,
+		now,
+		"no",
+		subscription.ID,
+	)
+	if err != nil {
+		log.Printf("更新订阅状态失败: %v", err)
+		return 0, fmt.Errorf("更新订阅状态失败: %w", err)
+	}
+
+	var amount float64
+	if refund && subscription.EndDate.After(now) {
+		cycles := s.paidCycles(subscription)
+
+		// 锁定尚未退款的成功支付，最近的支付对应最近的计费周期
+		var rows *sql.Rows
+		rows, err = tx.QueryContext(ctx,
+			s.db.ForUpdate(`SELECT id, amount FROM payments 
+            WHERE subscription_id = ? AND status = 'success' AND type <> 'refund' 
+            AND id NOT IN (SELECT original_payment_id FROM payments WHERE original_payment_id IS NOT NULL) 
+            ORDER BY payment_date DESC, id DESC LIMIT ?`),
+			subscription.ID,
+			len(cycles),
+		)
+		if err != nil {
+			log.Printf("获取支付记录失败: %v", err)
+			return 0, fmt.Errorf("获取支付记录失败: %w", err)
+		}
+		var payments []Payment
+		for rows.Next() {
+			var payment Payment
+			if err = rows.Scan(&payment.ID, &payment.Amount); err != nil {
+				rows.Close()
+				log.Printf("读取支付记录失败: %v", err)
+				return 0, fmt.Errorf("读取支付记录失败: %w", err)
+			}
+			payments = append(payments, payment)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			log.Printf("遍历支付记录失败: %v", err)
+			return 0, fmt.Errorf("遍历支付记录失败: %w", err)
+		}
+		if len(payments) == 0 {
+			log.Printf("订阅 %d 没有可退款的支付", subscription.ID)
+		}
+
+		// 每笔支付按其所属计费周期的剩余时长比例退款，尚未开始的周期全额退还
+		for i, payment := range payments {
+			refundAmount := proratedAmount(payment.Amount, cycles[i].start, cycles[i].end, now)
+			if refundAmount <= 0 {
+				continue
+			}
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO payments 
+                (user_id, subscription_id, amount, payment_date, status, type, reason, original_payment_id) 
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				subscription.UserID,
+				subscription.ID,
+				-refundAmount,
+				now,
+				"success",
+				"refund",
+				PaymentReasonProrated,
+				payment.ID,
+			)
+			if err != nil {
+				log.Printf("创建退款记录失败: %v", err)
+				return 0, fmt.Errorf("创建退款记录失败: %w", err)
+			}
+			amount += refundAmount
+		}
+		amount = math.Round(amount*100) / 100
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		return 0, fmt.Errorf("提交事务失败: %w", err)
+	}
+
+	return amount, nil
+}
+
+// billingCycle 是一个计费周期 [start, end)
+type billingCycle struct {
+	start, end time.Time
+}
+
+// paidCycles 返回订阅已经支付、尚未结束的计费周期，最近的周期在前
+// 已续约但尚未进入新周期的订阅 [StartDate, EndDate) 跨越当前周期和续约周期，
+// 续约时预付的周期由续约支付覆盖；进入新周期时才扣款的续约没有预付支付，只包含当前周期
+func (s *SubscriptionService) paidCycles(sub *Subscription) []billingCycle {
+	if sub.Status != StatusRenewed {
+		return []billingCycle{{sub.StartDate, sub.EndDate}}
+	}
+	cycleStart := s.renewedCycleStart(*sub)
+	current := billingCycle{sub.StartDate, cycleStart}
+	if s.settings.String(SettingRenewedCycle) == RenewedCycleCharge {
+		return []billingCycle{current}
+	}
+	return []billingCycle{{cycleStart, sub.EndDate}, current}
+}
+
+// proratedAmount 按 [start, end) 周期中 now 之后的剩余时长比例计算金额，按分取整
+func proratedAmount(amount float64, start, end, now time.Time) float64 {
+	period := end.Sub(start)
+	remaining := end.Sub(now)
+	if period <= 0 || remaining <= 0 {
+		return 0
+	}
+	if remaining > period {
+		remaining = period
+	}
+	return math.Round(amount*float64(remaining)/float64(period)*100) / 100
+}
+
+// 退款：为一笔成功的支付插入等额负数的退款记录，每笔支付只能退款一次
+// reference 不为空时作为幂等引用，相同引用的重复请求返回已有的退款，不再生成退款记录
+func (s *SubscriptionService) RefundPayment(ctx context.Context, paymentID, userID int64, reference string) (*Payment, error) {
+	log.Printf("处理退款请求: 支付ID=%d, 用户ID=%d, 引用=%q", paymentID, userID, reference)
+
+	// 开始事务
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		log.Printf("开始事务失败: %v", err)
+		return nil, fmt.Errorf("开始事务失败: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
+
+	// 锁定原支付记录，防止并发重复退款
+	var payment Payment
+	err = tx.QueryRowContext(ctx,
+		s.db.ForUpdate(`SELECT id, user_id, subscription_id, amount, status, type 
+        FROM payments WHERE id = ?`),
+		paymentID,
+	).Scan(&payment.ID, &payment.UserID, &payment.SubscriptionID, &payment.Amount, &payment.Status, &payment.Type)
+	if err == sql.ErrNoRows {
+		err = errors.New("支付记录不存在")
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("获取支付记录失败: %v", err)
+		return nil, fmt.Errorf("获取支付记录失败: %w", err)
+	}
+
+	// 验证用户ID
+	if payment.UserID != userID {
+		log.Printf("用户ID不匹配: 支付所属用户=%d, 请求用户=%d", payment.UserID, userID)
+		err = errors.New("用户ID与支付记录不匹配")
+		return nil, err
+	}
+
+	// 相同引用的退款已经存在时直接返回
+	if reference != "" {
+		var existing *Payment
+		existing, err = refundByReference(tx.QueryRowContext(ctx, refundByReferenceQuery, reference), payment.ID)
+		if err == nil {
+			tx.Rollback()
+			log.Printf("退款引用 %q 已对应退款 %d，返回已有的退款", reference, existing.ID)
+			return existing, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		err = nil
+	}
+
+	// 验证支付状态
+	if payment.Status != "success" || payment.Type == "refund" {
+		log.Printf("支付记录不适合退款: 状态=%s, 类型=%s", payment.Status, payment.Type)
+		err = errors.New("只有成功的支付可以退款")
+		return nil, err
+	}
+
+	// 检查是否已经退款
+	var refunded int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM payments WHERE original_payment_id = ?`, payment.ID).Scan(&refunded)
+	if err != nil {
+		log.Printf("检查退款记录失败: %v", err)
+		return nil, fmt.Errorf("检查退款记录失败: %w", err)
+	}
+	if refunded > 0 {
+		err = ErrAlreadyRefunded
+		return nil, err
+	}
+
+	// 订阅仍在套餐的最短承诺期内时不能退款
+	var subscription Subscription
+	err = tx.QueryRowContext(ctx,
+		`SELECT id, plan, start_date FROM subscriptions WHERE id = ?`,
+		payment.SubscriptionID,
+	).Scan(&subscription.ID, &subscription.Plan, &subscription.StartDate)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+	case err != nil:
+		log.Printf("获取订阅信息失败: %v", err)
+		return nil, fmt.Errorf("获取订阅信息失败: %w", err)
+	default:
+		if err = s.checkCommitment(ctx, tx, &subscription, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	// 创建退款记录
+	refund := &Payment{
+		UserID:            payment.UserID,
+		SubscriptionID:    payment.SubscriptionID,
+		Amount:            -payment.Amount,
+		PaymentDate:       time.Now(),
+		Status:            "success",
+		Type:              "refund",
+		Reason:            PaymentReasonRefund,
+		OriginalPaymentID: &payment.ID,
+	}
+	if reference != "" {
+		refund.RefundReference = &reference
+	}
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO payments 
+        (user_id, subscription_id, amount, payment_date, status, type, reason, original_payment_id, refund_reference) 
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		refund.UserID,
+		refund.SubscriptionID,
+		refund.Amount,
+		refund.PaymentDate,
+		refund.Status,
+		refund.Type,
+		refund.Reason,
+		refund.OriginalPaymentID,
+		refund.RefundReference,
+	)
+	if isDuplicateEntry(err) {
+		// 行锁不可用时相同引用的并发请求都能通过上面的检查，由 refund_reference 的唯一约束保证只退款一次
+		tx.Rollback()
+		err = nil
+		log.Printf("退款引用 %q 已被并发的请求使用，返回已有的退款", reference)
+		return s.db.GetRefundByReference(ctx, reference, payment.ID)
+	}
+	if err != nil {
+		log.Printf("创建退款记录失败: %v", err)
+		return nil, fmt.Errorf("创建退款记录失败: %w", err)
+	}
+	refund.ID, err = result.LastInsertId()
+	if err != nil {
+		log.Printf("获取退款记录ID失败: %v", err)
+		return nil, fmt.Errorf("获取退款记录ID失败: %w", err)
+	}
+
+	// 提交事务
+	if err = tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		return nil, fmt.Errorf("提交事务失败: %w", err)
+	}
+
+	log.Printf("支付 %d 退款成功，金额: %.2f", payment.ID, payment.Amount)
+
+	s.cache.apply(statsDelta{paymentAmount: -payment.Amount})
+
+	return refund, nil
+}
+
+// checkCommitment 订阅仍在套餐的最短承诺期内时返回 ErrWithinCommitment
+// 承诺期从订阅最早一次成功的首次订阅支付开始计算，没有首次订阅支付时从当前周期的开始日期计算
+func (s *SubscriptionService) checkCommitment(ctx context.Context, tx *sql.Tx, subscription *Subscription, now time.Time) error {
+	plan, ok := s.plans[subscription.Plan]
+	if !ok || plan.MinCommitmentDays <= 0 {
+		return nil
+	}
+
+	committedAt := subscription.StartDate
+	err := tx.QueryRowContext(ctx,
+		`SELECT payment_date FROM payments
+        WHERE subscription_id = ? AND type = 'initial' AND status = 'success'
+        ORDER BY payment_date, id LIMIT 1`,
+		subscription.ID,
+	).Scan(&committedAt)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("获取首次订阅支付失败: %v", err)
+		return fmt.Errorf("获取首次订阅支付失败: %w", err)
+	}
+
+	commitmentEnd := committedAt.AddDate(0, 0, plan.MinCommitmentDays)
+	if now.Before(commitmentEnd) {
+		log.Printf("订阅 %d 的 %s 套餐承诺期至 %s，拒绝退款", subscription.ID, plan.Name, commitmentEnd.Format("2006-01-02"))
+		return fmt.Errorf("%w: 承诺期至 %s", ErrWithinCommitment, commitmentEnd.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// 重试发送失败的通知
+func (s *SubscriptionService) RetryFailedNotifications() {
+	log.Printf("开始重试失败的通知")
+
+	succeeded, err := s.notificationSvc.RetryFailedNotifications()
+	if err != nil {
+		log.Printf("重试失败通知出错: %v", err)
+		return
+	}
+
+	log.Printf("失败通知重试完成，成功 %d 条", succeeded)
+}
+
+// 发送因每日上限推迟且已到计划时间的通知
+func (s *SubscriptionService) SendDeferredNotifications() {
+	log.Printf("开始发送推迟的通知")
+
+	succeeded, err := s.notificationSvc.SendDeferredNotifications()
+	if err != nil {
+		log.Printf("发送推迟通知出错: %v", err)
+		return
+	}
+
+	log.Printf("推迟通知发送完成，成功 %d 条", succeeded)
+}
+
+// 检查即将到期的订阅并发送通知，返回本次处理完成、发送了通知和处理失败的订阅数
+// 每个提醒档位在一个计费周期内只发送一次，已发送的档位通过通知记录判断
+func (s *SubscriptionService) CheckExpiringSubscriptions() (BatchSummary, error) {
+	log.Printf("开始检查即将到期的订阅")
+
+	now := s.clock.Now()
+	tiers := s.noticeTiers()
+	subscriptions, err := s.db.GetExpiringSubscriptionsForNotification(now, tiers[0])
+	if err != nil {
+		log.Printf("获取即将到期订阅失败: %v", err)
+		return BatchSummary{}, fmt.Errorf("获取即将到期订阅失败: %w", err)
+	}
+
+	log.Printf("找到 %d 个处于提醒窗口内的即将到期订阅", len(subscriptions))
+
+	var summary BatchSummary
+	for _, sub := range subscriptions {
+		tier := currentNoticeTier(tiers, sub.EndDate.Sub(now))
+		if tier == 0 {
+			continue
+		}
+
+		// 检查当前档位在本计费周期内是否已经提醒过
+		noticeType := expiryNoticeType(tiers, tier)
+		tierStart := sub.EndDate.AddDate(0, 0, -tier)
+		sent, err := s.db.HasNotificationSince(sub.ID, noticeType, tierStart)
+		if err != nil {
+			log.Printf("检查订阅 %d 的提醒记录失败: %v", sub.ID, err)
+			summary.Failed++
+			continue
+		}
+		if sent {
+			// 本档位已经提醒过，本次没有处理，不计入任何计数
+			continue
+		}
+
+		// 发送即将到期通知，最后一个档位发送最后提醒
+		var result NoticeResult
+		if noticeType == "final_notice" {
+			result, err = s.notificationSvc.SendFinalNotice(sub.UserID, sub.ID)
+		} else {
+			result, err = s.notificationSvc.SendExpirationNotice(sub.UserID, sub.ID)
+		}
+		if err != nil {
+			log.Printf("发送订阅 %d 到期通知失败: %v", sub.ID, err)
+			// 邮件发送失败时失败记录已保存，其他失败需要单独记录以便重试
+			if !errors.Is(err, ErrDeliveryFailed) {
+				if err := s.notificationSvc.QueueFailedNotification(sub.UserID, sub.ID, noticeType); err != nil {
+					log.Printf("记录待重试的到期通知失败: %v", err)
+				}
+			}
+			summary.Failed++
+			continue
+		}
+		summary.Processed++
+		if result == NoticeDeduplicated || result == NoticeSuppressed {
+			continue
+		}
+
+		// 更新通知已发送标志
+		summary.Notified++
+		err = s.db.UpdateSubscriptionNotificationSent(sub.ID, true)
+		if err != nil {
+			log.Printf("更新订阅 %d 通知状态失败: %v", sub.ID, err)
+		} else {
+			log.Printf("订阅 %d 提前 %d 天的到期通知已发送", sub.ID, tier)
+		}
+	}
+
+	return summary, nil
+}
+
+// 到期后需要处理的订阅状态，GetExpiredSubscriptions 按此列表查询，须与 expiredTransition 保持一致
+// 已续约订阅在续约的周期开始时由 dueRenewedSubscriptions 单独选出，不按到期日处理
+var expirableStatuses = []string{StatusSubscribed, StatusUnsubscribed, StatusTrial}
+
+// expiredTransition 返回到期订阅应转换到的状态，不需要处理的状态返回空字符串
+func expiredTransition(status string) string {
+	switch status {
+	case StatusUnsubscribed, StatusSubscribed, StatusTrial:
+		return StatusInactive
+	default:
+		return ""
+	}
+}
+
+// paymentReason 根据实收金额、目录价格和此前成交价格判断差异原因
+// 所有写入支付记录的路径都应使用该函数，保证财务对账口径一致
+func paymentReason(amount, catalogPrice, previousAmount float64) string {
+	switch {
+	case sameAmount(amount, catalogPrice):
+		return PaymentReasonStandard
+	case previousAmount > 0 && sameAmount(amount, previousAmount):
+		return PaymentReasonGrandfathered
+	default:
+		return PaymentReasonCustomAmount
+	}
+}
+
+// sameAmount 按分比较两个金额
+func sameAmount(a, b float64) bool {
+	return math.Round(a*100) == math.Round(b*100)
+}
+
+// currentNoticeTier 返回剩余时长所处的最小提醒档位，不在任何档位内时返回0
+func currentNoticeTier(tiers []int, remaining time.Duration) int {
+	for i := len(tiers) - 1; i >= 0; i-- {
+		if remaining <= time.Duration(tiers[i])*24*time.Hour {
+			return tiers[i]
+		}
+	}
+	return 0
+}
+
+// expiryNoticeType 返回 tier 档位发送的通知类型
+// 配置了多个档位时最后一个（提前天数最少的）档位发送 final_notice，其余发送 expiration_notice
+func expiryNoticeType(tiers []int, tier int) string {
+	if len(tiers) > 1 && tier == tiers[len(tiers)-1] {
+		return "final_notice"
+	}
+	return "expiration_notice"
+}
+
+// 处理已过期订阅，返回状态更新成功、发送结束通知和处理失败的订阅数
+func (s *SubscriptionService) ProcessExpiredSubscriptions() (BatchSummary, error) {
+	log.Printf("开始处理已过期的订阅")
+
+	// 已续约 -> 已订阅（开始续约的周期），日期、状态和新周期扣款在同一事务中更新
+	// 先于到期处理，续约的周期也已结束的订阅在下面按已订阅到期结束
+	runAt := s.clock.Now()
+	var summary BatchSummary
+	renewed, err := s.dueRenewedSubscriptions(context.Background(), runAt)
+	if err != nil {
+		log.Printf("获取已续约订阅失败: %v", err)
+		return BatchSummary{}, fmt.Errorf("获取已续约订阅失败: %w", err)
+	}
+	for _, sub := range renewed {
+		if err := s.advanceRenewedCycle(sub, runAt); err != nil {
+			log.Printf("订阅 %d 进入新周期失败: %v", sub.ID, err)
+			s.recordProcessingFailure(runAt, sub.ID, err)
+			summary.Failed++
+		} else {
+			summary.Processed++
+		}
+	}
+
+	subscriptions, err := s.db.GetExpiredSubscriptions(runAt)
+	if err != nil {
+		log.Printf("获取已过期订阅失败: %v", err)
+		return BatchSummary{}, fmt.Errorf("获取已过期订阅失败: %w", err)
+	}
+
+	log.Printf("找到 %d 个已过期的订阅需要处理", len(subscriptions))
+
+	for _, sub := range subscriptions {
+		s.expireSubscription(sub, runAt, &summary)
+	}
+
+	// 刷新缓存
+	if err = s.cache.refreshCache(); err != nil {
+		log.Printf("刷新缓存失败: %v", err)
+	}
+
+	return summary, nil
+}
+
+// expireSubscription 结束一个已过期的订阅并把结果计入 summary
+func (s *SubscriptionService) expireSubscription(sub Subscription, runAt time.Time, summary *BatchSummary) {
+	// 根据当前状态判断转换为什么状态
+	newStatus := expiredTransition(sub.Status)
+
+	// 到期日处于屏蔽时段内的已退订/已订阅订阅按配置顺延，不结束订阅
+	if (sub.Status == StatusUnsubscribed || sub.Status == StatusSubscribed) &&
+		s.suppressExtend && s.notificationSvc.suppression.Contains(sub.EndDate) {
+		if s.suppressExtendSubscription(sub, runAt) {
+			summary.Processed++
+		} else {
+			summary.Failed++
+		}
+		return
+	}
+
+	// 更新状态，成功后再发送结束通知，更新失败的订阅只计入失败
+	if err := s.db.UpdateSubscriptionStatus(context.Background(), sub.ID, newStatus); err != nil {
+		log.Printf("更新订阅 %d 状态为 %s 失败: %v", sub.ID, newStatus, err)
+		s.recordProcessingFailure(runAt, sub.ID, err)
+		summary.Failed++
+		return
+	}
+	summary.Processed++
+
+	switch sub.Status {
+	case StatusUnsubscribed, StatusSubscribed:
+		// 已退订/已订阅但没有操作 -> 未激活
+		s.notifyAsync("subscription_ended", sub.UserID, sub.ID)
+		summary.Notified++
+		log.Printf("订阅 %d 状态更新为未激活", sub.ID)
+
+	case StatusTrial:
+		// 试用到期 -> 未激活
+		s.notifyAsync("trial_ended", sub.UserID, sub.ID)
+		summary.Notified++
+		log.Printf("订阅 %d 试用结束，状态更新为未激活", sub.ID)
+	}
+}
+
+// advanceRenewedCycle 已续约订阅进入续约时已支付的周期：续约时到期日已顺延一个计费周期，这里只把开始日期移到该周期的开始，
+// 重置到期提醒和续订偏好后转为已订阅，到期日不变；扣款方式为 charge 时续约未收费，由 chargeRenewedCycle 扣款后进入新周期
+func (s *SubscriptionService) advanceRenewedCycle(sub Subscription, runAt time.Time) error {
+	ctx := context.Background()
+	newStart := s.renewedCycleStart(sub)
+	if s.settings.String(SettingRenewedCycle) == RenewedCycleCharge {
+		// 任务延迟运行时续约的周期可能在处理前已经结束，该周期用户仍可使用，照常扣款并记录下来供人工核对
+		if !sub.EndDate.After(runAt) {
+			log.Printf("警告: 订阅 %d 续约的周期 %s - %s 在处理前已结束，补扣该周期费用",
+				sub.ID, newStart.Format("2006-01-02"), sub.EndDate.Format("2006-01-02"))
+			s.recordProcessingFailure(runAt, sub.ID, fmt.Errorf("续约的周期 %s - %s 在处理前已结束，已补扣该周期费用，请核对",
+				newStart.Format("2006-01-02"), sub.EndDate.Format("2006-01-02")))
+		}
+		return s.chargeRenewedCycle(ctx, sub, newStart, runAt)
+	}
+
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("事务回滚")
+		}
+	}()
+
+	// 只更新仍为已续约状态的订阅，避免与并发的用户操作冲突
+	result, err := tx.ExecContext(ctx,
+		`UPDATE subscriptions
+    SET start_date = ?, status = ?, notification_sent = ?, renewal_preference = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND status = ?`,
+		newStart,
+		StatusSubscribed,
+		false,
+		"undecided",
+		sub.ID,
+		StatusRenewed,
+	)
+	if err != nil {
+		return fmt.Errorf("更新订阅周期失败: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("更新订阅周期失败: %w", err)
+	}
+	if affected == 0 {
+		err = fmt.Errorf("%w: 订阅 %d 已不是已续约状态", ErrVersionConflict, sub.ID)
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %w", err)
+	}
+
+	log.Printf("订阅 %d 状态从已续约更新为已订阅，进入新周期 %s - %s",
+		sub.ID, newStart.Format("2006-01-02"), sub.EndDate.Format("2006-01-02"))
+	return nil
+}
+
+// dueRenewedSubscriptions 返回续约时已支付的周期在 now 之前已经开始的已续约订阅
+func (s *SubscriptionService) dueRenewedSubscriptions(ctx context.Context, now time.Time) ([]Subscription, error) {
+	// 到期日晚于 now 之后一个最长计费周期的订阅，续约的周期不可能已经开始
+	horizon := defaultPlanDuration.AddTo(now)
+	for _, plan := range s.plans {
+		if end := plan.Duration.AddTo(now); end.After(horizon) {
+			horizon = end
+		}
+	}
+
+	candidates, err := s.db.GetRenewedSubscriptionsEndingBefore(ctx, horizon)
+	if err != nil {
+		return nil, err
+	}
+
+	var due []Subscription
+	for _, sub := range candidates {
+		if !s.renewedCycleStart(sub).After(now) {
+			due = append(due, sub)
+		}
+	}
+	return due, nil
+}
+
+// suppressExtendSubscription 将到期日处于屏蔽时段内的订阅顺延屏蔽时段的时长，顺延失败时返回 false
+func (s *SubscriptionService) suppressExtendSubscription(sub Subscription, runAt time.Time) bool {
+	window := s.notificationSvc.suppression
+	newEnd := sub.EndDate.Add(window.End.Sub(window.Start))
+
+	if err := s.db.UpdateSubscriptionDates(sub.ID, sub.StartDate, newEnd); err != nil {
+		log.Printf("顺延订阅 %d 失败: %v", sub.ID, err)
+		s.recordProcessingFailure(runAt, sub.ID, err)
+		return false
+	}
+	if err := s.db.UpdateSubscriptionNotificationSent(sub.ID, false); err != nil {
+		log.Printf("重置订阅 %d 通知状态失败: %v", sub.ID, err)
+	}
+
+	log.Printf("订阅 %d 到期日处于通知屏蔽时段内，顺延至 %s", sub.ID, newEnd.Format("2006-01-02 15:04:05"))
+	return true
+}
+
+// recordProcessingFailure 记录定时任务中处理失败的订阅，便于后续排查
+func (s *SubscriptionService) recordProcessingFailure(runAt time.Time, subscriptionID int64, cause error) {
+	failure := &ProcessingFailure{
+		RunAt:          runAt,
+		SubscriptionID: subscriptionID,
+		Error:          cause.Error(),
+	}
+
+	if _, err := s.db.CreateProcessingFailure(failure); err != nil {
+		log.Printf("记录订阅 %d 处理失败信息失败: %v", subscriptionID, err)
+	}
+}
+
+// 管理API - 获取未解决的处理失败记录
+func (s *SubscriptionService) GetProcessingFailures(ctx context.Context) ([]ProcessingFailure, error) {
+	log.Printf("获取未解决的处理失败记录")
+	return s.db.GetUnresolvedProcessingFailures(ctx)
+}
+
+// 管理API - 将处理失败记录标记为已解决
+func (s *SubscriptionService) ResolveProcessingFailure(ctx context.Context, id int64) error {
+	log.Printf("标记处理失败记录 %d 为已解决", id)
+	return s.db.ResolveProcessingFailure(ctx, id)
+}
+
+// ReconcileAgainstPayments 按每个订阅最近一次有效支付校正明显不一致的状态，返回校正的订阅数
+// 只处理两种情况：未激活但当前周期已付费且未到期的订阅恢复为已订阅；
+// 已续约但当前周期没有有效续订支付的订阅改回已订阅，避免进入新周期时免费顺延
+func (s *SubscriptionService) ReconcileAgainstPayments() (fixed int, err error) {
+	ctx := context.Background()
+	log.Printf("开始按支付记录校正订阅状态")
+
+	states, err := s.db.GetSubscriptionPaymentStates(ctx)
+	if err != nil {
+		log.Printf("获取订阅支付状态失败: %v", err)
+		return 0, err
+	}
+
+	now := s.clock.Now()
+	for _, state := range states {
+		newStatus, reason := reconciledStatus(state, now)
+		if newStatus == "" {
+			continue
+		}
+
+		if err := s.db.UpdateSubscriptionStatus(ctx, state.ID, newStatus); err != nil {
+			log.Printf("校正订阅 %d 状态失败: %v", state.ID, err)
+			return fixed, err
+		}
+		fixed++
+		log.Printf("订阅 %d 状态从 %s 校正为 %s: %s (支付 %d, 类型 %s, 时间 %s)",
+			state.ID, state.Status, newStatus, reason, state.PaymentID, state.PaymentType, state.PaymentDate.Format(time.DateTime))
+	}
+
+	log.Printf("按支付记录校正订阅状态完成，共校正 %d 个订阅", fixed)
+
+	if fixed > 0 {
+		if err := s.cache.refreshCache(); err != nil {
+			log.Printf("刷新缓存失败: %v", err)
+		}
+	}
+	return fixed, nil
+}
+
+// reconciledStatus 返回与支付记录一致的订阅状态及原因，状态无需校正时返回空字符串
+func reconciledStatus(state SubscriptionPaymentState, now time.Time) (string, string) {
+	// 支付落在当前周期内且未退款，说明当前周期已付费
+	paidThisPeriod := !state.Refunded && !state.PaymentDate.Before(state.StartDate)
+
+	switch state.Status {
+	case StatusInactive:
+		if paidThisPeriod && state.EndDate.After(now) {
+			return StatusSubscribed, "当前周期已付费且未到期"
+		}
+	case StatusRenewed:
+		if !paidThisPeriod || (state.PaymentType != "renewal" && state.PaymentType != "comped") {
+			return StatusSubscribed, "当前周期没有有效的续订支付"
+		}
+	}
+	return "", ""
+}
+
+// notifyAsync 将通知加入后台队列，不阻塞当前请求；关闭服务前可通过 DrainNotifications 等待发送完成
+func (s *SubscriptionService) notifyAsync(notificationType string, userID, subscriptionID int64) {
+	s.notices.Enqueue(Notification{Type: notificationType, UserID: userID, SubscriptionID: subscriptionID})
+}
+
+// DrainNotifications 等待后台队列中的通知发送完成，ctx 结束时不再等待并返回错误
+func (s *SubscriptionService) DrainNotifications(ctx context.Context) error {
+	return s.notices.Drain(ctx)
+}
+
+// 关闭服务
+// 关闭数据库前最多等待 drainTimeout，让后台通知写完发送记录；超时后不再等待，未完成的通知可能丢失
+func (s *SubscriptionService) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	if err := s.DrainNotifications(ctx); err != nil {
+		log.Printf("关闭前仍有后台通知未发送完成: %v", err)
+	}
+	s.notices.Close()
+
+	// 停止缓存更新和数据库状态探测
 	s.cache.Stop()
+	s.health.Stop()
 
 	// 关闭数据库连接
 	if err := s.db.Close(); err != nil {
@@ -1,14 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sync/singleflight"
 )
 
 // 测试数据库配置
@@ -23,7 +43,7 @@ func setupTestDB() error {
 	defer db.Close()
 
 	// 清空测试数据
-	tables := []string{"notifications", "payments", "subscriptions", "users"}
+	tables := []string{"settings", "coupons", "subscription_events", "processing_failures", "notifications", "payments", "subscriptions", "users"}
 	// for _, table := range tables {
 	// 	_, err := db.Exec("TRUNCATE TABLE " + table)
 	// 	if err != nil {
@@ -66,7 +86,7 @@ func TestMain(m *testing.M) {
 
 // 创建测试服务实例
 func createTestService(t *testing.T) *SubscriptionService {
-	service, err := NewSubscriptionService(testDSN)
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN})
 	if err != nil {
 		t.Fatalf("创建订阅服务失败: %v", err)
 	}
@@ -104,17 +124,38 @@ func TestCreateUser(t *testing.T) {
 			email:    "",
 			wantErr:  true,
 		},
+		{
+			name:     "缺少域名",
+			userName: "格式错误用户",
+			email:    "user@",
+			wantErr:  true,
+		},
+		{
+			name:     "缺少用户名部分",
+			userName: "格式错误用户",
+			email:    "@example.com",
+			wantErr:  true,
+		},
+		{
+			name:     "格式正确的邮箱",
+			userName: "格式正确用户",
+			email:    "user@example.com",
+			wantErr:  false,
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			userID, err := service.CreateUser(tc.userName, tc.email)
+			userID, err := service.CreateUser(context.Background(), tc.userName, tc.email)
 
 			// 检查错误
 			if (err != nil) != tc.wantErr {
 				t.Errorf("CreateUser() 错误 = %v, 期望错误 = %v", err, tc.wantErr)
 				return
 			}
+			if tc.wantErr && !errors.Is(err, ErrInvalidProfile) {
+				t.Errorf("无效的用户资料应返回 ErrInvalidProfile, 实际=%v", err)
+			}
 
 			// 如果期望成功，验证用户ID是否有效
 			if !tc.wantErr {
@@ -123,7 +164,7 @@ func TestCreateUser(t *testing.T) {
 				}
 
 				// 尝试获取用户验证是否创建成功
-				user, err := service.db.GetUserByID(userID)
+				user, err := service.db.GetUserByID(context.Background(), userID)
 				if err != nil {
 					t.Errorf("创建后无法获取用户: %v", err)
 				}
@@ -134,7 +175,7 @@ func TestCreateUser(t *testing.T) {
 				}
 
 				// 检查是否创建了未激活订阅
-				subs, err := service.db.GetUserSubscriptions(userID)
+				subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
 				if err != nil {
 					t.Errorf("获取用户订阅失败: %v", err)
 				}
@@ -147,6 +188,76 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+// 测试重复邮箱创建用户被拒绝
+func TestCreateUserDuplicateEmail(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	email := "duplicate@example.com"
+	if _, err := service.CreateUser(context.Background(), "第一个用户", email); err != nil {
+		t.Fatalf("创建第一个用户失败: %v", err)
+	}
+
+	_, err := service.CreateUser(context.Background(), "第二个用户", email)
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("重复邮箱应返回 ErrDuplicateEmail, 实际: %v", err)
+	}
+
+	// 通过HTTP接口创建时返回409
+	body := strings.NewReader(`{"name":"第三个用户","email":"duplicate@example.com"}`)
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleCreateUser(rec, httptest.NewRequest(http.MethodPost, "/api/users", body))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("状态码错误: 期望=%d, 实际=%d", http.StatusConflict, rec.Code)
+	}
+
+	var count int
+	if err := service.db.db.QueryRow(`SELECT COUNT(*) FROM users WHERE email = ?`, email).Scan(&count); err != nil {
+		t.Fatalf("查询用户数失败: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("同一邮箱的用户数错误: 期望=1, 实际=%d", count)
+	}
+}
+
+// 测试请求体的大小限制和未知字段检查：分别返回说明原因的400
+func TestRequestBodyStrictness(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	oversized := `{"name":"过大请求用户","email":"oversized_body@example.com","padding":"` + strings.Repeat("x", maxRequestBodyBytes) + `"}`
+	cases := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"请求体过大", oversized, "请求体过大"},
+		{"未知字段", `{"name":"未知字段用户","email":"unknown_field@example.com","nickname":"x"}`, `请求包含未知字段: "nickname"`},
+		{"格式错误", `{"name":`, "无效的请求数据"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.HandleCreateUser(rec, httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(c.body)))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+			}
+			if !strings.Contains(rec.Body.String(), c.message) {
+				t.Errorf("错误信息应包含 %q, 实际=%s", c.message, rec.Body.String())
+			}
+		})
+	}
+
+	var count int
+	if err := service.db.db.QueryRow(`SELECT COUNT(*) FROM users WHERE email IN ('oversized_body@example.com', 'unknown_field@example.com')`).Scan(&count); err != nil {
+		t.Fatalf("查询用户数失败: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("被拒绝的请求不应创建用户, 实际创建了 %d 个", count)
+	}
+}
+
 // 测试激活订阅
 func TestActivateSubscription(t *testing.T) {
 	// 创建服务实例
@@ -156,19 +267,24 @@ func TestActivateSubscription(t *testing.T) {
 	// 创建测试用户
 	testUser := "订阅测试用户"
 	testEmail := "subscription_test@example.com"
-	userID, err := service.CreateUser(testUser, testEmail)
+	userID, err := service.CreateUser(context.Background(), testUser, testEmail)
 	if err != nil {
 		t.Fatalf("创建测试用户失败: %v", err)
 	}
 
+	// 不在目录中的套餐不能激活
+	if err := service.ActivateSubscription(context.Background(), userID, "platinum", ""); !errors.Is(err, ErrUnknownPlan) {
+		t.Errorf("激活未知套餐应返回 ErrUnknownPlan, 实际: %v", err)
+	}
+
 	// 测试激活订阅
-	err = service.ActivateSubscription(userID, "premium")
+	err = service.ActivateSubscription(context.Background(), userID, "premium", "")
 	if err != nil {
 		t.Errorf("激活订阅失败: %v", err)
 	}
 
 	// 验证订阅状态
-	subs, err := service.db.GetUserSubscriptions(userID)
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
 	if err != nil {
 		t.Errorf("获取用户订阅失败: %v", err)
 	}
@@ -202,8 +318,9 @@ func TestActivateSubscription(t *testing.T) {
 		t.Fatalf("期望1条付款记录，实际有%d条", len(payments))
 	}
 
-	if payments[0].Amount != SubscriptionPrice {
-		t.Errorf("付款金额错误: 期望=%.2f, 实际=%.2f", SubscriptionPrice, payments[0].Amount)
+	// 按激活套餐的目录价格扣款
+	if expected := service.plans["premium"].Price; payments[0].Amount != expected {
+		t.Errorf("付款金额错误: 期望=%.2f, 实际=%.2f", expected, payments[0].Amount)
 	}
 
 	if payments[0].Type != "initial" {
@@ -211,6 +328,86 @@ func TestActivateSubscription(t *testing.T) {
 	}
 }
 
+// 测试激活时使用优惠码：折扣反映在支付金额中，无效优惠码不激活
+func TestActivateSubscriptionWithCoupon(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	expired := time.Now().Add(-time.Hour)
+	coupons := []struct {
+		code          string
+		discountType  string
+		discountValue float64
+		expiresAt     *time.Time
+	}{
+		{"HALF", CouponPercent, 50, nil},
+		{"TENOFF", CouponFixed, 10, nil},
+		{"EXPIRED", CouponPercent, 20, &expired},
+	}
+	for _, c := range coupons {
+		_, err := service.db.db.Exec(`INSERT INTO coupons (code, discount_type, discount_value, expires_at, max_uses)
+                  VALUES (?, ?, ?, ?, 1)`, c.code, c.discountType, c.discountValue, c.expiresAt)
+		if err != nil {
+			t.Fatalf("创建优惠码失败: %v", err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		code     string
+		wantErr  bool
+		expected float64
+	}{
+		{"百分比折扣", "HALF", false, 15.00},
+		{"固定金额减免", "TENOFF", false, 19.99},
+		{"已使用", "HALF", true, 0},
+		{"已过期", "EXPIRED", true, 0},
+		{"不存在", "NOSUCHCODE", true, 0},
+	}
+
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			userID, err := service.CreateUser(context.Background(), c.name, fmt.Sprintf("coupon_test_%d@example.com", i))
+			if err != nil {
+				t.Fatalf("创建测试用户失败: %v", err)
+			}
+
+			err = service.ActivateSubscription(context.Background(), userID, "basic", c.code)
+			subs, _ := service.db.GetUserSubscriptions(context.Background(), userID)
+			payments, _ := service.db.GetUserPayments(userID)
+
+			if c.wantErr {
+				if !errors.Is(err, ErrInvalidCoupon) {
+					t.Fatalf("无效优惠码应返回 ErrInvalidCoupon, 实际=%v", err)
+				}
+				if len(subs) != 1 || subs[0].Status != StatusInactive || len(payments) != 0 {
+					t.Errorf("无效优惠码不应激活订阅: 订阅=%+v, 支付=%d条", subs, len(payments))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("激活订阅失败: %v", err)
+			}
+			if len(payments) != 1 {
+				t.Fatalf("期望1条付款记录，实际有%d条", len(payments))
+			}
+			if !sameAmount(payments[0].Amount, c.expected) || payments[0].Reason != PaymentReasonCoupon {
+				t.Errorf("优惠后支付记录错误: 期望金额=%.2f, 实际金额=%.2f, 原因=%s",
+					c.expected, payments[0].Amount, payments[0].Reason)
+			}
+		})
+	}
+
+	coupon, err := service.db.GetCoupon(context.Background(), "HALF")
+	if err != nil {
+		t.Fatalf("获取优惠码失败: %v", err)
+	}
+	if coupon.UsedCount != 1 {
+		t.Errorf("优惠码使用次数错误: 期望=1, 实际=%d", coupon.UsedCount)
+	}
+}
+
 // 测试续订功能
 func TestRenewSubscription(t *testing.T) {
 	// 创建服务实例
@@ -220,18 +417,18 @@ func TestRenewSubscription(t *testing.T) {
 	// 创建并激活测试用户订阅
 	testUser := "续订测试用户"
 	testEmail := "renewal_test@example.com"
-	userID, err := service.CreateUser(testUser, testEmail)
+	userID, err := service.CreateUser(context.Background(), testUser, testEmail)
 	if err != nil {
 		t.Fatalf("创建测试用户失败: %v", err)
 	}
 
-	err = service.ActivateSubscription(userID, "basic")
+	err = service.ActivateSubscription(context.Background(), userID, "basic", "")
 	if err != nil {
 		t.Fatalf("激活订阅失败: %v", err)
 	}
 
 	// 获取订阅ID
-	subs, err := service.db.GetUserSubscriptions(userID)
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
 	if err != nil || len(subs) != 1 {
 		t.Fatalf("获取用户订阅失败: %v", err)
 	}
@@ -245,13 +442,13 @@ func TestRenewSubscription(t *testing.T) {
 		Amount:         SubscriptionPrice,
 	}
 
-	err = service.RenewSubscription(request)
+	_, err = service.RenewSubscription(context.Background(), request)
 	if err != nil {
 		t.Errorf("续订失败: %v", err)
 	}
 
 	// 验证订阅状态
-	subs, err = service.db.GetUserSubscriptions(userID)
+	subs, err = service.db.GetUserSubscriptions(context.Background(), userID)
 	if err != nil {
 		t.Errorf("获取用户订阅失败: %v", err)
 	}
@@ -292,373 +489,6502 @@ func TestRenewSubscription(t *testing.T) {
 	}
 }
 
-// 测试取消续订功能
-func TestCancelRenewal(t *testing.T) {
-	// 创建服务实例
+// 测试续订接口返回新的到期时间和扣费金额
+func TestRenewSubscriptionResponse(t *testing.T) {
 	service := createTestService(t)
 	defer service.Close()
 
-	// 创建并激活测试用户订阅
-	testUser := "取消续订测试用户"
-	testEmail := "cancel_test@example.com"
-	userID, err := service.CreateUser(testUser, testEmail)
+	userID, err := service.CreateUser(context.Background(), "续订响应测试用户", "renew_response_test@example.com")
 	if err != nil {
 		t.Fatalf("创建测试用户失败: %v", err)
 	}
-
-	err = service.ActivateSubscription(userID, "basic")
-	if err != nil {
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
 		t.Fatalf("激活订阅失败: %v", err)
 	}
 
-	// 获取订阅ID
-	subs, err := service.db.GetUserSubscriptions(userID)
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
 	if err != nil || len(subs) != 1 {
 		t.Fatalf("获取用户订阅失败: %v", err)
 	}
+	oldEndDate := subs[0].EndDate
 
-	subID := subs[0].ID
+	body, _ := json.Marshal(RenewalRequest{SubscriptionID: subs[0].ID, UserID: userID, Amount: 19.99})
+	req := httptest.NewRequest(http.MethodPost, "/api/subscriptions/renew", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleRenewSubscription(rec, req)
 
-	// 测试取消续订
-	request := CancelRenewalRequest{
-		SubscriptionID: subID,
-		UserID:         userID,
+	if rec.Code != http.StatusOK {
+		t.Fatalf("续订请求失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
 	}
 
-	err = service.CancelRenewal(request)
-	if err != nil {
-		t.Errorf("取消续订失败: %v", err)
+	var response RenewalResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("解析续订响应失败: %v", err)
 	}
 
-	// 验证订阅状态和续订偏好
-	subs, err = service.db.GetUserSubscriptions(userID)
-	if err != nil {
-		t.Errorf("获取用户订阅失败: %v", err)
+	if response.SubscriptionID != subs[0].ID {
+		t.Errorf("订阅ID错误: 期望=%d, 实际=%d", subs[0].ID, response.SubscriptionID)
 	}
-
-	if len(subs) != 1 || subs[0].Status != StatusUnsubscribed {
-		t.Errorf("取消续订后状态错误: 期望=%s, 实际=%s", StatusUnsubscribed, subs[0].Status)
+	if response.Status != StatusRenewed {
+		t.Errorf("续订后状态错误: 期望=%s, 实际=%s", StatusRenewed, response.Status)
+	}
+	if !response.EndDate.Equal(oldEndDate.AddDate(0, 1, 0)) {
+		t.Errorf("到期时间错误: 期望=%v, 实际=%v", oldEndDate.AddDate(0, 1, 0), response.EndDate)
+	}
+	if response.Amount != 19.99 {
+		t.Errorf("扣费金额错误: 期望=19.99, 实际=%.2f", response.Amount)
 	}
 
-	if subs[0].RenewalPreference != "no" {
-		t.Errorf("续订偏好错误: 期望=no, 实际=%s", subs[0].RenewalPreference)
+	// 续约记录续约事件，作为做出续订决定的时间
+	var renewals int
+	if err := service.db.db.QueryRow(`SELECT COUNT(*) FROM subscription_events WHERE subscription_id = ? AND event_type = ?`,
+		subs[0].ID, EventRenewal).Scan(&renewals); err != nil || renewals != 1 {
+		t.Errorf("续约事件记录错误: 数量=%d, err=%v", renewals, err)
 	}
 }
 
-// 测试系统统计
-func TestGetSystemStats(t *testing.T) {
-	// 创建服务实例
+// 测试全额减免优惠码续订：不扣款，记录 comped 类型的0元支付并正常顺延；负数金额被拒绝
+func TestRenewSubscriptionCompedCoupon(t *testing.T) {
 	service := createTestService(t)
 	defer service.Close()
+	ctx := context.Background()
 
-	// 获取初始统计
-	initialStats := service.GetSystemStats()
-
-	// 创建几个测试用户和订阅
-	testUsers := []struct {
-		name  string
-		email string
-	}{
-		{"统计测试用户1", "stats_test1@example.com"},
-		{"统计测试用户2", "stats_test2@example.com"},
-		{"统计测试用户3", "stats_test3@example.com"},
+	if _, err := service.db.db.Exec(`INSERT INTO coupons (code, discount_type, discount_value, max_uses)
+              VALUES ('RENEWFREE', ?, 100, 2)`, CouponPercent); err != nil {
+		t.Fatalf("创建优惠码失败: %v", err)
 	}
 
-	for _, user := range testUsers {
-		userID, err := service.CreateUser(user.name, user.email)
-		if err != nil {
-			t.Fatalf("创建测试用户失败: %v", err)
-		}
-
-		err = service.ActivateSubscription(userID, "basic")
-		if err != nil {
-			t.Fatalf("激活订阅失败: %v", err)
-		}
+	userID, err := service.CreateUser(ctx, "赠送续订测试用户", "comped_renewal_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
 	}
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID, oldEndDate := subs[0].ID, subs[0].EndDate
 
-	// 强制刷新缓存
-	if err := service.cache.refreshCache(); err != nil {
-		t.Fatalf("刷新缓存失败: %v", err)
+	// 负数金额不续订
+	_, err = service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: subID, UserID: userID, Amount: -5})
+	if !errors.Is(err, ErrInvalidAmount) {
+		t.Fatalf("负数金额应返回 ErrInvalidAmount, 实际=%v", err)
 	}
 
-	// 获取更新后的统计
-	updatedStats := service.GetSystemStats()
+	// 配置为拒绝时，0元续订不生效，也不占用优惠码
+	if err := service.settings.Update(ctx, map[string]string{SettingZeroAmountRenewal: ZeroAmountRenewalReject}); err != nil {
+		t.Fatalf("更新设置失败: %v", err)
+	}
+	_, err = service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: subID, UserID: userID, Amount: SubscriptionPrice, CouponCode: "RENEWFREE"})
+	service.settings.Update(ctx, map[string]string{SettingZeroAmountRenewal: ZeroAmountRenewalComp})
+	if !errors.Is(err, ErrInvalidAmount) {
+		t.Fatalf("配置为拒绝时0元续订应返回 ErrInvalidAmount, 实际=%v", err)
+	}
 
-	// 验证用户数增加
-	expectedUserIncrease := len(testUsers)
-	actualUserIncrease := updatedStats.TotalUsers - initialStats.TotalUsers
-	if actualUserIncrease != expectedUserIncrease {
-		t.Errorf("用户数增加错误: 期望=%d, 实际=%d", expectedUserIncrease, actualUserIncrease)
+	response, err := service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: subID, UserID: userID, Amount: SubscriptionPrice, CouponCode: "RENEWFREE"})
+	if err != nil {
+		t.Fatalf("使用全额减免优惠码续订失败: %v", err)
 	}
 
-	// 验证活跃订阅数增加
-	expectedSubIncrease := len(testUsers)
-	actualSubIncrease := updatedStats.ActiveSubscriptions - initialStats.ActiveSubscriptions
-	if actualSubIncrease != expectedSubIncrease {
-		t.Errorf("活跃订阅数增加错误: 期望=%d, 实际=%d", expectedSubIncrease, actualSubIncrease)
+	expectedEnd := oldEndDate.AddDate(0, 1, 0)
+	if response.Status != StatusRenewed || !response.EndDate.Equal(expectedEnd) || response.Amount != 0 {
+		t.Errorf("赠送续订响应错误: 状态=%s, 到期时间=%v(期望%v), 金额=%.2f",
+			response.Status, response.EndDate, expectedEnd, response.Amount)
 	}
 
-	// 验证付款金额增加
-	expectedAmountIncrease := float64(len(testUsers)) * SubscriptionPrice
-	actualAmountIncrease := updatedStats.TotalPaymentAmount - initialStats.TotalPaymentAmount
-	if actualAmountIncrease != expectedAmountIncrease {
-		t.Errorf("付款总额增加错误: 期望=%.2f, 实际=%.2f", expectedAmountIncrease, actualAmountIncrease)
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil {
+		t.Fatalf("获取付款记录失败: %v", err)
+	}
+	if len(payments) != 2 {
+		t.Fatalf("期望2条付款记录，实际有%d条", len(payments))
+	}
+	var comped *Payment
+	for i := range payments {
+		if payments[i].Type == "comped" {
+			comped = &payments[i]
+		}
+		if payments[i].Type == "renewal" {
+			t.Errorf("0元续订不应记录 renewal 类型的支付: %+v", payments[i])
+		}
+	}
+	if comped == nil {
+		t.Fatalf("缺少 comped 类型的支付记录: %+v", payments)
+	}
+	if comped.Amount != 0 || comped.Status != StatusSuccess || comped.Reason != PaymentReasonCoupon {
+		t.Errorf("赠送支付记录错误: %+v", *comped)
 	}
 
-	// 验证更新时间是否刷新
-	if !updatedStats.LastUpdated.After(initialStats.LastUpdated) {
-		t.Errorf("统计更新时间未刷新: 初始=%v, 更新后=%v", initialStats.LastUpdated, updatedStats.LastUpdated)
+	coupon, err := service.db.GetCoupon(ctx, "RENEWFREE")
+	if err != nil {
+		t.Fatalf("获取优惠码失败: %v", err)
+	}
+	if coupon.UsedCount != 1 {
+		t.Errorf("优惠码使用次数错误: 期望=1, 实际=%d", coupon.UsedCount)
 	}
 }
 
-// 创建测试数据库连接和通知服务实例
-func createTestNotificationService(t *testing.T) (*NotificationService, *DatabaseService) {
-	db, err := NewDatabaseService(testDSN)
+// 测试沿用旧价格的续订记录 grandfathered 原因
+func TestRenewalPaymentReason(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "价格差异测试用户", "payment_reason_test@example.com")
 	if err != nil {
-		t.Fatalf("创建数据库服务失败: %v", err)
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
 	}
 
-	notificationSvc := NewNotificationService(db)
-	return notificationSvc, db
-}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
 
-// 创建测试用户和订阅
-func createTestUserAndSubscription(t *testing.T, db *DatabaseService) (int64, int64) {
-	// 创建测试用户
-	user := &User{
-		Name:  "通知测试用户",
-		Email: "notification_test@example.com",
+	// 模拟用户以调价前的旧价格首次订阅
+	oldPrice := 19.99
+	if _, err := service.db.db.Exec("UPDATE payments SET amount = ? WHERE subscription_id = ?", oldPrice, subs[0].ID); err != nil {
+		t.Fatalf("更新首次支付金额失败: %v", err)
 	}
 
-	userID, err := db.CreateUser(user)
+	_, err = service.RenewSubscription(context.Background(), RenewalRequest{SubscriptionID: subs[0].ID, UserID: userID, Amount: oldPrice})
 	if err != nil {
-		t.Fatalf("创建测试用户失败: %v", err)
+		t.Fatalf("续订失败: %v", err)
 	}
 
-	// 创建测试订阅
-	now := time.Now()
-	endDate := now.AddDate(0, 1, 0)
-
-	tx, err := db.BeginTx()
+	payments, err := service.db.GetUserPayments(userID)
 	if err != nil {
-		t.Fatalf("开始事务失败: %v", err)
+		t.Fatalf("获取用户付款记录失败: %v", err)
 	}
 
-	result, err := tx.Exec(
-		`INSERT INTO subscriptions 
-        (user_id, plan, start_date, end_date, status, notification_sent, renewal_preference) 
-        VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		userID,
-		"premium",
-		now,
-		endDate,
-		StatusSubscribed,
-		false,
-		"undecided",
-	)
+	reasons := make(map[string]string)
+	for _, payment := range payments {
+		reasons[payment.Type] = payment.Reason
+	}
 
-	if err != nil {
-		tx.Rollback()
-		t.Fatalf("创建测试订阅失败: %v", err)
+	if reasons["initial"] != PaymentReasonStandard {
+		t.Errorf("首次支付原因错误: 期望=%s, 实际=%s", PaymentReasonStandard, reasons["initial"])
+	}
+	if reasons["renewal"] != PaymentReasonGrandfathered {
+		t.Errorf("续订支付原因错误: 期望=%s, 实际=%s", PaymentReasonGrandfathered, reasons["renewal"])
 	}
 
-	err = tx.Commit()
+	// 未指定金额时按套餐的目录价格续订，与目录价格比较而不是统一的默认价格
+	premiumUserID, err := service.CreateUser(context.Background(), "套餐价格续订测试用户", "plan_price_renewal_test@example.com")
 	if err != nil {
-		t.Fatalf("提交事务失败: %v", err)
+		t.Fatalf("创建测试用户失败: %v", err)
 	}
-
-	subscriptionID, err := result.LastInsertId()
+	if err := service.ActivateSubscription(context.Background(), premiumUserID, "premium", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	premiumSubs, err := service.db.GetUserSubscriptions(context.Background(), premiumUserID)
+	if err != nil || len(premiumSubs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	response, err := service.RenewSubscription(context.Background(), RenewalRequest{SubscriptionID: premiumSubs[0].ID, UserID: premiumUserID})
 	if err != nil {
-		t.Fatalf("获取订阅ID失败: %v", err)
+		t.Fatalf("续订失败: %v", err)
+	}
+	if expected := service.plans["premium"].Price; response.Amount != expected {
+		t.Errorf("续订金额应为套餐价格: 期望=%.2f, 实际=%.2f", expected, response.Amount)
+	}
+	payments, err = service.db.GetUserPayments(premiumUserID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	for _, payment := range payments {
+		if payment.Reason != PaymentReasonStandard {
+			t.Errorf("按目录价格的 %s 支付原因错误: 期望=%s, 实际=%s", payment.Type, PaymentReasonStandard, payment.Reason)
+		}
 	}
-
-	return userID, subscriptionID
 }
 
-// 获取用户最新的通知
-func getLatestNotification(t *testing.T, db *DatabaseService, userID int64, notificationType string) *Notification {
-	query := `SELECT id, user_id, subscription_id, type, content, sent_at, status 
-              FROM notifications 
-              WHERE user_id = ? AND type = ? 
-              ORDER BY sent_at DESC LIMIT 1`
-
-	var notification Notification
-	err := db.db.QueryRow(query, userID, notificationType).Scan(
-		&notification.ID,
-		&notification.UserID,
-		&notification.SubscriptionID,
-		&notification.Type,
-		&notification.Content,
-		&notification.SentAt,
-		&notification.Status,
-	)
+// 测试按套餐计费周期激活和续订
+func TestPlanDurations(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{
+		DatabaseDSN: testDSN,
+		Plans: []Plan{
+			{Name: "basic", Duration: PlanDuration{Months: 1}},
+			{Name: "annual", Duration: PlanDuration{Years: 1}},
+			{Name: "trial", Duration: PlanDuration{Days: 14}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
 
+	newSubsBefore, err := service.db.GetNewSubscriptionsMonth()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil
-		}
-		t.Fatalf("查询通知失败: %v", err)
+		t.Fatalf("获取本月新增订阅数失败: %v", err)
 	}
 
-	return &notification
-}
+	cases := []struct {
+		plan     string
+		duration PlanDuration
+	}{
+		{"annual", PlanDuration{Years: 1}},
+		{"trial", PlanDuration{Days: 14}},
+	}
 
-// 测试发送到期通知
+	for i, c := range cases {
+		userID, err := service.CreateUser(context.Background(), "套餐周期测试用户", fmt.Sprintf("plan_duration_%d@example.com", i))
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(context.Background(), userID, c.plan, ""); err != nil {
+			t.Fatalf("激活 %s 订阅失败: %v", c.plan, err)
+		}
+
+		subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+		if err != nil || len(subs) != 1 {
+			t.Fatalf("获取用户订阅失败: %v", err)
+		}
+		sub := subs[0]
+
+		if want := c.duration.AddTo(sub.StartDate); !sub.EndDate.Equal(want) {
+			t.Errorf("%s 激活后到期时间错误: 期望=%v, 实际=%v", c.plan, want, sub.EndDate)
+		}
+
+		response, err := service.RenewSubscription(context.Background(), RenewalRequest{SubscriptionID: sub.ID, UserID: userID, Amount: SubscriptionPrice})
+		if err != nil {
+			t.Fatalf("续订 %s 订阅失败: %v", c.plan, err)
+		}
+		if want := c.duration.AddTo(sub.EndDate); !response.EndDate.Equal(want) {
+			t.Errorf("%s 续订后到期时间错误: 期望=%v, 实际=%v", c.plan, want, response.EndDate)
+		}
+	}
+
+	// 本月新增订阅统计按首次支付计算，不受计费周期影响
+	newSubsAfter, err := service.db.GetNewSubscriptionsMonth()
+	if err != nil {
+		t.Fatalf("获取本月新增订阅数失败: %v", err)
+	}
+	if newSubsAfter-newSubsBefore != len(cases) {
+		t.Errorf("本月新增订阅数错误: 期望增加%d, 实际增加%d", len(cases), newSubsAfter-newSubsBefore)
+	}
+}
+
+// 测试续订时套餐已从目录中移除：默认拒绝，配置 fallback 时按后备价格续订并标记支付记录
+func TestRenewUnknownPlan(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{"默认拒绝", "", true},
+		{"后备价格", UnknownPlanFallback, false},
+	}
+
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			service, err := NewSubscriptionService(&Config{
+				DatabaseDSN:       testDSN,
+				UnknownPlanPolicy: c.policy,
+				FallbackPlanPrice: 19.99,
+			})
+			if err != nil {
+				t.Fatalf("创建订阅服务失败: %v", err)
+			}
+			defer service.Close()
+
+			userID, err := service.CreateUser(context.Background(), "未知套餐测试用户", fmt.Sprintf("unknown_plan_%d@example.com", i))
+			if err != nil {
+				t.Fatalf("创建测试用户失败: %v", err)
+			}
+			if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+				t.Fatalf("激活订阅失败: %v", err)
+			}
+			subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+			if err != nil || len(subs) != 1 {
+				t.Fatalf("获取用户订阅失败: %v", err)
+			}
+			sub := subs[0]
+
+			// 模拟套餐已从目录中移除
+			if _, err := service.db.db.Exec("UPDATE subscriptions SET plan = ? WHERE id = ?", "legacy", sub.ID); err != nil {
+				t.Fatalf("更新订阅套餐失败: %v", err)
+			}
+
+			response, err := service.RenewSubscription(context.Background(), RenewalRequest{SubscriptionID: sub.ID, UserID: userID, Amount: SubscriptionPrice})
+			if c.wantErr {
+				if !errors.Is(err, ErrUnknownPlan) {
+					t.Fatalf("应返回 ErrUnknownPlan, 实际=%v", err)
+				}
+				if updated, _ := service.db.GetSubscriptionByID(context.Background(), sub.ID); updated.Status != StatusSubscribed {
+					t.Errorf("拒绝续订时状态不应改变: %s", updated.Status)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("后备续订失败: %v", err)
+			}
+			if want := sub.EndDate.AddDate(0, 1, 0); !response.EndDate.Equal(want) || response.Amount != 19.99 {
+				t.Errorf("后备续订结果错误: 到期=%v(期望%v), 金额=%.2f", response.EndDate, want, response.Amount)
+			}
+
+			payments, err := service.db.GetUserPayments(userID)
+			if err != nil {
+				t.Fatalf("获取用户付款记录失败: %v", err)
+			}
+			last := payments[0]
+			for _, p := range payments {
+				if p.Type == "renewal" {
+					last = p
+				}
+			}
+			if last.Type != "renewal" || !sameAmount(last.Amount, 19.99) || last.Reason != PaymentReasonPlanFallback {
+				t.Errorf("后备续订支付记录错误: %+v", last)
+			}
+		})
+	}
+
+	if _, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN, UnknownPlanPolicy: "ignore"}); err == nil {
+		t.Error("无效的未知套餐处理方式应返回错误")
+	}
+}
+
+// 测试运行时修改设置后无需重启即生效
+func TestRuntimeSettings(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	// 设置保存在数据库中，避免影响其他测试创建的服务
+	defer service.db.db.Exec("DELETE FROM settings")
+
+	putSettings := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.HandleSettings(rec, httptest.NewRequest(http.MethodPut, "/api/admin/settings", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	handler.HandleSettings(rec, httptest.NewRequest(http.MethodGet, "/api/admin/settings", nil))
+	var settings map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&settings); err != nil {
+		t.Fatalf("解析设置失败: %v", err)
+	}
+	if settings[SettingUnknownPlanPolicy] != UnknownPlanReject || settings[SettingFallbackPlanPrice] != "29.99" {
+		t.Errorf("默认设置错误: %v", settings)
+	}
+
+	// 无效的取值和未知设置项被拒绝，且不保存任何一项
+	for _, body := range []string{
+		`{"fallback_plan_price": "-1"}`,
+		`{"unknown_plan_policy": "ignore"}`,
+		`{"fallback_plan_price": "9.99", "no_such_setting": "1"}`,
+		`{"expiry_notice_tiers": "3,x"}`,
+		`{"expiry_notice_tiers": "0"}`,
+		`{"rate_limit_per_minute": "-1"}`,
+	} {
+		if rec := putSettings(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("无效设置 %s 状态码错误: 期望=%d, 实际=%d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	userID, err := service.CreateUser(context.Background(), "运行时设置测试用户", "settings_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	if _, err := service.db.db.Exec("UPDATE subscriptions SET plan = ? WHERE id = ?", "legacy", subs[0].ID); err != nil {
+		t.Fatalf("更新订阅套餐失败: %v", err)
+	}
+	request := RenewalRequest{SubscriptionID: subs[0].ID, UserID: userID, Amount: SubscriptionPrice}
+
+	// 默认拒绝续订未知套餐
+	if _, err := service.RenewSubscription(context.Background(), request); !errors.Is(err, ErrUnknownPlan) {
+		t.Fatalf("修改设置前应拒绝续订, 实际=%v", err)
+	}
+
+	rec = putSettings(`{"unknown_plan_policy": "fallback", "fallback_plan_price": "9.99"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("更新设置失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	response, err := service.RenewSubscription(context.Background(), request)
+	if err != nil {
+		t.Fatalf("修改设置后续订失败: %v", err)
+	}
+	if response.Amount != 9.99 {
+		t.Errorf("续订应使用新的后备价格: 期望=9.99, 实际=%.2f", response.Amount)
+	}
+
+	// 设置修改前开始的加载在修改后才完成时，结果不能写入缓存
+	store := service.settings
+	store.invalidate()
+	store.mu.RLock()
+	generation := store.generation
+	store.mu.RUnlock()
+	stale := map[string]string{SettingFallbackPlanPrice: "29.99"}
+	store.invalidate()
+	store.store(stale, generation)
+	if price := store.String(SettingFallbackPlanPrice); price != "9.99" {
+		t.Errorf("失效前开始的加载结果不应写入缓存: %s", price)
+	}
+
+	// 修改到期提醒档位后，下一轮检查按新的提醒窗口发送
+	if settings[SettingExpiryNoticeTiers] != "3,1" {
+		t.Errorf("默认提醒档位错误: %q", settings[SettingExpiryNoticeTiers])
+	}
+	noticeUser, err := service.CreateUser(context.Background(), "提醒档位设置测试用户", "settings_tiers_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), noticeUser, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	noticeSubs, err := service.db.GetUserSubscriptions(context.Background(), noticeUser)
+	if err != nil || len(noticeSubs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	service.setClock(newVirtualClock(noticeSubs[0].EndDate.Add(-5 * 24 * time.Hour)))
+	service.CheckExpiringSubscriptions()
+	if notices := getNotifications(t, service.db, noticeSubs[0].ID, "expiration_notice"); len(notices) != 0 {
+		t.Errorf("默认档位下剩余5天不应提醒: %d", len(notices))
+	}
+	if rec := putSettings(`{"expiry_notice_tiers": "1, 7"}`); rec.Code != http.StatusOK {
+		t.Fatalf("更新提醒档位失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	service.CheckExpiringSubscriptions()
+	if err := service.DrainNotifications(context.Background()); err != nil {
+		t.Fatalf("等待后台通知失败: %v", err)
+	}
+	if notices := getNotifications(t, service.db, noticeSubs[0].ID, "expiration_notice"); len(notices) != 1 {
+		t.Errorf("修改档位后剩余5天应发送到期提醒: %d", len(notices))
+	}
+
+	// 限流上限在下一个请求时生效，设置为0时不限流
+	limiter := NewDynamicRateLimiter(service.RateLimitPerMinute)
+	allowed := func() bool {
+		ok, _ := limiter.Allow("10.0.0.9")
+		return ok
+	}
+	if rec := putSettings(`{"rate_limit_per_minute": "2"}`); rec.Code != http.StatusOK {
+		t.Fatalf("更新限流设置失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	if !allowed() || !allowed() || allowed() {
+		t.Error("上限为2时第3个请求应被限流")
+	}
+	if rec := putSettings(`{"rate_limit_per_minute": "0"}`); rec.Code != http.StatusOK {
+		t.Fatalf("更新限流设置失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	if !allowed() {
+		t.Error("上限为0时不应限流")
+	}
+}
+
+// 测试关闭功能开关后接口立即不可用，重新开启后恢复
+func TestFeatureFlags(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	// 开关保存在数据库中，避免影响其他测试创建的服务
+	defer service.db.db.Exec("DELETE FROM settings")
+
+	refundsByPlan := handler.RequireFeature(FeatureRefundsByPlan, handler.HandleRefundsByPlan)
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		refundsByPlan(rec, httptest.NewRequest(http.MethodGet,
+			"/api/admin/refunds-by-plan?start_time=2009-01-01T00:00:00Z&end_time=2009-02-01T00:00:00Z", nil))
+		return rec
+	}
+	putSettings := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.HandleSettings(rec, httptest.NewRequest(http.MethodPut, "/api/admin/settings", strings.NewReader(body)))
+		return rec
+	}
+
+	// 默认开启
+	if rec := get(); rec.Code != http.StatusOK {
+		t.Fatalf("功能开启时状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	if rec := putSettings(`{"feature_refunds_by_plan": "maybe"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("无效的开关取值状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+
+	if rec := putSettings(`{"feature_refunds_by_plan": "off"}`); rec.Code != http.StatusOK {
+		t.Fatalf("关闭功能失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	if rec := get(); rec.Code != http.StatusNotFound {
+		t.Errorf("功能关闭后状态码错误: 期望=%d, 实际=%d", http.StatusNotFound, rec.Code)
+	}
+	if !service.FeatureEnabled(FeatureEligiblePlans) {
+		t.Error("关闭一个功能不应影响其他功能")
+	}
+
+	if rec := putSettings(`{"feature_refunds_by_plan": "on"}`); rec.Code != http.StatusOK {
+		t.Fatalf("开启功能失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	if rec := get(); rec.Code != http.StatusOK {
+		t.Errorf("功能重新开启后状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+
+	// 每个功能开关都登记了取值校验，可以通过设置接口修改
+	for _, flag := range featureFlags {
+		if _, ok := settingValidators[flag]; !ok {
+			t.Errorf("功能开关 %s 未登记取值校验", flag)
+		}
+	}
+}
+
+// 测试退款
+func TestRefundPayment(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "退款测试用户", "refund_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil || len(payments) != 1 {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	paymentID := payments[0].ID
+
+	totalBefore := service.GetSystemStats().TotalPaymentAmount
+
+	// 其他用户不能退款
+	if _, err := service.RefundPayment(context.Background(), paymentID, userID+1000, ""); err == nil {
+		t.Error("其他用户的退款请求应当失败")
+	}
+
+	// 相同引用的重复请求返回同一笔退款
+	refund, err := service.RefundPayment(context.Background(), paymentID, userID, "refund-test-ref")
+	if err != nil {
+		t.Fatalf("退款失败: %v", err)
+	}
+	again, err := service.RefundPayment(context.Background(), paymentID, userID, "refund-test-ref")
+	if err != nil {
+		t.Fatalf("相同引用的重复退款应返回已有的退款: %v", err)
+	}
+	if again.ID != refund.ID || again.Amount != refund.Amount {
+		t.Errorf("相同引用应返回同一笔退款: 第一次=%+v, 第二次=%+v", refund, again)
+	}
+
+	// 不带引用的重复退款应当失败
+	if _, err := service.RefundPayment(context.Background(), paymentID, userID, ""); !errors.Is(err, ErrAlreadyRefunded) {
+		t.Errorf("重复退款应返回 ErrAlreadyRefunded, 实际: %v", err)
+	}
+
+	payments, err = service.db.GetUserPayments(userID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	var refunds []Payment
+	for _, payment := range payments {
+		if payment.Type == "refund" {
+			refunds = append(refunds, payment)
+		}
+	}
+	if len(refunds) != 1 {
+		t.Fatalf("退款记录数量错误: 期望=1, 实际=%d", len(refunds))
+	}
+	if refunds[0].Amount != -SubscriptionPrice {
+		t.Errorf("退款金额错误: 期望=%.2f, 实际=%.2f", -SubscriptionPrice, refunds[0].Amount)
+	}
+	if refunds[0].Reason != PaymentReasonRefund {
+		t.Errorf("退款记录的原因错误: 期望=%s, 实际=%s", PaymentReasonRefund, refunds[0].Reason)
+	}
+	if refunds[0].OriginalPaymentID == nil || *refunds[0].OriginalPaymentID != paymentID {
+		t.Errorf("退款记录未关联原支付: %v", refunds[0].OriginalPaymentID)
+	}
+	if refunds[0].ID != refund.ID || refunds[0].RefundReference == nil || *refunds[0].RefundReference != "refund-test-ref" {
+		t.Errorf("退款记录的引用错误: %+v", refunds[0])
+	}
+
+	// 缓存中的付款总额应扣除退款
+	totalAfter := service.GetSystemStats().TotalPaymentAmount
+	if diff := totalBefore - totalAfter; diff < SubscriptionPrice-0.001 || diff > SubscriptionPrice+0.001 {
+		t.Errorf("付款总额未扣除退款: 退款前=%.2f, 退款后=%.2f", totalBefore, totalAfter)
+	}
+
+	// 引用不能用于其他支付的退款
+	otherID, err := service.CreateUser(context.Background(), "退款引用测试用户", "refund_reference_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), otherID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	otherPayments, err := service.db.GetUserPayments(otherID)
+	if err != nil || len(otherPayments) != 1 {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	if _, err := service.RefundPayment(context.Background(), otherPayments[0].ID, otherID, "refund-test-ref"); !errors.Is(err, ErrRefundReferenceConflict) {
+		t.Errorf("引用已用于其他支付时应返回 ErrRefundReferenceConflict, 实际: %v", err)
+	}
+}
+
+// 测试按支付记录校正订阅状态：与最近一次有效支付矛盾的状态被改正，一致的状态不变
+func TestReconcileAgainstPayments(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+
+	activate := func(name, email string) (int64, int64) {
+		userID, err := service.CreateUser(ctx, name, email)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+		subs, err := service.db.GetUserSubscriptions(ctx, userID)
+		if err != nil || len(subs) != 1 {
+			t.Fatalf("获取用户订阅失败: %v", err)
+		}
+		return userID, subs[0].ID
+	}
+
+	// 已付费且未到期，却被标记为未激活
+	_, driftedID := activate("校正测试用户1", "reconcile_drifted@example.com")
+	if err := service.db.UpdateSubscriptionStatus(ctx, driftedID, StatusInactive); err != nil {
+		t.Fatalf("更新订阅状态失败: %v", err)
+	}
+
+	// 已续约，但续订支付已退款
+	renewedUser, renewedID := activate("校正测试用户2", "reconcile_renewed@example.com")
+	if _, err := service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: renewedID, UserID: renewedUser, Amount: SubscriptionPrice}); err != nil {
+		t.Fatalf("续订失败: %v", err)
+	}
+	payments, err := service.db.GetUserPayments(renewedUser)
+	if err != nil {
+		t.Fatalf("获取付款记录失败: %v", err)
+	}
+	for _, payment := range payments {
+		if payment.Type == "renewal" {
+			if _, err := service.RefundPayment(ctx, payment.ID, renewedUser, ""); err != nil {
+				t.Fatalf("退款失败: %v", err)
+			}
+		}
+	}
+
+	// 未激活且唯一的支付已退款，状态与支付记录一致
+	refundedUser, refundedID := activate("校正测试用户3", "reconcile_refunded@example.com")
+	payments, err = service.db.GetUserPayments(refundedUser)
+	if err != nil || len(payments) != 1 {
+		t.Fatalf("获取付款记录失败: %v", err)
+	}
+	if _, err := service.RefundPayment(ctx, payments[0].ID, refundedUser, ""); err != nil {
+		t.Fatalf("退款失败: %v", err)
+	}
+	if err := service.db.UpdateSubscriptionStatus(ctx, refundedID, StatusInactive); err != nil {
+		t.Fatalf("更新订阅状态失败: %v", err)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	fixed, err := service.ReconcileAgainstPayments()
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatalf("校正订阅状态失败: %v", err)
+	}
+	if fixed < 2 {
+		t.Errorf("校正数量错误: 期望至少2, 实际=%d", fixed)
+	}
+
+	expected := map[int64]string{
+		driftedID:  StatusSubscribed,
+		renewedID:  StatusSubscribed,
+		refundedID: StatusInactive,
+	}
+	for id, status := range expected {
+		sub, err := service.db.GetSubscriptionByID(ctx, id)
+		if err != nil {
+			t.Fatalf("获取订阅失败: %v", err)
+		}
+		if sub.Status != status {
+			t.Errorf("订阅 %d 校正后状态错误: 期望=%s, 实际=%s", id, status, sub.Status)
+		}
+	}
+	if !strings.Contains(buf.String(), fmt.Sprintf("订阅 %d 状态从 %s 校正为 %s", driftedID, StatusInactive, StatusSubscribed)) {
+		t.Errorf("日志未记录状态校正: %s", buf.String())
+	}
+
+	// 再次校正时没有需要改正的订阅
+	if fixed, err := service.ReconcileAgainstPayments(); err != nil || fixed != 0 {
+		t.Errorf("重复校正不应改变状态: 校正=%d, 错误=%v", fixed, err)
+	}
+}
+
+// 测试管理员只修改订阅的单个字段：其他字段不变，版本递增并记录审计事件，过期版本返回409
+func TestPatchSubscription(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+
+	userID, err := service.CreateUser(ctx, "修改订阅测试用户", "patch_subscription_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	before := subs[0]
+
+	handler := NewSubscriptionHandler(service)
+	patch := func(id int64, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/api/admin/subscriptions?id=%d", id), strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.HandlePatchSubscription(rec, req)
+		return rec
+	}
+
+	rec := patch(before.ID, fmt.Sprintf(`{"renewal_preference": "no", "version": %d}`, before.Version))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("修改订阅失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	after, err := service.db.GetSubscriptionByID(ctx, before.ID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	if after.RenewalPreference != "no" {
+		t.Errorf("续订偏好未修改: %s", after.RenewalPreference)
+	}
+	if after.Version != before.Version+1 {
+		t.Errorf("版本未递增: 修改前=%d, 修改后=%d", before.Version, after.Version)
+	}
+	unchanged := *after
+	unchanged.RenewalPreference, unchanged.Version = before.RenewalPreference, before.Version
+	if !unchanged.StartDate.Equal(before.StartDate) || !unchanged.EndDate.Equal(before.EndDate) {
+		t.Errorf("订阅周期不应改变: 修改前=%v - %v, 修改后=%v - %v", before.StartDate, before.EndDate, after.StartDate, after.EndDate)
+	}
+	unchanged.StartDate, unchanged.EndDate = before.StartDate, before.EndDate
+	if unchanged != before {
+		t.Errorf("其他字段不应改变:\n修改前=%+v\n修改后=%+v", before, *after)
+	}
+
+	var detail string
+	err = service.db.db.QueryRow(`SELECT detail FROM subscription_events WHERE subscription_id = ? AND event_type = ?`,
+		before.ID, EventAdminPatch).Scan(&detail)
+	if err != nil || detail != "renewal_preference=no" {
+		t.Errorf("审计事件错误: detail=%q, err=%v", detail, err)
+	}
+
+	// 过期的版本、不允许的字段、无效的值和不存在的订阅
+	cases := []struct {
+		name   string
+		id     int64
+		body   string
+		status int
+	}{
+		{"过期版本", before.ID, fmt.Sprintf(`{"renewal_preference": "yes", "version": %d}`, before.Version), http.StatusConflict},
+		{"不允许的字段", before.ID, `{"user_id": 1}`, http.StatusBadRequest},
+		{"无效的值", before.ID, `{"renewal_preference": "maybe"}`, http.StatusBadRequest},
+		{"无效的周期", before.ID, `{"end_date": "2001-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{"没有字段", before.ID, `{}`, http.StatusBadRequest},
+		{"订阅不存在", before.ID + 100000, `{"renewal_preference": "yes"}`, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if rec := patch(c.id, c.body); rec.Code != c.status {
+			t.Errorf("%s: 状态码错误: 期望=%d, 实际=%d, 响应=%s", c.name, c.status, rec.Code, rec.Body.String())
+		}
+	}
+
+	final, err := service.db.GetSubscriptionByID(ctx, before.ID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	if final.RenewalPreference != "no" || final.Version != after.Version {
+		t.Errorf("失败的修改不应生效: %+v", *final)
+	}
+}
+
+// 测试取消续订功能
+func TestCancelRenewal(t *testing.T) {
+	// 创建服务实例
+	service := createTestService(t)
+	defer service.Close()
+
+	// 创建并激活测试用户订阅
+	testUser := "取消续订测试用户"
+	testEmail := "cancel_test@example.com"
+	userID, err := service.CreateUser(context.Background(), testUser, testEmail)
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	err = service.ActivateSubscription(context.Background(), userID, "basic", "")
+	if err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+
+	// 获取订阅ID
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+
+	subID := subs[0].ID
+
+	// 测试取消续订
+	request := CancelRenewalRequest{
+		SubscriptionID: subID,
+		UserID:         userID,
+	}
+
+	err = service.CancelRenewal(context.Background(), request)
+	if err != nil {
+		t.Errorf("取消续订失败: %v", err)
+	}
+
+	// 验证订阅状态和续订偏好
+	subs, err = service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil {
+		t.Errorf("获取用户订阅失败: %v", err)
+	}
+
+	if len(subs) != 1 || subs[0].Status != StatusUnsubscribed {
+		t.Errorf("取消续订后状态错误: 期望=%s, 实际=%s", StatusUnsubscribed, subs[0].Status)
+	}
+
+	if subs[0].RenewalPreference != "no" {
+		t.Errorf("续订偏好错误: 期望=no, 实际=%s", subs[0].RenewalPreference)
+	}
+}
+
+// 测试订阅已被其他请求续约后，续订不再更新订阅，重复的续订请求返回409
+func TestRenewalGuardsAgainstDoubleCharge(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+	ctx := context.Background()
+
+	userID, err := service.CreateUser(ctx, "重复续订测试用户", "double_renewal_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	request := RenewalRequest{SubscriptionID: subs[0].ID, UserID: userID, Amount: SubscriptionPrice}
+	if _, err := service.RenewSubscription(ctx, request); err != nil {
+		t.Fatalf("续订失败: %v", err)
+	}
+	renewed, err := service.db.GetSubscriptionByID(ctx, subs[0].ID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+
+	// 模拟并发请求：读取时仍为已订阅，更新时订阅已被另一个请求续约
+	tx, err := service.db.BeginTx(ctx)
+	if err != nil {
+		t.Fatalf("开始事务失败: %v", err)
+	}
+	err = markRenewed(ctx, tx, subs[0].ID, renewed.EndDate.AddDate(0, 1, 0))
+	tx.Rollback()
+	if !errors.Is(err, ErrAlreadyRenewed) {
+		t.Errorf("已续约的订阅应返回 ErrAlreadyRenewed, 实际=%v", err)
+	}
+
+	// 重复的续订请求返回409，不再记录支付
+	body, _ := json.Marshal(request)
+	rec := httptest.NewRecorder()
+	handler.HandleRenewSubscription(rec, httptest.NewRequest(http.MethodPost, "/api/subscriptions/renew", bytes.NewReader(body)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("重复续订状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusConflict, rec.Code, rec.Body.String())
+	}
+
+	var renewals int
+	if err := service.db.db.QueryRow(`SELECT COUNT(*) FROM payments WHERE subscription_id = ? AND type = 'renewal'`, subs[0].ID).Scan(&renewals); err != nil {
+		t.Fatalf("查询续订支付失败: %v", err)
+	}
+	if renewals != 1 {
+		t.Errorf("应只记录一笔续订支付: 实际=%d", renewals)
+	}
+	if after, _ := service.db.GetSubscriptionByID(ctx, subs[0].ID); !after.EndDate.Equal(renewed.EndDate) || after.Version != renewed.Version {
+		t.Errorf("重复续订不应修改订阅: 之前=%+v, 之后=%+v", renewed, after)
+	}
+}
+
+// 测试订阅记录的创建时间和修改时间
+func TestSubscriptionTimestamps(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+
+	userID, err := service.CreateUser(ctx, "时间戳测试用户", "timestamps_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	sub := subs[0]
+	if sub.CreatedAt.IsZero() || sub.UpdatedAt.IsZero() {
+		t.Fatalf("新订阅应记录创建和修改时间: %+v", sub)
+	}
+
+	body, _ := json.Marshal(sub)
+	var fields map[string]any
+	json.Unmarshal(body, &fields)
+	if fields["created_at"] == nil || fields["updated_at"] == nil {
+		t.Errorf("订阅 JSON 缺少时间戳字段: %s", body)
+	}
+
+	// 把时间戳调到过去，修改订阅后只有修改时间更新
+	past := time.Date(2005, 3, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := service.db.db.Exec(`UPDATE subscriptions SET created_at = ?, updated_at = ? WHERE id = ?`, past, past, sub.ID); err != nil {
+		t.Fatalf("更新订阅时间戳失败: %v", err)
+	}
+	if err := service.db.UpdateRenewalPreference(ctx, sub.ID, "yes"); err != nil {
+		t.Fatalf("更新续订偏好失败: %v", err)
+	}
+	updated, err := service.db.GetSubscriptionByID(ctx, sub.ID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	if !updated.CreatedAt.Equal(past) {
+		t.Errorf("修改订阅不应改变创建时间: 期望=%v, 实际=%v", past, updated.CreatedAt)
+	}
+	if !updated.UpdatedAt.After(past) {
+		t.Errorf("修改订阅后应更新修改时间: %v", updated.UpdatedAt)
+	}
+}
+
+// 测试续订和取消续订其他用户的订阅时与订阅不存在的结果相同，订阅保持不变
+func TestSubscriptionOwnershipHidden(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+	ctx := context.Background()
+
+	owner, err := service.CreateUser(ctx, "订阅所有者", "ownership_owner@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	other, err := service.CreateUser(ctx, "其他用户", "ownership_other@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, owner, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, owner)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+
+	if _, err := service.db.GetSubscriptionByIDForUser(ctx, subID, owner); err != nil {
+		t.Errorf("所有者应能获取订阅: %v", err)
+	}
+
+	for _, id := range []int64{subID, subID + 1000000} {
+		if _, err := service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: id, UserID: other, Amount: SubscriptionPrice}); !errors.Is(err, ErrSubscriptionNotFound) {
+			t.Errorf("续订订阅 %d 应返回 ErrSubscriptionNotFound, 实际=%v", id, err)
+		}
+		if err := service.CancelRenewal(ctx, CancelRenewalRequest{SubscriptionID: id, UserID: other}); !errors.Is(err, ErrSubscriptionNotFound) {
+			t.Errorf("取消续订订阅 %d 应返回 ErrSubscriptionNotFound, 实际=%v", id, err)
+		}
+	}
+
+	body := fmt.Sprintf(`{"subscription_id": %d, "user_id": %d}`, subID, other)
+	rec := httptest.NewRecorder()
+	handler.HandleCancelRenewal(rec, httptest.NewRequest(http.MethodPost, "/api/subscriptions/cancel", strings.NewReader(body)))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "订阅不存在") {
+		t.Errorf("取消其他用户的订阅应返回404: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	sub, err := service.db.GetSubscriptionByID(ctx, subID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	if sub.Status != StatusSubscribed || sub.Version != subs[0].Version {
+		t.Errorf("其他用户的请求不应修改订阅: %+v", sub)
+	}
+}
+
+// 测试立即终止订阅并按剩余时长比例退款
+// 测试更新用户资料：校验邮箱格式，邮箱重复时返回409
+func TestUpdateUserProfile(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	userID, err := service.CreateUser(context.Background(), "资料测试用户", "profile_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if _, err := service.CreateUser(context.Background(), "另一个用户", "profile_other@example.com"); err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.HandleUsers(rec, httptest.NewRequest(http.MethodPatch, "/api/users", strings.NewReader(body)))
+		return rec
+	}
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"邮箱为空", fmt.Sprintf(`{"user_id": %d, "name": "新名字", "email": ""}`, userID), http.StatusBadRequest},
+		{"邮箱格式错误", fmt.Sprintf(`{"user_id": %d, "name": "新名字", "email": "not-an-email"}`, userID), http.StatusBadRequest},
+		{"邮箱重复", fmt.Sprintf(`{"user_id": %d, "name": "新名字", "email": "profile_other@example.com"}`, userID), http.StatusConflict},
+		{"用户不存在", `{"user_id": 999999, "name": "新名字", "email": "nobody@example.com"}`, http.StatusNotFound},
+		{"更新成功", fmt.Sprintf(`{"user_id": %d, "name": "新名字", "email": "profile_new@example.com"}`, userID), http.StatusOK},
+		{"内容未变化", fmt.Sprintf(`{"user_id": %d, "name": "新名字", "email": "profile_new@example.com"}`, userID), http.StatusOK},
+	}
+	for _, c := range cases {
+		if rec := patch(c.body); rec.Code != c.status {
+			t.Errorf("%s: 状态码错误: 期望=%d, 实际=%d, 响应=%s", c.name, c.status, rec.Code, rec.Body.String())
+		}
+	}
+
+	user, err := service.db.GetUserByID(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("获取用户信息失败: %v", err)
+	}
+	if user.Name != "新名字" || user.Email != "profile_new@example.com" {
+		t.Errorf("用户资料未更新: %+v", user)
+	}
+
+	// 创建用户时邮箱重复同样返回409
+	rec := httptest.NewRecorder()
+	handler.HandleUsers(rec, httptest.NewRequest(http.MethodPost, "/api/users",
+		strings.NewReader(`{"name": "重复用户", "email": "profile_other@example.com"}`)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("创建重复邮箱用户状态码错误: 期望=%d, 实际=%d", http.StatusConflict, rec.Code)
+	}
+}
+
+// 测试为已激活用户重新发送欢迎通知
+func TestResendOnboarding(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	userID, err := service.CreateUser(context.Background(), "引导通知测试用户", "resend_onboarding_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	resend := func(userID int64) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"user_id": %d}`, userID)
+		rec := httptest.NewRecorder()
+		handler.HandleResendOnboarding(rec, httptest.NewRequest(http.MethodPost, "/api/admin/users/resend-onboarding", strings.NewReader(body)))
+		return rec
+	}
+
+	// 未激活的用户没有可介绍的订阅
+	if rec := resend(userID); rec.Code != http.StatusConflict {
+		t.Errorf("未激活用户状态码错误: 期望=%d, 实际=%d", http.StatusConflict, rec.Code)
+	}
+	if rec := resend(999999); rec.Code != http.StatusNotFound {
+		t.Errorf("用户不存在时状态码错误: 期望=%d, 实际=%d", http.StatusNotFound, rec.Code)
+	}
+
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	if got := len(getNotifications(t, service.db, subs[0].ID, "welcome_notice")); got != 1 {
+		t.Fatalf("激活后欢迎通知数量错误: 期望=1, 实际=%d", got)
+	}
+
+	if rec := resend(userID); rec.Code != http.StatusOK {
+		t.Fatalf("重新发送状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	notices := getNotifications(t, service.db, subs[0].ID, "welcome_notice")
+	if len(notices) != 2 || notices[1].Status != "sent" {
+		t.Errorf("欢迎通知未重新发送: %+v", notices)
+	}
+}
+
+// 测试JWT认证：用户只能访问自己的数据，管理接口需要管理员令牌
+func TestJWTAuthMiddleware(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+	auth := NewJWTAuth("jwt_test_secret")
+
+	userID, err := service.CreateUser(context.Background(), "认证测试用户", "jwt_auth_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	issue := func(userID int64, admin bool, ttl time.Duration) string {
+		token, err := auth.IssueToken(userID, admin, ttl)
+		if err != nil {
+			t.Fatalf("签发令牌失败: %v", err)
+		}
+		return token
+	}
+	userToken := issue(userID, false, time.Hour)
+	adminToken := issue(1, true, time.Hour)
+	forged, _ := NewJWTAuth("other_secret").IssueToken(userID, true, time.Hour)
+
+	serve := func(h http.HandlerFunc, method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	subscriptions := auth.RequireUser(handler.HandleUserSubscriptions)
+	own := fmt.Sprintf("/api/subscriptions?user_id=%d", userID)
+	other := fmt.Sprintf("/api/subscriptions?user_id=%d", userID+1)
+	cases := []struct {
+		name   string
+		target string
+		token  string
+		status int
+	}{
+		{"缺少令牌", own, "", http.StatusUnauthorized},
+		{"签名不匹配", own, forged, http.StatusUnauthorized},
+		{"令牌过期", own, issue(userID, false, -time.Minute), http.StatusUnauthorized},
+		{"访问自己的数据", own, userToken, http.StatusOK},
+		{"访问其他用户的数据", other, userToken, http.StatusForbidden},
+		{"管理员访问任意用户", other, adminToken, http.StatusOK},
+	}
+	for _, c := range cases {
+		if rec := serve(subscriptions, http.MethodGet, c.target, c.token, ""); rec.Code != c.status {
+			t.Errorf("%s: 状态码错误: 期望=%d, 实际=%d", c.name, c.status, rec.Code)
+		}
+	}
+
+	// 请求体中的 user_id 同样校验，校验后处理器仍能读取完整请求体
+	var received string
+	echo := auth.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	})
+	body := fmt.Sprintf(`{"user_id": %d, "subscription_id": 1}`, userID)
+	if rec := serve(echo, http.MethodPost, "/api/subscriptions/cancel", userToken, body); rec.Code != http.StatusOK || received != body {
+		t.Errorf("请求体校验后应原样交给处理器: 状态码=%d, 请求体=%q", rec.Code, received)
+	}
+	body = fmt.Sprintf(`{"user_id": %d, "subscription_id": 1}`, userID+1)
+	if rec := serve(echo, http.MethodPost, "/api/subscriptions/cancel", userToken, body); rec.Code != http.StatusForbidden {
+		t.Errorf("请求体中的其他用户状态码错误: 期望=%d, 实际=%d", http.StatusForbidden, rec.Code)
+	}
+
+	// 请求体不是单个JSON对象时拒绝，不能跳过校验让处理器读到其他用户的 user_id
+	cancel := auth.RequireUser(handler.HandleCancelRenewal)
+	for _, body := range []string{
+		fmt.Sprintf(`{"user_id": %d, "subscription_id": 1} x`, userID+1),
+		fmt.Sprintf(`{"user_id": %d}{"user_id": %d}`, userID+1, userID),
+	} {
+		if rec := serve(cancel, http.MethodPost, "/api/subscriptions/cancel", userToken, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("请求体 %q 状态码错误: 期望=%d, 实际=%d", body, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	// 注册用户不需要认证
+	users := auth.RequireUser(handler.HandleUsers, http.MethodPost)
+	if rec := serve(users, http.MethodPost, "/api/users", "", `{"name": "注册用户", "email": "jwt_signup_test@example.com"}`); rec.Code != http.StatusOK {
+		t.Errorf("注册用户状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+
+	stats := auth.RequireAdmin(handler.HandleSystemStats)
+	if rec := serve(stats, http.MethodGet, "/api/admin/stats", userToken, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("普通用户访问管理接口状态码错误: 期望=%d, 实际=%d", http.StatusForbidden, rec.Code)
+	}
+	if rec := serve(stats, http.MethodGet, "/api/admin/stats", adminToken, ""); rec.Code != http.StatusOK {
+		t.Errorf("管理员访问管理接口状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+}
+
+// 测试访问日志记录请求的方法、路径、状态码和耗时
+func TestAccessLogRecordsStatus(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stdout)
+
+	handler := accessLog(http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/no-such-path", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusNotFound, rec.Code)
+	}
+	if !strings.Contains(buf.String(), "请求完成: GET /api/no-such-path 状态码=404 耗时=") {
+		t.Errorf("访问日志缺少状态码: %s", buf.String())
+	}
+
+	// 未显式写状态码的处理器记录为200
+	buf.Reset()
+	accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/users", nil))
+	if !strings.Contains(buf.String(), "请求完成: POST /api/users 状态码=200") {
+		t.Errorf("访问日志状态码错误: %s", buf.String())
+	}
+}
+
+// 测试按IP限流：超出限制返回429和 Retry-After，令牌按速率补充，空闲的桶被清理
+func TestRateLimiter(t *testing.T) {
+	clock := newVirtualClock(time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC))
+	limiter := NewRateLimiter(3)
+	limiter.clock = clock
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(remoteAddr, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := request("10.0.0.1:5000", "/api/subscriptions"); rec.Code != http.StatusOK {
+			t.Fatalf("第%d个请求不应被限流: %d", i+1, rec.Code)
+		}
+	}
+	rec := request("10.0.0.1:5001", "/api/subscriptions")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "20" {
+		t.Fatalf("超出限制应返回429和 Retry-After: 状态码=%d, Retry-After=%q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// 其他IP和免限流路径不受影响
+	if rec := request("10.0.0.2:5000", "/api/subscriptions"); rec.Code != http.StatusOK {
+		t.Errorf("其他IP不应被限流: %d", rec.Code)
+	}
+	if rec := request("10.0.0.1:5000", "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("健康检查不应被限流: %d", rec.Code)
+	}
+
+	// 20秒补充一个令牌
+	clock.Advance(20 * time.Second)
+	if rec := request("10.0.0.1:5000", "/api/subscriptions"); rec.Code != http.StatusOK {
+		t.Errorf("令牌补充后应允许请求: %d", rec.Code)
+	}
+	if rec := request("10.0.0.1:5000", "/api/subscriptions"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("补充的令牌用完后应再次限流: %d", rec.Code)
+	}
+
+	// 未补满的桶保留，补满后清理
+	clock.Advance(30 * time.Second)
+	if evicted := limiter.evict(); evicted != 0 {
+		t.Errorf("未补满的桶不应被清理: %d", evicted)
+	}
+	clock.Advance(time.Minute)
+	if evicted := limiter.evict(); evicted != 2 || len(limiter.buckets) != 0 {
+		t.Errorf("空闲的桶应被清理: evicted=%d, 剩余=%d", evicted, len(limiter.buckets))
+	}
+}
+
+// 测试管理员分页列出用户及其最近的订阅，并按订阅状态筛选
+func TestListUsers(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+
+	createUser := func(email string) int64 {
+		userID, err := service.CreateUser(ctx, "用户列表测试用户", email)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		return userID
+	}
+	subscribed := createUser("list_users_subscribed@example.com")
+	if err := service.ActivateSubscription(ctx, subscribed, "premium", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	unsubscribed := createUser("list_users_unsubscribed@example.com")
+	if err := service.ActivateSubscription(ctx, unsubscribed, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, unsubscribed)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	if err := service.db.UpdateSubscriptionStatus(ctx, subs[0].ID, StatusUnsubscribed); err != nil {
+		t.Fatalf("更新订阅状态失败: %v", err)
+	}
+	// 直接插入的用户没有任何订阅
+	res, err := service.db.db.Exec("INSERT INTO users (name, email, created_at) VALUES (?, ?, ?)",
+		"用户列表测试用户", "list_users_none@example.com", time.Now())
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	noSubscription, _ := res.LastInsertId()
+
+	// 逐页读取全部结果
+	listAll := func(status string) map[int64]UserWithSubscription {
+		users := make(map[int64]UserWithSubscription)
+		for offset := 0; ; offset += 2 {
+			page, err := service.ListUsers(ctx, status, 2, offset)
+			if err != nil {
+				t.Fatalf("获取用户列表失败: %v", err)
+			}
+			for _, user := range page.Users {
+				users[user.ID] = user
+			}
+			if offset+2 >= page.Total {
+				if len(users) != page.Total {
+					t.Errorf("分页结果数与总数不一致: %d != %d", len(users), page.Total)
+				}
+				return users
+			}
+		}
+	}
+
+	all := listAll("")
+	if user := all[subscribed]; user.Plan != "premium" || user.Status != StatusSubscribed || user.EndDate == nil {
+		t.Errorf("已订阅用户的订阅信息错误: %+v", user)
+	}
+	if user, ok := all[noSubscription]; !ok || user.Email != "list_users_none@example.com" || user.Status != "" || user.EndDate != nil {
+		t.Errorf("没有订阅的用户也应列出且订阅字段为空: %+v", user)
+	}
+
+	filtered := listAll(StatusUnsubscribed)
+	if _, ok := filtered[unsubscribed]; !ok {
+		t.Errorf("按状态筛选应包含已退订用户")
+	}
+	for _, user := range filtered {
+		if user.Status != StatusUnsubscribed {
+			t.Errorf("筛选结果包含其他状态的用户: %+v", user)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleListUsers(rec, httptest.NewRequest(http.MethodGet, "/api/admin/users?status=unsubscribed&limit=1", nil))
+	var page UserPage
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil || len(page.Users) != 1 || page.Total != len(filtered) {
+		t.Errorf("接口返回的分页结果错误: %v, %+v", err, page)
+	}
+
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleListUsers(rec, httptest.NewRequest(http.MethodGet, "/api/admin/users?offset=-1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("offset无效时应返回400: %d", rec.Code)
+	}
+}
+
+// 测试按用户名或邮箱搜索用户，通配符按字面匹配
+func TestSearchUsers(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 直接插入，邮箱中的 % 无法通过注册校验
+	for _, user := range []struct{ name, email string }{
+		{"搜索测试用户", "usersearch_100%@example.com"},
+		{"搜索测试用户", "usersearch_1000@example.com"},
+		{"搜索测试用户", "usersearch_x_y@example.com"},
+		{"搜索测试用户", "usersearch_xzy@example.com"},
+		{"搜索测试专用名", "usersearch_named@example.com"},
+	} {
+		if _, err := service.db.db.Exec("INSERT INTO users (name, email) VALUES (?, ?)", user.name, user.email); err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+	}
+
+	search := func(query string) []string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		NewSubscriptionHandler(service).HandleSearchUsers(rec, httptest.NewRequest(http.MethodGet, "/api/admin/users/search?"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+		}
+		var users []User
+		if err := json.NewDecoder(rec.Body).Decode(&users); err != nil {
+			t.Fatalf("解析响应失败: %v", err)
+		}
+		emails := make([]string, len(users))
+		for i, user := range users {
+			emails[i] = user.Email
+		}
+		return emails
+	}
+
+	testCases := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{"百分号按字面匹配", "q=" + url.QueryEscape("100%"), []string{"usersearch_100%@example.com"}},
+		{"下划线按字面匹配", "q=x_y", []string{"usersearch_x_y@example.com"}},
+		{"匹配用户名", "q=" + url.QueryEscape("专用名"), []string{"usersearch_named@example.com"}},
+		{"限制返回条数", "q=usersearch_&limit=2", []string{"usersearch_100%@example.com", "usersearch_1000@example.com"}},
+		{"没有匹配", "q=usersearch_none", []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if emails := search(tc.query); !slices.Equal(emails, tc.expected) {
+				t.Errorf("搜索结果错误: 期望=%v, 实际=%v", tc.expected, emails)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleSearchUsers(rec, httptest.NewRequest(http.MethodGet, "/api/admin/users/search?q=+", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("空搜索内容应返回400，实际=%d", rec.Code)
+	}
+}
+
+// 测试按ID查询单个用户
+func TestGetUser(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	userID, err := service.CreateUser(context.Background(), "查询测试用户", "get_user_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.HandleUsers(rec, httptest.NewRequest(http.MethodGet, "/api/users"+query, nil))
+		return rec
+	}
+
+	rec := get(fmt.Sprintf("?user_id=%d", userID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var user User
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if user.ID != userID || user.Name != "查询测试用户" || user.Email != "get_user_test@example.com" {
+		t.Errorf("用户信息不匹配: %+v", user)
+	}
+
+	cases := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"缺少user_id", "", http.StatusBadRequest},
+		{"user_id格式错误", "?user_id=abc", http.StatusBadRequest},
+		{"用户不存在", "?user_id=999999", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if rec := get(c.query); rec.Code != c.status {
+			t.Errorf("%s: 状态码错误: 期望=%d, 实际=%d", c.name, c.status, rec.Code)
+		}
+	}
+}
+
+// signWebhook 按支付网关的方式生成 Stripe-Signature 请求头
+func signWebhook(secret string, body []byte, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 测试支付网关回调确认待支付订单后才激活订阅
+func TestPaymentWebhook(t *testing.T) {
+	secret := "whsec_test"
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN, PaymentWebhookSecret: secret})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	// 激活后只创建待确认的支付，订阅保持未激活
+	activate := func(name, email string) (Subscription, int64) {
+		userID, err := service.CreateUser(context.Background(), name, email)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(context.Background(), userID, "premium", ""); err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+		subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+		if err != nil || len(subs) != 1 {
+			t.Fatalf("获取用户订阅失败: %v", err)
+		}
+		if subs[0].Status != StatusInactive || subs[0].Plan != "premium" {
+			t.Fatalf("等待支付确认时订阅不应激活: %+v", subs[0])
+		}
+
+		var paymentID int64
+		var status string
+		err = service.db.db.QueryRow(`SELECT id, status FROM payments WHERE subscription_id = ?`, subs[0].ID).Scan(&paymentID, &status)
+		if err != nil {
+			t.Fatalf("获取支付记录失败: %v", err)
+		}
+		if status != StatusPending {
+			t.Fatalf("支付记录状态错误: 期望=%s, 实际=%s", StatusPending, status)
+		}
+		return subs[0], paymentID
+	}
+
+	post := func(body, signature string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks/payment", strings.NewReader(body))
+		req.Header.Set("Stripe-Signature", signature)
+		rec := httptest.NewRecorder()
+		handler.HandlePaymentWebhook(rec, req)
+		return rec
+	}
+	send := func(paymentID int64, status string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"payment_id": %d, "status": "%s"}`, paymentID, status)
+		return post(body, signWebhook(secret, []byte(body), time.Now()))
+	}
+
+	sub, paymentID := activate("支付回调成功用户", "webhook_success_test@example.com")
+	body := fmt.Sprintf(`{"payment_id": %d, "status": "success"}`, paymentID)
+
+	signatureCases := []struct {
+		name      string
+		signature string
+	}{
+		{"缺少签名", ""},
+		{"密钥错误", signWebhook("whsec_other", []byte(body), time.Now())},
+		{"时间戳过期", signWebhook(secret, []byte(body), time.Now().Add(-time.Hour))},
+	}
+	for _, c := range signatureCases {
+		if rec := post(body, c.signature); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: 状态码错误: 期望=%d, 实际=%d", c.name, http.StatusUnauthorized, rec.Code)
+		}
+	}
+	if got, _ := service.db.GetSubscriptionByID(context.Background(), sub.ID); got.Status != StatusInactive {
+		t.Fatalf("签名无效时订阅不应激活: %+v", got)
+	}
+
+	if rec := send(paymentID, StatusSuccess); rec.Code != http.StatusOK {
+		t.Fatalf("确认支付成功失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	got, err := service.db.GetSubscriptionByID(context.Background(), sub.ID)
+	if err != nil {
+		t.Fatalf("获取订阅信息失败: %v", err)
+	}
+	if got.Status != StatusSubscribed || !got.EndDate.After(time.Now()) {
+		t.Errorf("支付成功后订阅应激活: %+v", got)
+	}
+
+	// 重复回调相同结果视为成功，回调相反结果返回409
+	if rec := send(paymentID, StatusSuccess); rec.Code != http.StatusOK {
+		t.Errorf("重复回调状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+	if rec := send(paymentID, StatusFailed); rec.Code != http.StatusConflict {
+		t.Errorf("已确认支付再次回调失败状态码错误: 期望=%d, 实际=%d", http.StatusConflict, rec.Code)
+	}
+
+	// 支付失败时订阅保持未激活
+	failedSub, failedPaymentID := activate("支付回调失败用户", "webhook_failed_test@example.com")
+	if rec := send(failedPaymentID, StatusFailed); rec.Code != http.StatusOK {
+		t.Fatalf("确认支付失败出错: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	var status string
+	if err := service.db.db.QueryRow(`SELECT status FROM payments WHERE id = ?`, failedPaymentID).Scan(&status); err != nil || status != StatusFailed {
+		t.Errorf("支付记录应为 failed: %s, %v", status, err)
+	}
+	if got, _ := service.db.GetSubscriptionByID(context.Background(), failedSub.ID); got.Status != StatusInactive {
+		t.Errorf("支付失败后订阅不应激活: %+v", got)
+	}
+
+	// 等待确认期间重复激活不会再创建支付或占用优惠码；支付失败时归还优惠码，之后可以重新激活
+	if _, err := service.db.db.Exec(`INSERT INTO coupons (code, discount_type, discount_value, max_uses)
+                  VALUES (?, ?, ?, ?)`, "WEBHOOK_ONCE", CouponPercent, 50, 1); err != nil {
+		t.Fatalf("创建优惠码失败: %v", err)
+	}
+	couponUser, err := service.CreateUser(context.Background(), "支付回调优惠码用户", "webhook_coupon_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), couponUser, "premium", "WEBHOOK_ONCE"); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), couponUser, "premium", ""); !errors.Is(err, ErrActivationPending) {
+		t.Errorf("有待确认的支付时重复激活应返回 ErrActivationPending: %v", err)
+	}
+	usedCount := func() int {
+		var used int
+		if err := service.db.db.QueryRow(`SELECT used_count FROM coupons WHERE code = ?`, "WEBHOOK_ONCE").Scan(&used); err != nil {
+			t.Fatalf("查询优惠码失败: %v", err)
+		}
+		return used
+	}
+	var couponPaymentID int64
+	var pendingCount int
+	if err := service.db.db.QueryRow(`SELECT MAX(id), COUNT(*) FROM payments WHERE user_id = ?`, couponUser).Scan(&couponPaymentID, &pendingCount); err != nil || pendingCount != 1 {
+		t.Fatalf("重复激活不应创建支付: 支付数=%d, %v", pendingCount, err)
+	}
+	if used := usedCount(); used != 1 {
+		t.Fatalf("优惠码使用次数错误: %d", used)
+	}
+	if rec := send(couponPaymentID, StatusFailed); rec.Code != http.StatusOK {
+		t.Fatalf("确认支付失败出错: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	if used := usedCount(); used != 0 {
+		t.Errorf("支付失败后应归还优惠码: 使用次数=%d", used)
+	}
+	if err := service.ActivateSubscription(context.Background(), couponUser, "premium", "WEBHOOK_ONCE"); err != nil {
+		t.Errorf("支付失败后应可以重新激活: %v", err)
+	}
+
+	// 回调只确认首次订阅支付
+	var renewalPaymentID int64
+	err = service.db.db.QueryRow(`SELECT id FROM payments WHERE subscription_id = ? AND type = 'initial'`, sub.ID).Scan(&renewalPaymentID)
+	if err != nil {
+		t.Fatalf("获取支付记录失败: %v", err)
+	}
+	if _, err := service.db.db.Exec(`UPDATE payments SET type = 'renewal', status = ? WHERE id = ?`, StatusPending, renewalPaymentID); err != nil {
+		t.Fatalf("更新支付记录失败: %v", err)
+	}
+	if rec := send(renewalPaymentID, StatusSuccess); rec.Code != http.StatusConflict {
+		t.Errorf("续订支付回调状态码错误: 期望=%d, 实际=%d", http.StatusConflict, rec.Code)
+	}
+
+	if rec := send(999999, StatusSuccess); rec.Code != http.StatusNotFound {
+		t.Errorf("支付不存在时状态码错误: 期望=%d, 实际=%d", http.StatusNotFound, rec.Code)
+	}
+	if rec := send(paymentID, "refunded"); rec.Code != http.StatusBadRequest {
+		t.Errorf("支付结果无效时状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+// 测试支付失败后订阅保持未激活，且失败记录计入系统统计
+func TestFailedPaymentStats(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN, PaymentWebhookSecret: "whsec_test"})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+
+	if err := service.cache.refreshCache(); err != nil {
+		t.Fatalf("刷新缓存失败: %v", err)
+	}
+	failedBefore := service.GetSystemStats().FailedPayments
+
+	userID, err := service.CreateUser(context.Background(), "支付失败测试用户", "failed_payment_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+
+	var paymentID int64
+	if err := service.db.db.QueryRow(`SELECT id FROM payments WHERE subscription_id = ?`, subs[0].ID).Scan(&paymentID); err != nil {
+		t.Fatalf("获取支付记录失败: %v", err)
+	}
+
+	if err := service.ConfirmPayment(context.Background(), paymentID, StatusFailed); err != nil {
+		t.Fatalf("标记支付失败出错: %v", err)
+	}
+	if sub, _ := service.db.GetSubscriptionByID(context.Background(), subs[0].ID); sub.Status != StatusInactive {
+		t.Errorf("支付失败后订阅应保持未激活: %+v", sub)
+	}
+
+	// 失败的支付不能再变为成功
+	if err := service.ConfirmPayment(context.Background(), paymentID, StatusSuccess); !errors.Is(err, ErrPaymentNotPending) {
+		t.Errorf("失败的支付变为成功应返回 ErrPaymentNotPending, 实际: %v", err)
+	}
+
+	if err := service.cache.refreshCache(); err != nil {
+		t.Fatalf("刷新缓存失败: %v", err)
+	}
+	if failed := service.GetSystemStats().FailedPayments; failed != failedBefore+1 {
+		t.Errorf("支付失败记录数错误: 期望=%d, 实际=%d", failedBefore+1, failed)
+	}
+}
+
+func TestCancelImmediately(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	userID, err := service.CreateUser(context.Background(), "立即终止测试用户", "cancel_immediate_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	sub := subs[0]
+
+	// 当前周期剩余一半
+	now := time.Now()
+	if err := service.db.UpdateSubscriptionDates(sub.ID, now.Add(-15*24*time.Hour), now.Add(15*24*time.Hour)); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+
+	cancel := func(request CancelRenewalRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(request)
+		rec := httptest.NewRecorder()
+		handler.HandleCancelRenewal(rec, httptest.NewRequest(http.MethodPost, "/api/subscriptions/cancel", bytes.NewReader(body)))
+		return rec
+	}
+
+	// 非立即终止时不允许退款
+	if rec := cancel(CancelRenewalRequest{SubscriptionID: sub.ID, UserID: userID, Refund: true}); rec.Code != http.StatusBadRequest {
+		t.Errorf("refund=true 且 immediate=false 时状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec := cancel(CancelRenewalRequest{SubscriptionID: sub.ID, UserID: userID, Immediate: true, Refund: true})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("立即终止失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	updated, err := service.db.GetSubscriptionByID(context.Background(), sub.ID)
+	if err != nil {
+		t.Fatalf("获取订阅信息失败: %v", err)
+	}
+	if updated.Status != StatusInactive || updated.RenewalPreference != "no" {
+		t.Errorf("立即终止后状态错误: 状态=%s, 续订偏好=%s", updated.Status, updated.RenewalPreference)
+	}
+	if diff := time.Since(updated.EndDate); diff < -time.Minute || diff > time.Minute {
+		t.Errorf("立即终止后结束日期应为当前时间, 实际=%v", updated.EndDate)
+	}
+
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	var refund *Payment
+	for i := range payments {
+		if payments[i].Type == "refund" {
+			refund = &payments[i]
+		}
+	}
+	if refund == nil {
+		t.Fatal("未创建按比例退款记录")
+	}
+	if expected := -SubscriptionPrice / 2; math.Abs(refund.Amount-expected) > 0.02 || refund.Reason != PaymentReasonProrated {
+		t.Errorf("按比例退款错误: 期望金额约=%.2f, 实际=%.2f, 原因=%s", expected, refund.Amount, refund.Reason)
+	}
+
+	// 已终止的订阅不能再次取消
+	if rec := cancel(CancelRenewalRequest{SubscriptionID: sub.ID, UserID: userID, Immediate: true}); rec.Code == http.StatusOK {
+		t.Error("已终止的订阅不应再次取消")
+	}
+
+	// 已续约的订阅：续约预付的周期尚未开始，全额退还续约支付；当前周期的支付按剩余时长比例退还
+	renewedUserID, err := service.CreateUser(context.Background(), "续约后立即终止测试用户", "cancel_immediate_renewed_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), renewedUserID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err = service.db.GetUserSubscriptions(context.Background(), renewedUserID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	renewed := subs[0]
+	if err := service.db.UpdateSubscriptionDates(renewed.ID, now.Add(-15*24*time.Hour), now.Add(15*24*time.Hour)); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+	if _, err := service.RenewSubscription(context.Background(), RenewalRequest{SubscriptionID: renewed.ID, UserID: renewedUserID}); err != nil {
+		t.Fatalf("续订失败: %v", err)
+	}
+
+	rec = cancel(CancelRenewalRequest{SubscriptionID: renewed.ID, UserID: renewedUserID, Immediate: true, Refund: true})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("立即终止已续约订阅失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	payments, err = service.db.GetUserPayments(renewedUserID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	var refunded float64
+	var refunds int
+	for _, payment := range payments {
+		if payment.Type == "refund" {
+			refunded += payment.Amount
+			refunds++
+		}
+	}
+	if expected := -SubscriptionPrice * 1.5; refunds != 2 || math.Abs(refunded-expected) > 0.02 {
+		t.Errorf("已续约订阅退款错误: 期望2笔共约=%.2f, 实际%d笔共=%.2f", expected, refunds, refunded)
+	}
+
+	// 终止时间和退款比例按服务的时钟计算：30天的周期过去20天，退还三分之一
+	clockUserID, err := service.CreateUser(context.Background(), "虚拟时钟立即终止测试用户", "cancel_immediate_clock_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), clockUserID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err = service.db.GetUserSubscriptions(context.Background(), clockUserID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	if err := service.db.UpdateSubscriptionDates(subs[0].ID, now.Add(-15*24*time.Hour), now.Add(15*24*time.Hour)); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+	cancelAt := now.Add(5 * 24 * time.Hour)
+	service.setClock(newVirtualClock(cancelAt))
+	defer service.setClock(realClock{})
+	if rec := cancel(CancelRenewalRequest{SubscriptionID: subs[0].ID, UserID: clockUserID, Immediate: true, Refund: true}); rec.Code != http.StatusOK {
+		t.Fatalf("立即终止失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	if ended, err := service.db.GetSubscriptionByID(context.Background(), subs[0].ID); err != nil || ended.EndDate.Sub(cancelAt).Abs() > time.Second {
+		t.Errorf("立即终止后结束日期应为时钟时间: 期望=%v, 实际=%+v, 错误=%v", cancelAt, ended, err)
+	}
+	payments, err = service.db.GetUserPayments(clockUserID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	refunded = 0
+	for _, payment := range payments {
+		if payment.Type == "refund" {
+			refunded += payment.Amount
+		}
+	}
+	if expected := -SubscriptionPrice / 3; math.Abs(refunded-expected) > 0.02 {
+		t.Errorf("按时钟计算的退款错误: 期望约=%.2f, 实际=%.2f", expected, refunded)
+	}
+}
+
+// 测试最短承诺期内不能退款，但可以取消到期后的续订
+func TestMinCommitmentPeriod(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{
+		DatabaseDSN: testDSN,
+		Plans: []Plan{
+			{Name: "basic", Duration: PlanDuration{Months: 1}, Price: 30, MinCommitmentDays: 30},
+		},
+	})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+	ctx := context.Background()
+
+	userID, err := service.CreateUser(ctx, "承诺期测试用户", "commitment_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	sub := subs[0]
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil || len(payments) != 1 {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+
+	cancel := func(request CancelRenewalRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(request)
+		rec := httptest.NewRecorder()
+		handler.HandleCancelRenewal(rec, httptest.NewRequest(http.MethodPost, "/api/subscriptions/cancel", bytes.NewReader(body)))
+		return rec
+	}
+	refunds := func() int {
+		var count int
+		if err := service.db.db.QueryRow(`SELECT COUNT(*) FROM payments WHERE subscription_id = ? AND type = 'refund'`, sub.ID).Scan(&count); err != nil {
+			t.Fatalf("查询退款记录失败: %v", err)
+		}
+		return count
+	}
+
+	// 承诺期内立即终止并退款被拒绝，订阅保持不变
+	rec := cancel(CancelRenewalRequest{SubscriptionID: sub.ID, UserID: userID, Immediate: true, Refund: true})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("承诺期内退款状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusConflict, rec.Code, rec.Body.String())
+	}
+	if _, err := service.RefundPayment(ctx, payments[0].ID, userID, ""); !errors.Is(err, ErrWithinCommitment) {
+		t.Errorf("承诺期内退款支付应返回 ErrWithinCommitment, 实际=%v", err)
+	}
+	if updated, _ := service.db.GetSubscriptionByID(ctx, sub.ID); updated.Status != StatusSubscribed {
+		t.Errorf("退款被拒绝时订阅不应变化: %+v", updated)
+	}
+	if n := refunds(); n != 0 {
+		t.Errorf("承诺期内不应创建退款记录: %d", n)
+	}
+
+	// 承诺期内可以取消到期后的续订
+	if rec := cancel(CancelRenewalRequest{SubscriptionID: sub.ID, UserID: userID}); rec.Code != http.StatusOK {
+		t.Fatalf("承诺期内取消续订失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	if updated, _ := service.db.GetSubscriptionByID(ctx, sub.ID); updated.Status != StatusUnsubscribed {
+		t.Errorf("取消续订后状态错误: %s", updated.Status)
+	}
+
+	// 承诺期从首次订阅支付开始计算，期满后可以退款
+	if _, err := service.db.db.Exec(`UPDATE payments SET payment_date = ? WHERE id = ?`, time.Now().AddDate(0, 0, -31), payments[0].ID); err != nil {
+		t.Fatalf("更新支付日期失败: %v", err)
+	}
+	if _, err := service.RefundPayment(ctx, payments[0].ID, userID, ""); err != nil {
+		t.Errorf("承诺期满后退款失败: %v", err)
+	}
+	if n := refunds(); n != 1 {
+		t.Errorf("承诺期满后应创建退款记录: %d", n)
+	}
+}
+
+// 测试系统统计
+func TestGetSystemStats(t *testing.T) {
+	// 创建服务实例
+	service := createTestService(t)
+	defer service.Close()
+
+	// 获取初始统计
+	initialStats := service.GetSystemStats()
+
+	// 创建几个测试用户和订阅
+	testUsers := []struct {
+		name  string
+		email string
+	}{
+		{"统计测试用户1", "stats_test1@example.com"},
+		{"统计测试用户2", "stats_test2@example.com"},
+		{"统计测试用户3", "stats_test3@example.com"},
+	}
+
+	for _, user := range testUsers {
+		userID, err := service.CreateUser(context.Background(), user.name, user.email)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+
+		err = service.ActivateSubscription(context.Background(), userID, "basic", "")
+		if err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+	}
+
+	// 强制刷新缓存
+	if err := service.cache.refreshCache(); err != nil {
+		t.Fatalf("刷新缓存失败: %v", err)
+	}
+
+	// 获取更新后的统计
+	updatedStats := service.GetSystemStats()
+
+	// 验证用户数增加
+	expectedUserIncrease := len(testUsers)
+	actualUserIncrease := updatedStats.TotalUsers - initialStats.TotalUsers
+	if actualUserIncrease != expectedUserIncrease {
+		t.Errorf("用户数增加错误: 期望=%d, 实际=%d", expectedUserIncrease, actualUserIncrease)
+	}
+
+	// 验证活跃订阅数增加
+	expectedSubIncrease := len(testUsers)
+	actualSubIncrease := updatedStats.ActiveSubscriptions - initialStats.ActiveSubscriptions
+	if actualSubIncrease != expectedSubIncrease {
+		t.Errorf("活跃订阅数增加错误: 期望=%d, 实际=%d", expectedSubIncrease, actualSubIncrease)
+	}
+
+	// 验证付款金额增加
+	expectedAmountIncrease := float64(len(testUsers)) * SubscriptionPrice
+	actualAmountIncrease := updatedStats.TotalPaymentAmount - initialStats.TotalPaymentAmount
+	if !sameAmount(actualAmountIncrease, expectedAmountIncrease) {
+		t.Errorf("付款总额增加错误: 期望=%.2f, 实际=%.2f", expectedAmountIncrease, actualAmountIncrease)
+	}
+
+	// 验证更新时间是否刷新
+	if !updatedStats.LastUpdated.After(initialStats.LastUpdated) {
+		t.Errorf("统计更新时间未刷新: 初始=%v, 更新后=%v", initialStats.LastUpdated, updatedStats.LastUpdated)
+	}
+}
+
+// 测试业务操作增量更新统计缓存，结果与全量查询一致
+func TestIncrementalStats(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 以全量查询的结果为起点，之后不再调用 refreshCache
+	if err := service.cache.refreshCache(); err != nil {
+		t.Fatalf("刷新缓存失败: %v", err)
+	}
+	before := service.GetSystemStats()
+
+	var subIDs []int64
+	for i, plan := range []string{"basic", "premium", "premium"} {
+		userID, err := service.CreateUser(context.Background(), fmt.Sprintf("增量统计测试用户%d", i), fmt.Sprintf("incremental_stats_test%d@example.com", i))
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(context.Background(), userID, plan, ""); err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+		subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+		if err != nil || len(subs) != 1 {
+			t.Fatalf("获取用户订阅失败: %v", err)
+		}
+		subIDs = append(subIDs, subs[0].ID)
+	}
+
+	sub0, _ := service.db.GetSubscriptionByID(context.Background(), subIDs[0])
+	if _, err := service.RenewSubscription(context.Background(), RenewalRequest{SubscriptionID: sub0.ID, UserID: sub0.UserID, Amount: SubscriptionPrice}); err != nil {
+		t.Fatalf("续订失败: %v", err)
+	}
+	sub1, _ := service.db.GetSubscriptionByID(context.Background(), subIDs[1])
+	if err := service.CancelRenewal(context.Background(), CancelRenewalRequest{SubscriptionID: sub1.ID, UserID: sub1.UserID, Immediate: true, Refund: true}); err != nil {
+		t.Fatalf("立即终止失败: %v", err)
+	}
+
+	stats := service.GetSystemStats()
+	if stats.TotalUsers != before.TotalUsers+3 || stats.ActiveSubscriptions != before.ActiveSubscriptions+2 ||
+		stats.ActiveByPlan["premium"] != before.ActiveByPlan["premium"]+1 || stats.RenewalsMonth != before.RenewalsMonth+1 {
+		t.Errorf("增量统计错误: 之前=%+v, 之后=%+v", before, stats)
+	}
+
+	// 增量结果与全量查询一致
+	full, err := service.cache.queryStats()
+	if err != nil {
+		t.Fatalf("查询统计失败: %v", err)
+	}
+	if stats.TotalUsers != full.TotalUsers || stats.ActiveSubscriptions != full.ActiveSubscriptions ||
+		stats.NewSubscriptionsMonth != full.NewSubscriptionsMonth || stats.RenewalsMonth != full.RenewalsMonth ||
+		stats.FailedPayments != full.FailedPayments ||
+		!sameAmount(stats.TotalPaymentAmount, full.TotalPaymentAmount) ||
+		!sameAmount(stats.NewPaymentAmountMonth, full.NewPaymentAmountMonth) ||
+		!sameAmount(stats.RenewalAmountMonth, full.RenewalAmountMonth) {
+		t.Errorf("增量统计与全量查询不一致: 增量=%+v, 全量=%+v", stats, full)
+	}
+	for plan, count := range full.ActiveByPlan {
+		if stats.ActiveByPlan[plan] != count {
+			t.Errorf("套餐 %s 活跃订阅数不一致: 增量=%d, 全量=%d", plan, stats.ActiveByPlan[plan], count)
+		}
+	}
+
+	// 并发累加不丢失增量
+	const writers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			service.cache.apply(statsDelta{users: 1, activeByPlan: map[string]int{"basic": 1}})
+		}()
+	}
+	wg.Wait()
+	after := service.GetSystemStats()
+	if after.TotalUsers != stats.TotalUsers+writers || after.ActiveSubscriptions != stats.ActiveSubscriptions+writers ||
+		after.ActiveByPlan["basic"] != stats.ActiveByPlan["basic"]+writers {
+		t.Errorf("并发累加结果错误: 之前=%+v, 之后=%+v", stats, after)
+	}
+}
+
+// 测试按套餐统计活跃订阅数，且返回的统计不共享缓存中的 map
+func TestActiveSubscriptionsByPlan(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	if err := service.cache.refreshCache(); err != nil {
+		t.Fatalf("刷新缓存失败: %v", err)
+	}
+	before := service.GetSystemStats().ActiveByPlan
+
+	plans := []string{"premium", "premium", "annual"}
+	for i, plan := range plans {
+		userID, err := service.CreateUser(context.Background(), fmt.Sprintf("套餐统计测试用户%d", i), fmt.Sprintf("plan_stats_test%d@example.com", i))
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(context.Background(), userID, plan, ""); err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+	}
+
+	if err := service.cache.refreshCache(); err != nil {
+		t.Fatalf("刷新缓存失败: %v", err)
+	}
+	stats := service.GetSystemStats()
+	for plan, increase := range map[string]int{"premium": 2, "annual": 1} {
+		if got := stats.ActiveByPlan[plan] - before[plan]; got != increase {
+			t.Errorf("套餐 %s 活跃订阅数增加错误: 期望=%d, 实际=%d", plan, increase, got)
+		}
+	}
+
+	// 修改返回的 map 不影响后续读取
+	stats.ActiveByPlan["premium"] = -1
+	if service.GetSystemStats().ActiveByPlan["premium"] == -1 {
+		t.Error("修改返回的统计数据影响了缓存")
+	}
+}
+
+// 测试统计接口的ETag和条件GET
+func TestStatsConditionalGet(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	endpoints := []struct {
+		path   string
+		handle http.HandlerFunc
+	}{
+		{"/api/admin/stats", handler.HandleSystemStats},
+		{"/api/admin/monthly-stats", handler.HandleMonthlyStats},
+	}
+
+	for _, endpoint := range endpoints {
+		get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, endpoint.path, nil)
+			if ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+			endpoint.handle(rec, req)
+			return rec
+		}
+
+		first := get("")
+		etag := first.Header().Get("ETag")
+		if first.Code != http.StatusOK || etag == "" {
+			t.Fatalf("%s: 首次请求应返回200和ETag: 状态码=%d, ETag=%q", endpoint.path, first.Code, etag)
+		}
+
+		// 缓存未刷新时条件请求返回304且不带响应体
+		repeat := get(etag)
+		if repeat.Code != http.StatusNotModified || repeat.Body.Len() != 0 {
+			t.Errorf("%s: 条件请求应返回304: 状态码=%d, 响应=%s", endpoint.path, repeat.Code, repeat.Body.String())
+		}
+
+		// 缓存刷新后ETag变化，旧ETag返回200
+		if err := service.cache.refreshCache(); err != nil {
+			t.Fatalf("刷新缓存失败: %v", err)
+		}
+		refreshed := get(etag)
+		if refreshed.Code != http.StatusOK || refreshed.Header().Get("ETag") == etag {
+			t.Errorf("%s: 缓存刷新后应返回200和新的ETag: 状态码=%d, ETag=%q", endpoint.path, refreshed.Code, refreshed.Header().Get("ETag"))
+		}
+	}
+}
+
+// 创建测试数据库连接和通知服务实例
+func createTestNotificationService(t *testing.T) (*NotificationService, *DatabaseService) {
+	db, err := NewDatabaseService(testDSN, 0, DBPoolConfig{})
+	if err != nil {
+		t.Fatalf("创建数据库服务失败: %v", err)
+	}
+
+	notificationSvc := NewNotificationService(db, NoopSender{})
+	return notificationSvc, db
+}
+
+// 创建测试用户和订阅
+func createTestUserAndSubscription(t *testing.T, db *DatabaseService) (int64, int64) {
+	// 创建测试用户，邮箱唯一，按测试名区分
+	user := &User{
+		Name:  "通知测试用户",
+		Email: fmt.Sprintf("notification_test_%s@example.com", strings.ToLower(t.Name())),
+	}
+
+	userID, err := db.CreateUser(context.Background(), user)
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	// 创建测试订阅
+	now := time.Now()
+	endDate := now.AddDate(0, 1, 0)
+
+	tx, err := db.BeginTx(context.Background())
+	if err != nil {
+		t.Fatalf("开始事务失败: %v", err)
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO subscriptions 
+        (user_id, plan, start_date, end_date, status, notification_sent, renewal_preference) 
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID,
+		"premium",
+		now,
+		endDate,
+		StatusSubscribed,
+		false,
+		"undecided",
+	)
+
+	if err != nil {
+		tx.Rollback()
+		t.Fatalf("创建测试订阅失败: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("提交事务失败: %v", err)
+	}
+
+	subscriptionID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatalf("获取订阅ID失败: %v", err)
+	}
+
+	return userID, subscriptionID
+}
+
+// 获取用户最新的通知
+func getLatestNotification(t *testing.T, db *DatabaseService, userID int64, notificationType string) *Notification {
+	query := `SELECT id, user_id, subscription_id, type, content, sent_at, status 
+              FROM notifications 
+              WHERE user_id = ? AND type = ? 
+              ORDER BY sent_at DESC LIMIT 1`
+
+	var notification Notification
+	err := db.db.QueryRow(query, userID, notificationType).Scan(
+		&notification.ID,
+		&notification.UserID,
+		&notification.SubscriptionID,
+		&notification.Type,
+		&notification.Content,
+		&notification.SentAt,
+		&notification.Status,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		t.Fatalf("查询通知失败: %v", err)
+	}
+
+	return &notification
+}
+
+// 测试发送到期通知
 func TestSendExpirationNotice(t *testing.T) {
 	notificationSvc, db := createTestNotificationService(t)
 	defer db.Close()
 
-	userID, subscriptionID := createTestUserAndSubscription(t, db)
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+
+	// 发送通知
+	result, err := notificationSvc.SendExpirationNotice(userID, subscriptionID)
+	if err != nil {
+		t.Fatalf("发送到期通知失败: %v", err)
+	}
+	if result != NoticeSent {
+		t.Errorf("发送结果错误: 期望=%s, 实际=%s", NoticeSent, result)
+	}
+
+	// 验证通知记录
+	notification := getLatestNotification(t, db, userID, "expiration_notice")
+	if notification == nil {
+		t.Fatal("未找到通知记录")
+	}
+
+	// 检查通知内容是否包含预期的关键信息
+	if notification.UserID != userID {
+		t.Errorf("通知用户ID不匹配: 期望=%d, 实际=%d", userID, notification.UserID)
+	}
+
+	if notification.SubscriptionID != subscriptionID {
+		t.Errorf("通知订阅ID不匹配: 期望=%d, 实际=%d", subscriptionID, notification.SubscriptionID)
+	}
+
+	if notification.Status != "sent" {
+		t.Errorf("通知状态错误: 期望=sent, 实际=%s", notification.Status)
+	}
+
+	if !strings.Contains(notification.Content, "到期") {
+		t.Errorf("通知内容未包含'到期'关键词: %s", notification.Content)
+	}
+}
+
+// 测试去重窗口内重复发送到期通知只投递一次
+func TestSendExpirationNoticeDeduplicated(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	clock := newVirtualClock(time.Now())
+	notificationSvc.clock = clock
+	notificationSvc.dedupWindow = 5 * time.Minute
+
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+
+	result, err := notificationSvc.SendExpirationNotice(userID, subscriptionID)
+	if err != nil || result != NoticeSent {
+		t.Fatalf("首次发送到期通知失败: result=%s, err=%v", result, err)
+	}
+
+	// 窗口内再次发送应被去重，且不返回错误
+	clock.Set(clock.Now().Add(time.Minute))
+	result, err = notificationSvc.SendExpirationNotice(userID, subscriptionID)
+	if err != nil {
+		t.Fatalf("重复发送到期通知返回错误: %v", err)
+	}
+	if result != NoticeDeduplicated {
+		t.Errorf("发送结果错误: 期望=%s, 实际=%s", NoticeDeduplicated, result)
+	}
+
+	if notices := getNotifications(t, db, subscriptionID, "expiration_notice"); len(notices) != 1 {
+		t.Fatalf("窗口内通知数量错误: 期望=1, 实际=%d", len(notices))
+	}
+
+	// 超出窗口后可以再次发送
+	clock.Set(clock.Now().Add(10 * time.Minute))
+	result, err = notificationSvc.SendExpirationNotice(userID, subscriptionID)
+	if err != nil || result != NoticeSent {
+		t.Fatalf("窗口外发送到期通知失败: result=%s, err=%v", result, err)
+	}
+
+	if notices := getNotifications(t, db, subscriptionID, "expiration_notice"); len(notices) != 2 {
+		t.Errorf("窗口外通知数量错误: 期望=2, 实际=%d", len(notices))
+	}
+}
+
+// 测试发送续约成功通知
+func TestSendRenewalConfirmation(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+
+	// 发送通知
+	err := notificationSvc.SendRenewalConfirmation(userID, subscriptionID)
+	if err != nil {
+		t.Fatalf("发送续约确认通知失败: %v", err)
+	}
+
+	// 验证通知记录
+	notification := getLatestNotification(t, db, userID, "renewal_confirmation")
+	if notification == nil {
+		t.Fatal("未找到通知记录")
+	}
+
+	// 检查通知内容是否包含预期的关键信息
+	if !strings.Contains(notification.Content, "成功续约") {
+		t.Errorf("通知内容未包含'成功续约'关键词: %s", notification.Content)
+	}
+}
+
+// 测试发送取消续约确认通知
+func TestSendCancelConfirmation(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+
+	// 发送通知
+	err := notificationSvc.SendCancelConfirmation(userID, subscriptionID)
+	if err != nil {
+		t.Fatalf("发送取消续约通知失败: %v", err)
+	}
+
+	// 验证通知记录
+	notification := getLatestNotification(t, db, userID, "cancel_confirmation")
+	if notification == nil {
+		t.Fatal("未找到通知记录")
+	}
+
+	// 检查通知内容是否包含预期的关键信息
+	if !strings.Contains(notification.Content, "取消续约") {
+		t.Errorf("通知内容未包含'取消续约'关键词: %s", notification.Content)
+	}
+}
+
+// 测试发送订阅结束通知
+func TestSendSubscriptionEndedNotice(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+
+	// 发送通知
+	err := notificationSvc.SendSubscriptionEndedNotice(userID, subscriptionID)
+	if err != nil {
+		t.Fatalf("发送订阅结束通知失败: %v", err)
+	}
+
+	// 验证通知记录
+	notification := getLatestNotification(t, db, userID, "subscription_ended")
+	if notification == nil {
+		t.Fatal("未找到通知记录")
+	}
+
+	// 检查通知内容是否包含预期的关键信息
+	if !strings.Contains(notification.Content, "订阅已结束") {
+		t.Errorf("通知内容未包含'订阅已结束'关键词: %s", notification.Content)
+	}
+}
+
+// 测试处理无效用户ID的情况
+func TestSendNotificationInvalidUser(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	_, subscriptionID := createTestUserAndSubscription(t, db)
+
+	// 使用不存在的用户ID
+	invalidUserID := int64(9999999)
+
+	// 尝试发送通知
+	_, err := notificationSvc.SendExpirationNotice(invalidUserID, subscriptionID)
+
+	// 预期会失败
+	if err == nil {
+		t.Fatal("对不存在的用户发送通知应当失败，但却成功了")
+	}
+
+	// 验证错误信息
+	if !strings.Contains(err.Error(), "用户不存在") {
+		t.Errorf("错误消息不符合预期: %v", err)
+	}
+}
+
+// 测试处理无效订阅ID的情况
+func TestSendNotificationInvalidSubscription(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	userID, _ := createTestUserAndSubscription(t, db)
+
+	// 使用不存在的订阅ID
+	invalidSubID := int64(9999999)
+
+	// 尝试发送通知
+	err := notificationSvc.SendRenewalConfirmation(userID, invalidSubID)
+
+	// 预期会失败
+	if err == nil {
+		t.Fatal("对不存在的订阅发送通知应当失败，但却成功了")
+	}
+
+	// 验证错误信息
+	if !strings.Contains(err.Error(), "订阅不存在") {
+		t.Errorf("错误消息不符合预期: %v", err)
+	}
+}
+
+// 测试到期查询覆盖状态机中所有有到期转换的状态，已续约订阅按续约的周期单独处理，不按到期日选中
+func TestExpiredSubscriptionsMatchStatusMachine(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+
+	userID, err := service.CreateUser(ctx, "到期状态测试用户", "expired_status_machine@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	endDate := time.Now().AddDate(0, 0, -1)
+	ids := make(map[string]int64)
+	for _, status := range []string{StatusInactive, StatusSubscribed, StatusRenewed, StatusUnsubscribed, StatusTrial} {
+		res, err := service.db.db.Exec(`INSERT INTO subscriptions (user_id, plan, start_date, end_date, status, renewal_preference)
+                  VALUES (?, ?, ?, ?, ?, ?)`, userID, "basic", endDate.AddDate(0, -1, 0), endDate, status, "undecided")
+		if err != nil {
+			t.Fatalf("创建订阅失败: %v", err)
+		}
+		ids[status], _ = res.LastInsertId()
+	}
+
+	expired, err := service.db.GetExpiredSubscriptions(time.Now())
+	if err != nil {
+		t.Fatalf("获取已过期订阅失败: %v", err)
+	}
+	selected := make(map[int64]bool)
+	for _, sub := range expired {
+		selected[sub.ID] = true
+	}
+
+	for status, id := range ids {
+		if want := expiredTransition(status) != ""; selected[id] != want {
+			t.Errorf("状态 %s 的到期订阅是否被选中错误: 期望=%v, 实际=%v", status, want, selected[id])
+		}
+	}
+}
+
+// 测试已续约订阅在续约的周期开始时进入新周期：续约 -> 原到期 -> 处理，只增加续约时支付的一个周期，下次处理不再选中；
+// charge 方式续约时不收费，进入新周期时按套餐价格扣款
+func TestRenewedSubscriptionAdvancesCycle(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+	clock := newVirtualClock(time.Now())
+	service.setClock(clock)
+
+	// 续约后返回订阅ID、续约前和续约后的到期日
+	renewedSubscription := func(email string) (int64, time.Time, time.Time) {
+		userID, err := service.CreateUser(ctx, "新周期测试用户", email)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(ctx, userID, "quarterly", ""); err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+		subs, err := service.db.GetUserSubscriptions(ctx, userID)
+		if err != nil || len(subs) != 1 {
+			t.Fatalf("获取用户订阅失败: %v", err)
+		}
+		subID := subs[0].ID
+		if _, err := service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: subID, UserID: userID, Amount: SubscriptionPrice}); err != nil {
+			t.Fatalf("续订失败: %v", err)
+		}
+		if err := service.db.UpdateSubscriptionNotificationSent(subID, true); err != nil {
+			t.Fatalf("更新通知状态失败: %v", err)
+		}
+		renewed, err := service.db.GetSubscriptionByID(ctx, subID)
+		if err != nil {
+			t.Fatalf("获取订阅失败: %v", err)
+		}
+		return subID, subs[0].EndDate, renewed.EndDate
+	}
+	renewalPayments := func(subID int64) (count int, total float64) {
+		err := service.db.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM payments
+                  WHERE subscription_id = ? AND type = 'renewal' AND status = 'success'`, subID).Scan(&count, &total)
+		if err != nil {
+			t.Fatalf("查询续订支付失败: %v", err)
+		}
+		return count, total
+	}
+	processAt := func(now time.Time) {
+		clock.Set(now)
+		if _, err := service.ProcessExpiredSubscriptions(); err != nil {
+			t.Fatalf("处理已过期订阅失败: %v", err)
+		}
+	}
+
+	subID, oldEnd, renewedEnd := renewedSubscription("renewed_cycle_prepaid@example.com")
+	if !renewedEnd.Equal(oldEnd.AddDate(0, 3, 0)) {
+		t.Fatalf("续约应顺延一个周期: 原到期=%v, 续约后=%v", oldEnd, renewedEnd)
+	}
+
+	// 当前周期未结束时不进入新周期
+	processAt(oldEnd.Add(-time.Hour))
+	if sub, _ := service.db.GetSubscriptionByID(ctx, subID); sub.Status != StatusRenewed {
+		t.Fatalf("当前周期结束前不应进入新周期: %+v", sub)
+	}
+
+	processAt(oldEnd.Add(time.Hour))
+	sub, err := service.db.GetSubscriptionByID(ctx, subID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	if sub.Status != StatusSubscribed || !sub.EndDate.Equal(renewedEnd) || sub.StartDate.Before(oldEnd) || !sub.StartDate.Before(oldEnd.AddDate(0, 0, 4)) {
+		t.Fatalf("订阅应进入续约的周期且只增加一个周期: 状态=%s, 开始=%v, 结束=%v", sub.Status, sub.StartDate, sub.EndDate)
+	}
+	if sub.NotificationSent || sub.RenewalPreference != "undecided" {
+		t.Errorf("新周期应重置提醒和续订偏好: %+v", sub)
+	}
+	if count, _ := renewalPayments(subID); count != 1 {
+		t.Errorf("prepaid 方式不应记录新周期支付: 续订支付数=%d", count)
+	}
+
+	// 再次处理时不会被选中，到期日不变
+	processAt(oldEnd.Add(2 * time.Hour))
+	if again, _ := service.db.GetSubscriptionByID(ctx, subID); again.Status != StatusSubscribed || !again.EndDate.Equal(renewedEnd) || again.Version != sub.Version {
+		t.Errorf("再次处理后订阅不应变化: %+v", again)
+	}
+
+	// 已被其他操作修改的订阅不进入新周期
+	conflictID, _, _ := renewedSubscription("renewed_cycle_conflict@example.com")
+	conflict, _ := service.db.GetSubscriptionByID(ctx, conflictID)
+	if err := service.db.UpdateSubscriptionStatus(ctx, conflictID, StatusUnsubscribed); err != nil {
+		t.Fatalf("更新订阅状态失败: %v", err)
+	}
+	if err := service.advanceRenewedCycle(*conflict, time.Now()); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("订阅已不是已续约状态时应返回 ErrVersionConflict: %v", err)
+	}
+
+	// charge 方式续约时不收费，进入新周期时按套餐价格记录续订支付
+	if err := service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCycleCharge}); err != nil {
+		t.Fatalf("更新设置失败: %v", err)
+	}
+	defer service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCyclePrepaid})
+	subID, oldEnd, renewedEnd = renewedSubscription("renewed_cycle_charge@example.com")
+	if count, _ := renewalPayments(subID); count != 0 {
+		t.Fatalf("charge 方式续约时不应收费: 续订支付数=%d", count)
+	}
+	processAt(oldEnd.Add(time.Hour))
+
+	sub, err = service.db.GetSubscriptionByID(ctx, subID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	if sub.Status != StatusSubscribed || !sub.EndDate.Equal(renewedEnd) {
+		t.Errorf("订阅应进入续约的周期: 状态=%s, 开始=%v, 结束=%v", sub.Status, sub.StartDate, sub.EndDate)
+	}
+	if count, total := renewalPayments(subID); count != 1 || !sameAmount(total, 79.99) {
+		t.Errorf("charge 方式应记录一笔新周期支付: 续订支付数=%d, 总额=%.2f", count, total)
+	}
+
+	// 任务延迟到续约的周期也结束后才运行：照常扣款，并记录处理失败供人工核对
+	overdueID, _, overdueEnd := renewedSubscription("renewed_cycle_overdue@example.com")
+	processAt(overdueEnd.Add(time.Hour))
+	if count, total := renewalPayments(overdueID); count != 1 || !sameAmount(total, 79.99) {
+		t.Errorf("续约的周期已结束时仍应扣款: 续订支付数=%d, 总额=%.2f", count, total)
+	}
+	failures, err := service.GetProcessingFailures(ctx)
+	if err != nil {
+		t.Fatalf("获取处理失败记录失败: %v", err)
+	}
+	flagged := false
+	for _, failure := range failures {
+		if failure.SubscriptionID == overdueID {
+			flagged = true
+		}
+	}
+	if !flagged {
+		t.Error("续约的周期在处理前已结束时应记录处理失败供核对")
+	}
+
+	// 套餐已不在目录中时按 unknown_plan_policy 处理：拒绝时不扣款并记录处理失败，后备时按后备价格扣款
+	legacyID, _, _ := renewedSubscription("renewed_cycle_legacy@example.com")
+	if _, err := service.db.db.Exec("UPDATE subscriptions SET plan = ? WHERE id = ?", "legacy", legacyID); err != nil {
+		t.Fatalf("更新订阅套餐失败: %v", err)
+	}
+	legacy, err := service.db.GetSubscriptionByID(ctx, legacyID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	legacyDue := service.renewedCycleStart(*legacy).Add(time.Hour)
+	processAt(legacyDue)
+	if sub, _ := service.db.GetSubscriptionByID(ctx, legacyID); sub.Status != StatusRenewed {
+		t.Errorf("拒绝未知套餐时订阅不应进入新周期: %+v", sub)
+	}
+	if count, _ := renewalPayments(legacyID); count != 0 {
+		t.Errorf("拒绝未知套餐时不应扣款: 续订支付数=%d", count)
+	}
+	failures, err = service.GetProcessingFailures(ctx)
+	if err != nil {
+		t.Fatalf("获取处理失败记录失败: %v", err)
+	}
+	flagged = false
+	for _, failure := range failures {
+		if failure.SubscriptionID == legacyID && strings.Contains(failure.Error, ErrUnknownPlan.Error()) {
+			flagged = true
+		}
+	}
+	if !flagged {
+		t.Error("拒绝未知套餐时应记录处理失败")
+	}
+
+	if err := service.settings.Update(ctx, map[string]string{SettingUnknownPlanPolicy: UnknownPlanFallback}); err != nil {
+		t.Fatalf("更新设置失败: %v", err)
+	}
+	defer service.settings.Update(ctx, map[string]string{SettingUnknownPlanPolicy: UnknownPlanReject})
+	processAt(legacyDue.Add(time.Hour))
+	var amount float64
+	var reason string
+	err = service.db.db.QueryRow(`SELECT amount, reason FROM payments WHERE subscription_id = ? AND type = 'renewal' AND status = 'success'`, legacyID).Scan(&amount, &reason)
+	if err != nil || !sameAmount(amount, service.settings.Float(SettingFallbackPlanPrice)) || reason != PaymentReasonPlanFallback {
+		t.Errorf("后备方式应按后备价格扣款并记录原因: 金额=%.2f, 原因=%s, 错误=%v", amount, reason, err)
+	}
+}
+
+// flakyCharger 每个订阅前 failures 次扣款失败，之后扣款成功
+type flakyCharger struct {
+	mu       sync.Mutex
+	failures map[int64]int
+	calls    map[int64]int
+	keys     []string // 每次扣款的幂等键
+}
+
+func (c *flakyCharger) Charge(ctx context.Context, userID, subscriptionID int64, amount float64, idempotencyKey string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[subscriptionID]++
+	c.keys = append(c.keys, idempotencyKey)
+	if c.calls[subscriptionID] <= c.failures[subscriptionID] {
+		return errors.New("银行卡余额不足")
+	}
+	return nil
+}
+
+// 测试新周期扣款失败后每天重试：重试成功进入新周期，重试3次仍失败时订阅结束
+func TestDunningRetriesFailedRenewal(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+
+	if err := service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCycleCharge}); err != nil {
+		t.Fatalf("更新设置失败: %v", err)
+	}
+	defer service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCyclePrepaid})
+
+	// 续约后返回订阅ID、续约前和续约后的到期日
+	renewedSubscription := func(email string) (int64, time.Time, time.Time) {
+		userID, err := service.CreateUser(ctx, "扣款重试测试用户", email)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(ctx, userID, "quarterly", ""); err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+		subs, err := service.db.GetUserSubscriptions(ctx, userID)
+		if err != nil || len(subs) != 1 {
+			t.Fatalf("获取用户订阅失败: %v", err)
+		}
+		subID := subs[0].ID
+		response, err := service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: subID, UserID: userID, Amount: SubscriptionPrice})
+		if err != nil {
+			t.Fatalf("续订失败: %v", err)
+		}
+		return subID, subs[0].EndDate, response.EndDate
+	}
+	recovered, recoveredEnd, recoveredRenewedEnd := renewedSubscription("dunning_recovered@example.com")
+	exhausted, _, _ := renewedSubscription("dunning_exhausted@example.com")
+
+	// recovered 第一次重试仍失败、第二次重试成功；exhausted 始终失败
+	charger := &flakyCharger{
+		failures: map[int64]int{recovered: 2, exhausted: 100},
+		calls:    make(map[int64]int),
+	}
+	service.charger = charger
+	clock := newVirtualClock(recoveredEnd.Add(time.Hour))
+	service.setClock(clock)
+
+	status := func(subID int64) (string, int) {
+		var status string
+		var attempts int
+		err := service.db.db.QueryRow(`SELECT status, dunning_attempts FROM subscriptions WHERE id = ?`, subID).Scan(&status, &attempts)
+		if err != nil {
+			t.Fatalf("查询订阅状态失败: %v", err)
+		}
+		return status, attempts
+	}
+	renewalPayments := func(subID int64, paymentStatus string) int {
+		var count int
+		err := service.db.db.QueryRow(`SELECT COUNT(*) FROM payments
+                  WHERE subscription_id = ? AND type = 'renewal' AND status = ?`, subID, paymentStatus).Scan(&count)
+		if err != nil {
+			t.Fatalf("查询续订支付失败: %v", err)
+		}
+		return count
+	}
+
+	// 批处理结束时的全量刷新失败，缓存中只有各步累加的增量
+	service.cache.loadStats = func() (SystemStats, error) { return SystemStats{}, errors.New("统计查询失败") }
+	activeBefore := service.GetSystemStats().ActiveByPlan["quarterly"]
+	activeChange := func() int { return service.GetSystemStats().ActiveByPlan["quarterly"] - activeBefore }
+
+	// 进入新周期时扣款失败，转为扣款失败状态，不再计入活跃订阅
+	service.ProcessExpiredSubscriptions()
+	for _, subID := range []int64{recovered, exhausted} {
+		if got, attempts := status(subID); got != StatusPastDue || attempts != 1 {
+			t.Fatalf("订阅 %d 扣款失败后状态错误: 状态=%s, 失败次数=%d", subID, got, attempts)
+		}
+	}
+	if change := activeChange(); change != -2 {
+		t.Errorf("扣款失败后活跃订阅数变化错误: 期望=-2, 实际=%d", change)
+	}
+	if sub, _ := service.db.GetSubscriptionByID(ctx, recovered); !sub.EndDate.Equal(recoveredRenewedEnd) {
+		t.Errorf("扣款失败时不应进入新周期: %+v", sub)
+	}
+
+	// 未满一天不重试
+	service.ProcessPastDueSubscriptions()
+	if charger.calls[recovered] != 1 {
+		t.Errorf("未到重试时间不应扣款: 扣款次数=%d", charger.calls[recovered])
+	}
+
+	// 第一次重试：两个订阅都失败
+	clock.Advance(25 * time.Hour)
+	service.ProcessPastDueSubscriptions()
+	if got, attempts := status(recovered); got != StatusPastDue || attempts != 2 {
+		t.Errorf("第一次重试后状态错误: 状态=%s, 失败次数=%d", got, attempts)
+	}
+
+	// 第二次重试：recovered 扣款成功，进入续约的周期
+	clock.Advance(25 * time.Hour)
+	service.ProcessPastDueSubscriptions()
+	sub, err := service.db.GetSubscriptionByID(ctx, recovered)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	if sub.Status != StatusSubscribed || sub.StartDate.Before(recoveredEnd) || !sub.EndDate.Equal(recoveredRenewedEnd) {
+		t.Errorf("重试成功后应进入新周期: 状态=%s, 开始=%v, 结束=%v", sub.Status, sub.StartDate, sub.EndDate)
+	}
+	if _, attempts := status(recovered); attempts != 0 {
+		t.Errorf("重试成功后应清除失败次数: %d", attempts)
+	}
+	if failed, success := renewalPayments(recovered, StatusFailed), renewalPayments(recovered, StatusSuccess); failed != 2 || success != 1 {
+		t.Errorf("recovered 支付记录错误: 失败=%d, 成功=%d", failed, success)
+	}
+	if change := activeChange(); change != -1 {
+		t.Errorf("重试成功后活跃订阅数变化错误: 期望=-1, 实际=%d", change)
+	}
+
+	// 第三次重试仍失败，重试次数用完，订阅结束
+	clock.Advance(25 * time.Hour)
+	service.ProcessPastDueSubscriptions()
+	if got, attempts := status(exhausted); got != StatusInactive || attempts != dunningMaxRetries+1 {
+		t.Errorf("重试次数用完后状态错误: 状态=%s, 失败次数=%d", got, attempts)
+	}
+	if failed := renewalPayments(exhausted, StatusFailed); failed != dunningMaxRetries+1 {
+		t.Errorf("exhausted 失败支付数错误: %d", failed)
+	}
+	if change := activeChange(); change != -1 {
+		t.Errorf("订阅结束后活跃订阅数变化错误: 期望=-1, 实际=%d", change)
+	}
+
+	// 结束的订阅不再重试
+	clock.Advance(25 * time.Hour)
+	service.ProcessPastDueSubscriptions()
+	if charger.calls[exhausted] != dunningMaxRetries+1 || charger.calls[recovered] != 3 {
+		t.Errorf("扣款次数错误: %v", charger.calls)
+	}
+
+	if err := service.DrainNotifications(ctx); err != nil {
+		t.Fatalf("等待后台通知失败: %v", err)
+	}
+	if n := len(getNotifications(t, service.db, recovered, "payment_failed")); n != 2 {
+		t.Errorf("recovered 扣款失败通知数错误: %d", n)
+	}
+	if n := len(getNotifications(t, service.db, exhausted, "payment_failed")); n != dunningMaxRetries {
+		t.Errorf("exhausted 扣款失败通知数错误: %d", n)
+	}
+	if n := len(getNotifications(t, service.db, exhausted, "subscription_ended")); n != 1 {
+		t.Errorf("exhausted 订阅结束通知数错误: %d", n)
+	}
+}
+
+// 测试续订扣款前先占用订阅：用同一份快照重复处理时只有一次扣款，扣款使用待确认支付对应的幂等键
+func TestRenewalChargeClaimedBeforeCharging(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+
+	if err := service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCycleCharge}); err != nil {
+		t.Fatalf("更新设置失败: %v", err)
+	}
+	defer service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCyclePrepaid})
+
+	userID, err := service.CreateUser(ctx, "扣款占用测试用户", "renewal_claim@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, userID, "quarterly", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+	if _, err := service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: subID, UserID: userID, Amount: SubscriptionPrice}); err != nil {
+		t.Fatalf("续订失败: %v", err)
+	}
+	snapshot, err := service.db.GetSubscriptionByID(ctx, subID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+
+	charger := &flakyCharger{failures: map[int64]int{subID: 1}, calls: make(map[int64]int)}
+	service.charger = charger
+	runAt := subs[0].EndDate.Add(time.Hour)
+
+	// 两个任务读到同一份快照：第一个扣款失败转为扣款失败状态，第二个占用失败，不扣款
+	if err := service.advanceRenewedCycle(*snapshot, runAt); err != nil {
+		t.Fatalf("进入新周期失败: %v", err)
+	}
+	if err := service.advanceRenewedCycle(*snapshot, runAt); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("重复处理同一份快照应返回 ErrVersionConflict: %v", err)
+	}
+	if charger.calls[subID] != 1 {
+		t.Fatalf("同一周期只应扣款一次: 扣款次数=%d", charger.calls[subID])
+	}
+
+	pastDue, err := service.db.GetPastDueSubscriptions(ctx, runAt)
+	if err != nil {
+		t.Fatalf("获取扣款失败的订阅失败: %v", err)
+	}
+	var stale *PastDueSubscription
+	for i := range pastDue {
+		if pastDue[i].ID == subID {
+			stale = &pastDue[i]
+		}
+	}
+	if stale == nil {
+		t.Fatalf("订阅应处于扣款失败状态")
+	}
+
+	// 两个重试任务读到同一份快照：只有一个扣款并进入新周期
+	for i := 0; i < 2; i++ {
+		if err := service.retryPastDue(ctx, *stale, runAt.Add(25*time.Hour)); err != nil {
+			t.Fatalf("重试扣款失败: %v", err)
+		}
+	}
+	if charger.calls[subID] != 2 {
+		t.Errorf("重试只应扣款一次: 扣款次数=%d", charger.calls[subID])
+	}
+	if len(charger.keys) != 2 || charger.keys[0] == charger.keys[1] || charger.keys[0] == "" {
+		t.Errorf("每次扣款应使用不同的幂等键: %v", charger.keys)
+	}
+
+	var pending, success, failed int
+	err = service.db.db.QueryRow(`SELECT
+                  COALESCE(SUM(CASE WHEN status = 'pending' THEN 1 ELSE 0 END), 0),
+                  COALESCE(SUM(CASE WHEN status = 'success' THEN 1 ELSE 0 END), 0),
+                  COALESCE(SUM(CASE WHEN status = 'failed' THEN 1 ELSE 0 END), 0)
+                  FROM payments WHERE subscription_id = ? AND type = 'renewal'`, subID).Scan(&pending, &success, &failed)
+	if err != nil {
+		t.Fatalf("查询续订支付失败: %v", err)
+	}
+	if pending != 0 || success != 1 || failed != 1 {
+		t.Errorf("续订支付记录错误: 待确认=%d, 成功=%d, 失败=%d", pending, success, failed)
+	}
+	if sub, _ := service.db.GetSubscriptionByID(ctx, subID); sub.Status != StatusSubscribed {
+		t.Errorf("重试成功后应进入新周期: %+v", sub)
+	}
+}
+
+// 测试处理已过期订阅失败时记录失败信息
+func TestProcessExpiredSubscriptionsRecordsFailure(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "处理失败测试用户", "processing_failure_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+
+	// 将订阅结束日期调整到过去，使其成为已过期订阅
+	endDate := time.Now().AddDate(0, 0, -1)
+	if err := service.db.UpdateSubscriptionDates(subID, endDate.AddDate(0, -1, 0), endDate); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+
+	// 通过触发器让该订阅的状态更新失败，模拟处理过程中的数据库错误
+	_, err = service.db.db.Exec(fmt.Sprintf(
+		`CREATE TRIGGER fail_status_update BEFORE UPDATE ON subscriptions FOR EACH ROW
+        BEGIN
+            IF NEW.id = %d AND NEW.status <> OLD.status THEN
+                SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'forced status update failure';
+            END IF;
+        END`, subID))
+	if err != nil {
+		t.Fatalf("创建触发器失败: %v", err)
+	}
+	defer service.db.db.Exec("DROP TRIGGER IF EXISTS fail_status_update")
+
+	summary, err := service.ProcessExpiredSubscriptions()
+	if err != nil {
+		t.Fatalf("处理已过期订阅失败: %v", err)
+	}
+	if summary.Failed < 1 {
+		t.Errorf("结果应包含处理失败的订阅: %+v", summary)
+	}
+
+	// 状态更新失败的订阅不应收到结束通知
+	if err := service.DrainNotifications(context.Background()); err != nil {
+		t.Fatalf("等待通知发送失败: %v", err)
+	}
+	var ended int
+	if err := service.db.db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE subscription_id = ? AND type = 'subscription_ended'`,
+		subID).Scan(&ended); err != nil {
+		t.Fatalf("查询通知记录失败: %v", err)
+	}
+	if ended != 0 {
+		t.Errorf("状态更新失败的订阅不应发送结束通知: %d", ended)
+	}
+
+	// 验证失败记录出现在未解决列表中
+	failures, err := service.GetProcessingFailures(context.Background())
+	if err != nil {
+		t.Fatalf("获取处理失败记录失败: %v", err)
+	}
+
+	var failure *ProcessingFailure
+	for i := range failures {
+		if failures[i].SubscriptionID == subID {
+			failure = &failures[i]
+			break
+		}
+	}
+
+	if failure == nil {
+		t.Fatalf("未找到订阅 %d 的处理失败记录: %+v", subID, failures)
+	}
+
+	if !strings.Contains(failure.Error, "forced status update failure") {
+		t.Errorf("失败原因不符合预期: %s", failure.Error)
+	}
+
+	// 状态更新失败，订阅应保持原状态
+	sub, err := service.db.GetSubscriptionByID(context.Background(), subID)
+	if err != nil {
+		t.Fatalf("获取订阅失败: %v", err)
+	}
+	if sub.Status != StatusSubscribed {
+		t.Errorf("订阅状态不应被修改: 期望=%s, 实际=%s", StatusSubscribed, sub.Status)
+	}
+
+	// 标记为已解决后不应再出现在列表中
+	if err := service.ResolveProcessingFailure(context.Background(), failure.ID); err != nil {
+		t.Fatalf("标记处理失败记录为已解决失败: %v", err)
+	}
+
+	failures, err = service.GetProcessingFailures(context.Background())
+	if err != nil {
+		t.Fatalf("获取处理失败记录失败: %v", err)
+	}
+	for _, f := range failures {
+		if f.ID == failure.ID {
+			t.Errorf("已解决的失败记录仍出现在列表中: %+v", f)
+		}
+	}
+
+	// 重复标记应返回错误
+	if err := service.ResolveProcessingFailure(context.Background(), failure.ID); err == nil {
+		t.Error("重复标记已解决的失败记录应当失败")
+	}
+}
+
+// 测试欢迎通知发送失败时不影响订阅激活，并记录待重试通知
+func TestActivateSubscriptionWelcomeNoticeFailure(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "欢迎通知失败测试用户", "welcome_failure_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	// 删除用户记录，使欢迎通知因找不到用户而发送失败
+	if _, err := service.db.db.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		t.Fatalf("删除测试用户失败: %v", err)
+	}
+
+	// 激活应当成功
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("欢迎通知失败不应导致激活失败: %v", err)
+	}
+
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+
+	if subs[0].Status != StatusSubscribed {
+		t.Errorf("订阅状态错误: 期望=%s, 实际=%s", StatusSubscribed, subs[0].Status)
+	}
+
+	// 验证失败的欢迎通知已记录待重试
+	notification := getLatestNotification(t, service.db, userID, "welcome_notice")
+	if notification == nil {
+		t.Fatal("未找到待重试的欢迎通知记录")
+	}
+
+	if notification.Status != "failed" {
+		t.Errorf("通知状态错误: 期望=failed, 实际=%s", notification.Status)
+	}
+
+	if notification.SubscriptionID != subs[0].ID {
+		t.Errorf("通知订阅ID不匹配: 期望=%d, 实际=%d", subs[0].ID, notification.SubscriptionID)
+	}
+}
+
+// 测试激活订阅后发送欢迎通知
+func TestActivateSubscriptionSendsWelcomeNotice(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "欢迎通知测试用户", "welcome_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	// 创建未激活订阅时不应发送欢迎通知
+	if notification := getLatestNotification(t, service.db, userID, "welcome_notice"); notification != nil {
+		t.Fatalf("创建未激活订阅时不应发送欢迎通知: %+v", notification)
+	}
+
+	if err := service.ActivateSubscription(context.Background(), userID, "premium", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+
+	notification := getLatestNotification(t, service.db, userID, "welcome_notice")
+	if notification == nil {
+		t.Fatal("未找到欢迎通知记录")
+	}
+
+	if notification.Status != "sent" {
+		t.Errorf("通知状态错误: 期望=sent, 实际=%s", notification.Status)
+	}
+
+	if !strings.Contains(notification.Content, "premium") {
+		t.Errorf("欢迎通知未包含套餐名称: %s", notification.Content)
+	}
+
+	if !strings.Contains(notification.Content, subs[0].EndDate.Format("2006-01-02")) {
+		t.Errorf("欢迎通知未包含到期日期: %s", notification.Content)
+	}
+}
+
+// 测试缓存刷新期间读取到的统计快照保持内部一致
+func TestCacheSnapshotConsistency(t *testing.T) {
+	cache := &SubscriptionCache{
+		updateInterval: time.Hour,
+		stopChan:       make(chan struct{}),
+	}
+
+	// 模拟耗时的数据库查询：各项指标依次查询，每次查询之间存在延迟，
+	// 同一轮刷新得到的各项指标取值相同
+	generation := 0
+	cache.loadStats = func() (SystemStats, error) {
+		generation++
+		var stats SystemStats
+		stats.TotalUsers = generation
+		time.Sleep(time.Millisecond)
+		stats.ActiveSubscriptions = generation
+		time.Sleep(time.Millisecond)
+		stats.NewSubscriptionsMonth = generation
+		time.Sleep(time.Millisecond)
+		stats.RenewalsMonth = generation
+		return stats, nil
+	}
+
+	if err := cache.refreshCache(); err != nil {
+		t.Fatalf("初始化缓存失败: %v", err)
+	}
+
+	const refreshes = 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < refreshes; i++ {
+			if err := cache.refreshCache(); err != nil {
+				t.Errorf("刷新缓存失败: %v", err)
+			}
+		}
+	}()
+
+	// 刷新进行期间持续读取，每次读到的快照都必须来自同一轮刷新
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		stats := cache.GetStats()
+		if stats.ActiveSubscriptions != stats.TotalUsers ||
+			stats.NewSubscriptionsMonth != stats.TotalUsers ||
+			stats.RenewalsMonth != stats.TotalUsers {
+			t.Fatalf("读取到不一致的统计快照: %+v", stats)
+		}
+	}
+
+	if stats := cache.GetStats(); stats.TotalUsers != refreshes+1 {
+		t.Errorf("最终快照不是最新一轮刷新结果: 期望=%d, 实际=%d", refreshes+1, stats.TotalUsers)
+	}
+}
+
+// 统计订阅某类通知的发送记录
+func getNotifications(t *testing.T, db *DatabaseService, subscriptionID int64, notificationType string) []Notification {
+	rows, err := db.db.Query(
+		`SELECT id, user_id, subscription_id, type, content, sent_at, status, retry_count, channel
+        FROM notifications WHERE subscription_id = ? AND type = ? ORDER BY sent_at`,
+		subscriptionID, notificationType,
+	)
+	if err != nil {
+		t.Fatalf("查询通知失败: %v", err)
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.SubscriptionID, &n.Type, &n.Content, &n.SentAt, &n.Status, &n.RetryCount, &n.Channel); err != nil {
+			t.Fatalf("解析通知失败: %v", err)
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications
+}
+
+// 测试多档位到期提醒：每个档位在计费周期内只发送一次
+func TestExpiryNoticeTiers(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN, ExpiryNoticeTiers: []int{1, 7, 3}})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+
+	clock := newVirtualClock(time.Now())
+	service.setClock(clock)
+
+	userID, err := service.CreateUser(context.Background(), "多档位提醒测试用户", "notice_tiers_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+
+	// 订阅在10天后到期
+	endDate := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+	if err := service.db.UpdateSubscriptionDates(subID, subs[0].StartDate, endDate); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+
+	day := 24 * time.Hour
+	steps := []struct {
+		remaining time.Duration // 距离到期的剩余时间
+		wantTotal int           // 截至此时应发送的提醒总数
+	}{
+		{10*day - time.Hour, 0},
+		{7*day - time.Hour, 1}, // 进入7天档位
+		{6 * day, 1},           // 同一档位不重复提醒
+		{3*day - time.Hour, 2}, // 进入3天档位
+		{2 * day, 2},
+		{day - time.Hour, 3}, // 进入1天档位
+		{12 * time.Hour, 3},
+	}
+
+	// 最后一个档位发送 final_notice，其余档位发送 expiration_notice
+	reminders := func() []Notification {
+		return append(getNotifications(t, service.db, subID, "expiration_notice"),
+			getNotifications(t, service.db, subID, "final_notice")...)
+	}
+
+	for _, step := range steps {
+		clock.Set(endDate.Add(-step.remaining))
+		service.CheckExpiringSubscriptions()
+
+		if notices := reminders(); len(notices) != step.wantTotal {
+			t.Fatalf("剩余 %v 时提醒数量错误: 期望=%d, 实际=%d", step.remaining, step.wantTotal, len(notices))
+		}
+	}
+
+	// 验证三次提醒分别发生在各自档位内：(下一档位, 当前档位]
+	notices := reminders()
+	if notices[0].Type != "expiration_notice" || notices[1].Type != "expiration_notice" || notices[2].Type != "final_notice" {
+		t.Errorf("提醒类型错误: %s, %s, %s", notices[0].Type, notices[1].Type, notices[2].Type)
+	}
+	windows := []struct{ from, to int }{{3, 7}, {1, 3}, {0, 1}}
+	for i, w := range windows {
+		remaining := endDate.Sub(notices[i].SentAt)
+		if remaining > time.Duration(w.to)*day || remaining <= time.Duration(w.from)*day {
+			t.Errorf("第%d次提醒时间不在 %d 天档位内: 剩余=%v", i+1, w.to, remaining)
+		}
+	}
+}
+
+// 测试默认档位：提前3天发送到期通知，提前1天发送最后提醒，每种提醒只发送一次
+func TestFinalExpiryNotice(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	clock := newVirtualClock(time.Now())
+	service.setClock(clock)
+
+	userID, err := service.CreateUser(context.Background(), "最后提醒测试用户", "final_notice_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+
+	day := 24 * time.Hour
+	endDate := time.Now().Add(10 * day).Truncate(time.Second)
+	if err := service.db.UpdateSubscriptionDates(subID, subs[0].StartDate, endDate); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+
+	steps := []struct {
+		remaining  time.Duration
+		wantNotice int // 截至此时 expiration_notice 的数量
+		wantFinal  int // 截至此时 final_notice 的数量
+	}{
+		{4 * day, 0, 0},
+		{3*day - time.Hour, 1, 0},
+		{2 * day, 1, 0},
+		{day - time.Hour, 1, 1},
+		{6 * time.Hour, 1, 1},
+	}
+	for _, step := range steps {
+		clock.Set(endDate.Add(-step.remaining))
+		service.CheckExpiringSubscriptions()
+
+		notices := getNotifications(t, service.db, subID, "expiration_notice")
+		finals := getNotifications(t, service.db, subID, "final_notice")
+		if len(notices) != step.wantNotice || len(finals) != step.wantFinal {
+			t.Fatalf("剩余 %v 时提醒数量错误: 到期通知=%d(期望%d), 最后提醒=%d(期望%d)",
+				step.remaining, len(notices), step.wantNotice, len(finals), step.wantFinal)
+		}
+	}
+
+	finals := getNotifications(t, service.db, subID, "final_notice")
+	if !strings.Contains(finals[0].Content, "最后一次提醒") {
+		t.Errorf("最后提醒内容错误: %s", finals[0].Content)
+	}
+}
+
+// 测试提醒提前天数由配置的最大档位决定：5天后到期的订阅不在3天窗口内，在7天窗口内
+func TestExpiryNoticeLeadWindow(t *testing.T) {
+	_, db := createTestNotificationService(t)
+	defer db.Close()
+	_, subID := createTestUserAndSubscription(t, db)
+
+	now := time.Now()
+	if err := db.UpdateSubscriptionDates(subID, now.AddDate(0, 0, -25), now.AddDate(0, 0, 5)); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+
+	selected := func(leadDays int) bool {
+		subs, err := db.GetExpiringSubscriptionsForNotification(now, leadDays)
+		if err != nil {
+			t.Fatalf("获取即将到期订阅失败: %v", err)
+		}
+		return slices.ContainsFunc(subs, func(sub Subscription) bool { return sub.ID == subID })
+	}
+	if selected(3) {
+		t.Error("5天后到期的订阅不应在3天窗口内")
+	}
+	if !selected(7) {
+		t.Error("5天后到期的订阅应在7天窗口内")
+	}
+
+	// 通过配置的档位传入窗口：默认3天不提醒，配置7天档位后提醒
+	for _, tc := range []struct {
+		tiers     []int
+		wantTotal int
+	}{
+		{nil, 0},
+		{[]int{7}, 1},
+	} {
+		service, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN, ExpiryNoticeTiers: tc.tiers})
+		if err != nil {
+			t.Fatalf("创建订阅服务失败: %v", err)
+		}
+		service.CheckExpiringSubscriptions()
+		service.Close()
+
+		if notices := getNotifications(t, db, subID, "expiration_notice"); len(notices) != tc.wantTotal {
+			t.Errorf("档位 %v 下提醒数量错误: 期望=%d, 实际=%d", tc.tiers, tc.wantTotal, len(notices))
+		}
+	}
+}
+
+// 测试通知屏蔽时段内到期和结束通知只记录不发送，并顺延到期日处于时段内的订阅
+func TestNotificationSuppressionWindow(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	window := SuppressionWindow{Start: now.Add(-24 * time.Hour), End: now.Add(24 * time.Hour)}
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN, NotificationSuppression: window, ExtendSuppressed: true})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+
+	clock := newVirtualClock(now)
+	service.setClock(clock)
+
+	activate := func(name, email string, endDate time.Time) Subscription {
+		userID, err := service.CreateUser(context.Background(), name, email)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+		subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+		if err != nil || len(subs) != 1 {
+			t.Fatalf("获取用户订阅失败: %v", err)
+		}
+		if err := service.db.UpdateSubscriptionDates(subs[0].ID, endDate.AddDate(0, -1, 0), endDate); err != nil {
+			t.Fatalf("更新订阅日期失败: %v", err)
+		}
+		subs[0].EndDate = endDate
+		return subs[0]
+	}
+
+	// 屏蔽时段内的到期通知只记录为 suppressed
+	expiring := activate("屏蔽到期通知用户", "suppress_expiring_test@example.com", now.Add(48*time.Hour))
+	service.CheckExpiringSubscriptions()
+	notices := getNotifications(t, service.db, expiring.ID, "expiration_notice")
+	if len(notices) != 1 || notices[0].Status != "suppressed" {
+		t.Fatalf("屏蔽时段内的到期通知应记录为 suppressed: %+v", notices)
+	}
+
+	// 屏蔽时段结束后正常发送，此时已进入最后一个提醒档位
+	clock.Set(window.End.Add(time.Hour))
+	service.CheckExpiringSubscriptions()
+	notices = getNotifications(t, service.db, expiring.ID, "final_notice")
+	if len(notices) != 1 || notices[0].Status != "sent" {
+		t.Fatalf("屏蔽时段结束后应发送最后提醒: %+v", notices)
+	}
+
+	// 屏蔽时段内的结束通知只记录为 suppressed
+	clock.Set(now)
+	ended := activate("屏蔽结束通知用户", "suppress_ended_test@example.com", now.Add(-time.Hour))
+	if err := service.notificationSvc.SendSubscriptionEndedNotice(ended.UserID, ended.ID); err != nil {
+		t.Fatalf("发送结束通知失败: %v", err)
+	}
+	notices = getNotifications(t, service.db, ended.ID, "subscription_ended")
+	if len(notices) != 1 || notices[0].Status != "suppressed" {
+		t.Fatalf("屏蔽时段内的结束通知应记录为 suppressed: %+v", notices)
+	}
+
+	// 到期日处于屏蔽时段内的订阅顺延屏蔽时段的时长，状态保持不变
+	service.ProcessExpiredSubscriptions()
+	sub, err := service.db.GetSubscriptionByID(context.Background(), ended.ID)
+	if err != nil {
+		t.Fatalf("获取订阅信息失败: %v", err)
+	}
+	if sub.Status != StatusSubscribed || !sub.EndDate.Equal(ended.EndDate.Add(48*time.Hour)) {
+		t.Errorf("订阅未按屏蔽时段顺延: 状态=%s, 到期日=%v, 期望到期日=%v", sub.Status, sub.EndDate, ended.EndDate.Add(48*time.Hour))
+	}
+}
+
+// 测试系统动态按时间倒序合并多种事件
+func TestGetRecentActivity(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用远在未来的时间，保证种子事件排在其他测试数据（包括按虚拟时钟记录的支付）之前
+	base := time.Now().AddDate(10, 0, 0).Truncate(time.Second)
+
+	res, err := service.db.db.Exec("INSERT INTO users (name, email, created_at) VALUES (?, ?, ?)",
+		"动态测试用户", "activity_test@example.com", base)
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	userID, _ := res.LastInsertId()
+	subID := int64(9001)
+
+	payments := []struct {
+		paymentType string
+		status      string
+		offset      time.Duration
+	}{
+		{"initial", "success", 1 * time.Minute},
+		{"renewal", "success", 2 * time.Minute},
+		{"renewal", "failed", 3 * time.Minute}, // 失败的支付不出现在动态中
+	}
+	for _, p := range payments {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, userID, subID, 9.99, base.Add(p.offset), p.status, p.paymentType)
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+
+	err = service.db.CreateSubscriptionEvent(context.Background(), &SubscriptionEvent{
+		SubscriptionID: subID,
+		UserID:         userID,
+		EventType:      EventCancellation,
+		CreatedAt:      base.Add(4 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("记录订阅事件失败: %v", err)
+	}
+
+	events, err := service.GetRecentActivity(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("获取系统动态失败: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("动态数量错误: 期望=3, 实际=%d", len(events))
+	}
+
+	expected := []string{EventCancellation, EventRenewal, EventActivation}
+	for i, want := range expected {
+		if events[i].Type != want {
+			t.Errorf("第%d条动态类型错误: 期望=%s, 实际=%s", i+1, want, events[i].Type)
+		}
+		if events[i].UserID != userID {
+			t.Errorf("第%d条动态用户错误: 期望=%d, 实际=%d", i+1, userID, events[i].UserID)
+		}
+	}
+
+	// 取更多条目时应包含注册事件
+	events, err = service.GetRecentActivity(context.Background(), 4)
+	if err != nil {
+		t.Fatalf("获取系统动态失败: %v", err)
+	}
+	if len(events) != 4 || events[3].Type != EventSignup {
+		t.Errorf("注册事件缺失或顺序错误: %+v", events)
+	}
+}
+
+// 测试从激活到首次做出续订或取消决定的平均时长
+func TestAvgTimeToDecision(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用过去的固定时间段和不会与其他测试冲突的订阅ID
+	windowStart := time.Date(2002, 5, 1, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2002, 5, 31, 0, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return windowStart.AddDate(0, 0, d) }
+
+	pay := func(subscriptionID int64, paymentType string, at time.Time) {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, 0, subscriptionID, SubscriptionPrice, at, "success", paymentType)
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+	event := func(subscriptionID int64, eventType string, at time.Time) {
+		err := service.db.CreateSubscriptionEvent(context.Background(), &SubscriptionEvent{SubscriptionID: subscriptionID, EventType: eventType, CreatedAt: at})
+		if err != nil {
+			t.Fatalf("记录订阅事件失败: %v", err)
+		}
+	}
+	cancel := func(subscriptionID int64, at time.Time) { event(subscriptionID, EventCancellation, at) }
+
+	// 激活2天后取消续订
+	pay(900001, "initial", day(1))
+	cancel(900001, day(3))
+
+	// 激活4天后续订，续订在新周期开始时才扣款，之后的取消不影响首次决定
+	pay(900002, "initial", day(2))
+	event(900002, EventRenewal, day(6))
+	pay(900002, "renewal", day(12))
+	cancel(900002, day(20))
+
+	// 续订扣款不作为决定时间：只有扣款记录、没有续约事件的订阅视为尚未做出决定
+	pay(900006, "initial", day(3))
+	pay(900006, "renewal", day(4))
+
+	// 激活6小时后取消
+	pay(900003, "initial", day(5))
+	cancel(900003, day(5).Add(6*time.Hour))
+
+	// 尚未做出决定
+	pay(900004, "initial", day(4))
+
+	// 激活时间不在查询范围内
+	pay(900005, "initial", windowEnd.AddDate(0, 0, 1))
+	cancel(900005, windowEnd.AddDate(0, 0, 2))
+
+	avg, err := service.GetAvgTimeToDecision(context.Background(), windowStart, windowEnd)
+	if err != nil {
+		t.Fatalf("查询平均续订决定时长失败: %v", err)
+	}
+	expected := (48*time.Hour + 96*time.Hour + 6*time.Hour) / 3
+	if avg != expected {
+		t.Errorf("平均续订决定时长错误: 期望=%v, 实际=%v", expected, avg)
+	}
+
+	// 没有做出决定的订阅时返回0
+	avg, err = service.GetAvgTimeToDecision(context.Background(), day(4), day(4))
+	if err != nil || avg != 0 {
+		t.Errorf("没有决定记录时应返回0: avg=%v, err=%v", avg, err)
+	}
+
+	handler := NewSubscriptionHandler(service)
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/time-to-decision?start_time="+windowStart.Format(time.RFC3339)+"&end_time="+windowEnd.Format(time.RFC3339), nil)
+	rec := httptest.NewRecorder()
+	handler.HandleAvgTimeToDecision(rec, req)
+	var response struct {
+		AvgSeconds float64 `json:"avg_seconds"`
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil || response.AvgSeconds != expected.Seconds() {
+		t.Errorf("接口返回的平均时长错误: %v, %+v", err, response)
+	}
+}
+
+// 测试月度收入序列：首次订阅和续订分开统计，没有收入的月份补零
+func TestMonthlyRevenueSeries(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用过去的固定时间段，避免与其他测试数据重叠
+	pay := func(amount float64, at time.Time, status, paymentType string) {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, 0, 0, amount, at, status, paymentType)
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+	pay(10, time.Date(2004, 1, 5, 0, 0, 0, 0, time.UTC), "success", "initial")
+	pay(20, time.Date(2004, 1, 20, 0, 0, 0, 0, time.UTC), "success", "renewal")
+	pay(-5, time.Date(2004, 1, 25, 0, 0, 0, 0, time.UTC), "success", "refund")
+	pay(99, time.Date(2004, 1, 26, 0, 0, 0, 0, time.UTC), "failed", "renewal")
+	pay(30, time.Date(2004, 3, 31, 23, 0, 0, 0, time.UTC), "success", "renewal")
+	pay(40, time.Date(2004, 4, 2, 0, 0, 0, 0, time.UTC), "success", "initial")
+
+	body := `{"start_time": "2004-01-01T00:00:00Z", "end_time": "2004-03-31T23:59:59Z"}`
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleRevenueSeries(rec, httptest.NewRequest(http.MethodPost, "/api/admin/revenue-series", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+
+	var series []MonthlyRevenue
+	if err := json.NewDecoder(rec.Body).Decode(&series); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	expected := []MonthlyRevenue{
+		{Month: "2004-01", Initial: 10, Renewal: 20, Other: -5, Total: 25},
+		{Month: "2004-02"},
+		{Month: "2004-03", Renewal: 30, Total: 30},
+	}
+	if !slices.Equal(series, expected) {
+		t.Errorf("月度收入序列错误:\n期望=%+v\n实际=%+v", expected, series)
+	}
+}
+
+// 测试时间段付费统计：金额按首次订阅和续订拆分，并计算人均付费
+func TestTimeRangeStats(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用过去的固定时间段，避免与其他测试数据重叠
+	pay := func(userID int64, amount float64, at time.Time, status, paymentType string) {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, userID, 0, amount, at, status, paymentType)
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+	pay(1, 30, time.Date(2008, 5, 1, 0, 0, 0, 0, time.UTC), "success", "initial")
+	pay(1, 30, time.Date(2008, 5, 31, 0, 0, 0, 0, time.UTC), "success", "renewal")
+	pay(2, 50, time.Date(2008, 5, 10, 0, 0, 0, 0, time.UTC), "success", "initial")
+	pay(2, 10, time.Date(2008, 5, 12, 0, 0, 0, 0, time.UTC), "success", "upgrade")
+	pay(3, 99, time.Date(2008, 5, 20, 0, 0, 0, 0, time.UTC), "failed", "renewal")
+	pay(4, 70, time.Date(2008, 6, 1, 0, 0, 0, 0, time.UTC), "success", "initial")
+
+	body := `{"start_time": "2008-05-01T00:00:00Z", "end_time": "2008-05-31T23:59:59Z"}`
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleTimeRangeStats(rec, httptest.NewRequest(http.MethodPost, "/api/admin/time-range-stats", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+
+	var stats TimeRangeStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if stats.PaidUsers != 2 || stats.TotalPayments != 120 {
+		t.Errorf("付费用户数或总额错误: %+v", stats)
+	}
+	if stats.InitialPayments != 80 || stats.RenewalPayments != 30 {
+		t.Errorf("首次订阅和续订金额错误: 期望=80/30, 实际=%v/%v", stats.InitialPayments, stats.RenewalPayments)
+	}
+	if stats.AvgPerUser != 60 {
+		t.Errorf("人均付费错误: 期望=60, 实际=%v", stats.AvgPerUser)
+	}
+
+	// 没有付费的时间段人均为0
+	empty, err := service.GetPaymentStatsByTimeRange(context.Background(), TimeRangeQuery{
+		StartTime: time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(2008, 1, 31, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("查询时间段统计失败: %v", err)
+	}
+	if empty.PaidUsers != 0 || empty.AvgPerUser != 0 {
+		t.Errorf("空时间段统计错误: %+v", empty)
+	}
+}
+
+// 测试按套餐统计退款金额
+func TestRefundsByPlan(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	subscription := func(plan string) int64 {
+		result, err := service.db.db.Exec(`INSERT INTO subscriptions (user_id, plan, start_date, end_date, status)
+                  VALUES (?, ?, ?, ?, ?)`, 0, plan, time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2009, 2, 1, 0, 0, 0, 0, time.UTC), StatusInactive)
+		if err != nil {
+			t.Fatalf("创建订阅失败: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		return id
+	}
+	// 使用过去的固定时间段，避免与其他测试数据重叠
+	pay := func(subID int64, amount float64, at time.Time, status, paymentType string) {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, 0, subID, amount, at, status, paymentType)
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+	basic1, basic2, premium := subscription("basic"), subscription("basic"), subscription("premium")
+	pay(basic1, -10, time.Date(2009, 1, 5, 0, 0, 0, 0, time.UTC), "success", "refund")
+	pay(basic2, -12.5, time.Date(2009, 1, 20, 0, 0, 0, 0, time.UTC), "success", "refund")
+	pay(premium, -40, time.Date(2009, 1, 31, 0, 0, 0, 0, time.UTC), "success", "refund")
+	pay(premium, 49.99, time.Date(2009, 1, 10, 0, 0, 0, 0, time.UTC), "success", "initial")
+	pay(premium, -7, time.Date(2009, 2, 2, 0, 0, 0, 0, time.UTC), "success", "refund")
+
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleRefundsByPlan(rec, httptest.NewRequest(http.MethodGet,
+		"/api/admin/refunds-by-plan?start_time=2009-01-01T00:00:00Z&end_time=2009-01-31T23:59:59Z", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var response struct {
+		Refunds map[string]float64 `json:"refunds"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if len(response.Refunds) != 2 || !sameAmount(response.Refunds["basic"], 22.5) || !sameAmount(response.Refunds["premium"], 40) {
+		t.Errorf("套餐退款金额错误: %v", response.Refunds)
+	}
+
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleRefundsByPlan(rec, httptest.NewRequest(http.MethodGet,
+		"/api/admin/refunds-by-plan?start_time=2009-02-01T00:00:00Z&end_time=2009-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("时间范围颠倒时状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+// 测试月度结账报表的JSON和CSV输出
+func TestMonthlyReport(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用过去的固定月份，避免与其他测试数据重叠
+	pay := func(amount float64, at time.Time, status, paymentType string) {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, 0, 0, amount, at, status, paymentType)
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+	pay(10, time.Date(2006, 2, 1, 0, 0, 0, 0, time.UTC), "success", "initial")
+	pay(12, time.Date(2006, 2, 10, 0, 0, 0, 0, time.UTC), "success", "initial")
+	pay(20, time.Date(2006, 2, 15, 0, 0, 0, 0, time.UTC), "success", "renewal")
+	pay(5, time.Date(2006, 2, 16, 0, 0, 0, 0, time.UTC), "success", "upgrade")
+	pay(-4, time.Date(2006, 2, 28, 23, 59, 0, 0, time.UTC), "success", "refund")
+	pay(99, time.Date(2006, 2, 20, 0, 0, 0, 0, time.UTC), "failed", "renewal")
+	pay(50, time.Date(2006, 3, 1, 0, 0, 0, 0, time.UTC), "success", "renewal")
+	pay(60, time.Date(2006, 1, 31, 23, 59, 0, 0, time.UTC), "success", "initial")
+
+	handler := NewSubscriptionHandler(service)
+	rec := httptest.NewRecorder()
+	handler.HandleMonthlyReport(rec, httptest.NewRequest(http.MethodGet, "/api/admin/monthly-report?month=2006-02", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+
+	var report MonthlyReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	expected := MonthlyReport{
+		Month:            "2006-02",
+		NewSubscriptions: 2,
+		NewRevenue:       22,
+		Renewals:         1,
+		RenewalRevenue:   20,
+		Refunds:          1,
+		RefundAmount:     4,
+		NetRevenue:       43,
+	}
+	if report != expected {
+		t.Errorf("月度报表错误:\n期望=%+v\n实际=%+v", expected, report)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.HandleMonthlyReport(rec, httptest.NewRequest(http.MethodGet, "/api/admin/monthly-report?month=2006-02&format=csv", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); !strings.Contains(disposition, "monthly_report_2006-02.csv") {
+		t.Errorf("文件名错误: %s", disposition)
+	}
+
+	expectedLines := []string{
+		"month,new_subscriptions,new_revenue,renewals,renewal_revenue,refunds,refund_amount,net_revenue",
+		"2006-02,2,22.00,1,20.00,1,4.00,43.00",
+	}
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); !slices.Equal(lines, expectedLines) {
+		t.Errorf("CSV内容错误:\n期望=%v\n实际=%v", expectedLines, lines)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.HandleMonthlyReport(rec, httptest.NewRequest(http.MethodGet, "/api/admin/monthly-report?month=2006-02&format=xml", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("不支持的格式应返回400，实际=%d", rec.Code)
+	}
+}
+
+// 测试每日新用户数，没有注册的日期补零
+func TestNewUserCounts(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用过去的固定时间段，避免与其他测试数据重叠
+	createUser := func(name string, createdAt time.Time) {
+		_, err := service.db.db.Exec("INSERT INTO users (name, email, created_at) VALUES (?, ?, ?)",
+			name, name+"_daily@example.com", createdAt)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+	}
+	createUser("daily_a", time.Date(2005, 6, 1, 8, 0, 0, 0, time.UTC))
+	createUser("daily_b", time.Date(2005, 6, 1, 23, 30, 0, 0, time.UTC))
+	createUser("daily_c", time.Date(2005, 6, 3, 0, 0, 0, 0, time.UTC))
+	createUser("daily_d", time.Date(2005, 6, 5, 12, 0, 0, 0, time.UTC))
+
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleNewUserCounts(rec, httptest.NewRequest(http.MethodGet,
+		"/api/admin/new-users?start=2005-06-01T00:00:00Z&end=2005-06-04T23:59:59Z", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+
+	var counts []DailyCount
+	if err := json.NewDecoder(rec.Body).Decode(&counts); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	expected := []DailyCount{
+		{Date: "2005-06-01", Count: 2},
+		{Date: "2005-06-02", Count: 0},
+		{Date: "2005-06-03", Count: 1},
+		{Date: "2005-06-04", Count: 0},
+	}
+	if !slices.Equal(counts, expected) {
+		t.Errorf("每日新用户数错误:\n期望=%+v\n实际=%+v", expected, counts)
+	}
+}
+
+// 测试转化漏斗各阶段人数及转化率
+func TestConversionFunnel(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用过去的固定时间段，避免与其他测试数据重叠
+	windowStart := time.Date(2001, 3, 1, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2001, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	createUser := func(name string, createdAt time.Time) int64 {
+		res, err := service.db.db.Exec("INSERT INTO users (name, email, created_at) VALUES (?, ?, ?)",
+			name, name+"_funnel@example.com", createdAt)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		id, _ := res.LastInsertId()
+		return id
+	}
+	startTrial := func(userID int64, at time.Time) {
+		err := service.db.CreateSubscriptionEvent(context.Background(), &SubscriptionEvent{UserID: userID, EventType: EventTrialStart, CreatedAt: at})
+		if err != nil {
+			t.Fatalf("记录试用事件失败: %v", err)
+		}
+	}
+	pay := func(userID int64, paymentType, status string, at time.Time) {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, userID, 0, SubscriptionPrice, at, status, paymentType)
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+
+	day := func(d int) time.Time { return windowStart.AddDate(0, 0, d) }
+
+	// 试用后激活并续订两次
+	a := createUser("funnel_a", day(1))
+	startTrial(a, day(2))
+	pay(a, "initial", "success", day(10))
+	pay(a, "renewal", "success", day(20))
+	pay(a, "renewal", "success", day(25))
+
+	// 试用后未激活
+	b := createUser("funnel_b", day(1))
+	startTrial(b, day(3))
+
+	// 未试用直接激活，激活人数因此多于试用人数
+	c := createUser("funnel_c", day(5))
+	pay(c, "initial", "success", day(6))
+	f := createUser("funnel_f", day(7))
+	pay(f, "initial", "success", day(8))
+
+	// 激活支付失败
+	d := createUser("funnel_d", day(5))
+	pay(d, "initial", "failed", day(6))
+
+	// 时间段外注册的用户不计入
+	e := createUser("funnel_e", windowStart.AddDate(0, 0, -10))
+	startTrial(e, day(1))
+	pay(e, "initial", "success", day(2))
+
+	rec := httptest.NewRecorder()
+	target := fmt.Sprintf("/api/admin/funnel?start_time=%s&end_time=%s",
+		windowStart.Format(time.RFC3339), windowEnd.Format(time.RFC3339))
+	NewSubscriptionHandler(service).HandleConversionFunnel(rec, httptest.NewRequest(http.MethodGet, target, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var funnel Funnel
+	if err := json.NewDecoder(rec.Body).Decode(&funnel); err != nil {
+		t.Fatalf("解析转化漏斗响应失败: %v", err)
+	}
+
+	if funnel.Users != 5 || funnel.Trials != 2 || funnel.Activated != 3 || funnel.TrialActivated != 1 || funnel.Renewed != 1 {
+		t.Errorf("漏斗人数错误: 期望=5/2/3/1/1, 实际=%d/%d/%d/%d/%d",
+			funnel.Users, funnel.Trials, funnel.Activated, funnel.TrialActivated, funnel.Renewed)
+	}
+	if funnel.TrialRate != 0.4 || funnel.ActivationRate != 0.5 || math.Abs(funnel.RenewalRate-1.0/3) > 1e-9 {
+		t.Errorf("转化率错误: 期望=0.4/0.5/0.33, 实际=%v/%v/%v",
+			funnel.TrialRate, funnel.ActivationRate, funnel.RenewalRate)
+	}
+
+	// 缺少时间参数返回400
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleConversionFunnel(rec, httptest.NewRequest(http.MethodGet, "/api/admin/funnel", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("缺少参数时状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+// 测试非关键依赖异常时健康检查为 degraded
+func TestHealthCheckDegraded(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{
+		DatabaseDSN: testDSN,
+		HealthDependencies: []HealthDependency{
+			{
+				Name:     "redis",
+				Critical: false,
+				Check: func(ctx context.Context) error {
+					return fmt.Errorf("dial tcp 127.0.0.1:6379: connection refused")
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+
+	var report HealthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("解析健康检查响应失败: %v", err)
+	}
+
+	if report.Status != HealthDegraded {
+		t.Errorf("整体状态错误: 期望=%s, 实际=%s", HealthDegraded, report.Status)
+	}
+
+	deps := make(map[string]DependencyStatus)
+	for _, dep := range report.Dependencies {
+		deps[dep.Name] = dep
+	}
+
+	if db, ok := deps["database"]; !ok || db.Status != HealthHealthy || !db.Critical {
+		t.Errorf("数据库依赖状态错误: %+v", db)
+	}
+	if redis, ok := deps["redis"]; !ok || redis.Status != HealthUnhealthy || redis.Critical || redis.Error == "" {
+		t.Errorf("redis依赖状态错误: %+v", redis)
+	}
+}
+
+// 测试生命周期模拟：已订阅 -> 到期提醒 -> 未激活，且不修改真实数据
+func TestSimulateLifecycle(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "生命周期模拟测试用户", "simulate_lifecycle_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+
+	body, _ := json.Marshal(SimulateLifecycleRequest{SubscriptionID: subID, StepHours: 12})
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleSimulateLifecycle(rec,
+		httptest.NewRequest(http.MethodPost, "/api/admin/simulate-lifecycle", bytes.NewReader(body)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("模拟请求失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	var steps []LifecycleStep
+	if err := json.NewDecoder(rec.Body).Decode(&steps); err != nil {
+		t.Fatalf("解析模拟响应失败: %v", err)
+	}
+
+	expected := []struct{ event, status string }{
+		{"start", StatusSubscribed},
+		{"expiration_notice", StatusSubscribed},
+		{"final_notice", StatusSubscribed},
+		{"expired", StatusInactive},
+		{"subscription_ended", StatusInactive},
+	}
+	if len(steps) != len(expected) {
+		t.Fatalf("状态序列长度错误: 期望=%d, 实际=%d, 序列=%+v", len(expected), len(steps), steps)
+	}
+	for i, want := range expected {
+		if steps[i].Event != want.event || steps[i].Status != want.status {
+			t.Errorf("第%d步错误: 期望=%s/%s, 实际=%s/%s", i+1, want.event, want.status, steps[i].Event, steps[i].Status)
+		}
+	}
+
+	// 提醒在到期前3天内，最后提醒在到期前1天内，过期在到期之后
+	if remaining := subs[0].EndDate.Sub(steps[1].At); remaining <= 24*time.Hour || remaining > 3*24*time.Hour {
+		t.Errorf("提醒时间不在3天档位内: 剩余=%v", remaining)
+	}
+	if remaining := subs[0].EndDate.Sub(steps[2].At); remaining <= 0 || remaining > 24*time.Hour {
+		t.Errorf("最后提醒时间不在1天档位内: 剩余=%v", remaining)
+	}
+	if !steps[3].At.After(subs[0].EndDate) {
+		t.Errorf("过期时间早于到期时间: %v", steps[3].At)
+	}
+
+	// 模拟不应修改数据库中的订阅
+	sub, err := service.db.GetSubscriptionByID(context.Background(), subID)
+	if err != nil {
+		t.Fatalf("获取订阅信息失败: %v", err)
+	}
+	if sub.Status != StatusSubscribed {
+		t.Errorf("模拟后真实订阅状态被修改: %s", sub.Status)
+	}
+	if notices := getNotifications(t, service.db, subID, "expiration_notice"); len(notices) != 0 {
+		t.Errorf("模拟不应发送通知，实际发送了%d条", len(notices))
+	}
+	if steps[1].Detail != string(NoticeSent) {
+		t.Errorf("模拟的提醒状态错误: %q", steps[1].Detail)
+	}
+
+	// charge 方式下续约的订阅进入新周期时扣款，扣款失败后按重试规则恢复或结束
+	ctx := context.Background()
+	if err := service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCycleCharge}); err != nil {
+		t.Fatalf("更新设置失败: %v", err)
+	}
+	defer service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCyclePrepaid})
+
+	renewedID, err := service.CreateUser(ctx, "生命周期模拟扣款测试用户", "simulate_lifecycle_dunning@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, renewedID, "quarterly", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	renewedSubs, err := service.db.GetUserSubscriptions(ctx, renewedID)
+	if err != nil || len(renewedSubs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	renewed := renewedSubs[0].ID
+	if _, err := service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: renewed, UserID: renewedID, Amount: SubscriptionPrice}); err != nil {
+		t.Fatalf("续订失败: %v", err)
+	}
+	paymentsBefore, err := service.db.GetUserPayments(renewedID)
+	if err != nil {
+		t.Fatalf("获取支付记录失败: %v", err)
+	}
+
+	// events 返回模拟的事件序列，扣款事件附带支付状态
+	events := func(failedCharges int) []string {
+		steps, err := service.SimulateLifecycle(ctx, SimulateLifecycleRequest{SubscriptionID: renewed, FailedCharges: failedCharges})
+		if err != nil {
+			t.Fatalf("模拟生命周期失败: %v", err)
+		}
+		var events []string
+		for _, step := range steps {
+			event := step.Event
+			if event == "renewal_charge" {
+				event += "/" + step.Detail
+			}
+			events = append(events, event)
+		}
+		return events
+	}
+
+	recovered := strings.Join(events(1), ",")
+	wantRecovered := "start,renewal_charge/failed,past_due,payment_failed,renewal_charge/success,new_cycle," +
+		"expiration_notice,final_notice,expired,subscription_ended"
+	if recovered != wantRecovered {
+		t.Errorf("扣款重试成功的序列错误:\n期望=%s\n实际=%s", wantRecovered, recovered)
+	}
+
+	exhausted := strings.Join(events(dunningMaxRetries+1), ",")
+	wantExhausted := "start,renewal_charge/failed,past_due,payment_failed" +
+		strings.Repeat(",renewal_charge/failed,payment_failed", dunningMaxRetries-1) +
+		",renewal_charge/failed,expired,subscription_ended"
+	if exhausted != wantExhausted {
+		t.Errorf("重试次数用完的序列错误:\n期望=%s\n实际=%s", wantExhausted, exhausted)
+	}
+
+	// 模拟扣款不应修改真实的订阅和支付
+	renewedSub, err := service.db.GetSubscriptionByID(ctx, renewed)
+	if err != nil {
+		t.Fatalf("获取订阅信息失败: %v", err)
+	}
+	if renewedSub.Status != StatusRenewed {
+		t.Errorf("模拟后真实订阅状态被修改: %s", renewedSub.Status)
+	}
+	paymentsAfter, err := service.db.GetUserPayments(renewedID)
+	if err != nil {
+		t.Fatalf("获取支付记录失败: %v", err)
+	}
+	if len(paymentsAfter) != len(paymentsBefore) {
+		t.Errorf("模拟不应记录支付: 模拟前=%d, 模拟后=%d", len(paymentsBefore), len(paymentsAfter))
+	}
+}
+
+// 测试从环境变量加载配置
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("DATABASE_DSN", "")
+	if _, err := loadConfig(); err == nil {
+		t.Error("未设置 DATABASE_DSN 时应返回错误")
+	}
+
+	t.Setenv("DATABASE_DSN", testDSN)
+	t.Setenv("SERVER_PORT", "9090")
+	t.Setenv("LOG_FILE", "")
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	if config.DatabaseDSN != testDSN || config.ServerPort != 9090 || config.LogFile != "" {
+		t.Errorf("配置加载错误: %+v", config)
+	}
+
+	if config.DBKeepaliveInterval != 5*time.Minute {
+		t.Errorf("连接保活间隔默认值错误: %v", config.DBKeepaliveInterval)
+	}
+
+	t.Setenv("DB_KEEPALIVE_INTERVAL", "30s")
+	if config, err := loadConfig(); err != nil || config.DBKeepaliveInterval != 30*time.Second {
+		t.Errorf("连接保活间隔加载错误: %v, %+v", err, config)
+	}
+
+	t.Setenv("DB_KEEPALIVE_INTERVAL", "abc")
+	if _, err := loadConfig(); err == nil {
+		t.Error("DB_KEEPALIVE_INTERVAL 无效时应返回错误")
+	}
+	t.Setenv("DB_KEEPALIVE_INTERVAL", "")
+
+	t.Setenv("DB_STATEMENT_TIMEOUT", "2s")
+	if config, err := loadConfig(); err != nil || config.DBStatementTimeout != 2*time.Second {
+		t.Errorf("语句超时加载错误: %v, %+v", err, config)
+	}
+	t.Setenv("DB_STATEMENT_TIMEOUT", "-1s")
+	if _, err := loadConfig(); err == nil {
+		t.Error("DB_STATEMENT_TIMEOUT 无效时应返回错误")
+	}
+	t.Setenv("DB_STATEMENT_TIMEOUT", "")
+
+	if !slices.Equal(config.ExpiryNoticeTiers, []int{3, 1}) {
+		t.Errorf("到期提醒档位默认值错误: %v", config.ExpiryNoticeTiers)
+	}
+	t.Setenv("EXPIRY_NOTICE_TIERS", "7, 3,1")
+	if config, err := loadConfig(); err != nil || !slices.Equal(config.ExpiryNoticeTiers, []int{7, 3, 1}) {
+		t.Errorf("到期提醒档位加载错误: %v, %+v", err, config)
+	}
+	t.Setenv("EXPIRY_NOTICE_TIERS", "7,x")
+	if _, err := loadConfig(); err == nil {
+		t.Error("EXPIRY_NOTICE_TIERS 无效时应返回错误")
+	}
+	t.Setenv("EXPIRY_NOTICE_TIERS", "")
+
+	t.Setenv("NOTIFICATION_SUPPRESS_START", "2030-01-01T00:00:00Z")
+	t.Setenv("NOTIFICATION_SUPPRESS_END", "2030-01-02T00:00:00Z")
+	t.Setenv("NOTIFICATION_SUPPRESS_EXTEND", "true")
+	config, err = loadConfig()
+	if err != nil || !config.ExtendSuppressed ||
+		!config.NotificationSuppression.Contains(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("通知屏蔽时段加载错误: %v, %+v", err, config)
+	}
+
+	t.Setenv("NOTIFICATION_SUPPRESS_END", "2029-12-31T00:00:00Z")
+	if _, err := loadConfig(); err == nil {
+		t.Error("NOTIFICATION_SUPPRESS_END 早于开始时间时应返回错误")
+	}
+	t.Setenv("NOTIFICATION_SUPPRESS_START", "")
+	t.Setenv("NOTIFICATION_SUPPRESS_END", "")
+	t.Setenv("NOTIFICATION_SUPPRESS_EXTEND", "")
+
+	t.Setenv("NOTIFICATION_DAILY_LIMIT", "5")
+	if config, err := loadConfig(); err != nil || config.NotificationDailyLimit != 5 {
+		t.Errorf("NOTIFICATION_DAILY_LIMIT 加载错误: %v, %+v", err, config)
+	}
+	t.Setenv("NOTIFICATION_DAILY_LIMIT", "-1")
+	if _, err := loadConfig(); err == nil {
+		t.Error("NOTIFICATION_DAILY_LIMIT 为负数时应返回错误")
+	}
+	t.Setenv("NOTIFICATION_DAILY_LIMIT", "")
+
+	t.Setenv("RATE_LIMIT_PER_MINUTE", "abc")
+	if _, err := loadConfig(); err == nil {
+		t.Error("RATE_LIMIT_PER_MINUTE 无效时应返回错误")
+	}
+	t.Setenv("RATE_LIMIT_PER_MINUTE", "")
+
+	t.Setenv("ACCESS_LOG", "false")
+	if config, err := loadConfig(); err != nil || config.AccessLog {
+		t.Errorf("ACCESS_LOG=false 时应关闭访问日志: %v, %+v", err, config)
+	}
+	t.Setenv("ACCESS_LOG", "maybe")
+	if _, err := loadConfig(); err == nil {
+		t.Error("ACCESS_LOG 无效时应返回错误")
+	}
+	t.Setenv("ACCESS_LOG", "")
+
+	// 设置短信网关后启用 sms 渠道，按配置的顺序回退
+	var gatewayRequest map[string]any
+	gatewayStatus := http.StatusOK
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&gatewayRequest)
+		w.WriteHeader(gatewayStatus)
+	}))
+	defer gateway.Close()
+	t.Setenv("JWT_SECRET", "jwt_test_secret")
+	t.Setenv("SMS_GATEWAY_URL", gateway.URL)
+	t.Setenv("NOTIFICATION_CHANNEL_ORDER", "payment_failed=email, sms; subscription_ended=sms")
+	config, err = loadConfig()
+	if err != nil {
+		t.Fatalf("短信渠道配置加载失败: %v", err)
+	}
+	if !slices.Equal(config.NotificationChannelOrder["payment_failed"], []string{ChannelEmail, ChannelSMS}) ||
+		!slices.Equal(config.NotificationChannelOrder["subscription_ended"], []string{ChannelSMS}) {
+		t.Errorf("渠道顺序加载错误: %v", config.NotificationChannelOrder)
+	}
+	if errs := config.Validate(); len(errs) != 0 {
+		t.Errorf("短信渠道配置不应报告问题: %v", errs)
+	}
+	sms, ok := config.NotificationChannels[ChannelSMS]
+	if !ok {
+		t.Fatal("设置 SMS_GATEWAY_URL 后应启用 sms 渠道")
+	}
+	if err := sms.Deliver(&User{ID: 42}, "续订扣款失败", "请更新支付方式"); err != nil {
+		t.Errorf("短信网关发送失败: %v", err)
+	}
+	if gatewayRequest["user_id"] != float64(42) || gatewayRequest["body"] != "请更新支付方式" {
+		t.Errorf("短信网关收到的请求错误: %v", gatewayRequest)
+	}
+	gatewayStatus = http.StatusBadGateway
+	if err := sms.Deliver(&User{ID: 42}, "续订扣款失败", "请更新支付方式"); err == nil {
+		t.Error("短信网关返回错误状态码时应发送失败")
+	}
+
+	t.Setenv("SMS_GATEWAY_URL", "")
+	if config, err := loadConfig(); err != nil || len(config.Validate()) == 0 {
+		t.Errorf("未设置短信网关时使用 sms 渠道应报告问题: %v", err)
+	}
+	t.Setenv("SMS_GATEWAY_URL", "gateway.example.com/sms")
+	if _, err := loadConfig(); err == nil {
+		t.Error("SMS_GATEWAY_URL 无效时应返回错误")
+	}
+	t.Setenv("SMS_GATEWAY_URL", "")
+	t.Setenv("NOTIFICATION_CHANNEL_ORDER", "payment_failed")
+	if _, err := loadConfig(); err == nil {
+		t.Error("NOTIFICATION_CHANNEL_ORDER 格式错误时应返回错误")
+	}
+	t.Setenv("NOTIFICATION_CHANNEL_ORDER", "")
+
+	t.Setenv("SERVER_PORT", "abc")
+	if _, err := loadConfig(); err == nil {
+		t.Error("SERVER_PORT 无效时应返回错误")
+	}
+}
+
+// 测试配置校验一次报告全部问题
+func TestConfigValidate(t *testing.T) {
+	valid := &Config{DatabaseDSN: testDSN, ServerPort: 8080, SMTPPort: 587, JWTSecret: "jwt_test_secret"}
+	if errs := valid.Validate(); len(errs) != 0 {
+		t.Fatalf("有效配置不应报告问题: %v", errs)
+	}
+
+	// 未设置签名密钥时只有显式关闭认证才能启动
+	devOnly := &Config{DatabaseDSN: testDSN, ServerPort: 8080, AuthDisabled: true}
+	if errs := devOnly.Validate(); len(errs) != 0 {
+		t.Errorf("显式关闭认证的配置不应报告问题: %v", errs)
+	}
+
+	invalid := &Config{
+		DatabaseDSN:            "not a dsn",
+		ServerPort:             70000,
+		DBKeepaliveInterval:    -time.Second,
+		ExpiryCheckInterval:    -time.Minute,
+		DBMaxIdleConns:         -1,
+		ExpiryNoticeTiers:      []int{7, -1},
+		NotificationDailyLimit: -3,
+		PlanTransitions:        PlanTransitions{"basic": {"platinum"}},
+		UnknownPlanPolicy:      "ignore",
+		SMTPHost:               "smtp.example.com",
+		NotificationChannelOrder: map[string][]string{
+			"expiration_notice": {"sms", ChannelEmail},
+			"expiry_notice":     {ChannelEmail},
+		},
+	}
+	errs := invalid.Validate()
+
+	expected := []string{
+		"数据库DSN格式错误",
+		"服务端口无效: 70000",
+		"数据库保活间隔不能为负数",
+		"到期检查间隔不能为负数",
+		"数据库最大空闲连接数不能为负数: -1",
+		"到期提醒档位必须为正数: -1",
+		"每日通知上限不能为负数: -3",
+		"未知套餐: platinum",
+		"未知套餐处理方式无效: ignore",
+		"未设置 JWT_SECRET",
+		"SMTP端口无效: 0",
+		"未设置发件人地址",
+		"未配置的渠道: sms",
+		"渠道顺序中的通知类型未知: expiry_notice",
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("问题数量错误: 期望=%d, 实际=%d: %v", len(expected), len(errs), errs)
+	}
+	report := errors.Join(errs...).Error()
+	for _, want := range expected {
+		if !strings.Contains(report, want) {
+			t.Errorf("校验报告缺少问题 %q: %s", want, report)
+		}
+	}
+}
+
+// 测试连接池参数未配置时使用默认值，空闲连接数不超过最大连接数
+func TestDBPoolConfigDefaults(t *testing.T) {
+	tests := []struct {
+		pool DBPoolConfig
+		want DBPoolConfig
+	}{
+		{DBPoolConfig{}, DBPoolConfig{MaxOpenConns: 100, MaxIdleConns: 20, ConnMaxLifetime: time.Hour}},
+		{DBPoolConfig{MaxOpenConns: 5}, DBPoolConfig{MaxOpenConns: 5, MaxIdleConns: 5, ConnMaxLifetime: time.Hour}},
+		{
+			DBPoolConfig{MaxOpenConns: 200, MaxIdleConns: 50, ConnMaxLifetime: 10 * time.Minute},
+			DBPoolConfig{MaxOpenConns: 200, MaxIdleConns: 50, ConnMaxLifetime: 10 * time.Minute},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.pool.withDefaults(); got != tt.want {
+			t.Errorf("连接池参数错误: 配置=%+v, 期望=%+v, 实际=%+v", tt.pool, tt.want, got)
+		}
+	}
+
+	config := &Config{DatabaseDSN: testDSN, ServerPort: 8080, AuthDisabled: true, DBMaxOpenConns: 10, DBMaxIdleConns: 20}
+	if errs := config.Validate(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "不能超过最大连接数") {
+		t.Errorf("空闲连接数超过最大连接数时应报告问题: %v", errs)
+	}
+}
+
+// 测试缓存刷新和定时任务间隔可配置，未配置时使用默认值
+func TestConfiguredIntervals(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN, CacheUpdateInterval: time.Minute})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+	if service.cache.updateInterval != time.Minute {
+		t.Errorf("缓存刷新间隔错误: 期望=%v, 实际=%v", time.Minute, service.cache.updateInterval)
+	}
+
+	scheduler := NewTaskScheduler(service, 0, 0)
+	if scheduler.checkInterval != defaultExpiryCheckInterval || scheduler.processInterval != defaultExpiredProcessInterval {
+		t.Errorf("未配置时应使用默认间隔: 到期检查=%v, 过期处理=%v", scheduler.checkInterval, scheduler.processInterval)
+	}
+	scheduler = NewTaskScheduler(service, time.Hour, 2*time.Hour)
+	if scheduler.checkInterval != time.Hour || scheduler.processInterval != 2*time.Hour {
+		t.Errorf("配置的间隔未生效: 到期检查=%v, 过期处理=%v", scheduler.checkInterval, scheduler.processInterval)
+	}
+}
+
+// 测试跨时区写入的临近午夜支付按UTC归属月份
+func TestPaymentDateStoredInUTC(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "UTC归属测试用户", "utc_payment_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	amountBefore, err := service.db.GetNewPaymentAmountMonth()
+	if err != nil {
+		t.Fatalf("获取本月新增付费金额失败: %v", err)
+	}
+
+	monthStart := monthStartUTC(time.Now())
+	payments := []struct {
+		at     time.Time
+		amount float64
+	}{
+		// 本月第一天 UTC 00:00:30，以东八区时间写入
+		{monthStart.Add(30 * time.Second).In(time.FixedZone("UTC+8", 8*3600)), 11.11},
+		// 上月最后一天 UTC 23:59:30，以西五区时间写入（当地仍是同一天傍晚）
+		{monthStart.Add(-30 * time.Second).In(time.FixedZone("UTC-5", -5*3600)), 22.22},
+	}
+	for _, p := range payments {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, userID, 0, p.amount, p.at, "success", "initial")
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+
+	// 读回的时间应与写入的时刻一致且为UTC
+	stored, err := service.db.GetUserPayments(userID)
+	if err != nil || len(stored) != 2 {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	for i, payment := range stored {
+		if payment.PaymentDate.Location() != time.UTC || !payment.PaymentDate.Equal(payments[i].at) {
+			t.Errorf("支付时间存储错误: 期望=%v, 实际=%v", payments[i].at.UTC(), payment.PaymentDate)
+		}
+	}
+
+	// 只有本月的那笔计入本月统计
+	amountAfter, err := service.db.GetNewPaymentAmountMonth()
+	if err != nil {
+		t.Fatalf("获取本月新增付费金额失败: %v", err)
+	}
+	if diff := amountAfter - amountBefore; diff < 11.10 || diff > 11.12 {
+		t.Errorf("本月新增付费金额归属错误: 期望增加11.11, 实际增加%.2f", diff)
+	}
+}
+
+// 测试手动触发过期处理和到期检查，立即执行并返回处理的订阅数
+func TestManualTaskTriggers(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+	ctx := context.Background()
+
+	activate := func(email string, endDate time.Time) int64 {
+		userID, err := service.CreateUser(ctx, "手动任务测试用户", email)
+		if err != nil {
+			t.Fatalf("创建测试用户失败: %v", err)
+		}
+		if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+			t.Fatalf("激活订阅失败: %v", err)
+		}
+		subs, err := service.db.GetUserSubscriptions(ctx, userID)
+		if err != nil || len(subs) != 1 {
+			t.Fatalf("获取用户订阅失败: %v", err)
+		}
+		if err := service.db.UpdateSubscriptionDates(subs[0].ID, endDate.AddDate(0, -1, 0), endDate); err != nil {
+			t.Fatalf("更新订阅日期失败: %v", err)
+		}
+		return subs[0].ID
+	}
+	trigger := func(h http.HandlerFunc, method, path string) (int, BatchSummary) {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(method, path, nil))
+		var summary BatchSummary
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+				t.Fatalf("解析响应失败: %v", err)
+			}
+		}
+		return rec.Code, summary
+	}
+
+	if code, _ := trigger(handler.HandleProcessExpiredTask, http.MethodGet, "/api/admin/tasks/process-expired"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET 请求状态码错误: 期望=%d, 实际=%d", http.StatusMethodNotAllowed, code)
+	}
+
+	// 已过期的订阅立即结束
+	expiredID := activate("manual_process_expired@example.com", time.Now().Add(-time.Hour))
+	code, summary := trigger(handler.HandleProcessExpiredTask, http.MethodPost, "/api/admin/tasks/process-expired")
+	if code != http.StatusOK || summary.Processed < 1 || summary.Notified < 1 {
+		t.Fatalf("手动处理已过期订阅失败: 状态码=%d, 结果=%+v", code, summary)
+	}
+	if sub, _ := service.db.GetSubscriptionByID(ctx, expiredID); sub.Status != StatusInactive {
+		t.Errorf("手动处理后订阅应结束: %s", sub.Status)
+	}
+
+	// 即将到期的订阅立即收到提醒
+	expiringID := activate("manual_check_expiring@example.com", time.Now().Add(12*time.Hour))
+	code, summary = trigger(handler.HandleCheckExpiringTask, http.MethodPost, "/api/admin/tasks/check-expiring")
+	if code != http.StatusOK || summary.Processed < 1 || summary.Notified < 1 {
+		t.Fatalf("手动检查即将到期订阅失败: 状态码=%d, 结果=%+v", code, summary)
+	}
+	if sub, _ := service.db.GetSubscriptionByID(ctx, expiringID); !sub.NotificationSent {
+		t.Error("手动检查后应发送到期提醒")
+	}
+
+	// 再次检查时已提醒过的订阅不再计入处理完成
+	code, again := trigger(handler.HandleCheckExpiringTask, http.MethodPost, "/api/admin/tasks/check-expiring")
+	if code != http.StatusOK || again.Notified != 0 || again.Processed != summary.Processed-summary.Notified {
+		t.Errorf("重复检查的结果错误: 第一次=%+v, 第二次=%+v", summary, again)
+	}
+}
+
+// 测试暂停调度器后不再处理任务，恢复后继续处理
+func TestSchedulerPauseResume(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "调度器暂停测试用户", "scheduler_pause_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+
+	// 将订阅设为已过期
+	past := time.Now().Add(-48 * time.Hour)
+	if err := service.db.UpdateSubscriptionDates(subID, past.AddDate(0, -1, 0), past); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+
+	scheduler := NewTaskScheduler(service, 20*time.Millisecond, 20*time.Millisecond)
+
+	handler := NewSchedulerHandler(scheduler)
+	rec := httptest.NewRecorder()
+	handler.HandlePause(rec, httptest.NewRequest(http.MethodPost, "/api/admin/scheduler/pause", nil))
+	if rec.Code != http.StatusOK || !scheduler.Paused() {
+		t.Fatalf("暂停调度器失败: 状态码=%d", rec.Code)
+	}
+
+	scheduler.Start()
+	defer scheduler.Stop(context.Background())
+
+	// 暂停期间经过多个周期，订阅不应被处理
+	time.Sleep(150 * time.Millisecond)
+	sub, err := service.db.GetSubscriptionByID(context.Background(), subID)
+	if err != nil {
+		t.Fatalf("获取订阅信息失败: %v", err)
+	}
+	if sub.Status != StatusSubscribed {
+		t.Fatalf("暂停期间订阅被处理: 状态=%s", sub.Status)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.HandleResume(rec, httptest.NewRequest(http.MethodPost, "/api/admin/scheduler/resume", nil))
+	if rec.Code != http.StatusOK || scheduler.Paused() {
+		t.Fatalf("恢复调度器失败: 状态码=%d", rec.Code)
+	}
+
+	// 恢复后应在下一个周期处理过期订阅
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		sub, err = service.db.GetSubscriptionByID(context.Background(), subID)
+		if err == nil && sub.Status == StatusInactive {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("恢复后过期订阅未被处理: 状态=%s", sub.Status)
+}
+
+// 测试试用：不产生支付记录，到期后转为未激活并发送试用结束通知
+func TestStartTrial(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "试用测试用户", "trial_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	// 不在目录中的套餐不能试用
+	body, _ := json.Marshal(map[string]interface{}{"user_id": userID, "plan": "platinum"})
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleStartTrial(rec,
+		httptest.NewRequest(http.MethodPost, "/api/subscriptions/trial", bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("试用未知套餐状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+
+	// 试用不收费，不接受优惠码
+	body, _ = json.Marshal(map[string]interface{}{"user_id": userID, "plan": "premium", "coupon_code": "TRIAL10"})
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleStartTrial(rec,
+		httptest.NewRequest(http.MethodPost, "/api/subscriptions/trial", bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("试用携带优惠码状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"user_id": userID, "plan": "premium"})
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleStartTrial(rec,
+		httptest.NewRequest(http.MethodPost, "/api/subscriptions/trial", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("开始试用失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	sub := subs[0]
+
+	if sub.Status != StatusTrial || sub.Plan != "premium" {
+		t.Errorf("试用订阅状态错误: 状态=%s, 计划=%s", sub.Status, sub.Plan)
+	}
+	if days := sub.EndDate.Sub(sub.StartDate).Hours() / 24; days < TrialPeriodDays-0.01 || days > TrialPeriodDays+0.01 {
+		t.Errorf("试用天数错误: 期望=%d, 实际=%.2f", TrialPeriodDays, days)
+	}
+
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	if len(payments) != 0 {
+		t.Errorf("试用不应产生支付记录，实际有%d条", len(payments))
+	}
+
+	// 试用到期后只处理本测试的订阅，不影响其他测试留下的数据
+	past := time.Now().Add(-time.Hour)
+	if err := service.db.UpdateSubscriptionDates(sub.ID, past.AddDate(0, 0, -TrialPeriodDays), past); err != nil {
+		t.Fatalf("更新订阅日期失败: %v", err)
+	}
+	sub.StartDate, sub.EndDate = past.AddDate(0, 0, -TrialPeriodDays), past
+	var summary BatchSummary
+	service.expireSubscription(sub, time.Now(), &summary)
+	if summary.Processed != 1 || summary.Notified != 1 {
+		t.Errorf("试用到期处理结果错误: %+v", summary)
+	}
+
+	sub2, err := service.db.GetSubscriptionByID(context.Background(), sub.ID)
+	if err != nil {
+		t.Fatalf("获取订阅信息失败: %v", err)
+	}
+	if sub2.Status != StatusInactive {
+		t.Errorf("试用到期后状态错误: 期望=%s, 实际=%s", StatusInactive, sub2.Status)
+	}
+
+	// 等待异步发送的试用结束通知写入记录
+	if err := service.DrainNotifications(context.Background()); err != nil {
+		t.Fatalf("等待通知发送失败: %v", err)
+	}
+	if len(getNotifications(t, service.db, sub.ID, "trial_ended")) != 1 {
+		t.Error("未发送试用结束通知")
+	}
+
+	// 试用结束后订阅回到未激活状态，但同一用户不能再次试用
+	if err := service.StartTrial(context.Background(), userID, "basic"); !errors.Is(err, ErrTrialUsed) {
+		t.Errorf("再次试用应返回 ErrTrialUsed, 实际: %v", err)
+	}
+}
+
+// 测试活跃订阅查询：没有活跃订阅时返回204，激活后返回当前订阅
+func TestActiveSubscriptionEndpoint(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+	ctx := context.Background()
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.HandleActiveSubscription(rec, httptest.NewRequest(http.MethodGet, "/api/subscriptions/active?"+query, nil))
+		return rec
+	}
+
+	if rec := get("user_id=abc"); rec.Code != http.StatusBadRequest {
+		t.Errorf("无效的 user_id 状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+	if rec := get(""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "缺少user_id参数") {
+		t.Errorf("缺少 user_id 时应返回400: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	userID, err := service.CreateUser(ctx, "活跃订阅测试用户", "active_subscription_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	rec := get(fmt.Sprintf("user_id=%d", userID))
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Errorf("没有活跃订阅时应返回204: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	rec = get(fmt.Sprintf("user_id=%d", userID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("查询活跃订阅失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	var sub Subscription
+	if err := json.NewDecoder(rec.Body).Decode(&sub); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if sub.UserID != userID || sub.Plan != "basic" || sub.Status != StatusSubscribed {
+		t.Errorf("活跃订阅错误: %+v", sub)
+	}
+}
+
+// 测试订阅详情附带累计实付金额
+func TestSubscriptionDetailTotalPaid(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "累计支付测试用户", "total_paid_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+
+	// 首次支付29.99，两次续订各10.00，其中一次退款，另有一笔失败支付
+	for _, amount := range []float64{10, 10} {
+		if _, err := service.RenewSubscription(context.Background(), RenewalRequest{SubscriptionID: subID, UserID: userID, Amount: amount}); err != nil {
+			t.Fatalf("续订失败: %v", err)
+		}
+		if err := service.db.UpdateSubscriptionStatus(context.Background(), subID, StatusSubscribed); err != nil {
+			t.Fatalf("更新订阅状态失败: %v", err)
+		}
+	}
+	_, err = service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+              VALUES (?, ?, ?, ?, ?, ?)`, userID, subID, 50.0, time.Now(), "failed", "renewal")
+	if err != nil {
+		t.Fatalf("创建失败支付记录失败: %v", err)
+	}
+
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	// 一笔续订全额退款，另一笔按比例退还3.00
+	var renewals []Payment
+	for _, payment := range payments {
+		if payment.Type == "renewal" && payment.Status == "success" {
+			renewals = append(renewals, payment)
+		}
+	}
+	if len(renewals) != 2 {
+		t.Fatalf("续订支付数量错误: %d", len(renewals))
+	}
+	if _, err := service.RefundPayment(context.Background(), renewals[0].ID, userID, ""); err != nil {
+		t.Fatalf("退款失败: %v", err)
+	}
+	_, err = service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type, reason, original_payment_id)
+              VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, userID, subID, -3.0, time.Now(), "success", "refund", PaymentReasonProrated, renewals[1].ID)
+	if err != nil {
+		t.Fatalf("创建按比例退款记录失败: %v", err)
+	}
+
+	handler := NewSubscriptionHandler(service)
+	url := fmt.Sprintf("/api/subscriptions/detail?subscription_id=%d&user_id=%d", subID, userID)
+
+	// 未指定 include 时不返回累计金额
+	rec := httptest.NewRecorder()
+	handler.HandleSubscriptionDetail(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	var detail SubscriptionDetail
+	if err := json.NewDecoder(rec.Body).Decode(&detail); err != nil {
+		t.Fatalf("解析订阅详情失败: %v", err)
+	}
+	if detail.ID != subID || detail.TotalPaid != nil {
+		t.Errorf("订阅详情错误: %+v", detail)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.HandleSubscriptionDetail(rec, httptest.NewRequest(http.MethodGet, url+"&include=total_paid", nil))
+	detail = SubscriptionDetail{}
+	if err := json.NewDecoder(rec.Body).Decode(&detail); err != nil {
+		t.Fatalf("解析订阅详情失败: %v", err)
+	}
+
+	want := SubscriptionPrice + 10 - 3
+	if detail.TotalPaid == nil || *detail.TotalPaid < want-0.001 || *detail.TotalPaid > want+0.001 {
+		t.Errorf("累计实付金额错误: 期望=%.2f, 实际=%v", want, detail.TotalPaid)
+	}
+
+	// 其他用户的订阅与不存在的订阅一样返回404
+	rec = httptest.NewRecorder()
+	handler.HandleSubscriptionDetail(rec, httptest.NewRequest(http.MethodGet,
+		fmt.Sprintf("/api/subscriptions/detail?subscription_id=%d&user_id=%d", subID, userID+1000000), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("查询其他用户的订阅状态码错误: 期望=%d, 实际=%d", http.StatusNotFound, rec.Code)
+	}
+}
+
+// 测试付款记录分页
+func TestUserPaymentsPaged(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "分页测试用户", "payments_paged_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 25; i++ {
+		_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, userID, 0, float64(i+1), base.Add(time.Duration(i)*time.Minute), "success", "renewal")
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+
+	handler := NewSubscriptionHandler(service)
+	get := func(query string) PaymentPage {
+		rec := httptest.NewRecorder()
+		handler.HandleUserPayments(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/payments?user_id=%d%s", userID, query), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("查询支付记录失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+		}
+		var page PaymentPage
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("解析分页响应失败: %v", err)
+		}
+		return page
+	}
+
+	// 默认每页20条，按时间倒序
+	page := get("")
+	if page.Total != 25 || len(page.Payments) != 20 || page.Limit != 20 {
+		t.Errorf("默认分页错误: total=%d, len=%d, limit=%d", page.Total, len(page.Payments), page.Limit)
+	}
+	if len(page.Payments) > 0 && page.Payments[0].Amount != 25 {
+		t.Errorf("第一条记录应为最新支付: 实际金额=%.2f", page.Payments[0].Amount)
+	}
+
+	page = get("&limit=10&offset=20")
+	if page.Total != 25 || len(page.Payments) != 5 || page.Payments[0].Amount != 5 {
+		t.Errorf("偏移分页错误: total=%d, len=%d", page.Total, len(page.Payments))
+	}
+
+	// limit 上限为100
+	if page = get("&limit=1000"); page.Limit != 100 {
+		t.Errorf("limit上限错误: 期望=100, 实际=%d", page.Limit)
+	}
+}
+
+// 测试套餐变更矩阵
+func TestPlanTransitions(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{
+		DatabaseDSN: testDSN,
+		PlanTransitions: PlanTransitions{
+			"basic":   {"premium"},
+			"premium": {"annual"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+
+	if err := checkPlanTransition(service.transitions, "basic", "premium"); err != nil {
+		t.Errorf("basic -> premium 应当允许: %v", err)
+	}
+	if err := checkPlanTransition(service.transitions, "premium", "basic"); !errors.Is(err, ErrTransitionNotAllowed) {
+		t.Errorf("premium -> basic 应当返回 ErrTransitionNotAllowed, 实际=%v", err)
+	}
+
+	// 未配置矩阵时不限制
+	if err := checkPlanTransition(nil, "premium", "basic"); err != nil {
+		t.Errorf("未配置矩阵时应当允许: %v", err)
+	}
+}
+
+// 测试周期中途升级套餐按剩余时长补差价，降级被拒绝
+func TestChangePlan(t *testing.T) {
+	// 差价计算：旧套餐剩余15/31个周期的价值抵扣新套餐15天的费用
+	basic := Plan{Name: "basic", Duration: PlanDuration{Months: 1}, Price: 30}
+	premium := Plan{Name: "premium", Duration: PlanDuration{Months: 1}, Price: 60}
+	end := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)
+	if charge := upgradeCharge(basic, premium, end, now); charge != 14.52 {
+		t.Errorf("升级差价错误: 期望=14.52, 实际=%.2f", charge)
+	}
+	if charge := upgradeCharge(premium, basic, end, now); charge >= 0 {
+		t.Errorf("降级差价应为负数, 实际=%.2f", charge)
+	}
+
+	service := createTestService(t)
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+
+	userID, err := service.CreateUser(context.Background(), "套餐变更测试用户", "change_plan_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(context.Background(), userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	sub := subs[0]
+
+	changePlan := func(plan string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(ChangePlanRequest{SubscriptionID: sub.ID, UserID: userID, Plan: plan})
+		rec := httptest.NewRecorder()
+		handler.HandleChangePlan(rec, httptest.NewRequest(http.MethodPost, "/api/subscriptions/change-plan", bytes.NewReader(body)))
+		return rec
+	}
+
+	if rec := changePlan("premium"); rec.Code != http.StatusOK {
+		t.Fatalf("升级套餐失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	updated, err := service.db.GetSubscriptionByID(context.Background(), sub.ID)
+	if err != nil {
+		t.Fatalf("获取订阅信息失败: %v", err)
+	}
+	if updated.Plan != "premium" || !updated.EndDate.Equal(sub.EndDate) {
+		t.Errorf("升级后订阅错误: 套餐=%s, 到期=%v(期望%v)", updated.Plan, updated.EndDate, sub.EndDate)
+	}
+
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	var upgrade *Payment
+	for i := range payments {
+		if payments[i].Type == "upgrade" {
+			upgrade = &payments[i]
+		}
+	}
+	// 刚激活时剩余整个周期，差价约为两个套餐的价格差
+	if upgrade == nil || math.Abs(upgrade.Amount-(49.99-29.99)) > 0.05 || upgrade.Reason != PaymentReasonProrated {
+		t.Errorf("升级支付记录错误: %+v", upgrade)
+	}
+
+	// 周期中途降级被拒绝
+	if rec := changePlan("basic"); rec.Code != http.StatusBadRequest {
+		t.Errorf("降级状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+	if err := service.ChangePlan(context.Background(), userID, sub.ID, "basic"); !errors.Is(err, ErrDowngradeMidCycle) {
+		t.Errorf("降级应返回 ErrDowngradeMidCycle, 实际=%v", err)
+	}
+
+	// 其他用户的订阅与不存在的订阅一样返回404
+	body, _ := json.Marshal(ChangePlanRequest{SubscriptionID: sub.ID, UserID: userID + 1000000, Plan: "premium"})
+	rec := httptest.NewRecorder()
+	handler.HandleChangePlan(rec, httptest.NewRequest(http.MethodPost, "/api/subscriptions/change-plan", bytes.NewReader(body)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("变更其他用户的订阅状态码错误: 期望=%d, 实际=%d", http.StatusNotFound, rec.Code)
+	}
+
+	// charge 方式续约的周期尚未支付，只对当前周期补差价，续约的周期开始时按新套餐的价格扣款
+	ctx := context.Background()
+	if err := service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCycleCharge}); err != nil {
+		t.Fatalf("更新设置失败: %v", err)
+	}
+	defer service.settings.Update(ctx, map[string]string{SettingRenewedCycle: RenewedCyclePrepaid})
+	renewedUser, err := service.CreateUser(ctx, "续约后变更套餐测试用户", "change_plan_renewed_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, renewedUser, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err = service.db.GetUserSubscriptions(ctx, renewedUser)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	if _, err := service.RenewSubscription(ctx, RenewalRequest{SubscriptionID: subs[0].ID, UserID: renewedUser}); err != nil {
+		t.Fatalf("续订失败: %v", err)
+	}
+	options, err := service.GetEligiblePlanChanges(ctx, renewedUser)
+	if err != nil || len(options) == 0 {
+		t.Fatalf("查询可变更套餐失败: %v, %+v", err, options)
+	}
+	if err := service.ChangePlan(ctx, renewedUser, subs[0].ID, "premium"); err != nil {
+		t.Fatalf("续约后升级套餐失败: %v", err)
+	}
+	payments, err = service.db.GetUserPayments(renewedUser)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	upgrade = nil
+	for i := range payments {
+		if payments[i].Type == "upgrade" {
+			upgrade = &payments[i]
+		}
+	}
+	if upgrade == nil || math.Abs(upgrade.Amount-(49.99-29.99)) > 0.05 {
+		t.Errorf("charge 方式续约后只应对当前周期补差价: %+v", upgrade)
+	}
+	for _, option := range options {
+		if option.Plan == "premium" && upgrade != nil && math.Abs(option.Charge-upgrade.Amount) > 0.01 {
+			t.Errorf("差价预览与实际不一致: 预览=%.2f, 实际=%.2f", option.Charge, upgrade.Amount)
+		}
+	}
+}
+
+// 测试可变更套餐只包含转换矩阵允许且周期中途可以升级的套餐
+func TestEligiblePlanChanges(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{
+		DatabaseDSN: testDSN,
+		PlanTransitions: PlanTransitions{
+			"basic":   {"premium", "quarterly"},
+			"premium": {"annual"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+	handler := NewSubscriptionHandler(service)
+	ctx := context.Background()
+
+	get := func(userID int64) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.HandleEligiblePlans(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/subscriptions/eligible-plans?user_id=%d", userID), nil))
+		return rec
+	}
+
+	userID, err := service.CreateUser(ctx, "可变更套餐测试用户", "eligible_plans_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+
+	// 没有生效中的订阅
+	if rec := get(userID); rec.Code != http.StatusConflict {
+		t.Errorf("没有订阅时状态码错误: 期望=%d, 实际=%d", http.StatusConflict, rec.Code)
+	}
+
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+
+	// annual 不在矩阵中；quarterly 按天计费低于 basic，周期中途不能变更
+	rec := get(userID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("查询可变更套餐失败: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+	var options []PlanOption
+	if err := json.Unmarshal(rec.Body.Bytes(), &options); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if len(options) != 1 || options[0].Plan != "premium" {
+		t.Fatalf("可变更套餐错误: %+v", options)
+	}
+	option := options[0]
+	if option.Price != 49.99 || option.Duration != (PlanDuration{Months: 1}) || !slices.Contains(option.Features, "premium_content") {
+		t.Errorf("套餐信息错误: %+v", option)
+	}
+	// 刚激活时剩余整个周期，差价约为两个套餐的价格差
+	if math.Abs(option.Charge-(49.99-29.99)) > 0.05 {
+		t.Errorf("差价预览错误: %.2f", option.Charge)
+	}
+
+	// 预览的差价与实际变更收取的一致
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	if err := service.ChangePlan(ctx, userID, subs[0].ID, "premium"); err != nil {
+		t.Fatalf("变更套餐失败: %v", err)
+	}
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	for _, payment := range payments {
+		if payment.Type == "upgrade" && math.Abs(payment.Amount-option.Charge) > 0.01 {
+			t.Errorf("实际差价与预览不一致: 预览=%.2f, 实际=%.2f", option.Charge, payment.Amount)
+		}
+	}
+
+	// premium 只能变更到 annual，而 annual 按天计费更低
+	options, err = service.GetEligiblePlanChanges(ctx, userID)
+	if err != nil {
+		t.Fatalf("查询可变更套餐失败: %v", err)
+	}
+	if len(options) != 0 {
+		t.Errorf("premium 不应有可变更的套餐: %+v", options)
+	}
+
+	if rec := get(userID + 1000000); rec.Code != http.StatusNotFound {
+		t.Errorf("用户不存在时状态码错误: 期望=%d, 实际=%d", http.StatusNotFound, rec.Code)
+	}
+}
+
+// recordingSender 记录发送的邮件，可模拟发送失败
+type recordingSender struct {
+	mu   sync.Mutex
+	err  error
+	sent []string // 收件人列表
+}
+
+func (r *recordingSender) Send(to, subject, body string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.sent = append(r.sent, to)
+	return nil
+}
+
+// 测试通知通过邮件发送，并按发送结果记录状态
+func TestNotificationEmailDelivery(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	sender := &recordingSender{}
+	notificationSvc.sender = sender
+
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+	user, err := db.GetUserByID(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("获取用户信息失败: %v", err)
+	}
+
+	if err := notificationSvc.SendRenewalConfirmation(userID, subscriptionID); err != nil {
+		t.Fatalf("发送续约确认通知失败: %v", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0] != user.Email {
+		t.Errorf("邮件收件人错误: 期望=%s, 实际=%v", user.Email, sender.sent)
+	}
+	if notification := getLatestNotification(t, db, userID, "renewal_confirmation"); notification == nil || notification.Status != "sent" {
+		t.Errorf("发送成功的通知状态应为sent: %+v", notification)
+	}
+
+	// 邮件发送失败时记录为failed并返回 ErrDeliveryFailed
+	sender.err = fmt.Errorf("smtp: connection refused")
+	err = notificationSvc.SendCancelConfirmation(userID, subscriptionID)
+	if !errors.Is(err, ErrDeliveryFailed) {
+		t.Fatalf("发送失败应返回 ErrDeliveryFailed, 实际=%v", err)
+	}
+	if notification := getLatestNotification(t, db, userID, "cancel_confirmation"); notification == nil || notification.Status != "failed" {
+		t.Errorf("发送失败的通知状态应为failed: %+v", notification)
+	}
+}
+
+// 记录短信投递的测试渠道
+type recordingChannel struct {
+	delivered []int64 // 收到通知的用户ID
+}
+
+func (c *recordingChannel) Deliver(user *User, subject, body string) error {
+	c.delivered = append(c.delivered, user.ID)
+	return nil
+}
+
+// 测试邮件发送失败时回退到短信渠道，并记录最终送达的渠道
+func TestNotificationChannelFallback(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	notificationSvc.sender = &recordingSender{err: fmt.Errorf("smtp: connection refused")}
+	sms := &recordingChannel{}
+	notificationSvc.RegisterChannel(ChannelSMS, sms)
+	notificationSvc.channelOrder["renewal_confirmation"] = []string{ChannelEmail, ChannelSMS}
+
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+
+	if err := notificationSvc.SendRenewalConfirmation(userID, subscriptionID); err != nil {
+		t.Fatalf("短信回退发送应成功: %v", err)
+	}
+	if len(sms.delivered) != 1 || sms.delivered[0] != userID {
+		t.Errorf("短信渠道收件人错误: 期望=%d, 实际=%v", userID, sms.delivered)
+	}
+
+	notifications := getNotifications(t, db, subscriptionID, "renewal_confirmation")
+	if len(notifications) != 1 {
+		t.Fatalf("应记录1条续约确认通知, 实际=%d", len(notifications))
+	}
+	if notifications[0].Status != "sent" || notifications[0].Channel != ChannelSMS {
+		t.Errorf("通知应通过短信送达: 状态=%s, 渠道=%s", notifications[0].Status, notifications[0].Channel)
+	}
+
+	// 未配置回退顺序的通知类型仍只发邮件，失败即记录为failed
+	err := notificationSvc.SendCancelConfirmation(userID, subscriptionID)
+	if !errors.Is(err, ErrDeliveryFailed) {
+		t.Fatalf("发送失败应返回 ErrDeliveryFailed, 实际=%v", err)
+	}
+	if len(sms.delivered) != 1 {
+		t.Errorf("未配置回退的通知不应通过短信发送: %v", sms.delivered)
+	}
+	cancelled := getNotifications(t, db, subscriptionID, "cancel_confirmation")
+	if len(cancelled) != 1 || cancelled[0].Status != "failed" || cancelled[0].Channel != "" {
+		t.Errorf("发送失败的通知应为failed且无渠道: %+v", cancelled)
+	}
+}
+
+// 测试失败通知在一小时后重试，最多重试3次
+func TestRetryFailedNotifications(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	clock := newVirtualClock(time.Now())
+	notificationSvc.clock = clock
+	sender := &recordingSender{err: fmt.Errorf("smtp: connection refused")}
+	notificationSvc.sender = sender
+
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+
+	if err := notificationSvc.SendRenewalConfirmation(userID, subscriptionID); !errors.Is(err, ErrDeliveryFailed) {
+		t.Fatalf("发送应当失败, 实际=%v", err)
+	}
+
+	// 不足一小时不重试
+	clock.Advance(30 * time.Minute)
+	if _, err := notificationSvc.RetryFailedNotifications(); err != nil {
+		t.Fatalf("重试失败通知出错: %v", err)
+	}
+	notices := getNotifications(t, db, subscriptionID, "renewal_confirmation")
+	if len(notices) != 1 || notices[0].RetryCount != 0 {
+		t.Fatalf("不足一小时不应重试: %+v", notices)
+	}
+
+	// 持续失败时每小时重试一次，最多3次
+	for i := 0; i < 5; i++ {
+		clock.Advance(61 * time.Minute)
+		if _, err := notificationSvc.RetryFailedNotifications(); err != nil {
+			t.Fatalf("重试失败通知出错: %v", err)
+		}
+	}
+	notices = getNotifications(t, db, subscriptionID, "renewal_confirmation")
+	if len(notices) != 1 || notices[0].Status != "failed" || notices[0].RetryCount != maxNotificationRetries {
+		t.Fatalf("重试次数应达到上限: %+v", notices)
+	}
+
+	// 邮件服务恢复后，新的失败通知重试成功
+	if err := notificationSvc.SendCancelConfirmation(userID, subscriptionID); !errors.Is(err, ErrDeliveryFailed) {
+		t.Fatalf("发送应当失败, 实际=%v", err)
+	}
+	sender.mu.Lock()
+	sender.err = nil
+	sender.mu.Unlock()
+
+	clock.Advance(61 * time.Minute)
+	if _, err := notificationSvc.RetryFailedNotifications(); err != nil {
+		t.Fatalf("重试失败通知出错: %v", err)
+	}
+	notices = getNotifications(t, db, subscriptionID, "cancel_confirmation")
+	if len(notices) != 1 || notices[0].Status != "sent" || notices[0].RetryCount != 1 {
+		t.Errorf("重试成功后状态错误: %+v", notices)
+	}
+}
+
+// 测试每个用户每天的通知数上限：超出的推迟到次日发送，交易类通知不受限制
+func TestNotificationDailyLimit(t *testing.T) {
+	notificationSvc, db := createTestNotificationService(t)
+	defer db.Close()
+
+	clock := newVirtualClock(time.Date(2031, 3, 10, 10, 0, 0, 0, time.UTC))
+	notificationSvc.clock = clock
+	notificationSvc.dailyLimit = 2
+	sender := &recordingSender{}
+	notificationSvc.sender = sender
+
+	userID, subscriptionID := createTestUserAndSubscription(t, db)
+
+	if result, err := notificationSvc.SendExpirationNotice(userID, subscriptionID); err != nil || result != NoticeSent {
+		t.Fatalf("第1条通知应直接发送: result=%s, err=%v", result, err)
+	}
+	if err := notificationSvc.SendSubscriptionEndedNotice(userID, subscriptionID); err != nil {
+		t.Fatalf("发送第2条通知失败: %v", err)
+	}
+	if err := notificationSvc.SendTrialEndedNotice(userID, subscriptionID); err != nil {
+		t.Fatalf("发送第3条通知失败: %v", err)
+	}
+	clock.Advance(time.Minute)
+	if result, err := notificationSvc.SendExpirationNotice(userID, subscriptionID); err != nil || result != NoticeDeduplicated {
+		t.Fatalf("推迟的到期通知应计入去重: result=%s, err=%v", result, err)
+	}
+
+	// 交易类通知不受上限限制
+	if err := notificationSvc.SendRenewalConfirmation(userID, subscriptionID); err != nil {
+		t.Fatalf("发送续约确认失败: %v", err)
+	}
+	if len(sender.sent) != 3 {
+		t.Fatalf("当天应只发送3封邮件（2条普通通知+1条交易类通知），实际=%d", len(sender.sent))
+	}
+
+	nextDay := time.Date(2031, 3, 11, 0, 0, 0, 0, time.UTC)
+	deferred := getNotifications(t, db, subscriptionID, "trial_ended")
+	if len(deferred) != 1 || deferred[0].Status != "deferred" || !deferred[0].SentAt.Equal(nextDay) {
+		t.Fatalf("超出上限的通知应推迟到次日: %+v", deferred)
+	}
+
+	// 未到计划时间不发送
+	if sent, err := notificationSvc.SendDeferredNotifications(); err != nil || sent != 0 {
+		t.Fatalf("当天不应发送推迟通知: sent=%d, err=%v", sent, err)
+	}
+
+	clock.Set(nextDay.Add(30 * time.Minute))
+	if sent, err := notificationSvc.SendDeferredNotifications(); err != nil || sent != 1 {
+		t.Fatalf("次日应发送推迟通知: sent=%d, err=%v", sent, err)
+	}
+	deferred = getNotifications(t, db, subscriptionID, "trial_ended")
+	if len(deferred) != 1 || deferred[0].Status != "sent" || deferred[0].RetryCount != 0 {
+		t.Errorf("推迟通知发送后状态错误: %+v", deferred)
+	}
+	if len(sender.sent) != 4 {
+		t.Errorf("推迟通知应在次日发出，实际邮件数=%d", len(sender.sent))
+	}
+}
+
+// 测试并发的缓存刷新合并为一轮统计查询，已经开始查询的一轮不被写入之后的刷新共享
+func TestConcurrentRefreshDeduplicated(t *testing.T) {
+	cache := &SubscriptionCache{
+		updateInterval: time.Hour,
+		stopChan:       make(chan struct{}),
+	}
+
+	// 模拟耗时的统计查询：查询开始时读取当前用户数，然后阻塞直到测试放行
+	var queries atomic.Int32
+	var users atomic.Int64
+	users.Store(1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache.loadStats = func() (SystemStats, error) {
+		count := users.Load()
+		if queries.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return SystemStats{TotalUsers: int(count)}, nil
+	}
+
+	// 第一轮刷新开始查询后发生写入，之后的刷新不能共享第一轮读到的旧数据
+	first := cache.startRefresh()
+	<-started
+	users.Store(2)
+
+	const refreshes = 20
+	results := make([]<-chan singleflight.Result, refreshes)
+	for i := range results {
+		results[i] = cache.startRefresh()
+	}
+	close(release)
+
+	if result := <-first; result.Err != nil {
+		t.Fatalf("刷新缓存失败: %v", result.Err)
+	}
+	for _, ch := range results {
+		if result := <-ch; result.Err != nil {
+			t.Fatalf("刷新缓存失败: %v", result.Err)
+		}
+	}
+
+	// 第一轮进行期间到达的刷新合并为一轮新的查询
+	if got := queries.Load(); got != 2 {
+		t.Errorf("并发刷新应合并为两轮查询, 实际查询 %d 次", got)
+	}
+	if stats := cache.GetStats(); stats.TotalUsers != 2 {
+		t.Errorf("写入后的刷新应读到新数据: 期望用户数=2, 实际=%d", stats.TotalUsers)
+	}
+
+	// 上一轮刷新结束后再次刷新会重新查询
+	if err := cache.refreshCache(); err != nil {
+		t.Fatalf("刷新缓存失败: %v", err)
+	}
+	if got := queries.Load(); got != 3 {
+		t.Errorf("刷新结束后应重新查询, 实际查询 %d 次", got)
+	}
+}
+
+// 测试并发查询的统计结果与逐项查询一致，任一查询失败时刷新返回错误
+func TestQueryStatsConcurrent(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	stats, err := service.cache.queryStats()
+	if err != nil {
+		t.Fatalf("查询统计数据失败: %v", err)
+	}
+
+	users, _ := service.db.GetTotalUserCount()
+	active, _ := service.db.GetActiveSubscriptionsCount()
+	byPlan, _ := service.db.GetActiveSubscriptionsByPlan()
+	failed, _ := service.db.GetFailedPaymentsCount()
+	if stats.TotalUsers != users || stats.ActiveSubscriptions != active || stats.FailedPayments != failed {
+		t.Errorf("统计结果与逐项查询不一致: %+v", stats)
+	}
+	if len(stats.ActiveByPlan) != len(byPlan) {
+		t.Errorf("套餐活跃订阅数不一致: 期望=%v, 实际=%v", byPlan, stats.ActiveByPlan)
+	}
+
+	// 数据库连接关闭后所有查询都失败
+	db, err := NewDatabaseService(testDSN, 0, DBPoolConfig{})
+	if err != nil {
+		t.Fatalf("创建数据库服务失败: %v", err)
+	}
+	db.Close()
+	cache := &SubscriptionCache{db: db, stopChan: make(chan struct{})}
+	cache.loadStats = cache.queryStats
+	if err := cache.refreshCache(); err == nil {
+		t.Error("查询失败时刷新应返回错误")
+	}
+	if got := cache.GetStats(); !got.LastUpdated.IsZero() {
+		t.Errorf("刷新失败时不应替换快照: %+v", got)
+	}
+}
+
+// 测试刷新缓存时同步更新监控指标，以及处理器请求指标
+func TestMetricsUpdatedOnRefresh(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	service.cache.loadStats = func() (SystemStats, error) {
+		return SystemStats{TotalUsers: 42, ActiveSubscriptions: 7, TotalPaymentAmount: 123.45}, nil
+	}
+	if err := service.cache.refreshCache(); err != nil {
+		t.Fatalf("刷新缓存失败: %v", err)
+	}
+
+	if got := testutil.ToFloat64(metricTotalUsers); got != 42 {
+		t.Errorf("用户总数指标错误: 期望=42, 实际=%v", got)
+	}
+	if got := testutil.ToFloat64(metricActiveSubscriptions); got != 7 {
+		t.Errorf("活跃订阅指标错误: 期望=7, 实际=%v", got)
+	}
+
+	handler := instrumentHandler("/test", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad", http.StatusBadRequest)
+	})
+	before := testutil.ToFloat64(metricHTTPRequests.WithLabelValues("/test", "400"))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+	if got := testutil.ToFloat64(metricHTTPRequests.WithLabelValues("/test", "400")); got != before+1 {
+		t.Errorf("请求计数指标错误: 期望=%v, 实际=%v", before+1, got)
+	}
+}
+
+// 测试响应编码失败时返回完整的500且不输出部分内容
+func TestWriteJSONEncodeFailure(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeJSON(rec, http.StatusOK, map[string]interface{}{
+		"ok":  "部分内容",
+		"bad": make(chan int), // 无法编码
+	})
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("状态码错误: 期望=%d, 实际=%d", http.StatusInternalServerError, rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "部分内容") || strings.HasPrefix(rec.Body.String(), "{") {
+		t.Errorf("响应包含部分编码内容: %q", rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); strings.Contains(ct, "application/json") {
+		t.Errorf("编码失败时不应声明JSON内容类型: %s", ct)
+	}
+}
+
+// 测试数据库不可用时健康检查返回503，并记录状态切换
+func TestHealthCheckDatabaseDown(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	dbErr := fmt.Errorf("dial tcp 127.0.0.1:3306: connection refused")
+	down := func(ctx context.Context) error { return dbErr }
+	service.health.dependencies[0].Check = down
+	service.health.dbCheck = down
+
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("数据库不可用时状态码错误: 期望=%d, 实际=%d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	// 第一次探测发生切换，之后保持不变，恢复时再次切换
+	if !service.health.observeDatabase() {
+		t.Error("数据库不可用时应记录状态切换")
+	}
+	if service.health.observeDatabase() {
+		t.Error("状态未变化时不应重复记录")
+	}
+
+	service.health.dbCheck = service.db.HealthCheck
+	if !service.health.observeDatabase() {
+		t.Error("数据库恢复时应记录状态切换")
+	}
+}
+
+// 测试首次使用时连接失效，重试一次后恢复；其他错误不重试
+func TestBadConnRetry(t *testing.T) {
+	calls := 0
+	err := withBadConnRetry(func() error {
+		calls++
+		if calls == 1 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("连接失效后应重试成功: 错误=%v, 调用次数=%d", err, calls)
+	}
+
+	calls = 0
+	err = withBadConnRetry(func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+	if !errors.Is(err, driver.ErrBadConn) || calls != 2 {
+		t.Errorf("最多重试一次: 错误=%v, 调用次数=%d", err, calls)
+	}
+
+	calls = 0
+	syntaxErr := errors.New("Error 1064: syntax error")
+	err = withBadConnRetry(func() error {
+		calls++
+		return syntaxErr
+	})
+	if err != syntaxErr || calls != 1 {
+		t.Errorf("非连接错误不应重试: 错误=%v, 调用次数=%d", err, calls)
+	}
+}
+
+// fakeConnDriver 模拟数据库驱动：前 failures 次执行语句返回 driver.ErrBadConn，并记录每个连接被探测的次数
+type fakeConnDriver struct {
+	mu       sync.Mutex
+	failures int
+	execs    int
+	opened   int
+	pings    map[int]int
+}
+
+func (d *fakeConnDriver) Open(name string) (driver.Conn, error) {
+	return d.Connect(context.Background())
+}
+
+func (d *fakeConnDriver) Connect(ctx context.Context) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.opened++
+	return &fakeConn{driver: d, id: d.opened}, nil
+}
+
+func (d *fakeConnDriver) Driver() driver.Driver {
+	return d
+}
+
+type fakeConn struct {
+	driver *fakeConnDriver
+	id     int
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("不支持预处理语句")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("不支持事务")
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.execs++
+	if c.driver.execs <= c.driver.failures {
+		return nil, driver.ErrBadConn
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.pings[c.id]++
+	return nil
+}
+
+// 测试经由连接池执行语句时连接失效：连接池自身的重试用完后由 retryDB 再重试一次并恢复
+func TestBadConnRetryThroughPool(t *testing.T) {
+	// 连接池对 ErrBadConn 最多尝试3次，前3次都失败时只有 retryDB 的重试能恢复
+	fake := &fakeConnDriver{failures: 3, pings: make(map[int]int)}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+	service := &DatabaseService{db: retryDB{DB: db}}
+
+	result, err := service.db.ExecContext(context.Background(), "UPDATE users SET name = ?", "重试")
+	if err != nil {
+		t.Fatalf("连接失效后应重试成功: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 || fake.execs != 4 {
+		t.Errorf("重试结果错误: 影响行数=%d, 执行次数=%d", affected, fake.execs)
+	}
+}
+
+// 测试保活探测到每一个空闲连接，而不是反复探测最近归还的同一个连接
+func TestPingIdleConns(t *testing.T) {
+	fake := &fakeConnDriver{pings: make(map[int]int)}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+	db.SetMaxIdleConns(3)
+	service := &DatabaseService{db: retryDB{DB: db}}
+
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatalf("获取连接失败: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	service.pingIdleConns()
+	if len(fake.pings) != 3 {
+		t.Errorf("应探测全部3个空闲连接: %v", fake.pings)
+	}
+	for id, count := range fake.pings {
+		if count != 1 {
+			t.Errorf("连接 %d 探测次数错误: 期望=1, 实际=%d", id, count)
+		}
+	}
+	if idle := db.Stats().Idle; idle != 3 {
+		t.Errorf("探测后连接应归还连接池: 空闲连接数=%d", idle)
+	}
+}
+
+// 测试预测下月续订收入
+func TestProjectedRevenue(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用远期月份，避免与其他测试数据重叠
+	month := time.Date(2031, 5, 1, 0, 0, 0, 0, time.UTC)
+	type payment struct {
+		amount      float64
+		paymentType string
+	}
+	seeds := []struct {
+		plan       string
+		status     string
+		preference string
+		endDate    time.Time
+		payments   []payment
+	}{
+		// 按最近一次续订金额计入
+		{"basic", StatusSubscribed, "yes", month.AddDate(0, 0, 9), []payment{{29.99, "initial"}, {24.99, "renewal"}}},
+		// 没有支付记录时按套餐的目录价格计入
+		{"premium", StatusRenewed, "undecided", month.AddDate(0, 0, 19), nil},
+		// 套餐不在目录中时按后备价格计入
+		{"legacy", StatusSubscribed, "yes", month.AddDate(0, 0, 21), nil},
+		// 退款不影响预测金额
+		{"basic", StatusSubscribed, "yes", month.AddDate(0, 0, 25), []payment{{19.99, "initial"}, {-19.99, "refund"}}},
+		// 以下不计入：拒绝续订、到期日在下个月、已不在订阅中
+		{"basic", StatusSubscribed, "no", month.AddDate(0, 0, 5), nil},
+		{"basic", StatusSubscribed, "yes", month.AddDate(0, 1, 0), nil},
+		{"basic", StatusInactive, "yes", month.AddDate(0, 0, 5), nil},
+	}
+	for i, seed := range seeds {
+		res, err := service.db.db.Exec(`INSERT INTO subscriptions (user_id, plan, start_date, end_date, status, renewal_preference)
+                  VALUES (?, ?, ?, ?, ?, ?)`, 7000+i, seed.plan, seed.endDate.AddDate(0, -1, 0), seed.endDate, seed.status, seed.preference)
+		if err != nil {
+			t.Fatalf("创建订阅失败: %v", err)
+		}
+		subID, _ := res.LastInsertId()
+		for j, p := range seed.payments {
+			_, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                      VALUES (?, ?, ?, ?, ?, ?)`, 7000+i, subID, p.amount, seed.endDate.AddDate(0, -1, j), "success", p.paymentType)
+			if err != nil {
+				t.Fatalf("创建支付记录失败: %v", err)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleProjectedRevenue(rec,
+		httptest.NewRequest(http.MethodGet, "/api/admin/projected-revenue?month=2031-05", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var response struct {
+		Month            string  `json:"month"`
+		ProjectedRevenue float64 `json:"projected_revenue"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	expected := 24.99 + service.plans["premium"].Price + service.settings.Float(SettingFallbackPlanPrice) + 19.99
+	if response.Month != "2031-05" || !sameAmount(response.ProjectedRevenue, expected) {
+		t.Errorf("预测收入错误: 期望=%.2f, 实际=%.2f (月份=%s)", expected, response.ProjectedRevenue, response.Month)
+	}
+
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleProjectedRevenue(rec,
+		httptest.NewRequest(http.MethodGet, "/api/admin/projected-revenue?month=2031-5-1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("month格式错误时状态码错误: 期望=%d, 实际=%d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+// 测试按筛选条件导出订阅CSV
+func TestExportSubscriptionsCSV(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	startDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := startDate.AddDate(0, 1, 0)
+	var ids []int64
+	for _, status := range []string{StatusSubscribed, StatusUnsubscribed} {
+		res, err := service.db.db.Exec(`INSERT INTO subscriptions (user_id, plan, start_date, end_date, status, renewal_preference)
+                  VALUES (?, ?, ?, ?, ?, ?)`, 42, "export_plan", startDate, endDate, status, "yes")
+		if err != nil {
+			t.Fatalf("创建订阅失败: %v", err)
+		}
+		id, _ := res.LastInsertId()
+		ids = append(ids, id)
+	}
+
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleExportSubscriptions(rec,
+		httptest.NewRequest(http.MethodGet, "/api/admin/subscriptions/export?status=subscribed&plan=export_plan", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Content-Type错误: %s", ct)
+	}
+
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("CSV行数错误: 期望=2, 实际=%d\n%s", len(lines), rec.Body.String())
+	}
+	if lines[0] != "id,user_id,plan,start_date,end_date,status,renewal_preference" {
+		t.Errorf("CSV表头错误: %s", lines[0])
+	}
+	expected := fmt.Sprintf("%d,42,export_plan,2024-01-01T00:00:00Z,2024-02-01T00:00:00Z,subscribed,yes", ids[0])
+	if lines[1] != expected {
+		t.Errorf("CSV数据行错误: 期望=%s, 实际=%s", expected, lines[1])
+	}
+
+	// 没有匹配的订阅时只输出表头
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleExportSubscriptions(rec,
+		httptest.NewRequest(http.MethodGet, "/api/admin/subscriptions/export?plan=no_such_plan", nil))
+	if body := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || strings.Contains(body, "\n") {
+		t.Errorf("无匹配订阅时应只有表头: 状态码=%d, 响应=%s", rec.Code, body)
+	}
+}
+
+// 测试按时间段导出成功支付CSV
+func TestExportPaymentsCSV(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	// 使用过去的固定时间段，避免与其他测试数据重叠
+	rangeStart := time.Date(2003, 7, 1, 0, 0, 0, 0, time.UTC)
+	rangeEnd := time.Date(2003, 7, 31, 23, 59, 59, 0, time.UTC)
+	pay := func(amount float64, at time.Time, status, paymentType string) int64 {
+		res, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, 77, 88, amount, at, status, paymentType)
+		if err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+		id, _ := res.LastInsertId()
+		return id
+	}
+
+	first := pay(9.99, rangeStart.AddDate(0, 0, 2), "success", "initial")
+	second := pay(19.99, rangeStart.AddDate(0, 0, 20), "success", "renewal")
+	pay(9.99, rangeStart.AddDate(0, 0, 5), "failed", "renewal")
+	pay(9.99, rangeEnd.Add(time.Hour), "success", "renewal")
+
+	target := "/api/admin/payments/export?start=" + rangeStart.Format(time.RFC3339) + "&end=" + rangeEnd.Format(time.RFC3339)
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleExportPayments(rec, httptest.NewRequest(http.MethodGet, target, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="payments_20030701_20030731.csv"` {
+		t.Errorf("Content-Disposition错误: %s", cd)
+	}
+
+	expected := []string{
+		"payment_id,user_id,subscription_id,amount,payment_date,type",
+		fmt.Sprintf("%d,77,88,9.99,2003-07-03T00:00:00Z,initial", first),
+		fmt.Sprintf("%d,77,88,19.99,2003-07-21T00:00:00Z,renewal", second),
+	}
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); !slices.Equal(lines, expected) {
+		t.Errorf("CSV内容错误:\n期望=%v\n实际=%v", expected, lines)
+	}
+
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleExportPayments(rec, httptest.NewRequest(http.MethodGet, "/api/admin/payments/export?start=2003-07-01", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("时间格式错误应返回400: %d", rec.Code)
+	}
+}
+
+// 测试分析数据导出：按日期和维度聚合，不包含用户的姓名、邮箱或ID
+func TestAnalyticsExport(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+
+	name, email := "分析导出测试用户", "analytics_pii_test@example.com"
+	userID, err := service.CreateUser(ctx, name, email)
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	subID := subs[0].ID
+	if _, err := service.db.db.Exec(`UPDATE subscriptions SET plan = 'premium' WHERE id = ?`, subID); err != nil {
+		t.Fatalf("更新订阅套餐失败: %v", err)
+	}
+
+	// 使用过去的固定时间段，避免与其他测试数据重叠
+	rangeStart := time.Date(2007, 3, 1, 0, 0, 0, 0, time.UTC)
+	rangeEnd := time.Date(2007, 3, 31, 23, 59, 59, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2007, 3, d, 10, 0, 0, 0, time.UTC) }
+	pay := func(amount float64, at time.Time, status, paymentType string) {
+		if _, err := service.db.db.Exec(`INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type)
+                  VALUES (?, ?, ?, ?, ?, ?)`, userID, subID, amount, at, status, paymentType); err != nil {
+			t.Fatalf("创建支付记录失败: %v", err)
+		}
+	}
+	event := func(eventType string, at time.Time) {
+		if err := service.db.CreateSubscriptionEvent(ctx, &SubscriptionEvent{
+			SubscriptionID: subID, UserID: userID, EventType: eventType, Detail: email, CreatedAt: at,
+		}); err != nil {
+			t.Fatalf("创建订阅事件失败: %v", err)
+		}
+	}
+
+	event(EventTrialStart, day(2))
+	pay(29.99, day(5), "success", "initial")
+	pay(29.99, day(9), "success", "renewal")
+	pay(29.99, day(9), "success", "renewal")
+	pay(29.99, day(9), "failed", "renewal")
+	event(EventCancellation, day(20))
+	pay(29.99, rangeEnd.Add(time.Hour), "success", "renewal")
 
-	// 发送通知
-	err := notificationSvc.SendExpirationNotice(userID, subscriptionID)
+	target := "/api/admin/analytics-export?start=" + rangeStart.Format(time.RFC3339) + "&end=" + rangeEnd.Format(time.RFC3339)
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleAnalyticsExport(rec, httptest.NewRequest(http.MethodGet, target, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("状态码错误: 期望=%d, 实际=%d, 响应=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type错误: %s", ct)
+	}
+
+	body := rec.Body.String()
+	for _, pii := range []string{name, email, "user_id", "subscription_id"} {
+		if strings.Contains(body, pii) {
+			t.Errorf("导出数据不应包含 %q:\n%s", pii, body)
+		}
+	}
+
+	var records []AnalyticsRecord
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		var record AnalyticsRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("解析导出行失败: %v, 行=%s", err, line)
+		}
+		records = append(records, record)
+	}
+
+	expected := []AnalyticsRecord{
+		{Date: "2007-03-02", Category: AnalyticsSubscriptions, Event: EventTrialStart, Plan: "premium", Count: 1},
+		{Date: "2007-03-05", Category: AnalyticsSubscriptions, Event: EventActivation, Plan: "premium", Count: 1},
+		{Date: "2007-03-05", Category: AnalyticsPayments, Event: "initial", Status: "success", Count: 1, Amount: 29.99},
+		{Date: "2007-03-09", Category: AnalyticsPayments, Event: "renewal", Status: "failed", Count: 1, Amount: 29.99},
+		{Date: "2007-03-09", Category: AnalyticsPayments, Event: "renewal", Status: "success", Count: 2, Amount: 59.98},
+		{Date: "2007-03-20", Category: AnalyticsChurn, Event: EventCancellation, Plan: "premium", Count: 1},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("导出行数错误: 期望=%d, 实际=%d\n%s", len(expected), len(records), body)
+	}
+	for i, want := range expected {
+		got := records[i]
+		got.Amount = math.Round(got.Amount*100) / 100
+		if got != want {
+			t.Errorf("第%d行错误:\n期望=%+v\n实际=%+v", i+1, want, got)
+		}
+	}
+
+	// 只导出指定类别
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleAnalyticsExport(rec, httptest.NewRequest(http.MethodGet, target+"&categories=churn", nil))
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); rec.Code != http.StatusOK || len(lines) != 1 {
+		t.Errorf("按类别导出错误: 状态码=%d, 响应=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleAnalyticsExport(rec, httptest.NewRequest(http.MethodGet, target+"&categories=users", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("未知类别应返回400: %d", rec.Code)
+	}
+}
+
+// 测试请求被取消后数据库调用立即返回，且不占用连接
+func TestCancelledRequestAbortsQuery(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	userID, err := service.CreateUser(context.Background(), "取消请求测试用户", "cancel_ctx_test@example.com")
 	if err != nil {
-		t.Fatalf("发送到期通知失败: %v", err)
+		t.Fatalf("创建测试用户失败: %v", err)
 	}
 
-	// 验证通知记录
-	notification := getLatestNotification(t, db, userID, "expiration_notice")
-	if notification == nil {
-		t.Fatal("未找到通知记录")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	begin := time.Now()
+	if _, err := service.GetUserPaymentHistory(ctx, userID, 20, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("已取消的请求应返回 context.Canceled, 实际=%v", err)
+	}
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("已取消的激活请求应返回 context.Canceled, 实际=%v", err)
+	}
+	if _, err := service.GetUser(ctx, userID); !errors.Is(err, context.Canceled) {
+		t.Errorf("已取消的用户查询应返回 context.Canceled, 实际=%v", err)
+	}
+	if _, err := service.GetEligiblePlanChanges(ctx, userID); !errors.Is(err, context.Canceled) {
+		t.Errorf("已取消的套餐查询应返回 context.Canceled, 实际=%v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("取消的请求未及时返回，耗时: %v", elapsed)
 	}
 
-	// 检查通知内容是否包含预期的关键信息
-	if notification.UserID != userID {
-		t.Errorf("通知用户ID不匹配: 期望=%d, 实际=%d", userID, notification.UserID)
+	if inUse := service.db.db.Stats().InUse; inUse != 0 {
+		t.Errorf("取消的请求不应占用连接, 实际占用=%d", inUse)
 	}
 
-	if notification.SubscriptionID != subscriptionID {
-		t.Errorf("通知订阅ID不匹配: 期望=%d, 实际=%d", subscriptionID, notification.SubscriptionID)
+	// 订阅未被激活
+	subs, err := service.db.GetUserSubscriptions(context.Background(), userID)
+	if err != nil || len(subs) != 1 || subs[0].Status != StatusInactive {
+		t.Errorf("取消的激活请求不应修改订阅: %v, %+v", err, subs)
 	}
 
-	if notification.Status != "sent" {
-		t.Errorf("通知状态错误: 期望=sent, 实际=%s", notification.Status)
+	// 通过HTTP处理器时使用请求上下文
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/subscriptions?user_id=%d", userID), nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	NewSubscriptionHandler(service).HandleUserSubscriptions(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("取消的请求状态码错误: 期望=%d, 实际=%d", http.StatusInternalServerError, rec.Code)
 	}
+}
 
-	if !strings.Contains(notification.Content, "到期") {
-		t.Errorf("通知内容未包含'到期'关键词: %s", notification.Content)
+// 测试连接的会话时区固定为UTC，服务器端时间函数与Go端写入的时间一致
+func TestNormalizeDSNSessionTimeZone(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	var zone string
+	if err := service.db.db.QueryRow(`SELECT @@session.time_zone`).Scan(&zone); err != nil {
+		t.Fatalf("查询会话时区失败: %v", err)
+	}
+	if zone != "+00:00" {
+		t.Errorf("会话时区应为UTC: %s", zone)
 	}
 }
 
-// 测试发送续约成功通知
-func TestSendRenewalConfirmation(t *testing.T) {
-	notificationSvc, db := createTestNotificationService(t)
-	defer db.Close()
+// 测试语句执行时间上限：慢查询在配置的时限附近被中止
+func TestStatementTimeout(t *testing.T) {
+	dsn, err := normalizeDSN(testDSN, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("处理DSN失败: %v", err)
+	}
+	if !strings.Contains(dsn, "max_execution_time=1500") {
+		t.Errorf("DSN未设置会话级 max_execution_time: %s", dsn)
+	}
 
-	userID, subscriptionID := createTestUserAndSubscription(t, db)
+	timeout := 300 * time.Millisecond
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: testDSN, DBStatementTimeout: timeout})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
 
-	// 发送通知
-	err := notificationSvc.SendRenewalConfirmation(userID, subscriptionID)
+	begin := time.Now()
+	var slept int
+	err = service.db.db.QueryRowContext(context.Background(), "SELECT SLEEP(3)").Scan(&slept)
+	elapsed := time.Since(begin)
+	if err == nil {
+		t.Fatalf("慢查询应被中止")
+	}
+	if elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("慢查询未在时限附近中止: 时限=%v, 耗时=%v", timeout, elapsed)
+	}
+
+	// 未超时的语句正常执行
+	if _, err := service.db.GetUserSubscriptions(context.Background(), 1); err != nil {
+		t.Errorf("未超时的查询失败: %v", err)
+	}
+
+	// 执行时间上限不影响结果返回之后的逐行读取
+	rows, err := service.db.db.QueryContext(context.Background(), "SELECT 1 UNION ALL SELECT 2")
 	if err != nil {
-		t.Fatalf("发送续约确认通知失败: %v", err)
+		t.Fatalf("查询失败: %v", err)
+	}
+	defer rows.Close()
+	var read int
+	for rows.Next() {
+		time.Sleep(timeout)
+		read++
 	}
+	if err := rows.Err(); err != nil || read != 2 {
+		t.Errorf("读取结果超过时限后被中断: 读取=%d, 错误=%v", read, err)
+	}
+}
 
-	// 验证通知记录
-	notification := getLatestNotification(t, db, userID, "renewal_confirmation")
-	if notification == nil {
-		t.Fatal("未找到通知记录")
+// 测试数据库迁移：已有的表缺少新增的列时在启动时补齐列和唯一索引，已迁移的表不再变更
+func TestMigrateSchema(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: "sqlite::memory:"})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
 	}
+	defer service.Close()
+	ctx := context.Background()
+	db := service.db.db.DB
 
-	// 检查通知内容是否包含预期的关键信息
-	if !strings.Contains(notification.Content, "成功续约") {
-		t.Errorf("通知内容未包含'成功续约'关键词: %s", notification.Content)
+	// 模拟新增列之前创建的数据库
+	for _, stmt := range []string{
+		`DROP INDEX idx_payments_refund_reference`,
+		`ALTER TABLE payments DROP COLUMN refund_reference`,
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("还原旧表结构失败: %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := migrateSchema(ctx, db, dialectSQLite); err != nil {
+			t.Fatalf("第 %d 次迁移失败: %v", i+1, err)
+		}
+	}
+	columns, err := tableColumns(ctx, db, dialectSQLite, "payments")
+	if err != nil || !columns["refund_reference"] {
+		t.Fatalf("迁移后应包含 refund_reference 列: %v, 错误=%v", columns, err)
+	}
+
+	insert := `INSERT INTO payments (user_id, subscription_id, amount, payment_date, status, type, refund_reference)
+              VALUES (1, 1, -9.99, CURRENT_TIMESTAMP, 'success', 'refund', 'migrated-ref')`
+	if _, err := db.ExecContext(ctx, insert); err != nil {
+		t.Fatalf("写入退款引用失败: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, insert); !isDuplicateEntry(err) {
+		t.Errorf("迁移后的退款引用应唯一, 实际: %v", err)
+	}
+
+	// MySQL 从 information_schema 读取已有的列
+	mysqlService := createTestService(t)
+	defer mysqlService.Close()
+	columns, err = tableColumns(ctx, mysqlService.db.db.DB, dialectMySQL, "payments")
+	if err != nil || !columns["refund_reference"] || !columns["original_payment_id"] {
+		t.Errorf("MySQL 表结构读取错误: %v, 错误=%v", columns, err)
 	}
 }
 
-// 测试发送取消续约确认通知
-func TestSendCancelConfirmation(t *testing.T) {
-	notificationSvc, db := createTestNotificationService(t)
-	defer db.Close()
+// 测试模式：SQLite 内存数据库上完成创建、激活、续订的核心流程，不依赖外部数据库
+func TestSQLiteBackendCoreFlow(t *testing.T) {
+	service, err := NewSubscriptionService(&Config{DatabaseDSN: "sqlite::memory:"})
+	if err != nil {
+		t.Fatalf("创建订阅服务失败: %v", err)
+	}
+	defer service.Close()
+	ctx := context.Background()
 
-	userID, subscriptionID := createTestUserAndSubscription(t, db)
+	userID, err := service.CreateUser(ctx, "SQLite测试用户", "sqlite_test@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if _, err := service.CreateUser(ctx, "SQLite重复用户", "sqlite_test@example.com"); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("重复邮箱应返回 ErrDuplicateEmail，实际: %v", err)
+	}
 
-	// 发送通知
-	err := notificationSvc.SendCancelConfirmation(userID, subscriptionID)
+	if err := service.ActivateSubscription(ctx, userID, "basic", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v, 数量=%d", err, len(subs))
+	}
+	if subs[0].Status != StatusSubscribed {
+		t.Fatalf("激活后状态错误: 期望=%s, 实际=%s", StatusSubscribed, subs[0].Status)
+	}
+
+	resp, err := service.RenewSubscription(ctx, RenewalRequest{
+		SubscriptionID: subs[0].ID,
+		UserID:         userID,
+		Amount:         SubscriptionPrice,
+	})
 	if err != nil {
-		t.Fatalf("发送取消续约通知失败: %v", err)
+		t.Fatalf("续订失败: %v", err)
+	}
+	if !resp.EndDate.After(subs[0].EndDate) {
+		t.Errorf("续订后结束日期应延后: 原=%v, 新=%v", subs[0].EndDate, resp.EndDate)
 	}
 
-	// 验证通知记录
-	notification := getLatestNotification(t, db, userID, "cancel_confirmation")
-	if notification == nil {
-		t.Fatal("未找到通知记录")
+	subs, err = service.db.GetUserSubscriptions(ctx, userID)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	if subs[0].Status != StatusRenewed || subs[0].RenewalPreference != "yes" {
+		t.Errorf("续订后状态错误: 状态=%s, 偏好=%s", subs[0].Status, subs[0].RenewalPreference)
+	}
+	if !subs[0].EndDate.Equal(resp.EndDate) {
+		t.Errorf("结束日期未正确保存: 期望=%v, 实际=%v", resp.EndDate, subs[0].EndDate)
 	}
 
-	// 检查通知内容是否包含预期的关键信息
-	if !strings.Contains(notification.Content, "取消续约") {
-		t.Errorf("通知内容未包含'取消续约'关键词: %s", notification.Content)
+	payments, err := service.db.GetUserPayments(userID)
+	if err != nil {
+		t.Fatalf("获取用户付款记录失败: %v", err)
+	}
+	if len(payments) != 2 {
+		t.Fatalf("期望2条付款记录，实际有%d条", len(payments))
 	}
-}
 
-// 测试发送订阅结束通知
-func TestSendSubscriptionEndedNotice(t *testing.T) {
-	notificationSvc, db := createTestNotificationService(t)
-	defer db.Close()
+	// 方言相关的语句：过期查询、按月汇总和设置的覆盖写入
+	if _, err := service.db.db.Exec(`UPDATE subscriptions SET end_date = ?, status = ? WHERE id = ?`,
+		time.Now().Add(-time.Hour), StatusSubscribed, subs[0].ID); err != nil {
+		t.Fatalf("修改结束日期失败: %v", err)
+	}
+	expired, err := service.db.GetExpiredSubscriptions(time.Now())
+	if err != nil {
+		t.Fatalf("查询过期订阅失败: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ID != subs[0].ID {
+		t.Errorf("过期订阅查询结果错误: %+v", expired)
+	}
 
-	userID, subscriptionID := createTestUserAndSubscription(t, db)
+	now := time.Now()
+	series, err := service.db.GetMonthlyRevenueSeries(ctx, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("查询月度收入失败: %v", err)
+	}
+	if len(series) != 1 || series[0].Total != 2*SubscriptionPrice {
+		t.Errorf("月度收入错误: %+v", series)
+	}
 
-	// 发送通知
-	err := notificationSvc.SendSubscriptionEndedNotice(userID, subscriptionID)
+	for _, value := range []string{"7", "5"} {
+		if err := service.db.SaveSettings(ctx, map[string]string{"sqlite_test": value}); err != nil {
+			t.Fatalf("保存设置失败: %v", err)
+		}
+	}
+	settings, err := service.db.GetSettings(ctx)
 	if err != nil {
-		t.Fatalf("发送订阅结束通知失败: %v", err)
+		t.Fatalf("读取设置失败: %v", err)
+	}
+	if settings["sqlite_test"] != "5" {
+		t.Errorf("设置未被覆盖: %q", settings["sqlite_test"])
+	}
+}
+
+// 测试优雅关闭：各组件共享同一时限，拖慢关闭的组件被记录且不影响后续组件
+func TestGracefulShutdownBudget(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stdout)
+
+	var stopped []string
+	budget := 200 * time.Millisecond
+	begin := time.Now()
+	laggards := gracefulShutdown(budget,
+		shutdownStep{"快组件", func(ctx context.Context) error {
+			stopped = append(stopped, "快组件")
+			return nil
+		}},
+		// 不理会 ctx 的慢组件
+		shutdownStep{"慢组件", func(ctx context.Context) error {
+			time.Sleep(2 * time.Second)
+			return nil
+		}},
+		shutdownStep{"收尾组件", func(ctx context.Context) error {
+			stopped = append(stopped, "收尾组件")
+			return nil
+		}},
+	)
+	elapsed := time.Since(begin)
+
+	if elapsed > budget+100*time.Millisecond {
+		t.Errorf("关闭耗时超出时限: 时限=%v, 实际=%v", budget, elapsed)
+	}
+	if !slices.Equal(laggards, []string{"慢组件"}) {
+		t.Errorf("超时组件错误: %v", laggards)
+	}
+	if !slices.Equal(stopped, []string{"快组件", "收尾组件"}) {
+		t.Errorf("其他组件应正常关闭: %v", stopped)
+	}
+	if !strings.Contains(buf.String(), "慢组件未能在关闭时限") {
+		t.Errorf("日志未记录超时组件: %s", buf.String())
 	}
 
-	// 验证通知记录
-	notification := getLatestNotification(t, db, userID, "subscription_ended")
-	if notification == nil {
-		t.Fatal("未找到通知记录")
+	// 后台通知：发送完成后 DrainNotifications 返回，超出时限时返回错误
+	release := make(chan struct{})
+	defer close(release)
+	service := &SubscriptionService{notices: NewNotificationQueue(4, 1, func(n Notification) error {
+		if n.Type == "blocked" {
+			<-release
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})}
+	defer service.notices.Close()
+
+	service.notifyAsync("renewal_confirmation", 1, 1)
+	if err := service.DrainNotifications(context.Background()); err != nil {
+		t.Errorf("等待后台通知失败: %v", err)
 	}
 
-	// 检查通知内容是否包含预期的关键信息
-	if !strings.Contains(notification.Content, "订阅已结束") {
-		t.Errorf("通知内容未包含'订阅已结束'关键词: %s", notification.Content)
+	service.notifyAsync("blocked", 1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := service.DrainNotifications(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("通知未发送完成时应超时，实际: %v", err)
 	}
 }
 
-// 测试处理无效用户ID的情况
-func TestSendNotificationInvalidUser(t *testing.T) {
-	notificationSvc, db := createTestNotificationService(t)
-	defer db.Close()
+// 测试重复关闭数据库服务不会因为重复关闭保活通道而崩溃
+func TestDatabaseServiceCloseTwice(t *testing.T) {
+	service := createTestService(t)
+	service.notices.Close()
+	service.db.StartKeepalive(time.Hour)
 
-	_, subscriptionID := createTestUserAndSubscription(t, db)
+	if err := service.db.Close(); err != nil {
+		t.Fatalf("关闭数据库失败: %v", err)
+	}
+	if err := service.db.Close(); err != nil {
+		t.Errorf("重复关闭数据库应返回第一次关闭的结果，实际: %v", err)
+	}
+}
 
-	// 使用不存在的用户ID
-	invalidUserID := int64(9999999)
+// 测试关闭订阅服务时先等待后台通知写完记录再关闭数据库，超出排空时限后不再等待
+func TestCloseDrainsNotifications(t *testing.T) {
+	service := createTestService(t)
+	service.notices.Close()
 
-	// 尝试发送通知
-	err := notificationSvc.SendExpirationNotice(invalidUserID, subscriptionID)
+	var sendErr error
+	service.notices = NewNotificationQueue(1, 1, func(Notification) error {
+		time.Sleep(50 * time.Millisecond)
+		_, sendErr = service.db.db.Exec(`SELECT 1`)
+		return sendErr
+	})
+	service.notifyAsync("renewal_confirmation", 1, 1)
+	if err := service.Close(); err != nil {
+		t.Fatalf("关闭订阅服务失败: %v", err)
+	}
+	if sendErr != nil {
+		t.Errorf("后台通知应在数据库关闭前完成: %v", sendErr)
+	}
 
-	// 预期会失败
-	if err == nil {
-		t.Fatal("对不存在的用户发送通知应当失败，但却成功了")
+	service = createTestService(t)
+	service.notices.Close()
+	service.drainTimeout = 20 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	service.notices = NewNotificationQueue(1, 1, func(Notification) error {
+		<-release
+		return nil
+	})
+	service.notifyAsync("renewal_confirmation", 1, 1)
+
+	start := time.Now()
+	if err := service.Close(); err != nil {
+		t.Fatalf("关闭订阅服务失败: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("通知未发送完成时关闭应在排空时限后返回，实际耗时 %v", elapsed)
 	}
 
-	// 验证错误信息
-	if !strings.Contains(err.Error(), "用户不存在") {
-		t.Errorf("错误消息不符合预期: %v", err)
+	// 关闭后入队的通知被丢弃，不会阻塞或触发发送
+	service.notifyAsync("renewal_confirmation", 1, 1)
+}
+
+// 测试后台通知队列：发送协程数固定，队列满时入队阻塞，Depth 反映等待发送的通知数
+func TestNotificationQueue(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var sent []string
+	queue := NewNotificationQueue(2, 1, func(n Notification) error {
+		<-release
+		mu.Lock()
+		sent = append(sent, n.Type)
+		mu.Unlock()
+		return nil
+	})
+	defer queue.Close()
+
+	// 第一条被发送协程取出后阻塞，其余两条留在队列中
+	queue.Enqueue(Notification{Type: "first"})
+	deadline := time.Now().Add(time.Second)
+	for queue.Depth() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	queue.Enqueue(Notification{Type: "second"})
+	queue.Enqueue(Notification{Type: "third"})
+	if depth := queue.Depth(); depth != 2 {
+		t.Errorf("队列深度错误: 期望=2, 实际=%d", depth)
+	}
+
+	// 队列已满，第四条入队需要等待空位
+	enqueued := make(chan struct{})
+	go func() {
+		queue.Enqueue(Notification{Type: "fourth"})
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+		t.Fatal("队列已满时入队应阻塞")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-enqueued
+	if err := queue.Drain(context.Background()); err != nil {
+		t.Fatalf("等待通知发送完成失败: %v", err)
+	}
+	if !slices.Equal(sent, []string{"first", "second", "third", "fourth"}) {
+		t.Errorf("通知发送顺序错误: %v", sent)
+	}
+	if depth := queue.Depth(); depth != 0 {
+		t.Errorf("发送完成后队列应为空, 实际=%d", depth)
 	}
 }
 
-// 测试处理无效订阅ID的情况
-func TestSendNotificationInvalidSubscription(t *testing.T) {
-	notificationSvc, db := createTestNotificationService(t)
-	defer db.Close()
+// 测试权益快照：高级套餐用户的功能全部可用，订阅已失效的用户所有功能都不可用
+func TestEntitlementSnapshot(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+	ctx := context.Background()
+	handler := NewSubscriptionHandler(service)
 
-	userID, _ := createTestUserAndSubscription(t, db)
+	snapshot := func(userID int64) EntitlementSnapshot {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.HandleEntitlementSnapshot(rec, httptest.NewRequest(http.MethodGet,
+			fmt.Sprintf("/api/entitlements/snapshot?user_id=%d", userID), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("状态码错误: 期望=%d, 实际=%d", http.StatusOK, rec.Code)
+		}
+		var snapshot EntitlementSnapshot
+		if err := json.NewDecoder(rec.Body).Decode(&snapshot); err != nil {
+			t.Fatalf("解析响应失败: %v", err)
+		}
+		return snapshot
+	}
+	usable := func(snapshot EntitlementSnapshot) []string {
+		var features []string
+		for _, feature := range snapshot.Features {
+			if feature.Usable {
+				features = append(features, feature.Feature)
+			}
+		}
+		return features
+	}
 
-	// 使用不存在的订阅ID
-	invalidSubID := int64(9999999)
+	premium, err := service.CreateUser(ctx, "权益测试高级用户", "entitlement_premium@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, premium, "premium", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
 
-	// 尝试发送通知
-	err := notificationSvc.SendRenewalConfirmation(userID, invalidSubID)
+	got := snapshot(premium)
+	if !got.Active || got.Plan != "premium" || got.Status != StatusSubscribed || got.EndDate == nil {
+		t.Errorf("高级用户快照错误: %+v", got)
+	}
+	if len(got.Features) != len(catalogFeatures(service.plans)) {
+		t.Errorf("快照应列出目录中的全部功能: %+v", got.Features)
+	}
+	premiumPlan := service.plans["premium"]
+	expected := slices.Sorted(slices.Values(premiumPlan.Features))
+	if features := usable(got); !slices.Equal(features, expected) {
+		t.Errorf("高级用户可用功能错误: 期望=%v, 实际=%v", expected, features)
+	}
 
-	// 预期会失败
-	if err == nil {
-		t.Fatal("对不存在的订阅发送通知应当失败，但却成功了")
+	lapsed, err := service.CreateUser(ctx, "权益测试失效用户", "entitlement_lapsed@example.com")
+	if err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	if err := service.ActivateSubscription(ctx, lapsed, "premium", ""); err != nil {
+		t.Fatalf("激活订阅失败: %v", err)
+	}
+	subs, err := service.db.GetUserSubscriptions(ctx, lapsed)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("获取用户订阅失败: %v", err)
+	}
+	if err := service.db.UpdateSubscriptionStatus(ctx, subs[0].ID, StatusInactive); err != nil {
+		t.Fatalf("更新订阅状态失败: %v", err)
 	}
 
-	// 验证错误信息
-	if !strings.Contains(err.Error(), "订阅不存在") {
-		t.Errorf("错误消息不符合预期: %v", err)
+	got = snapshot(lapsed)
+	if got.Active || got.Plan != "" || got.EndDate != nil {
+		t.Errorf("失效用户不应有生效中的订阅: %+v", got)
+	}
+	if len(got.Features) == 0 {
+		t.Error("失效用户的快照也应列出全部功能")
+	}
+	if features := usable(got); len(features) != 0 {
+		t.Errorf("失效用户不应有可用功能: %v", features)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.HandleEntitlementSnapshot(rec, httptest.NewRequest(http.MethodGet, "/api/entitlements/snapshot?user_id=999999999", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("用户不存在时应返回404，实际=%d", rec.Code)
 	}
 }
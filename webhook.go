@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 签名时间戳与当前时间的最大偏差，超出时视为重放请求
+const webhookSignatureTolerance = 5 * time.Minute
+
+// ErrInvalidSignature webhook 签名缺失、格式错误或校验不通过
+var ErrInvalidSignature = errors.New("webhook签名无效")
+
+// ErrInvalidWebhookEvent 回调内容无法解析或字段无效
+var ErrInvalidWebhookEvent = errors.New("支付回调内容无效")
+
+// ErrPaymentNotFound 支付记录不存在
+var ErrPaymentNotFound = errors.New("支付记录不存在")
+
+// ErrPaymentNotPending 支付记录已被确认为其他状态
+var ErrPaymentNotPending = errors.New("支付记录不是待确认状态")
+
+// ErrActivationPending 订阅已有等待支付网关确认的首次支付
+var ErrActivationPending = errors.New("订阅有待确认的首次支付")
+
+// 支付网关回调的支付结果
+type PaymentWebhookEvent struct {
+	PaymentID int64  `json:"payment_id"`
+	Status    string `json:"status"` // success 或 failed
+}
+
+// verifyWebhookSignature 校验签名头 "t=<unix时间戳>,v1=<hex签名>"
+// 签名为以 secret 为密钥对 "<时间戳>.<请求体>" 计算的 HMAC-SHA256，与 Stripe 的签名方式一致
+func verifyWebhookSignature(secret, header string, body []byte, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("%w: 缺少时间戳或签名", ErrInvalidSignature)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: 时间戳格式错误", ErrInvalidSignature)
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > webhookSignatureTolerance || skew < -webhookSignatureTolerance {
+		return fmt.Errorf("%w: 时间戳超出允许范围", ErrInvalidSignature)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		if decoded, err := hex.DecodeString(signature); err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: 签名不匹配", ErrInvalidSignature)
+}